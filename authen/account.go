@@ -0,0 +1,67 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/userdb"
+import "errors"
+import "time"
+
+/*
+ The states of an account. Except for locked hashes without any password,
+ they are returned only for the right password; do not reveal them to the
+ client.
+
+ ErrAccountLocked: the hash is locked ("!" or "*" prefix).
+ */
+var ErrAccountLocked = errors.New("account locked")
+
+// The expiration date of the account has passed.
+var ErrAccountExpired = errors.New("account expired")
+
+// The password is older than its maximum age (and maybe its inactive period).
+var ErrPasswordExpired = errors.New("password expired")
+
+// The password has to be changed (last change is 0).
+var ErrPasswordChangeRequired = errors.New("password change required")
+
+// Returns the number of days since 1970-01-01, as used by shadow(5).
+func DaysSinceEpoch(t time.Time) int64 {
+	return t.Unix()/86400
+}
+
+/*
+ Checks the aging fields of a shadow entry at the time now, like pam_unix.
+ Returns nil, ErrAccountExpired, ErrPasswordChangeRequired or
+ ErrPasswordExpired, in that order of precedence. Whether the password is
+ locked is not checked here.
+
+ A password past its maximum age can still be changed by the user, unless it
+ is also past the inactive period.
+ */
+func CheckAging(sp *userdb.Shadow, now time.Time) error {
+	today := DaysSinceEpoch(now)
+	if sp.Expire>0 && today>=sp.Expire { return ErrAccountExpired }
+	if sp.LastChange==0 { return ErrPasswordChangeRequired }
+	// Unknown last change, or a clock behind it.
+	if sp.LastChange<0 || today<sp.LastChange { return nil }
+	// Like pam_unix: the password expires after the day LastChange+Max.
+	if sp.Max>=0 && today-sp.LastChange>sp.Max { return ErrPasswordExpired }
+	return nil
+}
+
+/*
+ Returns true, if the password of an entry, for which CheckAging returned
+ ErrPasswordExpired, is also past its inactive period; the user can no longer
+ change it.
+ */
+func PastInactive(sp *userdb.Shadow, now time.Time) bool {
+	if sp.Max<0 || sp.Inactive<0 || sp.LastChange<=0 { return false }
+	return DaysSinceEpoch(now)-sp.LastChange>sp.Max+sp.Inactive
+}
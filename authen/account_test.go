@@ -0,0 +1,45 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/userdb"
+import "testing"
+import "time"
+
+func TestCheckAging(t *testing.T) {
+	day := func(d int64) time.Time { return time.Unix(d*86400+3600,0) }
+	for _,tt := range []struct{
+		sp       userdb.Shadow
+		today    int64
+		err      error
+		inactive bool
+	}{
+		{userdb.Shadow{LastChange: 100, Max: -1, Inactive: -1, Expire: -1},1000,nil,false},
+		{userdb.Shadow{LastChange: 0, Max: -1, Inactive: -1, Expire: -1},1000,ErrPasswordChangeRequired,false},
+		{userdb.Shadow{LastChange: -1, Max: 10, Inactive: -1, Expire: -1},1000,nil,false},
+		// The account expires on the day Expire.
+		{userdb.Shadow{LastChange: 100, Max: -1, Inactive: -1, Expire: 200},199,nil,false},
+		{userdb.Shadow{LastChange: 100, Max: -1, Inactive: -1, Expire: 200},200,ErrAccountExpired,false},
+		{userdb.Shadow{LastChange: 0, Max: -1, Inactive: -1, Expire: 200},200,ErrAccountExpired,false},
+		// The password expires after the day LastChange+Max, like pam_unix.
+		{userdb.Shadow{LastChange: 100, Max: 30, Inactive: 5, Expire: -1},130,nil,false},
+		{userdb.Shadow{LastChange: 100, Max: 30, Inactive: 5, Expire: -1},131,ErrPasswordExpired,false},
+		{userdb.Shadow{LastChange: 100, Max: 30, Inactive: 5, Expire: -1},135,ErrPasswordExpired,false},
+		{userdb.Shadow{LastChange: 100, Max: 30, Inactive: 5, Expire: -1},136,ErrPasswordExpired,true},
+		{userdb.Shadow{LastChange: 100, Max: 30, Inactive: -1, Expire: -1},1000,ErrPasswordExpired,false},
+		{userdb.Shadow{LastChange: 100, Max: 0, Inactive: -1, Expire: -1},101,ErrPasswordExpired,false},
+		// A clock behind the last change.
+		{userdb.Shadow{LastChange: 100, Max: 30, Inactive: -1, Expire: -1},50,nil,false},
+	} {
+		now := day(tt.today)
+		if err := CheckAging(&tt.sp,now); err!=tt.err { t.Errorf("%+v on day %d: %v",tt.sp,tt.today,err) }
+		if PastInactive(&tt.sp,now)!=tt.inactive { t.Errorf("%+v on day %d: inactive %v",tt.sp,tt.today,!tt.inactive) }
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "context"
+import "errors"
+import "net"
+
+var ErrWrongPassword = errors.New("wrong password")
+
+/*
+ Information about the party, that tries to authenticate. Any field may be
+ left empty.
+ */
+type Remote struct{
+	// The address of the client, and the one it connected to.
+	Addr      net.Addr
+	LocalAddr net.Addr
+	// The service, the client wants to log into ("ssh", "portal", ...).
+	Service   string
+	// The client software (e.g. the SSH version string).
+	Client    string
+}
+
+// An authenticated user.
+type Identity struct{
+	User    string
+	// The name of the backend, that accepted the credentials.
+	Backend string
+	// Backend specific attributes.
+	Attrs   map[string]string
+}
+
+/*
+ Checks the password of user. Returns the Identity, if the credentials match,
+ NoSuchUser, if the backend does not know user, or another error.
+ */
+type Authenticator interface{
+	Authenticate(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error)
+}
+
+// Turns a function into an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+	return f(ctx,user,password,r)
+}
+
+type firstMatch []Authenticator
+
+/*
+ Returns an Authenticator, that tries the backends in order, and returns the
+ Identity of the first one, that accepts the credentials. If none does, the
+ first error other than NoSuchUser is returned, or NoSuchUser.
+ */
+func FirstMatch(backends ...Authenticator) Authenticator {
+	return firstMatch(backends)
+}
+
+func (f firstMatch) Authenticate(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+	err := NoSuchUser
+	for _,a := range f {
+		if e := ctx.Err(); e!=nil { return nil,e }
+		id,e := a.Authenticate(ctx,user,password,r)
+		if e==nil { return id,nil }
+		if err==NoSuchUser { err = e }
+	}
+	return nil,err
+}
+
+type allMustPass []Authenticator
+
+/*
+ Returns an Authenticator, that accepts the credentials only, if all backends
+ accept them. The Identity of the first backend is returned; the attributes
+ of all backends are merged into it.
+ */
+func AllMustPass(backends ...Authenticator) Authenticator {
+	return allMustPass(backends)
+}
+
+func (f allMustPass) Authenticate(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+	var id *Identity
+	if len(f)==0 { return nil,NoSuchUser }
+	for _,a := range f {
+		if e := ctx.Err(); e!=nil { return nil,e }
+		i,e := a.Authenticate(ctx,user,password,r)
+		if e!=nil { return nil,e }
+		if id==nil {
+			// A copy, as the backend may hand out a shared Identity.
+			c := *i
+			c.Attrs = make(map[string]string,len(i.Attrs))
+			for k,v := range i.Attrs { c.Attrs[k] = v }
+			id = &c
+			continue
+		}
+		for k,v := range i.Attrs {
+			if _,ok := id.Attrs[k]; ok { continue }
+			id.Attrs[k] = v
+		}
+	}
+	return id,nil
+}
@@ -0,0 +1,491 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/sshlib"
+import "github.com/maxymania/go-system/userdb"
+import "golang.org/x/crypto/ssh"
+import "bufio"
+import "bytes"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "syscall"
+import "time"
+
+/*
+ The authorized_keys files of a user, like AuthorizedKeysFile of sshd_config:
+ %h is replaced by the home directory, %u by the user name and %% by %.
+ Relative paths are relative to the home directory.
+ */
+var AuthorizedKeysFiles = []string{"%h/.ssh/authorized_keys"}
+
+/*
+ Whether environment= options (of authorized_keys and principals files) are
+ passed on, like PermitUserEnvironment of sshd_config. Off by default, as the
+ user controls these files; variables reported by sshlib.UnsafeEnv are never
+ passed on.
+ */
+var PermitUserEnvironment = false
+
+// None of the authorized_keys entries of the user accepts the key.
+var ErrKeyNotAuthorized = errors.New("public key not authorized")
+
+/*
+ An entry of an authorized_keys file (see sshd(8), "AUTHORIZED_KEYS FILE
+ FORMAT"). The restrictions (NoPty, ...) are the result of all options in
+ order, so "restrict,pty" only allows a pseudo-terminal.
+ */
+type AuthorizedKey struct{
+	Key               ssh.PublicKey
+	Comment           string
+	// The key is a CA, that signs user certificates.
+	CertAuthority     bool
+	// The principals, that certificates signed by the CA must carry.
+	Principals        []string
+	// The command, that is run instead of the requested one (command=).
+	Command           string
+	// Patterns of the client addresses (from=).
+	From              []string
+	// Permitted forwarding destinations, "host:port".
+	PermitOpen        []string
+	PermitListen      []string
+	// "NAME=value"
+	Environment       []string
+	// The key is no longer accepted after this; zero, if not set.
+	ExpiryTime        time.Time
+	Restrict          bool
+	NoPty             bool
+	NoPortForwarding  bool
+	NoAgentForwarding bool
+	NoX11Forwarding   bool
+	NoUserRC          bool
+	// The tun(4) device number of tunnel=.
+	Tunnel            string
+	/*
+	 Signatures of FIDO (sk-*) keys need not assert user presence. Note that
+	 golang.org/x/crypto/ssh does not check the flags of these signatures at
+	 all; therefore verify-required, which can not be enforced, makes an entry
+	 invalid.
+	 */
+	NoTouchRequired   bool
+}
+
+/*
+ Splits the options at unquoted commas. The options end at the first
+ unquoted blank; the rest of the line is returned.
+ */
+func splitOptions(s string) (opts []string, rest string, err error) {
+	q := false
+	start := 0
+	for i:=0; i<len(s); i++ {
+		c := s[i]
+		switch {
+		case q && c=='\\' && i+1<len(s) && s[i+1]=='"': i++
+		case c=='"': q = !q
+		case q:
+		case c==',':
+			opts = append(opts,s[start:i])
+			start = i+1
+		case c==' ' || c=='\t':
+			return append(opts,s[start:i]),strings.TrimLeft(s[i:]," \t"),nil
+		}
+	}
+	if q { return nil,"",errors.New("unterminated quote in options") }
+	return append(opts,s[start:]),"",nil
+}
+
+// Removes the quotes of an option value and its \" escapes.
+func unquoteOption(name, v string) (string,error) {
+	if len(v)<2 || v[0]!='"' || v[len(v)-1]!='"' { return "",fmt.Errorf("value of %s is not quoted",name) }
+	return strings.Replace(v[1:len(v)-1],"\\\"","\"",-1),nil
+}
+
+// Parses expiry-time: YYYYMMDD[HHMM[SS]], local time, or UTC with a trailing Z.
+func parseExpiry(v string) (time.Time,error) {
+	loc := time.Local
+	if strings.HasSuffix(v,"Z") || strings.HasSuffix(v,"z") {
+		loc = time.UTC
+		v = v[:len(v)-1]
+	}
+	layout := ""
+	switch len(v) {
+	case 8: layout = "20060102"
+	case 12: layout = "200601021504"
+	case 14: layout = "20060102150405"
+	default: return time.Time{},fmt.Errorf("invalid expiry-time %q",v)
+	}
+	return time.ParseInLocation(layout,v,loc)
+}
+
+// Checks a from= pattern; CIDR patterns must be valid.
+func checkFromPattern(p string) error {
+	p = strings.TrimPrefix(p,"!")
+	if p=="" { return errors.New("empty from= pattern") }
+	if strings.IndexByte(p,'/')>=0 {
+		if _,_,err := net.ParseCIDR(p); err!=nil { return fmt.Errorf("invalid from= network %q",p) }
+	}
+	return nil
+}
+
+func (k *AuthorizedKey) setOption(o string) error {
+	name,v,hasv := o,"",false
+	if i := strings.IndexByte(o,'='); i>=0 {
+		name,v,hasv = o[:i],o[i+1:],true
+	}
+	name = strings.ToLower(name)
+	if hasv {
+		var err error
+		if v,err = unquoteOption(name,v); err!=nil { return err }
+	}
+	flag := func(b *bool, val bool) error {
+		if hasv { return fmt.Errorf("option %s takes no value",name) }
+		*b = val
+		return nil
+	}
+	value := func() error {
+		if !hasv { return fmt.Errorf("option %s needs a value",name) }
+		return nil
+	}
+	switch name {
+	case "cert-authority": return flag(&k.CertAuthority,true)
+	case "restrict":
+		if err := flag(&k.Restrict,true); err!=nil { return err }
+		k.NoPty,k.NoPortForwarding,k.NoAgentForwarding,k.NoX11Forwarding,k.NoUserRC = true,true,true,true,true
+		return nil
+	case "no-pty": return flag(&k.NoPty,true)
+	case "pty": return flag(&k.NoPty,false)
+	case "no-port-forwarding": return flag(&k.NoPortForwarding,true)
+	case "port-forwarding": return flag(&k.NoPortForwarding,false)
+	case "no-agent-forwarding": return flag(&k.NoAgentForwarding,true)
+	case "agent-forwarding": return flag(&k.NoAgentForwarding,false)
+	case "no-x11-forwarding": return flag(&k.NoX11Forwarding,true)
+	case "x11-forwarding": return flag(&k.NoX11Forwarding,false)
+	case "no-user-rc": return flag(&k.NoUserRC,true)
+	case "user-rc": return flag(&k.NoUserRC,false)
+	case "no-touch-required": return flag(&k.NoTouchRequired,true)
+	case "verify-required": return errors.New("option verify-required is not supported")
+	case "command":
+		if err := value(); err!=nil { return err }
+		k.Command = v
+	case "principals":
+		if err := value(); err!=nil { return err }
+		k.Principals = append(k.Principals,strings.Split(v,",")...)
+	case "from":
+		if err := value(); err!=nil { return err }
+		for _,p := range strings.Split(v,",") {
+			if err := checkFromPattern(p); err!=nil { return err }
+			k.From = append(k.From,p)
+		}
+	case "permitopen","permitlisten":
+		if err := value(); err!=nil { return err }
+		for _,p := range strings.Split(v,",") {
+			// permitlisten takes a bare port as well.
+			if strings.LastIndexByte(p,':')<1 && (name=="permitopen" || p=="") { return fmt.Errorf("invalid %s %q",name,p) }
+		}
+		if name=="permitopen" {
+			k.PermitOpen = append(k.PermitOpen,strings.Split(v,",")...)
+		} else {
+			k.PermitListen = append(k.PermitListen,strings.Split(v,",")...)
+		}
+	case "environment":
+		if err := value(); err!=nil { return err }
+		i := strings.IndexByte(v,'=')
+		if i<1 || strings.ContainsAny(v[:i]," \t\n") || strings.IndexByte(v,'\n')>=0 { return fmt.Errorf("invalid environment %q",v) }
+		k.Environment = append(k.Environment,v)
+	case "expiry-time":
+		if err := value(); err!=nil { return err }
+		t,err := parseExpiry(v)
+		if err!=nil { return err }
+		// The earliest one applies.
+		if k.ExpiryTime.IsZero() || t.Before(k.ExpiryTime) { k.ExpiryTime = t }
+	case "tunnel":
+		if err := value(); err!=nil { return err }
+		if _,err := strconv.ParseUint(v,10,32); err!=nil { return fmt.Errorf("invalid tunnel %q",v) }
+		k.Tunnel = v
+	default:
+		return fmt.Errorf("unknown option %q",name)
+	}
+	return nil
+}
+
+func parseKeyBlob(typ, b64 string) (ssh.PublicKey,error) {
+	blob,err := base64.StdEncoding.DecodeString(b64)
+	if err!=nil { return nil,err }
+	k,err := ssh.ParsePublicKey(blob)
+	if err!=nil { return nil,err }
+	if k.Type()!=typ { return nil,fmt.Errorf("key type %s does not match %s",k.Type(),typ) }
+	if _,ok := k.(*ssh.Certificate); ok { return nil,errors.New("certificates are not allowed here") }
+	return k,nil
+}
+
+// Parses a line of an authorized_keys file: [options] keytype base64-key [comment]
+func ParseAuthorizedKey(line string) (*AuthorizedKey,error) {
+	line = strings.TrimLeft(line," \t")
+	k := new(AuthorizedKey)
+	f := strings.Fields(line)
+	if len(f)<2 { return nil,errors.New("missing key") }
+	if pk,err := parseKeyBlob(f[0],f[1]); err==nil {
+		k.Key = pk
+		k.Comment = strings.TrimSpace(strings.SplitN(line,f[1],2)[1])
+		return k,nil
+	}
+	opts,rest,err := splitOptions(line)
+	if err!=nil { return nil,err }
+	for _,o := range opts {
+		if err = k.setOption(o); err!=nil { return nil,err }
+	}
+	f = strings.Fields(rest)
+	if len(f)<2 { return nil,errors.New("missing key") }
+	if k.Key,err = parseKeyBlob(f[0],f[1]); err!=nil { return nil,err }
+	k.Comment = strings.TrimSpace(strings.SplitN(rest,f[1],2)[1])
+	return k,nil
+}
+
+/*
+ Parses an authorized_keys file; name is used in error messages. Empty lines
+ and comments (#) are skipped.
+ */
+func ParseAuthorizedKeys(r io.Reader, name string) ([]AuthorizedKey,error) {
+	var keys []AuthorizedKey
+	s := bufio.NewScanner(r)
+	s.Buffer(nil,1<<20)
+	n := 0
+	for s.Scan() {
+		n++
+		l := strings.TrimSpace(s.Text())
+		if l=="" || l[0]=='#' { continue }
+		k,err := ParseAuthorizedKey(l)
+		if err!=nil { return nil,fmt.Errorf("%s:%d: %v",name,n,err) }
+		keys = append(keys,*k)
+	}
+	return keys,s.Err()
+}
+
+// Matches a pattern with the wildcards * and ?.
+func matchWild(p, s string) bool {
+	for len(p)>0 {
+		switch p[0] {
+		case '*':
+			for i:=len(s); i>=0; i-- {
+				if matchWild(p[1:],s[i:]) { return true }
+			}
+			return false
+		case '?':
+			if len(s)==0 { return false }
+		default:
+			if len(s)==0 || p[0]!=s[0] { return false }
+		}
+		p,s = p[1:],s[1:]
+	}
+	return len(s)==0
+}
+
+/*
+ Returns true, if addr matches the from= patterns: no negated pattern (!)
+ matches, and at least one of the others does. Patterns are CIDR networks or
+ wildcard patterns of the address; host names are not resolved.
+ */
+func MatchFrom(patterns []string, addr net.Addr) bool {
+	ip := remoteIP(addr)
+	if ip==nil { return false }
+	s := ip.String()
+	ok := false
+	for _,p := range patterns {
+		neg := strings.HasPrefix(p,"!")
+		if neg { p = p[1:] }
+		m := false
+		if strings.IndexByte(p,'/')>=0 {
+			_,n,err := net.ParseCIDR(p)
+			m = err==nil && n.Contains(ip)
+		} else {
+			m = matchWild(strings.ToLower(p),s)
+		}
+		if m && neg { return false }
+		if m { ok = true }
+	}
+	return ok
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr: return a.IP
+	case *net.UDPAddr: return a.IP
+	case *net.IPAddr: return a.IP
+	case nil: return nil
+	}
+	h,_,err := net.SplitHostPort(addr.String())
+	if err!=nil { h = addr.String() }
+	return net.ParseIP(h)
+}
+
+/*
+ Checks the from= and expiry-time options of the entry against the client
+ address and now.
+ */
+func (k *AuthorizedKey) Allows(addr net.Addr, now time.Time) bool {
+	if !k.ExpiryTime.IsZero() && !now.Before(k.ExpiryTime) { return false }
+	if len(k.From)>0 && !MatchFrom(k.From,addr) { return false }
+	return true
+}
+
+/*
+ Returns the ssh.Permissions, that the options imply, in the vocabulary of
+ sshlib: the restrictions as Extensions (sshlib.NoPty, ...), permitopen,
+ permitlisten and tunnel as sshlib.PermitOpen, sshlib.PermitListen and
+ sshlib.Tunnel, environment as sshlib.Environment (see
+ PermitUserEnvironment) and command as the critical option
+ sshlib.ForceCommand.
+ */
+func (k *AuthorizedKey) Permissions() *ssh.Permissions {
+	p := &ssh.Permissions{CriticalOptions: make(map[string]string), Extensions: make(map[string]string)}
+	if k.Command!="" { p.CriticalOptions[sshlib.ForceCommand] = k.Command }
+	set := func(b bool, ext string) { if b { p.Extensions[ext] = "" } }
+	set(k.NoPty,sshlib.NoPty)
+	set(k.NoPortForwarding,sshlib.NoPortForwarding)
+	set(k.NoAgentForwarding,sshlib.NoAgentForwarding)
+	set(k.NoX11Forwarding,sshlib.NoX11Forwarding)
+	set(k.NoUserRC,sshlib.NoUserRC)
+	if len(k.PermitOpen)>0 { p.Extensions[sshlib.PermitOpen] = strings.Join(k.PermitOpen,",") }
+	if len(k.PermitListen)>0 { p.Extensions[sshlib.PermitListen] = strings.Join(k.PermitListen,",") }
+	if k.Tunnel!="" { p.Extensions[sshlib.Tunnel] = k.Tunnel }
+	if env := userEnvironment(k.Environment); len(env)>0 { p.Extensions[sshlib.Environment] = strings.Join(env,"\n") }
+	return p
+}
+
+// The environment= variables, that may be passed on.
+func userEnvironment(env []string) []string {
+	if !PermitUserEnvironment { return nil }
+	var r []string
+	for _,v := range env {
+		if !sshlib.UnsafeEnv(v) { r = append(r,v) }
+	}
+	return r
+}
+
+func expandKeysFile(f string, pw *userdb.Passwd) string {
+	r := strings.NewReplacer("%%","%","%h",pw.Home,"%u",pw.Name)
+	f = r.Replace(f)
+	if !filepath.IsAbs(f) { f = filepath.Join(pw.Home,f) }
+	return f
+}
+
+func secureMode(st *syscall.Stat_t, uid uint32) bool {
+	return (st.Uid==0 || st.Uid==uid) && st.Mode&022==0
+}
+
+/*
+ Reads the authorized_keys file path of the user pw, like sshd with
+ StrictModes: the file, and the directories up to the home directory (or /),
+ must be owned by root or the user and must not be writable by others. The
+ file is opened with the file system uid and gid of the user and must be a
+ regular file; it is not read otherwise (e.g. a FIFO or a device).
+ */
+func readKeysFile(path string, pw *userdb.Passwd) (data []byte, err error) {
+	err = withFsid(pw.Uid,pw.Gid,func() error {
+		data,err = readKeysFileAs(path,pw)
+		return err
+	})
+	return
+}
+
+func readKeysFileAs(path string, pw *userdb.Passwd) ([]byte,error) {
+	fd,err := syscall.Open(path,syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOCTTY|syscall.O_CLOEXEC,0)
+	if err!=nil { return nil,&os.PathError{Op: "open", Path: path, Err: err} }
+	f := os.NewFile(uintptr(fd),path)
+	defer f.Close()
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd,&st); err!=nil { return nil,err }
+	if st.Mode&syscall.S_IFMT!=syscall.S_IFREG || !secureMode(&st,pw.Uid) {
+		return nil,fmt.Errorf("bad ownership or modes for %s",path)
+	}
+	real,err := filepath.EvalSymlinks(path)
+	if err!=nil { return nil,err }
+	home,err := filepath.EvalSymlinks(pw.Home)
+	if err!=nil { home = pw.Home }
+	for d := filepath.Dir(real); ; d = filepath.Dir(d) {
+		if err = syscall.Stat(d,&st); err!=nil { return nil,err }
+		if !secureMode(&st,pw.Uid) { return nil,fmt.Errorf("bad ownership or modes for %s",d) }
+		if d==home || d=="/" { break }
+	}
+	var b bytes.Buffer
+	_,err = b.ReadFrom(f)
+	return b.Bytes(),err
+}
+
+/*
+ Returns the entries of the authorized_keys files (AuthorizedKeysFiles) of
+ user, that the client at addr may use. Lines, that can not be parsed, are
+ skipped, as sshd does; so are files, that are missing or insecure. The error
+ of the last file, that could not be read, is returned, if there are no
+ entries.
+ */
+func authorizedKeysOf(user string, addr net.Addr, now time.Time) ([]AuthorizedKey,error) {
+	pw,err := new(userdb.DB).LookupUser(user)
+	if err!=nil { return nil,err }
+	var keys []AuthorizedKey
+	var lerr error
+	for _,f := range AuthorizedKeysFiles {
+		data,err := readKeysFile(expandKeysFile(f,pw),pw)
+		if err!=nil {
+			if !os.IsNotExist(err) { lerr = err }
+			continue
+		}
+		for _,l := range strings.Split(string(data),"\n") {
+			l = strings.TrimSpace(l)
+			if l=="" || l[0]=='#' { continue }
+			k,err := ParseAuthorizedKey(l)
+			if err!=nil || !k.Allows(addr,now) { continue }
+			keys = append(keys,*k)
+		}
+	}
+	if len(keys)==0 && lerr!=nil { return nil,lerr }
+	return keys,nil
+}
+
+/*
+ Checks, whether key may log in as user from remoteAddr according to the
+ authorized_keys files of the user, and returns the ssh.Permissions, that the
+ options of the matching entry imply (see (*AuthorizedKey).Permissions).
+ Returns ErrKeyNotAuthorized, if no entry matches, and NoSuchUser, if there is
+ no such user.
+
+ User certificates are accepted from the CAs of cert-authority entries, if
+ they name one of the principals= of the entry (or the user, if there are
+ none); see (*CertAuth).Authenticate for the Permissions.
+ */
+func AuthenticatePublicKey(user string, key ssh.PublicKey, remoteAddr net.Addr) (*ssh.Permissions,error) {
+	keys,err := authorizedKeysOf(user,remoteAddr,time.Now())
+	if err!=nil { return nil,err }
+	if cert,ok := key.(*ssh.Certificate); ok {
+		ca := cert.SignatureKey.Marshal()
+		var ps []principal
+		for i := range keys {
+			k := &keys[i]
+			if !k.CertAuthority || !bytes.Equal(k.Key.Marshal(),ca) { continue }
+			if len(k.Principals)==0 { ps = append(ps,principal{user,k}) }
+			for _,p := range k.Principals { ps = append(ps,principal{p,k}) }
+		}
+		return checkUserCert(&ssh.CertChecker{SupportedCriticalOptions: []string{certForceCommand,certSourceAddress}},cert,ps,remoteAddr)
+	}
+	b := key.Marshal()
+	for i := range keys {
+		k := &keys[i]
+		if k.CertAuthority { continue }
+		if bytes.Equal(k.Key.Marshal(),b) { return k.Permissions(),nil }
+	}
+	return nil,ErrKeyNotAuthorized
+}
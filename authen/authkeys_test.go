@@ -0,0 +1,169 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/sshlib"
+import "github.com/maxymania/go-system/userdb"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "syscall"
+import "testing"
+import "time"
+
+const testKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+
+func TestParseAuthorizedKeyPlain(t *testing.T) {
+	k,err := ParseAuthorizedKey(testKey+" alice@host  ")
+	if err!=nil { t.Fatal(err) }
+	if k.Key.Type()!="ssh-ed25519" || k.Comment!="alice@host" { t.Errorf("got %s %q",k.Key.Type(),k.Comment) }
+	if k.Restrict || k.NoPty || k.Command!="" { t.Errorf("unexpected options %+v",k) }
+}
+
+func TestParseAuthorizedKeyOptions(t *testing.T) {
+	line := `restrict,pty,command="echo \"hi, there\"",from="10.0.0.0/8,!10.1.*",`+
+		`permitopen="db:5432",permitlisten="8080",permitlisten="localhost:9090",`+
+		`environment="FOO=a b",tunnel="3",expiry-time="20300102Z",no-touch-required `+testKey+" c"
+	k,err := ParseAuthorizedKey(line)
+	if err!=nil { t.Fatal(err) }
+	if !k.Restrict || k.NoPty || !k.NoPortForwarding || !k.NoAgentForwarding || !k.NoX11Forwarding || !k.NoUserRC {
+		t.Errorf("restrict,pty: %+v",k)
+	}
+	if k.Command!=`echo "hi, there"` { t.Errorf("command %q",k.Command) }
+	if !reflect.DeepEqual(k.From,[]string{"10.0.0.0/8","!10.1.*"}) { t.Errorf("from %q",k.From) }
+	if !reflect.DeepEqual(k.PermitOpen,[]string{"db:5432"}) { t.Errorf("permitopen %q",k.PermitOpen) }
+	if !reflect.DeepEqual(k.PermitListen,[]string{"8080","localhost:9090"}) { t.Errorf("permitlisten %q",k.PermitListen) }
+	if !reflect.DeepEqual(k.Environment,[]string{"FOO=a b"}) { t.Errorf("environment %q",k.Environment) }
+	if k.Tunnel!="3" || !k.NoTouchRequired { t.Errorf("tunnel %q, no-touch-required %v",k.Tunnel,k.NoTouchRequired) }
+	if !k.ExpiryTime.Equal(time.Date(2030,1,2,0,0,0,0,time.UTC)) { t.Errorf("expiry %v",k.ExpiryTime) }
+	if k.Comment!="c" { t.Errorf("comment %q",k.Comment) }
+}
+
+func TestParseAuthorizedKeyInvalid(t *testing.T) {
+	for _,o := range []string{
+		"bogus",
+		"no-pty=yes",
+		"command",
+		"command=unquoted",
+		`command="unterminated`,
+		`from="10.0.0.0/33"`,
+		`permitopen="nocolon"`,
+		`environment="=x"`,
+		`environment="A B=x"`,
+		`tunnel="x"`,
+		`expiry-time="2030"`,
+		"verify-required",
+	} {
+		if _,err := ParseAuthorizedKey(o+" "+testKey); err==nil { t.Errorf("%s: no error",o) }
+	}
+	if _,err := ParseAuthorizedKey("ssh-ed25519"); err==nil { t.Error("missing key: no error") }
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	data := "# comment\n\n"+testKey+" a\nno-pty "+testKey+" b\n"
+	ks,err := ParseAuthorizedKeys(strings.NewReader(data),"keys")
+	if err!=nil { t.Fatal(err) }
+	if len(ks)!=2 || ks[0].Comment!="a" || !ks[1].NoPty { t.Errorf("got %+v",ks) }
+	_,err = ParseAuthorizedKeys(strings.NewReader(data+"bogus "+testKey+"\n"),"keys")
+	if err==nil || !strings.HasPrefix(err.Error(),"keys:5:") { t.Errorf("error %v",err) }
+}
+
+func TestMatchFrom(t *testing.T) {
+	pats := []string{"10.0.0.0/8","!10.1.*","192.168.1.?","::1"}
+	for a,want := range map[string]bool{
+		"10.2.3.4": true, "10.1.3.4": false, "192.168.1.5": true,
+		"192.168.1.50": false, "::1": true, "172.16.0.1": false,
+	} {
+		if got := MatchFrom(pats,&net.TCPAddr{IP: net.ParseIP(a)}); got!=want { t.Errorf("%s: %v",a,got) }
+	}
+	if MatchFrom(pats,nil) { t.Error("nil address matches") }
+}
+
+func TestAllows(t *testing.T) {
+	k,err := ParseAuthorizedKey(`from="127.0.0.1",expiry-time="20300101" `+testKey)
+	if err!=nil { t.Fatal(err) }
+	lo := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	if !k.Allows(lo,time.Date(2029,1,1,0,0,0,0,time.Local)) { t.Error("denied before expiry") }
+	if k.Allows(lo,time.Date(2030,1,1,0,0,0,0,time.Local)) { t.Error("allowed at expiry") }
+	if k.Allows(&net.TCPAddr{IP: net.ParseIP("127.0.0.2")},time.Date(2029,1,1,0,0,0,0,time.Local)) { t.Error("allowed from other address") }
+}
+
+func TestPermissions(t *testing.T) {
+	defer func(v bool) { PermitUserEnvironment = v }(PermitUserEnvironment)
+	k,err := ParseAuthorizedKey(`no-pty,command="id",permitopen="a:1,b:2",permitlisten="80",tunnel="0",`+
+		`environment="LD_PRELOAD=/tmp/x.so",environment="FOO=1",environment="GCONV_PATH=/tmp" `+testKey)
+	if err!=nil { t.Fatal(err) }
+	p := k.Permissions()
+	if p.CriticalOptions[sshlib.ForceCommand]!="id" { t.Errorf("critical options %q",p.CriticalOptions) }
+	want := map[string]string{sshlib.NoPty: "", sshlib.PermitOpen: "a:1,b:2", sshlib.PermitListen: "80", sshlib.Tunnel: "0"}
+	if !reflect.DeepEqual(p.Extensions,want) { t.Errorf("extensions %q",p.Extensions) }
+	PermitUserEnvironment = true
+	if env := k.Permissions().Extensions[sshlib.Environment]; env!="FOO=1" { t.Errorf("environment %q",env) }
+}
+
+// A home directory of an unprivileged user 4242, with an .ssh directory.
+func testHome(t *testing.T) (*userdb.Passwd,string) {
+	if os.Geteuid()!=0 { t.Skip("needs root") }
+	d,err := ioutil.TempDir("","authkeystest")
+	if err!=nil { t.Fatal(err) }
+	pw := &userdb.Passwd{Name: "u", Uid: 4242, Gid: 4242, Home: filepath.Join(d,"home")}
+	if err = os.MkdirAll(filepath.Join(pw.Home,".ssh"),0755); err!=nil { t.Fatal(err) }
+	if err = os.Chmod(d,0755); err!=nil { t.Fatal(err) }
+	return pw,d
+}
+
+func TestReadKeysFile(t *testing.T) {
+	pw,d := testHome(t)
+	defer os.RemoveAll(d)
+	p := filepath.Join(pw.Home,".ssh","authorized_keys")
+	if err := ioutil.WriteFile(p,[]byte(testKey+"\n"),0600); err!=nil { t.Fatal(err) }
+	if err := os.Chown(p,4242,4242); err!=nil { t.Fatal(err) }
+	if b,err := readKeysFile(p,pw); err!=nil || string(b)!=testKey+"\n" { t.Errorf("got %q %v",b,err) }
+	os.Chmod(p,0622)
+	if _,err := readKeysFile(p,pw); err==nil { t.Error("group writable file accepted") }
+	os.Remove(p)
+	if _,err := readKeysFile(p,pw); !os.IsNotExist(err) { t.Errorf("missing file: %v",err) }
+}
+
+// A FIFO does not block, and is rejected.
+func TestReadKeysFileFIFO(t *testing.T) {
+	pw,d := testHome(t)
+	defer os.RemoveAll(d)
+	p := filepath.Join(pw.Home,".ssh","authorized_keys")
+	if err := syscall.Mkfifo(p,0644); err!=nil { t.Fatal(err) }
+	os.Chown(p,4242,4242)
+	done := make(chan error,1)
+	go func() { _,err := readKeysFile(p,pw); done <- err }()
+	select {
+	case err := <-done:
+		if err==nil { t.Error("FIFO accepted") }
+	case <-time.After(5*time.Second):
+		t.Fatal("blocked on the FIFO")
+	}
+}
+
+// Symlinks are followed with the permissions of the user only.
+func TestReadKeysFileSymlink(t *testing.T) {
+	pw,d := testHome(t)
+	defer os.RemoveAll(d)
+	p := filepath.Join(pw.Home,".ssh","authorized_keys")
+	secret := filepath.Join(d,"secret")
+	if err := ioutil.WriteFile(secret,[]byte(testKey+"\n"),0640); err!=nil { t.Fatal(err) }
+	// Like /etc/shadow: owned by root and a group, the user is not in.
+	if err := os.Chown(secret,0,4243); err!=nil { t.Fatal(err) }
+	for _,target := range []string{secret,"/dev/zero"} {
+		os.Remove(p)
+		if err := os.Symlink(target,p); err!=nil { t.Fatal(err) }
+		if b,err := readKeysFile(p,pw); err==nil { t.Errorf("%s: read %q",target,b) }
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/userdb"
+import "bufio"
+import "context"
+import "crypto/sha1"
+import "crypto/subtle"
+import "encoding/base64"
+import "os"
+import "strings"
+import "sync"
+import "time"
+
+const DefaultShadowFile = userdb.ShadowFile
+
+/*
+ Looks up the line of user in a file of colon-separated records, whose first
+ field is the user name (htpasswd). Returns the fields, or NoSuchUser and the
+ hash of another user (see equalizeTiming).
+ */
+func lookupRecord(path string, user string) ([]string,string,error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,"",err }
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	sample := ""
+	for s.Scan() {
+		l := s.Text()
+		if l=="" || l[0]=='#' { continue }
+		r := strings.Split(l,":")
+		if r[0]==user && len(r)>=2 { return r,"",nil }
+		if len(r)>=2 && sample=="" && isHash(r[1]) { sample = r[1] }
+	}
+	if err = s.Err(); err!=nil { return nil,"",err }
+	return nil,sample,NoSuchUser
+}
+
+/*
+ Authenticates against a shadow(5) file. Path defaults to /etc/shadow; a
+ separate file with the same format can be used for service accounts.
+
+ After the password, the account state is checked: locked hashes yield
+ ErrAccountLocked, the aging fields are checked by CheckAging.
+ */
+type Shadow struct{
+	Path string
+	// Backend name in the Identity; defaults to "shadow".
+	Name string
+}
+
+func (s *Shadow) Authenticate(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+	l,err := userdb.ReadShadow(s.path())
+	if err!=nil { return nil,err }
+	var sp *userdb.Shadow
+	sample := ""
+	for i := range l {
+		if l[i].Compat!=0 { continue }
+		if l[i].Name==user { sp = &l[i]; break }
+		if sample=="" && isHash(l[i].Password) { sample = l[i].Password }
+	}
+	if sp==nil { equalizeTiming(password,sample); return nil,NoSuchUser }
+	err = verifyHash(sp.Password,password)
+	if err!=nil { return nil,err }
+	err = CheckAging(sp,time.Now())
+	if err!=nil { return nil,err }
+	return &Identity{User: user, Backend: backendName(s.Name,"shadow")},nil
+}
+
+/*
+ Authenticates against an Apache htpasswd file. Supports the crypt(3) hashes
+ (bcrypt, apr1, md5, sha256 and sha512 crypt, yescrypt, ...) and {SHA}.
+ */
+type Htpasswd struct{
+	Path string
+	// Backend name in the Identity; defaults to "htpasswd".
+	Name string
+}
+
+func (h *Htpasswd) Authenticate(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+	rec,sample,err := lookupRecord(h.Path,user)
+	if err==NoSuchUser { equalizeTiming(password,sample) }
+	if err!=nil { return nil,err }
+	hash := rec[1]
+	if strings.HasPrefix(hash,"{SHA}") {
+		sum := sha1.Sum(password)
+		if subtle.ConstantTimeCompare([]byte(hash[5:]),[]byte(base64.StdEncoding.EncodeToString(sum[:])))!=1 {
+			return nil,ErrWrongPassword
+		}
+	} else {
+		err = verifyHash(hash,password)
+		if err!=nil { return nil,err }
+	}
+	return &Identity{User: user, Backend: backendName(h.Name,"htpasswd")},nil
+}
+
+/*
+ Authenticates against users held in memory. The passwords are stored as
+ crypt(3) hashes.
+ */
+type Memory struct{
+	// Backend name in the Identity; defaults to "memory".
+	Name   string
+	mu     sync.RWMutex
+	hashes map[string]string
+}
+
+// Adds or replaces a user.
+func (m *Memory) Set(user string, hash string) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	if m.hashes==nil { m.hashes = make(map[string]string) }
+	m.hashes[user] = hash
+}
+
+// Removes a user.
+func (m *Memory) Delete(user string) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	delete(m.hashes,user)
+}
+
+func (m *Memory) Authenticate(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+	m.mu.RLock()
+	hash,ok := m.hashes[user]
+	sample := ""
+	if !ok {
+		for _,h := range m.hashes {
+			if isHash(h) { sample = h; break }
+		}
+	}
+	m.mu.RUnlock()
+	if !ok { equalizeTiming(password,sample); return nil,NoSuchUser }
+	err := verifyHash(hash,password)
+	if err!=nil { return nil,err }
+	return &Identity{User: user, Backend: backendName(m.Name,"memory")},nil
+}
+
+func backendName(n, def string) string {
+	if n=="" { return def }
+	return n
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+/*
+ bcrypt ($2a$, $2b$, $2x$ and $2y$), as implemented by crypt_blowfish in
+ libxcrypt, including the sign extension bug of $2x$ and the countermeasure
+ of $2a$.
+ */
+
+import "golang.org/x/crypto/blowfish"
+import "encoding/binary"
+import "strings"
+
+const bfItoa64 = "./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// Flags by subtype: 1 = sign extension bug, 2 = safety countermeasure.
+var bfFlags = map[byte]byte{'a': 2, 'b': 4, 'x': 1, 'y': 4}
+
+func bfDecode(src string, size int) ([]byte,bool) {
+	dst := make([]byte,0,size)
+	var c [4]byte
+	for len(dst)<size {
+		n := 4
+		if size-len(dst)<3 { n = size-len(dst)+1 }
+		if len(src)<n { return nil,false }
+		for i := 0; i<n; i++ {
+			j := strings.IndexByte(bfItoa64,src[i])
+			if j<0 { return nil,false }
+			c[i] = byte(j)
+		}
+		src = src[n:]
+		dst = append(dst,c[0]<<2|(c[1]&0x30)>>4)
+		if n>2 { dst = append(dst,(c[1]&0x0f)<<4|(c[2]&0x3c)>>2) }
+		if n>3 { dst = append(dst,(c[2]&0x03)<<6|c[3]) }
+	}
+	return dst,true
+}
+
+func bfEncode(src []byte) string {
+	var dst []byte
+	for i := 0; i<len(src); {
+		c1 := src[i]; i++
+		dst = append(dst,bfItoa64[c1>>2])
+		c1 = (c1&0x03)<<4
+		if i>=len(src) {
+			dst = append(dst,bfItoa64[c1])
+			break
+		}
+		c2 := src[i]; i++
+		c1 |= c2>>4
+		dst = append(dst,bfItoa64[c1])
+		c1 = (c2&0x0f)<<2
+		if i>=len(src) {
+			dst = append(dst,bfItoa64[c1])
+			break
+		}
+		c2 = src[i]; i++
+		c1 |= c2>>6
+		dst = append(dst,bfItoa64[c1],bfItoa64[c2&0x3f])
+	}
+	return string(dst)
+}
+
+/*
+ BF_set_key(): The 18 key words, cycling through the key and its terminating
+ NUL. Returns the expanded key, and the key for the initial key schedule.
+ */
+func bfSetKey(key []byte, flags byte) (expanded, initial []byte) {
+	if i := strings.IndexByte(string(key),0); i>=0 { key = key[:i] }
+	key = append(key[:len(key):len(key)],0)
+	bug := flags&1
+	safety := uint32(flags&2)<<15
+	var sign,diff uint32
+	var words [18]uint32
+	ptr := 0
+	for i := range words {
+		var t0,t1 uint32
+		for j := 0; j<4; j++ {
+			t0 = t0<<8|uint32(key[ptr])
+			t1 = t1<<8|uint32(int32(int8(key[ptr])))
+			if j!=0 { sign |= t1&0x80 }
+			if key[ptr]==0 { ptr = 0 } else { ptr++ }
+		}
+		diff |= t0^t1
+		if bug!=0 { words[i] = t1 } else { words[i] = t0 }
+	}
+	diff |= diff>>16
+	diff &= 0xffff
+	diff += 0xffff
+	sign <<= 9
+	sign &= ^diff&safety
+	expanded = make([]byte,72)
+	for i,w := range words { binary.BigEndian.PutUint32(expanded[4*i:],w) }
+	initial = append([]byte(nil),expanded...)
+	binary.BigEndian.PutUint32(initial,words[0]^sign)
+	return
+}
+
+/*
+ Computes the crypt(3) hash of password with the setting ($2?$), like
+ BF_crypt() in libxcrypt.
+ */
+func bcryptCrypt(password []byte, setting string) (string,error) {
+	if len(setting)<7+22 || setting[0]!='$' || setting[1]!='2' || setting[3]!='$' ||
+		setting[4]<'0' || setting[4]>'3' || setting[5]<'0' || setting[5]>'9' ||
+		(setting[4]=='3' && setting[5]>'1') || setting[6]!='$' {
+		return "",ErrInvalidHash
+	}
+	flags,ok := bfFlags[setting[2]]
+	if !ok { return "",ErrInvalidHash }
+	cost := uint(setting[4]-'0')*10+uint(setting[5]-'0')
+	if cost<4 { return "",ErrInvalidHash }
+	salt,ok := bfDecode(setting[7:],16)
+	if !ok { return "",ErrInvalidHash }
+
+	expanded,initial := bfSetKey(password,flags)
+	c,err := blowfish.NewSaltedCipher(initial,salt)
+	if err!=nil { return "",err }
+	for i := uint64(0); i<1<<cost; i++ {
+		blowfish.ExpandKey(expanded,c)
+		blowfish.ExpandKey(salt,c)
+	}
+	data := []byte("OrpheanBeholderScryDoubt")
+	for i := 0; i<24; i += 8 {
+		for j := 0; j<64; j++ { c.Encrypt(data[i:i+8],data[i:i+8]) }
+	}
+	return setting[:7]+bfEncode(salt)+bfEncode(data[:23]),nil
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "strings"
+import "testing"
+
+// Hashes computed by crypt(3) of libxcrypt.
+var cryptVectors = []struct{ password, hash string }{
+	{"password","$y$j9T$F5Jx5fExrKuPp53xLKQ..1$tnSYvahCwPBHKZUspmcxMfb0.WiB9W.zEaKlOBL35rC"},
+	{"","$y$j9T$F5Jx5fExrKuPp53xLKQ..1$5P1uc1zvKhieqEtKttbwCQrTPXpY1cK9wEnTDKAqLD8"},
+	{"correct horse","$y$jAT$abcdefghijklmnopqrstu.$D2sE54LrThl8pUdWg6AMRGH9RiucDmppbyuWu.0Xf82"},
+	{"password","$y$j75$Lg7G5n7oXQ4c.YUkYGB1q/$Jubuehy.K499aquD6jCBtCAenEQMJasBiypJJC.9dM0"},
+	{"password","$y$j9T$$8GphBPUYahATxqgj0nfonf6iSyOHvCy5v.9VnYW6c15"},
+	{"password","$gy$j9T$F5Jx5fExrKuPp53xLKQ..1$Dogv.jai3UfiqXFIeQV0FWiA2xx/QPuuov.EGnMByDD"},
+	{"hunter2","$gy$jCT$HM87v.7RwpQLba8fDjNSk1$1FBBgfg5CRdHzw7LTfyJfJ1N0iNULyn6UtkNgmVktU/"},
+	{"password","$7$C6..../....SodiumChloride$6OIeehEnzbyu949sLkdyNyp6EorTTZ52ToM3ucR5RK7"},
+	{"pleaseletmein","$7$C6..../....SodiumChloride$kBGj9fHznVYFQMEn/qDCfrDevf9YDtcDdKvEqHJLV8D"},
+	{"password","$7$C6..../....$sr5D.9nzHohHQnwRgN58z6fuWG8mszL.wA4TuSk.6z3"},
+	{"password","$2b$04$abcdefghijklmnopqrstuughE8Ev8uGFaUgY2cNEySvxngrb/Jzdm"},
+	{"U*U","$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	// The sign extension bug of $2x$, and its countermeasure in $2a$.
+	{"\xff\xa334\xff\xff\xff\xa3345","$2a$05$/OK.fbVrR/bpIqNJ5ianF.ZC1JEJ8Z4gPfpe1JOr/oyPXTWl9EFd."},
+	{"\xff\xa334\xff\xff\xff\xa3345","$2b$05$/OK.fbVrR/bpIqNJ5ianF.o./n25XVfn6oAPaUvHe.Csk4zRfsYPi"},
+	{"\xff\xa334\xff\xff\xff\xa3345","$2y$05$/OK.fbVrR/bpIqNJ5ianF.o./n25XVfn6oAPaUvHe.Csk4zRfsYPi"},
+	{"\xff\xa3345","$2x$05$/OK.fbVrR/bpIqNJ5ianF.o./n25XVfn6oAPaUvHe.Csk4zRfsYPi"},
+	// Only 72 bytes count.
+	{strings.Repeat("a",72)+"b","$2b$04$abcdefghijklmnopqrstuuBzzIgyKkz7xMWYSzkIjUSnxEQFQ0WNe"},
+	{"Hello world!","$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+	{"Hello world!","$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+	{"Hello world!","$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+	{"Hello world!","$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+	{"This is just a test","$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	{"password","$1$saltstri$qQY4WxjABChYG1ccLpfkz/"},
+	{"","$1$$qRPK7m23GJusamGpoGLby/"},
+}
+
+// Hashes password with the setting, as verifyHash does.
+func testCrypt(password, setting string) (string,error) {
+	for _,n := range nativeCrypt {
+		if strings.HasPrefix(setting,n.prefix) { return n.crypt([]byte(password),setting) }
+	}
+	return "",ErrInvalidHash
+}
+
+func TestCryptVectors(t *testing.T) {
+	for _,v := range cryptVectors {
+		h,err := testCrypt(v.password,v.hash)
+		if err!=nil || h!=v.hash { t.Errorf("%q: got %q %v",v.hash,h,err); continue }
+		if err = verifyHash(v.hash,[]byte("x"+v.password)); err!=ErrWrongPassword { t.Errorf("%q: wrong password: %v",v.hash,err) }
+	}
+}
+
+// Salts are cut to their maximum length, like libxcrypt does.
+func TestCryptLongSalt(t *testing.T) {
+	for _,v := range []struct{ password, setting, want string }{
+		{"This is just a test","$6$rounds=5000$toolongsaltstring",
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"password","$1$toolongsaltstring","$1$toolongs$nbxWng79pwW9eFqyOCHnw1"},
+	} {
+		h,err := testCrypt(v.password,v.setting)
+		if err!=nil || h!=v.want { t.Errorf("%q: got %q %v",v.setting,h,err) }
+	}
+}
+
+// Settings, crypt(3) of libxcrypt fails for ("*0").
+func TestCryptMalformed(t *testing.T) {
+	for _,s := range []string{
+		"$y$","$y$j9T","$y$!9T$F5Jx5fExrKuPp53xLKQ..1","$y$j9T$F5Jx5f!xrKuPp53xLKQ..1","$y$jzz$abc",
+		"$gy$","$gy$j9T",
+		"$7$C6","$7$!6..../....salt",
+		"$2b$03$abcdefghijklmnopqrstuu","$2b$32$abcdefghijklmnopqrstuu","$2c$05$abcdefghijklmnopqrstuu",
+		"$2b$05$short","$2b$5$abcdefghijklmnopqrstuu","$2b$05abcdefghijklmnopqrstuu",
+		"$5$rounds=abc$salt","$6$rounds=10$roundstoolow","$6$rounds=$salt","$6$rounds=1000000000$salt",
+		"$6$rounds=01000$salt","$5$salt:x","$1$salt\n",
+		"$1","$6","$9$salt","x",
+	} {
+		if h,err := testCrypt("password",s); err!=ErrInvalidHash { t.Errorf("%q: got %q %v",s,h,err) }
+		if err := verifyHash(s,[]byte("password")); err!=ErrInvalidHash { t.Errorf("%q: verify %v",s,err) }
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	for _,v := range []struct{ scheme string; cost int }{{SchemeYescrypt,1},{SchemeSHA512Crypt,1000}} {
+		h,err := HashPassword([]byte("secret"),v.scheme,v.cost)
+		if err!=nil { t.Fatal(err) }
+		if verifyHash(h,[]byte("secret"))!=nil || verifyHash(h,[]byte("Secret"))!=ErrWrongPassword { t.Errorf("%s: %q",v.scheme,h) }
+		if verifyHash("!"+h,[]byte("secret"))!=ErrAccountLocked { t.Errorf("%s: locked hash accepted",v.scheme) }
+	}
+	if _,err := HashPassword([]byte("a\x00b"),SchemeYescrypt,0); err!=ErrInvalidPassword { t.Errorf("NUL: %v",err) }
+	if _,err := GenSalt(SchemeYescrypt,12); err==nil { t.Error("yescrypt cost 12 accepted") }
+	if _,err := GenSalt(SchemeSHA512Crypt,999); err==nil { t.Error("999 rounds accepted") }
+}
@@ -0,0 +1,358 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/userdb"
+import "context"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "syscall"
+import "time"
+import "unsafe"
+
+// The tally directory of pam_faillock.
+const DefaultFaillockDir = "/var/run/faillock"
+
+const FaillockConfFile = "/etc/security/faillock.conf"
+
+// Status bits of a tally record.
+const TALLY_STATUS_VALID = 0x1
+const TALLY_STATUS_RHOST = 0x2
+const TALLY_STATUS_TTY   = 0x4
+
+// struct tally: char source[52]; uint16_t reserved, status; uint64_t time.
+const tallySize = 64
+const tallySourceSize = 52
+const maxTallyRecords = 1024
+
+var ErrTooManyFailures = errors.New("too many authentication failures")
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x))==0 { nativeEndian = binary.BigEndian }
+}
+
+// A failed login, as recorded by pam_faillock.
+type TallyRecord struct{
+	// The remote host, tty or service.
+	Source string
+	Status uint16
+	Time   time.Time
+}
+
+func (t *TallyRecord) Valid() bool { return t.Status&TALLY_STATUS_VALID!=0 }
+
+// "RHOST", "TTY" or "SVC", like faillock(8).
+func (t *TallyRecord) Type() string {
+	switch {
+	case t.Status&TALLY_STATUS_RHOST!=0: return "RHOST"
+	case t.Status&TALLY_STATUS_TTY!=0: return "TTY"
+	}
+	return "SVC"
+}
+
+func tallyPath(dir, user string) (string,error) {
+	if user=="" || user=="." || user==".." || strings.ContainsAny(user,"/\x00") { return "",NoSuchUser }
+	if dir=="" { dir = DefaultFaillockDir }
+	return filepath.Join(dir,user),nil
+}
+
+/*
+ Opens and locks (flock) the tally file of user. Without create, a missing
+ file yields nil. A created file is owned by uid (if >=0), like pam_faillock.
+ */
+func openTally(dir, user string, create bool, uid int) (*os.File,error) {
+	p,err := tallyPath(dir,user)
+	if err!=nil { return nil,err }
+	var f *os.File
+	if create {
+		if err = os.MkdirAll(filepath.Dir(p),0755); err!=nil { return nil,err }
+		f,err = os.OpenFile(p,os.O_RDWR|os.O_CREATE|syscall.O_CLOEXEC,0660)
+	} else {
+		f,err = os.OpenFile(p,os.O_RDWR|syscall.O_CLOEXEC,0)
+		if os.IsNotExist(err) { return nil,nil }
+	}
+	if err!=nil { return nil,err }
+	for {
+		err = syscall.Flock(int(f.Fd()),syscall.LOCK_EX)
+		if err!=syscall.EINTR { break }
+	}
+	if err!=nil { f.Close(); return nil,err }
+	if create && uid>=0 {
+		if fi,e := f.Stat(); e==nil && fi.Sys().(*syscall.Stat_t).Uid!=uint32(uid) { f.Chown(uid,-1) }
+	}
+	return f,nil
+}
+
+func readTallyRecords(r io.Reader) ([]TallyRecord,error) {
+	data,err := ioutil.ReadAll(r)
+	if err!=nil { return nil,err }
+	recs := make([]TallyRecord,0,len(data)/tallySize)
+	for ; len(data)>=tallySize; data = data[tallySize:] {
+		src := data[:tallySourceSize]
+		if i := strings.IndexByte(string(src),0); i>=0 { src = src[:i] }
+		recs = append(recs,TallyRecord{
+			Source: string(src),
+			Status: nativeEndian.Uint16(data[54:]),
+			Time:   time.Unix(int64(nativeEndian.Uint64(data[56:])),0),
+		})
+	}
+	return recs,nil
+}
+
+func writeTallyRecords(f *os.File, recs []TallyRecord) error {
+	data := make([]byte,len(recs)*tallySize)
+	for i,t := range recs {
+		b := data[i*tallySize:]
+		copy(b[:tallySourceSize],t.Source)
+		nativeEndian.PutUint16(b[54:],t.Status)
+		nativeEndian.PutUint64(b[56:],uint64(t.Time.Unix()))
+	}
+	if _,err := f.WriteAt(data,0); err!=nil { return err }
+	return f.Truncate(int64(len(data)))
+}
+
+// Returns the tally records of user in dir (DefaultFaillockDir, if empty).
+func ReadTally(dir, user string) ([]TallyRecord,error) {
+	f,err := openTally(dir,user,false,-1)
+	if f==nil { return nil,err }
+	defer f.Close()
+	return readTallyRecords(f)
+}
+
+// Clears the tally of user in dir, like "faillock --reset".
+func ResetTally(dir, user string) error {
+	f,err := openTally(dir,user,false,-1)
+	if f==nil { return err }
+	defer f.Close()
+	return f.Truncate(0)
+}
+
+/*
+ Counts failed logins and locks users out, compatible with pam_faillock and
+ its tally files. It wraps another Authenticator:
+
+	auth := authen.NewFaillock(new(authen.Shadow))
+
+ While a user is locked out, the password is checked all the same, but
+ ErrTooManyFailures is returned. Users unknown to Auth are not recorded. Wrong
+ one-time codes count as failures as well, if Auth checks them (see
+ OTP.Authenticator).
+ */
+type Faillock struct{
+	Auth           Authenticator
+	// The tally directory; defaults to DefaultFaillockDir.
+	Dir            string
+	// Failures within FailInterval, that lock the user out (0: never).
+	Deny           int
+	FailInterval   time.Duration
+	// How long the user is locked out; 0 means until reset.
+	UnlockTime     time.Duration
+	// Whether root (uid 0) is counted, and its UnlockTime (negative: UnlockTime).
+	EvenDenyRoot   bool
+	RootUnlockTime time.Duration
+	/*
+	 Counts the failures per source (remote address), so that failures from
+	 one address do not lock the user out from others. On success, only the
+	 records of the source are cleared.
+	 */
+	PerSource      bool
+	// The user database for uid lookups; nil is the system's.
+	DB             *userdb.DB
+}
+
+// Returns a Faillock with the defaults of pam_faillock.
+func NewFaillock(a Authenticator) *Faillock {
+	return &Faillock{Auth: a, Deny: 3, FailInterval: 900*time.Second, UnlockTime: 600*time.Second, RootUnlockTime: -1}
+}
+
+/*
+ Reads the defaults and /etc/security/faillock.conf, if it exists.
+ */
+func LoadFaillock(a Authenticator) (*Faillock,error) {
+	f := NewFaillock(a)
+	r,err := os.Open(FaillockConfFile)
+	if os.IsNotExist(err) { return f,nil }
+	if err!=nil { return nil,err }
+	defer r.Close()
+	return f,f.Parse(r,FaillockConfFile)
+}
+
+func setSeconds(p *time.Duration) func(v string) error {
+	return func(v string) error {
+		if v=="never" { *p = 0; return nil }
+		n,err := strconv.ParseUint(v,10,32)
+		if err!=nil { return fmt.Errorf("invalid number %q",v) }
+		*p = time.Duration(n)*time.Second
+		return nil
+	}
+}
+
+/*
+ Parses faillock.conf(5) formatted data into f. name is used in error
+ messages.
+ */
+func (f *Faillock) Parse(r io.Reader, name string) error {
+	return parseConf(r,name,map[string]func(v string) error{
+		"dir": func(v string) error { f.Dir = v; return nil },
+		"deny": setInt(&f.Deny),
+		"fail_interval": setSeconds(&f.FailInterval),
+		"unlock_time": setSeconds(&f.UnlockTime),
+		"even_deny_root": setBool(&f.EvenDenyRoot),
+		"root_unlock_time": setSeconds(&f.RootUnlockTime),
+		"audit": ignoreSetting,
+		"silent": ignoreSetting,
+		"no_log_info": ignoreSetting,
+		"local_users_only": ignoreSetting,
+		"nodelay": ignoreSetting,
+		"admin_group": ignoreSetting,
+	})
+}
+
+// The state of the tally of a user.
+type TallyStatus struct{
+	// Failures within the fail interval.
+	Failures int
+	Locked   bool
+	// When the lock ends; zero, if only a reset ends it.
+	Until    time.Time
+	Records  []TallyRecord
+}
+
+// Source and status bits of a failure from r.
+func tallySource(r *Remote) (string,uint16) {
+	if r!=nil && r.Addr!=nil {
+		s := r.Addr.String()
+		if h,_,err := net.SplitHostPort(s); err==nil { s = h }
+		return s,TALLY_STATUS_VALID|TALLY_STATUS_RHOST
+	}
+	if r!=nil && r.Service!="" { return r.Service,TALLY_STATUS_VALID }
+	return "",TALLY_STATUS_VALID
+}
+
+func (f *Faillock) matches(t *TallyRecord, source string) bool {
+	if !t.Valid() { return false }
+	return !f.PerSource || t.Source==source
+}
+
+// Computes the status like check_tally() of pam_faillock.
+func (f *Faillock) status(recs []TallyRecord, source string, root bool, now time.Time) (st TallyStatus, unlocked bool) {
+	st.Records = recs
+	var latest time.Time
+	for i := range recs {
+		if f.matches(&recs[i],source) && recs[i].Time.After(latest) { latest = recs[i].Time }
+	}
+	for i := range recs {
+		if f.matches(&recs[i],source) && latest.Sub(recs[i].Time)<f.FailInterval { st.Failures++ }
+	}
+	if f.Deny<=0 || st.Failures<f.Deny { return }
+	ut := f.UnlockTime
+	if root && f.RootUnlockTime>=0 { ut = f.RootUnlockTime }
+	if ut>0 && latest.Add(ut).Before(now) { return st,true }
+	st.Locked = true
+	if ut>0 { st.Until = latest.Add(ut) }
+	return
+}
+
+// Returns the uid of user (-1, if unknown), and whether it is exempt.
+func (f *Faillock) lookup(user string) (int,bool) {
+	pw,err := f.DB.LookupUser(user)
+	if err!=nil { return -1,false }
+	return int(pw.Uid),pw.Uid==0 && !f.EvenDenyRoot
+}
+
+/*
+ Returns the tally of user, as seen from source (only relevant with
+ PerSource).
+ */
+func (f *Faillock) Status(user, source string) (*TallyStatus,error) {
+	recs,err := ReadTally(f.Dir,user)
+	if err!=nil { return nil,err }
+	uid,_ := f.lookup(user)
+	st,_ := f.status(recs,source,uid==0,time.Now())
+	return &st,nil
+}
+
+// Clears the tally of user.
+func (f *Faillock) Reset(user string) error {
+	return ResetTally(f.Dir,user)
+}
+
+// Appends a failure, like write_tally() of pam_faillock.
+func (f *Faillock) record(user string, uid int, source string, status uint16, unlocked bool, now time.Time) error {
+	fh,err := openTally(f.Dir,user,true,uid)
+	if err!=nil { return err }
+	defer fh.Close()
+	recs,err := readTallyRecords(fh)
+	if err!=nil { return err }
+	oldest := -1
+	for i := range recs {
+		if oldest<0 || recs[i].Time.Before(recs[oldest].Time) { oldest = i }
+		if unlocked || now.Sub(recs[i].Time)>=f.FailInterval { recs[i].Status &^= TALLY_STATUS_VALID }
+	}
+	t := TallyRecord{Source: source, Status: status, Time: now}
+	if len(source)>tallySourceSize { t.Source = source[:tallySourceSize] }
+	if oldest>=0 && (!recs[oldest].Valid() || len(recs)>=maxTallyRecords) {
+		recs[oldest] = t
+	} else {
+		recs = append(recs,t)
+	}
+	return writeTallyRecords(fh,recs)
+}
+
+// Clears the tally after a successful login.
+func (f *Faillock) clear(user string, source string) error {
+	fh,err := openTally(f.Dir,user,false,-1)
+	if fh==nil { return err }
+	defer fh.Close()
+	if !f.PerSource { return fh.Truncate(0) }
+	recs,err := readTallyRecords(fh)
+	if err!=nil { return err }
+	var keep []TallyRecord
+	for _,t := range recs {
+		if t.Source!=source { keep = append(keep,t) }
+	}
+	return writeTallyRecords(fh,keep)
+}
+
+func (f *Faillock) Authenticate(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+	uid,exempt := f.lookup(user)
+	if exempt { return f.Auth.Authenticate(ctx,user,password,r) }
+	source,status := tallySource(r)
+	now := time.Now()
+	recs,err := ReadTally(f.Dir,user)
+	if err!=nil && err!=NoSuchUser { return nil,err }
+	st,unlocked := f.status(recs,source,uid==0,now)
+
+	// Checked even while locked out, so the timing does not tell.
+	id,err := f.Auth.Authenticate(ctx,user,password,r)
+	switch err {
+	case nil:
+		if st.Locked { return nil,ErrTooManyFailures }
+		if len(recs)>0 {
+			if e := f.clear(user,source); e!=nil { return nil,e }
+		}
+		return id,nil
+	case ErrWrongPassword,ErrWrongCode,ErrCodeReused:
+		if e := f.record(user,uid,source,status,unlocked,now); e!=nil { return nil,e }
+		if st.Locked { return nil,ErrTooManyFailures }
+	}
+	return nil,err
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+func tallyDir(t *testing.T) string {
+	d,err := ioutil.TempDir("","faillocktest")
+	if err!=nil { t.Fatal(err) }
+	return d
+}
+
+func TestTallyRoundTrip(t *testing.T) {
+	d := tallyDir(t)
+	defer os.RemoveAll(d)
+	recs := []TallyRecord{
+		{"192.0.2.1",TALLY_STATUS_VALID|TALLY_STATUS_RHOST,time.Unix(1500000000,0)},
+		{"/dev/pts/1",TALLY_STATUS_TTY,time.Unix(1500000060,0)},
+		{"sshd",TALLY_STATUS_VALID,time.Unix(1500000120,0)},
+	}
+	f,err := openTally(d,"alice",true,-1)
+	if err!=nil { t.Fatal(err) }
+	if err = writeTallyRecords(f,recs); err!=nil { t.Fatal(err) }
+	f.Close()
+	data,err := ioutil.ReadFile(filepath.Join(d,"alice"))
+	if err!=nil { t.Fatal(err) }
+	// struct tally of pam_faillock, in native byte order.
+	if len(data)!=3*tallySize { t.Fatalf("%d bytes",len(data)) }
+	b := data[tallySize:]
+	if string(b[:10])!="/dev/pts/1" || b[10]!=0 { t.Errorf("source %q",b[:tallySourceSize]) }
+	if nativeEndian.Uint16(b[54:])!=TALLY_STATUS_TTY || nativeEndian.Uint64(b[56:])!=1500000060 { t.Errorf("record % x",b) }
+	got,err := ReadTally(d,"alice")
+	if err!=nil { t.Fatal(err) }
+	if !reflect.DeepEqual(got,recs) { t.Errorf("got %+v",got) }
+	if got[0].Type()!="RHOST" || got[1].Type()!="TTY" || got[2].Type()!="SVC" || got[1].Valid() { t.Errorf("types of %+v",got) }
+	// A trailing partial record is ignored.
+	if err = ioutil.WriteFile(filepath.Join(d,"bob"),data[:tallySize+10],0600); err!=nil { t.Fatal(err) }
+	if got,err = ReadTally(d,"bob"); err!=nil || len(got)!=1 { t.Errorf("partial: %+v %v",got,err) }
+	if got,err = ReadTally(d,"nobody"); err!=nil || got!=nil { t.Errorf("missing: %+v %v",got,err) }
+	if _,err = ReadTally(d,"../x"); err!=NoSuchUser { t.Errorf("invalid name: %v",err) }
+	if err = ResetTally(d,"alice"); err!=nil { t.Fatal(err) }
+	if got,err = ReadTally(d,"alice"); err!=nil || len(got)!=0 { t.Errorf("after reset: %+v %v",got,err) }
+}
+
+func TestFaillockRecord(t *testing.T) {
+	d := tallyDir(t)
+	defer os.RemoveAll(d)
+	f := NewFaillock(nil)
+	f.Dir = d
+	now := time.Unix(1500000000,0)
+	long := strings.Repeat("h",60)
+	for i := 0; i<3; i++ {
+		if err := f.record("alice",-1,long,TALLY_STATUS_VALID|TALLY_STATUS_RHOST,false,now.Add(time.Duration(i)*time.Second)); err!=nil { t.Fatal(err) }
+	}
+	recs,err := ReadTally(d,"alice")
+	if err!=nil || len(recs)!=3 { t.Fatalf("%+v %v",recs,err) }
+	if recs[2].Source!=long[:tallySourceSize] { t.Errorf("source %q",recs[2].Source) }
+	st,_ := f.status(recs,"",false,now.Add(3*time.Second))
+	if st.Failures!=3 || !st.Locked || !st.Until.Equal(now.Add(2*time.Second+f.UnlockTime)) { t.Errorf("status %+v",st) }
+	// Past the fail interval the old records are invalidated and reused.
+	later := now.Add(f.FailInterval+time.Hour)
+	if err = f.record("alice",-1,"tty1",TALLY_STATUS_VALID|TALLY_STATUS_TTY,false,later); err!=nil { t.Fatal(err) }
+	recs,_ = ReadTally(d,"alice")
+	if len(recs)!=3 || recs[0].Source!="tty1" || recs[1].Valid() || recs[2].Valid() { t.Errorf("after interval %+v",recs) }
+	if st,_ = f.status(recs,"",false,later); st.Failures!=1 || st.Locked { t.Errorf("status %+v",st) }
+}
+
+func TestFaillockClearPerSource(t *testing.T) {
+	d := tallyDir(t)
+	defer os.RemoveAll(d)
+	f := NewFaillock(nil)
+	f.Dir = d
+	f.PerSource = true
+	now := time.Now()
+	f.record("alice",-1,"a",TALLY_STATUS_VALID|TALLY_STATUS_RHOST,false,now)
+	f.record("alice",-1,"b",TALLY_STATUS_VALID|TALLY_STATUS_RHOST,false,now)
+	if err := f.clear("alice","a"); err!=nil { t.Fatal(err) }
+	recs,_ := ReadTally(d,"alice")
+	if len(recs)!=1 || recs[0].Source!="b" { t.Errorf("got %+v",recs) }
+	f.PerSource = false
+	f.clear("alice","a")
+	if recs,_ = ReadTally(d,"alice"); len(recs)!=0 { t.Errorf("got %+v",recs) }
+}
+
+func TestFaillockParse(t *testing.T) {
+	f := NewFaillock(nil)
+	err := f.Parse(strings.NewReader("# comment\ndir = /tmp/tally\ndeny=5\nunlock_time = never\neven_deny_root\nsilent\nnew_option = 1\n"),"faillock.conf")
+	if err!=nil { t.Fatal(err) }
+	if f.Dir!="/tmp/tally" || f.Deny!=5 || f.UnlockTime!=0 || !f.EvenDenyRoot { t.Errorf("got %+v",f) }
+	if err = f.Parse(strings.NewReader("deny = x\n"),"faillock.conf"); err==nil || !strings.HasPrefix(err.Error(),"faillock.conf:1:") { t.Errorf("error %v",err) }
+}
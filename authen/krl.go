@@ -0,0 +1,243 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "golang.org/x/crypto/ssh"
+import "bytes"
+import "crypto/sha1"
+import "crypto/sha256"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "math/big"
+import "time"
+
+const krlMagic = "SSHKRL\n\x00"
+
+// Sections of a KRL (see PROTOCOL.krl of OpenSSH).
+const krlSectionCertificates = 1
+const krlSectionExplicitKey = 2
+const krlSectionFingerprintSHA1 = 3
+const krlSectionSignature = 4
+const krlSectionFingerprintSHA256 = 5
+
+const krlCertSerialList = 0x20
+const krlCertSerialRange = 0x21
+const krlCertSerialBitmap = 0x22
+const krlCertKeyID = 0x23
+
+var errKRLTruncated = errors.New("krl: truncated")
+
+// The revoked certificates of one CA.
+type krlCerts struct{
+	// The blob of the CA key; empty for any CA.
+	ca      []byte
+	serials map[uint64]bool
+	ranges  [][2]uint64
+	bitmaps []krlBitmap
+	ids     map[string]bool
+}
+
+type krlBitmap struct{
+	offset uint64
+	bits   *big.Int
+}
+
+/*
+ A key revocation list, as written by ssh-keygen -k, or a plain list of
+ public keys (see RevokedKeys in sshd_config(5)).
+ */
+type KRL struct{
+	Version   uint64
+	Generated time.Time
+	Comment   string
+	certs     []*krlCerts
+	keys      map[string]bool
+	sha1      map[string]bool
+	sha256    map[string]bool
+}
+
+func newKRL() *KRL {
+	return &KRL{keys: make(map[string]bool), sha1: make(map[string]bool), sha256: make(map[string]bool)}
+}
+
+type krlReader []byte
+
+func (r *krlReader) uint32() (uint32,error) {
+	if len(*r)<4 { return 0,errKRLTruncated }
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v,nil
+}
+
+func (r *krlReader) uint64() (uint64,error) {
+	if len(*r)<8 { return 0,errKRLTruncated }
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v,nil
+}
+
+func (r *krlReader) byte() (byte,error) {
+	if len(*r)<1 { return 0,errKRLTruncated }
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v,nil
+}
+
+func (r *krlReader) string() ([]byte,error) {
+	n,err := r.uint32()
+	if err!=nil { return nil,err }
+	if uint64(len(*r))<uint64(n) { return nil,errKRLTruncated }
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v,nil
+}
+
+func (c *krlCerts) parse(r krlReader) error {
+	for len(r)>0 {
+		t,err := r.byte()
+		if err!=nil { return err }
+		d,err := r.string()
+		if err!=nil { return err }
+		s := krlReader(d)
+		switch t {
+		case krlCertSerialList:
+			for len(s)>0 {
+				v,err := s.uint64()
+				if err!=nil { return err }
+				c.serials[v] = true
+			}
+		case krlCertSerialRange:
+			lo,err := s.uint64()
+			if err!=nil { return err }
+			hi,err := s.uint64()
+			if err!=nil { return err }
+			c.ranges = append(c.ranges,[2]uint64{lo,hi})
+		case krlCertSerialBitmap:
+			off,err := s.uint64()
+			if err!=nil { return err }
+			b,err := s.string()
+			if err!=nil { return err }
+			c.bitmaps = append(c.bitmaps,krlBitmap{off,new(big.Int).SetBytes(b)})
+		case krlCertKeyID:
+			for len(s)>0 {
+				id,err := s.string()
+				if err!=nil { return err }
+				c.ids[string(id)] = true
+			}
+		default:
+			return fmt.Errorf("krl: unknown certificate section %d",t)
+		}
+	}
+	return nil
+}
+
+// Parses a binary KRL. Its signature, if any, is not checked.
+func ParseKRL(data []byte) (*KRL,error) {
+	if !bytes.HasPrefix(data,[]byte(krlMagic)) { return nil,errors.New("krl: bad magic") }
+	r := krlReader(data[len(krlMagic):])
+	k := newKRL()
+	v,err := r.uint32()
+	if err!=nil { return nil,err }
+	if v!=1 { return nil,fmt.Errorf("krl: unsupported format version %d",v) }
+	if k.Version,err = r.uint64(); err!=nil { return nil,err }
+	gen,err := r.uint64()
+	if err!=nil { return nil,err }
+	k.Generated = time.Unix(int64(gen),0)
+	if _,err = r.uint64(); err!=nil { return nil,err } // flags
+	if _,err = r.string(); err!=nil { return nil,err } // reserved
+	c,err := r.string()
+	if err!=nil { return nil,err }
+	k.Comment = string(c)
+	for len(r)>0 {
+		t,err := r.byte()
+		if err!=nil { return nil,err }
+		if t==krlSectionSignature { break }
+		d,err := r.string()
+		if err!=nil { return nil,err }
+		s := krlReader(d)
+		switch t {
+		case krlSectionCertificates:
+			ca,err := s.string()
+			if err!=nil { return nil,err }
+			if _,err = s.string(); err!=nil { return nil,err } // reserved
+			kc := &krlCerts{ca: ca, serials: make(map[uint64]bool), ids: make(map[string]bool)}
+			if err = kc.parse(s); err!=nil { return nil,err }
+			k.certs = append(k.certs,kc)
+		case krlSectionExplicitKey,krlSectionFingerprintSHA1,krlSectionFingerprintSHA256:
+			m := k.keys
+			if t==krlSectionFingerprintSHA1 { m = k.sha1 }
+			if t==krlSectionFingerprintSHA256 { m = k.sha256 }
+			for len(s)>0 {
+				b,err := s.string()
+				if err!=nil { return nil,err }
+				m[string(b)] = true
+			}
+		default:
+			return nil,fmt.Errorf("krl: unknown section %d",t)
+		}
+	}
+	return k,nil
+}
+
+/*
+ Reads a KRL, or a list of public keys (authorized_keys format without
+ certificates), from path.
+ */
+func ReadRevokedKeys(path string) (*KRL,error) {
+	data,err := ioutil.ReadFile(path)
+	if err!=nil { return nil,err }
+	if bytes.HasPrefix(data,[]byte(krlMagic)) { return ParseKRL(data) }
+	keys,err := ParseAuthorizedKeys(bytes.NewReader(data),path)
+	if err!=nil { return nil,err }
+	k := newKRL()
+	for _,e := range keys { k.keys[string(e.Key.Marshal())] = true }
+	return k,nil
+}
+
+func (k *KRL) keyRevoked(key ssh.PublicKey) bool {
+	b := key.Marshal()
+	if k.keys[string(b)] { return true }
+	h1 := sha1.Sum(b)
+	h2 := sha256.Sum256(b)
+	return k.sha1[string(h1[:])] || k.sha256[string(h2[:])]
+}
+
+func (c *krlCerts) revoked(cert *ssh.Certificate) bool {
+	if c.ids[cert.KeyId] { return true }
+	// Like OpenSSH: serial 0 is the default of ssh-keygen, never revoked by serial.
+	if cert.Serial==0 { return false }
+	if c.serials[cert.Serial] { return true }
+	for _,r := range c.ranges {
+		if cert.Serial>=r[0] && cert.Serial<=r[1] { return true }
+	}
+	for _,b := range c.bitmaps {
+		d := cert.Serial-b.offset
+		if cert.Serial>=b.offset && d<uint64(b.bits.BitLen()) && b.bits.Bit(int(d))==1 { return true }
+	}
+	return false
+}
+
+/*
+ Returns true, if the key is revoked. Certificates are revoked, if the
+ certificate (by serial or key ID), its key or the CA key is.
+ */
+func (k *KRL) IsRevoked(key ssh.PublicKey) bool {
+	cert,ok := key.(*ssh.Certificate)
+	if !ok { return k.keyRevoked(key) }
+	if k.keyRevoked(cert.Key) || k.keyRevoked(cert.SignatureKey) { return true }
+	ca := cert.SignatureKey.Marshal()
+	for _,c := range k.certs {
+		if len(c.ca)>0 && !bytes.Equal(c.ca,ca) { continue }
+		if c.revoked(cert) { return true }
+	}
+	return false
+}
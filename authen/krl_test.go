@@ -0,0 +1,173 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "golang.org/x/crypto/ssh"
+import "bytes"
+import "crypto/ed25519"
+import "crypto/rand"
+import "encoding/base64"
+import "encoding/binary"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+// An ed25519 key from a fixed seed.
+func testEdKey(t *testing.T, seed byte) (ssh.Signer,ssh.PublicKey) {
+	s,err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed},32)))
+	if err!=nil { t.Fatal(err) }
+	return s,s.PublicKey()
+}
+
+// A user certificate for the key of seed 2, signed by ca.
+func testCert(t *testing.T, ca ssh.Signer, serial uint64, id string, principals ...string) *ssh.Certificate {
+	_,pub := testEdKey(t,2)
+	c := &ssh.Certificate{Key: pub, Serial: serial, CertType: ssh.UserCert, KeyId: id, ValidPrincipals: principals,
+		ValidBefore: ssh.CertTimeInfinity, Permissions: ssh.Permissions{Extensions: map[string]string{"permit-pty": ""}}}
+	if err := c.SignCert(rand.Reader,ca); err!=nil { t.Fatal(err) }
+	return c
+}
+
+/*
+ Written by ssh-keygen -k -s ca.pub -z 42 (the CA of seed 1) from
+
+	serial: 1
+	serial: 5-7
+	serial: 100
+	serial: 102
+	serial: 104
+	serial: 106
+	serial: 1000-5000
+	serial: 1000000
+	serial: 2000000
+	serial: 3000000
+	id: bad-id
+
+ and updated by ssh-keygen -k -u -z 43 with the keys of seed 3 (key:), 4
+ (sha1:) and 5 (sha256:).
+ */
+const testKRL = "U1NIS1JMCgAAAAABAAAAAAAAACsAAAAAatZEhwAAAAAAAAAAAAAAAAAAAAABAAAAoAAAADMAAAALc3NoLWVkMjU1MTkAAAAgiojj3XQJ8ZX9UtstPLpdcspnCb8dlBIb83SIAbQPb1wAAAAAIgAAAA0AAAAAAAAAAQAAAAFxIgAAAA0AAAAAAAAAZAAAAAFVIQAAABAAAAAAAAAD6AAAAAAAABOIIAAAABgAAAAAAA9CQAAAAAAAHoSAAAAAAAAtxsAjAAAACgAAAAZiYWQtaWQCAAAANwAAADMAAAALc3NoLWVkMjU1MTkAAAAg7UkoxijRwsbq6QM4kFmVYSlZJzpcY/k2NsFGFKyHN9EDAAAAGAAAABQ7Ik03I8ZXk/Tzof9gYJQ7iruAhQUAAAAkAAAAICwOEKEprLRgsv1B33VN4yo5z8+eqUM7nfTprJTId4PM"
+
+func TestParseKRL(t *testing.T) {
+	data,_ := base64.StdEncoding.DecodeString(testKRL)
+	k,err := ParseKRL(data)
+	if err!=nil { t.Fatal(err) }
+	if k.Version!=43 || len(k.certs)!=1 || len(k.keys)!=1 || len(k.sha1)!=1 || len(k.sha256)!=1 { t.Fatalf("got %+v",k) }
+	ca,_ := testEdKey(t,1)
+	other,_ := testEdKey(t,9)
+	for _,tt := range []struct{
+		serial  uint64
+		revoked bool
+	}{
+		{0,false},{1,true},{2,false},{4,false},{5,true},{7,true},{8,false},
+		{100,true},{101,false},{106,true},{107,false},
+		{999,false},{1000,true},{5000,true},{5001,false},
+		{1000000,true},{1000001,false},{3000000,true},
+	} {
+		if r := k.IsRevoked(testCert(t,ca,tt.serial,"id","u")); r!=tt.revoked { t.Errorf("serial %d: revoked %v",tt.serial,r) }
+		// The serials are those of the CA only.
+		if k.IsRevoked(testCert(t,other,tt.serial,"id","u")) { t.Errorf("serial %d of another CA revoked",tt.serial) }
+	}
+	if !k.IsRevoked(testCert(t,ca,0,"bad-id","u")) { t.Error("key ID not revoked") }
+	for seed := byte(3); seed<=5; seed++ {
+		_,pub := testEdKey(t,seed)
+		if !k.IsRevoked(pub) { t.Errorf("key %d not revoked",seed) }
+	}
+	_,pub := testEdKey(t,2)
+	if k.IsRevoked(pub) { t.Error("key revoked") }
+	// A revoked CA key revokes its certificates.
+	s3,_ := testEdKey(t,3)
+	if !k.IsRevoked(testCert(t,s3,0,"id","u")) { t.Error("certificate of a revoked CA") }
+}
+
+func krlString(b []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:],uint32(len(b)))
+	return append(n[:],b...)
+}
+
+func krlUint64(v uint64) []byte {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:],v)
+	return n[:]
+}
+
+// A KRL with the certificate sections for any CA.
+func testKRLCerts(sections ...[]byte) []byte {
+	var certs []byte
+	certs = append(certs,krlString(nil)...) // any CA
+	certs = append(certs,krlString(nil)...) // reserved
+	for _,s := range sections { certs = append(certs,s...) }
+	b := []byte(krlMagic)
+	b = append(b,0,0,0,1)
+	b = append(b,krlUint64(1)...)
+	b = append(b,krlUint64(0)...)
+	b = append(b,krlUint64(0)...)
+	b = append(b,krlString(nil)...)
+	b = append(b,krlString([]byte("test"))...)
+	b = append(b,krlSectionCertificates)
+	return append(b,krlString(certs)...)
+}
+
+// Serial 0 is never revoked by serial, whatever the KRL says.
+func TestKRLSerialZero(t *testing.T) {
+	ca,_ := testEdKey(t,1)
+	for _,tt := range []struct{
+		name string
+		sec  []byte
+	}{
+		{"list",append([]byte{krlCertSerialList},krlString(append(krlUint64(0),krlUint64(3)...))...)},
+		{"range",append([]byte{krlCertSerialRange},krlString(append(krlUint64(0),krlUint64(3)...))...)},
+		{"bitmap",append([]byte{krlCertSerialBitmap},krlString(append(krlUint64(0),krlString([]byte{0x0f})...))...)},
+	} {
+		k,err := ParseKRL(testKRLCerts(tt.sec))
+		if err!=nil { t.Fatal(tt.name,err) }
+		if k.IsRevoked(testCert(t,ca,0,"id","u")) { t.Errorf("%s: serial 0 revoked",tt.name) }
+		if !k.IsRevoked(testCert(t,ca,3,"id","u")) { t.Errorf("%s: serial 3 not revoked",tt.name) }
+	}
+	k,err := ParseKRL(testKRLCerts(append([]byte{krlCertKeyID},krlString(krlString([]byte("x")))...)))
+	if err!=nil { t.Fatal(err) }
+	if !k.IsRevoked(testCert(t,ca,0,"x","u")) { t.Error("key ID of serial 0 not revoked") }
+}
+
+func TestParseKRLInvalid(t *testing.T) {
+	data,_ := base64.StdEncoding.DecodeString(testKRL)
+	for _,b := range [][]byte{
+		nil,
+		[]byte("SSHKRL\n"),
+		data[:len(data)-1],
+		data[:20],
+		testKRLCerts([]byte{0x99,0,0,0,0}),
+		testKRLCerts([]byte{krlCertSerialRange,0,0,0,8,0,0,0,0,0,0,0,1}),
+	} {
+		if _,err := ParseKRL(b); err==nil { t.Errorf("accepted % x",b) }
+	}
+	// Another format version.
+	v := append([]byte(nil),data...)
+	v[len(krlMagic)+3] = 2
+	if _,err := ParseKRL(v); err==nil { t.Error("version 2 accepted") }
+}
+
+func TestReadRevokedKeys(t *testing.T) {
+	d,err := ioutil.TempDir("","krltest")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(d)
+	_,pub := testEdKey(t,3)
+	_,other := testEdKey(t,4)
+	p := filepath.Join(d,"revoked")
+	ioutil.WriteFile(p,append([]byte("# revoked\n"),ssh.MarshalAuthorizedKey(pub)...),0644)
+	k,err := ReadRevokedKeys(p)
+	if err!=nil { t.Fatal(err) }
+	if !k.IsRevoked(pub) || k.IsRevoked(other) { t.Error("plain list") }
+	data,_ := base64.StdEncoding.DecodeString(testKRL)
+	ioutil.WriteFile(p,data,0644)
+	if k,err = ReadRevokedKeys(p); err!=nil || !k.IsRevoked(other) { t.Errorf("KRL: %v",err) }
+}
@@ -1,6 +1,6 @@
 /*
  * Copyright(C) 2015 Simon Schmidt
- * 
+ *
  * This Source Code Form is subject to the terms of the
  * Mozilla Public License, v. 2.0. If a copy of the MPL
  * was not distributed with this file, You can obtain one at
@@ -8,41 +8,96 @@
  */
 
 /*
- Checks user Credentials (/etc/shaddow). Uses "github.com/kless/osutil/user" and
- "github.com/kless/osutil/user/crypt".
+ Checks user Credentials (/etc/shaddow, htpasswd files, ...). Supported are
+ the crypt(3) hashes yescrypt ($y$), gost-yescrypt ($gy$), scrypt ($7$),
+ bcrypt ($2a$, $2b$, $2x$, $2y$), sha512crypt ($6$), sha256crypt ($5$),
+ md5crypt ($1$) and apr1 ($apr1$). The user database is read by
+ "github.com/maxymania/go-system/userdb".
+
+ The backends implement the Authenticator interface; they can be combined
+ using FirstMatch and AllMustPass:
+
+	auth := authen.FirstMatch(&authen.Shadow{}, &authen.Htpasswd{Path: "/etc/service-accounts"})
+	id,err := auth.Authenticate(ctx,user,password,&authen.Remote{Service: "ssh"})
  */
 package authen
 
-import "github.com/kless/osutil/user"
-import "github.com/kless/osutil/user/crypt"
-import _ "github.com/kless/osutil/user/crypt/apr1_crypt"
-import _ "github.com/kless/osutil/user/crypt/md5_crypt"
-import _ "github.com/kless/osutil/user/crypt/sha256_crypt"
-import _ "github.com/kless/osutil/user/crypt/sha512_crypt"
-
+import "github.com/maxymania/go-system/userdb"
+import "context"
+import "crypto/subtle"
 import "strings"
-import "errors"
-import "fmt"
+import "sync"
+
+var NoSuchUser = userdb.ErrNoSuchUser
+
+// The natively implemented crypt(3) schemes, by prefix.
+var nativeCrypt = []struct{
+	prefix string
+	crypt  func(password []byte, setting string) (string,error)
+}{
+	{"$y$",yescryptCrypt},
+	{"$7$",yescryptCrypt},
+	{"$gy$",gostYescryptCrypt},
+	{"$2",bcryptCrypt},
+	{"$6$",shaCrypt},
+	{"$5$",shaCrypt},
+	{"$1$",md5Crypt},
+	{"$apr1$",md5Crypt},
+}
+
+/*
+ Verifies password against a crypt(3) hash. Empty hashes never match, neither
+ do passwords containing NUL. Unsupported hashes yield ErrInvalidHash.
+
+ A hash locked with "!" (usermod -L) yields ErrAccountLocked only for the
+ right password; hashes without a password ("*", "!", "!!") always do.
+ */
+func verifyHash(hash string, password []byte) error {
+	if hash=="" { equalizeTiming(password,""); return ErrWrongPassword }
+	if strings.IndexByte(string(password),0)>=0 { return ErrWrongPassword }
+	if hash[0]=='!' || hash[0]=='*' {
+		h := strings.TrimLeft(hash,"!")
+		if h=="" || h[0]=='*' { equalizeTiming(password,""); return ErrAccountLocked }
+		if verifyHash(h,password)==nil { return ErrAccountLocked }
+		return ErrWrongPassword
+	}
+	for _,n := range nativeCrypt {
+		if !strings.HasPrefix(hash,n.prefix) { continue }
+		h,err := n.crypt(password,hash)
+		if err!=nil { return err }
+		if subtle.ConstantTimeCompare([]byte(h),[]byte(hash))!=1 { return ErrWrongPassword }
+		return nil
+	}
+	return ErrInvalidHash
+}
 
-var NoSuchUser = errors.New("no such user")
+var dummyOnce sync.Once
+var dummyHash string
 
-func catch2error(i interface{}, e *error) {
-	if i==nil { return }
-	if v,ok := i.(error); ok { *e = v; return }
-	*e = errors.New(fmt.Sprint(i))
+/*
+ Spends the time of a password verification, so that unknown users and
+ accounts without password cannot be told apart by the response time. The
+ hash sample (of another user of the backend) has the cost used there; if it
+ is empty, a hash of the default scheme is used.
+ */
+func equalizeTiming(password []byte, sample string) {
+	if !isHash(sample) {
+		dummyOnce.Do(func() { dummyHash,_ = HashPassword([]byte("*"),DefaultScheme,0) })
+		sample = dummyHash
+	}
+	if sample!="" { verifyHash(sample,password) }
 }
 
+// Returns true for crypt(3) hashes, that are not locked.
+func isHash(h string) bool { return len(h)>0 && h[0]=='$' }
+
 /*
  Authenticates an user using his name and password. Returns nil, if the
- Credentials match.
+ Credentials match and the account is usable; see CheckAging.
  */
 func AuthenticatePassword(usr string, password []byte) (err error) {
-	defer func() { catch2error(recover(),&err) }()
-	s,e := user.LookupShadow(usr)
-	if e!=nil { return e }
-	parts := strings.Split(s.String(),":")
-	if len(parts)<2 { return NoSuchUser }
-	return crypt.NewFromHash(parts[1]).Verify(parts[1],password)
+	_,err = new(Shadow).Authenticate(context.Background(),usr,password,nil)
+	return
 }
 
 
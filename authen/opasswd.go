@@ -0,0 +1,72 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/userdb"
+import "bytes"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+
+// The password history of pam_pwhistory and pam_unix.
+const DefaultOpasswdFile = "/etc/security/opasswd"
+
+/*
+ Returns the old password hashes of user from an opasswd file (lines
+ "user:uid:count:hash,hash,..."), oldest first. A missing file is not an error.
+ */
+func ReadOpasswd(path string, user string) ([]string,error) {
+	if path=="" { path = DefaultOpasswdFile }
+	data,err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) { return nil,nil }
+	if err!=nil { return nil,err }
+	for _,l := range strings.Split(string(data),"\n") {
+		f := strings.Split(l,":")
+		if len(f)<4 || f[0]!=user { continue }
+		if f[3]=="" { return []string{},nil }
+		return strings.Split(f[3],","),nil
+	}
+	return []string{},nil
+}
+
+/*
+ Appends hash to the history of user in an opasswd file, keeping the newest
+ remember hashes. The file is created with mode 0600, if missing. The caller
+ should hold the userdb Lock.
+ */
+func AddOpasswd(path string, user string, uid uint32, hash string, remember int) error {
+	if path=="" { path = DefaultOpasswdFile }
+	data,err := ioutil.ReadFile(path)
+	if err!=nil && !os.IsNotExist(err) { return err }
+	exists := err==nil
+	var lines [][]byte
+	if len(data)>0 { lines = bytes.Split(bytes.TrimSuffix(data,[]byte("\n")),[]byte("\n")) }
+	var hashes []string
+	idx := -1
+	for i,l := range lines {
+		f := strings.Split(string(l),":")
+		if len(f)<4 || f[0]!=user { continue }
+		if f[3]!="" { hashes = strings.Split(f[3],",") }
+		idx = i
+		break
+	}
+	hashes = append(hashes,hash)
+	if remember>0 && len(hashes)>remember { hashes = hashes[len(hashes)-remember:] }
+	l := []byte(user+":"+strconv.FormatUint(uint64(uid),10)+":"+strconv.Itoa(len(hashes))+":"+strings.Join(hashes,","))
+	if idx<0 {
+		lines = append(lines,l)
+	} else {
+		lines[idx] = l
+	}
+	out := append(bytes.Join(lines,[]byte("\n")),'\n')
+	if !exists { return ioutil.WriteFile(path,out,0600) }
+	return userdb.ReplaceFile(path,out)
+}
@@ -0,0 +1,290 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha1"
+import "crypto/subtle"
+import "encoding/base32"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "net/url"
+import "strconv"
+import "strings"
+import "time"
+
+// Digits of the one-time codes, and of the scratch codes.
+const OTPDigits = 6
+const ScratchDigits = 8
+
+// The defaults of google-authenticator.
+const DefaultStepSize = 30
+const DefaultWindowSize = 3
+
+var ErrWrongCode = errors.New("wrong verification code")
+var ErrCodeReused = errors.New("verification code already used")
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Computes the RFC 4226 HOTP code of secret for counter (HMAC-SHA1).
+func HOTP(secret []byte, counter uint64, digits int) string {
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:],counter)
+	m := hmac.New(sha1.New,secret)
+	m.Write(c[:])
+	h := m.Sum(nil)
+	o := h[len(h)-1]&0xf
+	v := binary.BigEndian.Uint32(h[o:])&0x7fffffff
+	mod := uint32(1)
+	for i:=0; i<digits; i++ { mod *= 10 }
+	return fmt.Sprintf("%0*d",digits,v%mod)
+}
+
+// Computes the RFC 6238 TOTP code of secret at t, with a step in seconds.
+func TOTP(secret []byte, t time.Time, step int, digits int) string {
+	return HOTP(secret,uint64(t.Unix()/int64(step)),digits)
+}
+
+/*
+ The secret of a user and its state, as in the ~/.google_authenticator file
+ of pam_google_authenticator: the base32 secret, option lines starting with
+ '"', and the scratch codes.
+ */
+type OTPSecret struct{
+	Secret        []byte
+	// Counter based (HOTP_COUNTER), instead of time based (TOTP_AUTH).
+	HOTP          bool
+	Counter       uint64
+	// The TOTP step in seconds (STEP_SIZE); 0 for DefaultStepSize.
+	StepSize      int
+	/*
+	 The number of codes accepted (WINDOW_SIZE); 0 for DefaultWindowSize. For
+	 TOTP, they are centered on the current step, for HOTP, they start at the
+	 counter.
+	 */
+	WindowSize    int
+	// Every TOTP code is accepted only once (DISALLOW_REUSE).
+	DisallowReuse bool
+	// The TOTP steps of the codes used recently.
+	Used          []int64
+	// At most RateLimit attempts within RateInterval seconds (RATE_LIMIT).
+	RateLimit     int
+	RateInterval  int
+	Attempts      []int64
+	// Single-use emergency codes.
+	ScratchCodes  []string
+	// Other option lines, kept as they are.
+	Options       []string
+}
+
+func parseInts(f []string) ([]int64,error) {
+	r := make([]int64,0,len(f))
+	for _,s := range f {
+		v,err := strconv.ParseInt(s,10,64)
+		if err!=nil { return nil,fmt.Errorf("invalid number %q",s) }
+		r = append(r,v)
+	}
+	return r,nil
+}
+
+func formatInts(l []int64) string {
+	s := ""
+	for _,v := range l { s += " "+strconv.FormatInt(v,10) }
+	return s
+}
+
+// Encodes a secret in base32, as authenticator apps expect it.
+func EncodeSecret(key []byte) string { return b32.EncodeToString(key) }
+
+// Decodes a base32 secret; case, blanks and padding do not matter.
+func DecodeSecret(s string) ([]byte,error) {
+	s = strings.ToUpper(strings.Replace(strings.TrimRight(s,"=")," ","",-1))
+	return b32.DecodeString(s)
+}
+
+// Parses the contents of a google_authenticator file.
+func ParseOTPSecret(data []byte) (*OTPSecret,error) {
+	lines := strings.Split(strings.Replace(string(data),"\r","",-1),"\n")
+	key,err := DecodeSecret(lines[0])
+	if err!=nil || len(key)==0 { return nil,errors.New("invalid secret") }
+	s := &OTPSecret{Secret: key}
+	for n,l := range lines[1:] {
+		l = strings.TrimSpace(l)
+		if l=="" { continue }
+		if l[0]!='"' {
+			if len(l)!=ScratchDigits { return nil,fmt.Errorf("line %d: invalid scratch code",n+2) }
+			s.ScratchCodes = append(s.ScratchCodes,l)
+			continue
+		}
+		f := strings.Fields(l[1:])
+		if len(f)==0 { continue }
+		var v []int64
+		switch f[0] {
+		case "RATE_LIMIT","WINDOW_SIZE","DISALLOW_REUSE","HOTP_COUNTER","STEP_SIZE":
+			if v,err = parseInts(f[1:]); err!=nil { return nil,fmt.Errorf("line %d: %v",n+2,err) }
+		}
+		switch f[0] {
+		case "RATE_LIMIT":
+			if len(v)<2 || v[0]<1 || v[1]<1 { return nil,fmt.Errorf("line %d: invalid RATE_LIMIT",n+2) }
+			s.RateLimit,s.RateInterval,s.Attempts = int(v[0]),int(v[1]),v[2:]
+		case "WINDOW_SIZE":
+			if len(v)!=1 || v[0]<1 || v[0]>100 { return nil,fmt.Errorf("line %d: invalid WINDOW_SIZE",n+2) }
+			s.WindowSize = int(v[0])
+		case "DISALLOW_REUSE":
+			s.DisallowReuse,s.Used = true,v
+		case "TOTP_AUTH":
+		case "HOTP_COUNTER":
+			if len(v)!=1 || v[0]<1 { return nil,fmt.Errorf("line %d: invalid HOTP_COUNTER",n+2) }
+			s.HOTP,s.Counter = true,uint64(v[0])
+		case "STEP_SIZE":
+			if len(v)!=1 || v[0]<1 || v[0]>60 { return nil,fmt.Errorf("line %d: invalid STEP_SIZE",n+2) }
+			s.StepSize = int(v[0])
+		default:
+			s.Options = append(s.Options,l)
+		}
+	}
+	return s,nil
+}
+
+// Formats the secret as a google_authenticator file.
+func (s *OTPSecret) String() string {
+	r := EncodeSecret(s.Secret)+"\n"
+	if s.RateLimit>0 { r += fmt.Sprintf("\" RATE_LIMIT %d %d%s\n",s.RateLimit,s.RateInterval,formatInts(s.Attempts)) }
+	if s.WindowSize>0 { r += fmt.Sprintf("\" WINDOW_SIZE %d\n",s.WindowSize) }
+	if s.DisallowReuse { r += "\" DISALLOW_REUSE"+formatInts(s.Used)+"\n" }
+	if s.HOTP {
+		r += fmt.Sprintf("\" HOTP_COUNTER %d\n",s.Counter)
+	} else {
+		r += "\" TOTP_AUTH\n"
+	}
+	if s.StepSize>0 { r += fmt.Sprintf("\" STEP_SIZE %d\n",s.StepSize) }
+	for _,o := range s.Options { r += o+"\n" }
+	for _,c := range s.ScratchCodes { r += c+"\n" }
+	return r
+}
+
+func (s *OTPSecret) step() int {
+	if s.StepSize>0 { return s.StepSize }
+	return DefaultStepSize
+}
+
+func (s *OTPSecret) window() int {
+	if s.WindowSize>0 { return s.WindowSize }
+	return DefaultWindowSize
+}
+
+// Records the attempt; false, if the rate limit is exceeded.
+func (s *OTPSecret) rateLimit(now time.Time) bool {
+	if s.RateLimit<=0 { return true }
+	t := now.Unix()
+	a := s.Attempts[:0]
+	for _,v := range s.Attempts {
+		if v>t-int64(s.RateInterval) && v<=t { a = append(a,v) }
+	}
+	s.Attempts = a
+	if len(a)>=s.RateLimit { return false }
+	s.Attempts = append(s.Attempts,t)
+	return true
+}
+
+func codeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a),[]byte(b))==1
+}
+
+/*
+ Checks the one-time code or scratch code at now, like pam_google_authenticator,
+ and updates the state: used scratch codes are removed, the HOTP counter
+ advances (also after a wrong code), used TOTP steps are recorded with
+ DisallowReuse, and the attempts are recorded with a RateLimit. The caller has
+ to save the secret afterwards, whatever the result.
+ */
+func (s *OTPSecret) Verify(code string, now time.Time) error {
+	code = strings.Replace(code," ","",-1)
+	if !s.rateLimit(now) { return ErrTooManyFailures }
+	if len(code)==ScratchDigits {
+		for i,c := range s.ScratchCodes {
+			if !codeEqual(c,code) { continue }
+			s.ScratchCodes = append(s.ScratchCodes[:i],s.ScratchCodes[i+1:]...)
+			return nil
+		}
+		return ErrWrongCode
+	}
+	if len(code)!=OTPDigits { return ErrWrongCode }
+	w := s.window()
+	if s.HOTP {
+		for i:=0; i<w; i++ {
+			if codeEqual(HOTP(s.Secret,s.Counter+uint64(i),OTPDigits),code) {
+				s.Counter += uint64(i)+1
+				return nil
+			}
+		}
+		s.Counter++
+		return ErrWrongCode
+	}
+	t := now.Unix()/int64(s.step())
+	for i := -int64((w-1)/2); i<=int64(w/2); i++ {
+		if !codeEqual(HOTP(s.Secret,uint64(t+i),OTPDigits),code) { continue }
+		if !s.DisallowReuse { return nil }
+		// Only the steps within the window need to be remembered.
+		used := s.Used[:0]
+		for _,u := range s.Used {
+			if u>=t-int64(w) && u<=t+int64(w) { used = append(used,u) }
+		}
+		s.Used = used
+		for _,u := range s.Used {
+			if u==t+i { return ErrCodeReused }
+		}
+		s.Used = append(s.Used,t+i)
+		return nil
+	}
+	return ErrWrongCode
+}
+
+/*
+ Creates a random secret (80 bits, like google-authenticator) with scratch
+ scratch codes. The other fields keep their zero values (TOTP, the default
+ step and window, no reuse protection and no rate limit).
+ */
+func NewOTPSecret(hotp bool, scratch int) (*OTPSecret,error) {
+	s := &OTPSecret{Secret: make([]byte,10), HOTP: hotp}
+	if hotp { s.Counter = 1 }
+	if _,err := rand.Read(s.Secret); err!=nil { return nil,err }
+	b := make([]byte,4)
+	for i:=0; i<scratch; i++ {
+		if _,err := rand.Read(b); err!=nil { return nil,err }
+		// 10000000..99999999, as google-authenticator does.
+		s.ScratchCodes = append(s.ScratchCodes,strconv.Itoa(10000000+int(binary.BigEndian.Uint32(b)%90000000)))
+	}
+	return s,nil
+}
+
+/*
+ Returns the otpauth:// URI of the secret (Key Uri Format of Google
+ Authenticator), e.g. for a QR code. The label is usually "user@host".
+ */
+func (s *OTPSecret) URI(label, issuer string) string {
+	typ := "totp"
+	q := url.Values{}
+	q.Set("secret",EncodeSecret(s.Secret))
+	if s.HOTP {
+		typ = "hotp"
+		q.Set("counter",strconv.FormatUint(s.Counter,10))
+	} else if s.StepSize>0 && s.StepSize!=DefaultStepSize {
+		q.Set("period",strconv.Itoa(s.StepSize))
+	}
+	if issuer!="" {
+		q.Set("issuer",issuer)
+		label = issuer+":"+label
+	}
+	u := url.URL{Scheme: "otpauth", Host: typ, Path: "/"+label, RawQuery: q.Encode()}
+	return u.String()
+}
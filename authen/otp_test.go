@@ -0,0 +1,131 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "context"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+// The secret of the test vectors of RFC 4226 and RFC 6238 (SHA1).
+var rfcSecret = []byte("12345678901234567890")
+
+// RFC 4226, Appendix D.
+func TestHOTP(t *testing.T) {
+	want := []string{"755224","287082","359152","969429","338314","254676","287922","162583","399871","520489"}
+	for c,w := range want {
+		if got := HOTP(rfcSecret,uint64(c),6); got!=w { t.Errorf("counter %d: %s, want %s",c,got,w) }
+	}
+}
+
+// RFC 6238, Appendix B (SHA1, 8 digits).
+func TestTOTP(t *testing.T) {
+	for ts,w := range map[int64]string{
+		59: "94287082", 1111111109: "07081804", 1111111111: "14050471",
+		1234567890: "89005924", 2000000000: "69279037", 20000000000: "65353130",
+	} {
+		if got := TOTP(rfcSecret,time.Unix(ts,0),30,8); got!=w { t.Errorf("%d: %s, want %s",ts,got,w) }
+	}
+}
+
+func TestSecretEncoding(t *testing.T) {
+	s := EncodeSecret(rfcSecret)
+	if s!="GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" { t.Errorf("encoded %s",s) }
+	for _,v := range []string{s,strings.ToLower(s),"GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ",s+"===="} {
+		b,err := DecodeSecret(v)
+		if err!=nil || string(b)!=string(rfcSecret) { t.Errorf("%q: %q %v",v,b,err) }
+	}
+}
+
+func TestOTPSecretFile(t *testing.T) {
+	data := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n\" RATE_LIMIT 3 30 1000 1010\n\" WINDOW_SIZE 17\n\" DISALLOW_REUSE 55 56\n"+
+		"\" TOTP_AUTH\n\" STEP_SIZE 60\n\" SOMETHING else\n12345678\n87654321\n"
+	s,err := ParseOTPSecret([]byte(data))
+	if err!=nil { t.Fatal(err) }
+	want := &OTPSecret{Secret: rfcSecret, StepSize: 60, WindowSize: 17, DisallowReuse: true, Used: []int64{55,56},
+		RateLimit: 3, RateInterval: 30, Attempts: []int64{1000,1010},
+		ScratchCodes: []string{"12345678","87654321"}, Options: []string{"\" SOMETHING else"}}
+	if !reflect.DeepEqual(s,want) { t.Errorf("got %+v",s) }
+	if s.String()!=data { t.Errorf("formatted as %q",s.String()) }
+	for _,bad := range []string{"!!!\n","GEZDGNBV\n123\n","GEZDGNBV\n\" WINDOW_SIZE 0\n","GEZDGNBV\n\" RATE_LIMIT x 30\n","GEZDGNBV\n\" STEP_SIZE 61\n"} {
+		if _,err := ParseOTPSecret([]byte(bad)); err==nil { t.Errorf("%q: no error",bad) }
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111,0)
+	s := &OTPSecret{Secret: rfcSecret, DisallowReuse: true}
+	code := func(d time.Duration) string { return TOTP(rfcSecret,now.Add(d),30,6) }
+	if err := s.Verify("000000",now); err!=ErrWrongCode { t.Errorf("wrong code: %v",err) }
+	if err := s.Verify(code(0),now); err!=nil { t.Errorf("right code: %v",err) }
+	if err := s.Verify(code(0),now); err!=ErrCodeReused { t.Errorf("reused code: %v",err) }
+	if err := s.Verify(code(-30*time.Second),now); err!=nil { t.Errorf("previous code: %v",err) }
+	if err := s.Verify(code(30*time.Second),now); err!=nil { t.Errorf("next code: %v",err) }
+	if err := s.Verify(code(-90*time.Second),now); err!=ErrWrongCode { t.Errorf("code outside the window: %v",err) }
+	if err := s.Verify("12345",now); err!=ErrWrongCode { t.Errorf("short code: %v",err) }
+}
+
+func TestVerifyHOTP(t *testing.T) {
+	s := &OTPSecret{Secret: rfcSecret, HOTP: true, Counter: 1}
+	now := time.Now()
+	// Counter 2, within the window of 3.
+	if err := s.Verify("359152",now); err!=nil || s.Counter!=3 { t.Errorf("%v, counter %d",err,s.Counter) }
+	if err := s.Verify("359152",now); err!=ErrWrongCode || s.Counter!=4 { t.Errorf("replay: %v, counter %d",err,s.Counter) }
+	// Counter 7 is outside the window 4..6.
+	if err := s.Verify("162583",now); err!=ErrWrongCode { t.Errorf("outside the window: %v",err) }
+}
+
+func TestVerifyScratchAndRateLimit(t *testing.T) {
+	now := time.Unix(1000000,0)
+	s := &OTPSecret{Secret: rfcSecret, ScratchCodes: []string{"11111111","22222222"}, RateLimit: 2, RateInterval: 30}
+	if err := s.Verify("2222 2222",now); err!=nil { t.Errorf("scratch code: %v",err) }
+	if !reflect.DeepEqual(s.ScratchCodes,[]string{"11111111"}) { t.Errorf("scratch codes %q",s.ScratchCodes) }
+	if err := s.Verify("22222222",now); err!=ErrWrongCode { t.Errorf("used scratch code: %v",err) }
+	if err := s.Verify("11111111",now); err!=ErrTooManyFailures { t.Errorf("rate limit: %v",err) }
+	if err := s.Verify("11111111",now.Add(31*time.Second)); err!=nil { t.Errorf("after the interval: %v",err) }
+}
+
+// Wrong codes are counted by a Faillock around OTP.Authenticator.
+func TestOTPFaillock(t *testing.T) {
+	if os.Geteuid()!=0 { t.Skip("needs root for the user database lookup of root") }
+	d,err := ioutil.TempDir("","otptest")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(d)
+	o := &OTP{Path: filepath.Join(d,"%u")}
+	s := &OTPSecret{Secret: rfcSecret}
+	if err = o.Enroll("root",s); err!=nil { t.Fatal(err) }
+	pass := AuthenticatorFunc(func(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+		if string(password)!="secret" { return nil,ErrWrongPassword }
+		return &Identity{User: user},nil
+	})
+	fl := NewFaillock(nil)
+	fl.Dir = filepath.Join(d,"tally")
+	fl.EvenDenyRoot = true
+	if err = os.Mkdir(fl.Dir,0700); err!=nil { t.Fatal(err) }
+	login := func(password, code string) error {
+		f := *fl
+		f.Auth = o.Authenticator(pass,code)
+		_,err := f.Authenticate(context.Background(),"root",[]byte(password),nil)
+		return err
+	}
+	for i:=0; i<2; i++ {
+		if err = login("secret","000000"); err!=ErrWrongCode { t.Fatalf("wrong code: %v",err) }
+	}
+	st,err := fl.Status("root","")
+	if err!=nil || st.Failures!=2 { t.Fatalf("status %+v %v",st,err) }
+	if err = login("secret",TOTP(rfcSecret,time.Now(),30,6)); err!=nil { t.Errorf("right code: %v",err) }
+	if st,_ = fl.Status("root",""); st.Failures!=0 { t.Errorf("tally not cleared: %+v",st) }
+	for i:=0; i<3; i++ { login("secret","000000") }
+	if err = login("secret",TOTP(rfcSecret,time.Now(),30,6)); err!=ErrTooManyFailures { t.Errorf("locked out: %v",err) }
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/userdb"
+import "context"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "runtime"
+import "strconv"
+import "strings"
+import "syscall"
+import "time"
+
+// The secret file of pam_google_authenticator; see OTP.Path.
+const DefaultOTPFile = "%h/.google_authenticator"
+
+// The user has no secret file.
+var ErrNotEnrolled = errors.New("no one-time password secret")
+
+/*
+ Checks one-time codes against the secret files of the users, like
+ pam_google_authenticator.
+ */
+type OTP struct{
+	/*
+	 The secret file of a user: %h is replaced by the home directory, %u by the
+	 user name and %% by %. A central location, like "/var/lib/otp/%u", works as
+	 well (see secret= of pam_google_authenticator). DefaultOTPFile, if empty.
+	 */
+	Path   string
+	// If not 0, it replaces the WINDOW_SIZE of the files.
+	Window int
+	// Users without a secret file pass (like nullok).
+	NullOK bool
+	/*
+	 The secret files are accessed with the file system uid and gid of this
+	 user (user= of pam_google_authenticator), e.g. "root" for a central
+	 location, that users can not access. If empty, the files are accessed as
+	 the user, who logs in, so a user can not redirect the access to files,
+	 the user can not write (by symlinks, also of directories in the path).
+	 */
+	User   string
+	// The user database; the system's, if nil.
+	DB     *userdb.DB
+}
+
+// Returns the path of the secret file of user.
+func (o *OTP) SecretPath(user string) (string,*userdb.Passwd,error) {
+	pw,err := o.DB.LookupUser(user)
+	if err!=nil { return "",nil,err }
+	p := o.Path
+	if p=="" { p = DefaultOTPFile }
+	return expandKeysFile(p,pw),pw,nil
+}
+
+// Runs fn with the file system ids, the secret file of pw is accessed with.
+func (o *OTP) access(pw *userdb.Passwd, fn func() error) error {
+	if o.User!="" {
+		var err error
+		if pw,err = o.DB.LookupUser(o.User); err!=nil { return err }
+	}
+	return withFsid(pw.Uid,pw.Gid,fn)
+}
+
+// Returns the file system uid of the calling thread.
+func fsuid() (int,error) {
+	b,err := ioutil.ReadFile("/proc/thread-self/status")
+	if err!=nil { return -1,err }
+	for _,l := range strings.Split(string(b),"\n") {
+		f := strings.Fields(l)
+		if len(f)==5 && f[0]=="Uid:" { return strconv.Atoi(f[4]) }
+	}
+	return -1,errors.New("no Uid in /proc/thread-self/status")
+}
+
+/*
+ Runs fn with the file system uid and gid of the calling thread set to uid and
+ gid, so fn can only access, what that user may access. If they can not be
+ reset, the error is returned and the goroutine stays locked to the thread,
+ which the runtime terminates, when the goroutine exits.
+ */
+func withFsid(uid, gid uint32, fn func() error) (err error) {
+	euid,egid := os.Geteuid(),os.Getegid()
+	if uint32(euid)==uid && uint32(egid)==gid { return fn() }
+	runtime.LockOSThread()
+	syscall.Setfsgid(int(gid))
+	syscall.Setfsuid(int(uid))
+	defer func() {
+		syscall.Setfsuid(euid)
+		syscall.Setfsgid(egid)
+		if id,e := fsuid(); id!=euid {
+			if e==nil { e = fmt.Errorf("file system uid is still %d",id) }
+			err = e
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+	if id,e := fsuid(); e!=nil || id!=int(uid) {
+		if e==nil { e = fmt.Errorf("can not access files as uid %d",uid) }
+		return e
+	}
+	return fn()
+}
+
+/*
+ Opens and locks (flock) the secret file. As the file is replaced on updates,
+ the lock is only held, if path still refers to the locked file.
+ */
+func lockSecretFile(path string) (*os.File,error) {
+	for {
+		f,err := os.OpenFile(path,os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,0)
+		if err!=nil { return nil,err }
+		for {
+			err = syscall.Flock(int(f.Fd()),syscall.LOCK_EX)
+			if err!=syscall.EINTR { break }
+		}
+		if err!=nil { f.Close(); return nil,err }
+		var a,b syscall.Stat_t
+		if syscall.Fstat(int(f.Fd()),&a)==nil && syscall.Lstat(path,&b)==nil && a.Dev==b.Dev && a.Ino==b.Ino { return f,nil }
+		f.Close()
+	}
+}
+
+/*
+ Replaces the secret file path with data, owned by uid and gid, with mode 0400,
+ as pam_google_authenticator does (writing path~ and renaming it). It is
+ called by OTP.access, so the files are created with its file system ids.
+ */
+func writeSecretFile(path string, data []byte, uid, gid uint32) (err error) {
+	tmp := path+"~"
+	os.Remove(tmp)
+	f,err := os.OpenFile(tmp,os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,0400)
+	if err!=nil { return }
+	defer func() {
+		if err!=nil { f.Close(); os.Remove(tmp) }
+	}()
+	if err = f.Chown(int(uid),int(gid)); err!=nil && !os.IsPermission(err) { return }
+	if _,err = f.Write(data); err!=nil { return }
+	if err = f.Sync(); err!=nil { return }
+	if err = f.Close(); err!=nil { return }
+	return os.Rename(tmp,path)
+}
+
+/*
+ Checks the code of user, and saves the new state of the secret file. The
+ file must be owned by the user (or root) and must not be accessible by
+ others. Returns ErrWrongCode, ErrCodeReused, ErrTooManyFailures (RATE_LIMIT)
+ or ErrNotEnrolled (unless NullOK).
+ */
+func (o *OTP) Verify(user, code string) error {
+	p,pw,err := o.SecretPath(user)
+	if err!=nil { return err }
+	var verr error
+	err = o.access(pw,func() error {
+		f,err := lockSecretFile(p)
+		if os.IsNotExist(err) {
+			if !o.NullOK { verr = ErrNotEnrolled }
+			return nil
+		}
+		if err!=nil { return err }
+		defer f.Close()
+		var st syscall.Stat_t
+		if err = syscall.Fstat(int(f.Fd()),&st); err!=nil { return err }
+		if st.Mode&syscall.S_IFMT!=syscall.S_IFREG || (st.Uid!=0 && st.Uid!=pw.Uid) || st.Mode&077!=0 {
+			return fmt.Errorf("bad ownership or modes for %s",p)
+		}
+		data,err := ioutil.ReadAll(f)
+		if err!=nil { return err }
+		s,err := ParseOTPSecret(data)
+		if err!=nil { return fmt.Errorf("%s: %v",p,err) }
+		w := s.WindowSize
+		if o.Window!=0 { s.WindowSize = o.Window }
+		verr = s.Verify(code,time.Now())
+		s.WindowSize = w
+		// Save the state, before the result counts.
+		return writeSecretFile(p,[]byte(s.String()),st.Uid,st.Gid)
+	})
+	if err!=nil { return err }
+	return verr
+}
+
+// Returns true, if user has a secret file.
+func (o *OTP) Enrolled(user string) (bool,error) {
+	p,pw,err := o.SecretPath(user)
+	if err!=nil { return false,err }
+	err = o.access(pw,func() error {
+		_,err := os.Lstat(p)
+		return err
+	})
+	if os.IsNotExist(err) { return false,nil }
+	return err==nil,err
+}
+
+/*
+ Writes the secret file of user, owned by the user and readable only by the
+ user. An existing file is replaced.
+ */
+func (o *OTP) Enroll(user string, s *OTPSecret) error {
+	p,pw,err := o.SecretPath(user)
+	if err!=nil { return err }
+	return o.access(pw,func() error {
+		if err := os.MkdirAll(filepath.Dir(p),0700); err!=nil { return err }
+		if f,err := lockSecretFile(p); err==nil { defer f.Close() }
+		return writeSecretFile(p,[]byte(s.String()),pw.Uid,pw.Gid)
+	})
+}
+
+/*
+ Returns an Authenticator, that checks the password with a and then code, the
+ one-time code of the user. Wrapped in a Faillock, wrong codes are counted as
+ failures, and the tally is only cleared, if both are right:
+
+	fl := *faillock
+	fl.Auth = otp.Authenticator(auth,code)
+	id,err := fl.Authenticate(ctx,user,password,r)
+ */
+func (o *OTP) Authenticator(a Authenticator, code string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, user string, password []byte, r *Remote) (*Identity,error) {
+		id,err := a.Authenticate(ctx,user,password,r)
+		if err!=nil { return nil,err }
+		if err = o.Verify(id.User,code); err!=nil { return nil,err }
+		return id,nil
+	})
+}
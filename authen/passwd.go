@@ -0,0 +1,154 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/userdb"
+import "crypto/rand"
+import "errors"
+import "fmt"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "time"
+
+// Hash schemes for HashPassword.
+const SchemeYescrypt = "yescrypt"
+const SchemeSHA512Crypt = "sha512crypt"
+
+const DefaultScheme = SchemeYescrypt
+
+var ErrInvalidPassword = errors.New("invalid password (contains NUL)")
+
+// The minimum age of the password has not passed yet.
+var ErrPasswordTooYoung = errors.New("password changed too recently")
+
+/*
+ Returns a crypt(3) setting with a random salt, like crypt_gensalt(3). The
+ cost is 1..11 for yescrypt, and the number of rounds (1000..999999999) for
+ sha512crypt; 0 selects the default (5, and 5000 rounds).
+ */
+func GenSalt(scheme string, cost int) (string,error) {
+	switch scheme {
+	case SchemeYescrypt:
+		if cost==0 { cost = 5 }
+		if cost<1 || cost>11 { return "",fmt.Errorf("invalid yescrypt cost %d",cost) }
+		// 1 KiB blocks for the lowest costs, 4 KiB above.
+		nlog2,r := cost+7,32
+		if cost<=2 { nlog2,r = cost+9,8 }
+		salt := make([]byte,16)
+		if _,err := rand.Read(salt); err!=nil { return "",err }
+		return "$y$j"+string(itoa64[nlog2-1])+string(itoa64[r-1])+"$"+encode64(salt),nil
+	case SchemeSHA512Crypt:
+		s := "$6$"
+		if cost!=0 {
+			if cost<shaRoundsMin || cost>shaRoundsMax { return "",fmt.Errorf("invalid sha512crypt rounds %d",cost) }
+			s += "rounds="+strconv.Itoa(cost)+"$"
+		}
+		salt := make([]byte,16)
+		if _,err := rand.Read(salt); err!=nil { return "",err }
+		for _,b := range salt { s += string(itoa64[b&0x3f]) }
+		return s,nil
+	}
+	return "",fmt.Errorf("unknown hash scheme %q",scheme)
+}
+
+// Hashes password with a random salt; see GenSalt.
+func HashPassword(password []byte, scheme string, cost int) (string,error) {
+	if strings.IndexByte(string(password),0)>=0 { return "",ErrInvalidPassword }
+	s,err := GenSalt(scheme,cost)
+	if err!=nil { return "",err }
+	if scheme==SchemeYescrypt { return yescryptCrypt(password,s) }
+	return shaCrypt(password,s)
+}
+
+func (s *Shadow) path() string {
+	if s.Path=="" { return DefaultShadowFile }
+	return s.Path
+}
+
+// Takes the lckpwdf(3) lock in the directory of the shadow file.
+func (s *Shadow) update(user string, fn func(sp *userdb.Shadow) error) error {
+	p := s.path()
+	l,err := userdb.LockPath(filepath.Join(filepath.Dir(p),filepath.Base(userdb.LockFile)),userdb.LockTimeout)
+	if err!=nil { return err }
+	defer l.Unlock()
+	return userdb.UpdateShadowFile(p,user,fn)
+}
+
+/*
+ Sets the password of user without any checks (as root does with passwd(1)),
+ and sets the last change to today. The shadow file is rewritten atomically,
+ keeping a backup (shadow-).
+ */
+func (s *Shadow) SetPassword(user string, password []byte, scheme string, cost int) error {
+	h,err := HashPassword(password,scheme,cost)
+	if err!=nil { return err }
+	return s.update(user,func(sp *userdb.Shadow) error {
+		sp.Password = h
+		sp.LastChange = DaysSinceEpoch(time.Now())
+		return nil
+	})
+}
+
+/*
+ Changes the password of user, who has to know the old one (as users do with
+ passwd(1)). Expired passwords and forced changes are accepted, unless the
+ password is past its inactive period; otherwise the minimum age has to have
+ passed (ErrPasswordTooYoung).
+ */
+func (s *Shadow) ChangePassword(user string, old, password []byte, scheme string, cost int) error {
+	return s.ChangePasswordPolicy(user,old,password,nil,scheme,cost)
+}
+
+/*
+ Like ChangePassword, but the new password is checked against p (if not nil)
+ while the lock is held, returning a PolicyError. If p.Remember is set, the
+ old hash is appended to the opasswd file under the same lock. The GECOS field
+ and uid are read from the passwd file next to the shadow file.
+ */
+func (s *Shadow) ChangePasswordPolicy(user string, old, password []byte, p *Policy, scheme string, cost int) error {
+	h,err := HashPassword(password,scheme,cost)
+	if err!=nil { return err }
+	return s.update(user,func(sp *userdb.Shadow) error {
+		if err := verifyHash(sp.Password,old); err!=nil { return err }
+		now := time.Now()
+		switch CheckAging(sp,now) {
+		case ErrAccountExpired:
+			return ErrAccountExpired
+		case ErrPasswordExpired:
+			if PastInactive(sp,now) { return ErrPasswordExpired }
+		case ErrPasswordChangeRequired:
+		default:
+			today := DaysSinceEpoch(now)
+			if sp.Min>0 && sp.LastChange>0 && today<sp.LastChange+sp.Min { return ErrPasswordTooYoung }
+		}
+		if p!=nil {
+			pw,err := s.passwd(user)
+			if err!=nil { return err }
+			if err = p.Check(password,&Candidate{User: user, Gecos: pw.Gecos, Old: old}); err!=nil { return err }
+			if p.Remember>0 && isHash(sp.Password) {
+				if err = AddOpasswd(p.OpasswdPath,user,pw.Uid,sp.Password,p.Remember); err!=nil { return err }
+			}
+		}
+		sp.Password = h
+		sp.LastChange = DaysSinceEpoch(now)
+		return nil
+	})
+}
+
+// Looks user up in the passwd file next to the shadow file.
+func (s *Shadow) passwd(user string) (*userdb.Passwd,error) {
+	l,err := userdb.ReadPasswd(filepath.Join(filepath.Dir(s.path()),filepath.Base(userdb.PasswdFile)))
+	if err!=nil { return nil,err }
+	for i := range l {
+		if l[i].Compat==0 && l[i].Name==user { return &l[i],nil }
+	}
+	return nil,userdb.ErrNoSuchUser
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "bufio"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+
+const PwqualityFile = "/etc/security/pwquality.conf"
+const PwqualityDir  = "/etc/security/pwquality.conf.d"
+const PwhistoryFile = "/etc/security/pwhistory.conf"
+
+/*
+ A password quality policy, with the settings of pwquality.conf(5) (libpwquality)
+ and remember/file of pwhistory.conf(5) (pam_pwhistory).
+
+	p,_ := authen.LoadPolicy()
+	err := p.Check(newpw,&authen.Candidate{User: "alice", Old: oldpw})
+	if v,ok := err.(authen.PolicyError); ok { ... show all of v ... }
+ */
+type Policy struct{
+	// Minimum number of characters of the new password, not present in the old.
+	DifOk          int
+	// Minimum length, reduced by the positive credits.
+	MinLen         int
+	/*
+	 Credits for digits, upper and lower case letters and other characters:
+	 positive values are the maximum credit towards MinLen, negative values
+	 the minimum number required.
+	 */
+	DCredit        int
+	UCredit        int
+	LCredit        int
+	OCredit        int
+	// Minimum number of character classes.
+	MinClass       int
+	// Maximum number of the same consecutive character (0: unchecked).
+	MaxRepeat      int
+	// Maximum length of a monotonic sequence, like "abc" or "4321" (0: unchecked).
+	MaxSequence    int
+	// Maximum number of consecutive characters of the same class (0: unchecked).
+	MaxClassRepeat int
+	// Rejects passwords containing words (3 characters or more) of the GECOS field.
+	GecosCheck     bool
+	// Rejects passwords found in the dictionary.
+	DictCheck      bool
+	// Rejects passwords containing the user name (or its reverse).
+	UserCheck      bool
+	// Rejects passwords containing a substring of this length of the user name (0: unchecked).
+	UserSubstr     int
+	// Words, that must not be contained.
+	BadWords       []string
+	/*
+	 A word list, one word per line. Unlike libpwquality, no cracklib
+	 dictionary is used.
+	 */
+	DictPath       string
+	// The number of old passwords, that must not be reused.
+	Remember       int
+	// The opasswd file; defaults to DefaultOpasswdFile.
+	OpasswdPath    string
+}
+
+// The defaults of libpwquality.
+func DefaultPolicy() *Policy {
+	return &Policy{DifOk: 1, MinLen: 8, DictCheck: true, UserCheck: true}
+}
+
+// A violated rule.
+type Violation struct{
+	// The setting, e.g. "minlen".
+	Rule    string
+	Message string
+}
+
+// All violations of a policy.
+type PolicyError []Violation
+
+func (e PolicyError) Error() string {
+	s := make([]string,len(e))
+	for i,v := range e { s[i] = v.Message }
+	return strings.Join(s,"; ")
+}
+
+// Setters of the settings.
+func setInt(p *int) func(v string) error {
+	return func(v string) error {
+		n,err := strconv.Atoi(v)
+		if err!=nil { return fmt.Errorf("invalid number %q",v) }
+		*p = n
+		return nil
+	}
+}
+
+func setBool(p *bool) func(v string) error {
+	return func(v string) error {
+		if v=="" { *p = true; return nil }
+		n,err := strconv.Atoi(v)
+		if err!=nil { return fmt.Errorf("invalid number %q",v) }
+		*p = n!=0
+		return nil
+	}
+}
+
+func ignoreSetting(v string) error { return nil }
+
+func (p *Policy) settings() map[string]func(v string) error {
+	return map[string]func(v string) error{
+		"difok": setInt(&p.DifOk),
+		"minlen": setInt(&p.MinLen),
+		"dcredit": setInt(&p.DCredit),
+		"ucredit": setInt(&p.UCredit),
+		"lcredit": setInt(&p.LCredit),
+		"ocredit": setInt(&p.OCredit),
+		"minclass": setInt(&p.MinClass),
+		"maxrepeat": setInt(&p.MaxRepeat),
+		"maxsequence": setInt(&p.MaxSequence),
+		"maxclassrepeat": setInt(&p.MaxClassRepeat),
+		"gecoscheck": setBool(&p.GecosCheck),
+		"dictcheck": setBool(&p.DictCheck),
+		"usercheck": setBool(&p.UserCheck),
+		"usersubstr": setInt(&p.UserSubstr),
+		"badwords": func(v string) error { p.BadWords = strings.Fields(v); return nil },
+		"dictpath": func(v string) error { p.DictPath = v; return nil },
+		"remember": setInt(&p.Remember),
+		"file": func(v string) error { p.OpasswdPath = v; return nil },
+		// Settings for the PAM modules, not the checks.
+		"enforcing": ignoreSetting,
+		"retry": ignoreSetting,
+		"enforce_for_root": ignoreSetting,
+		"local_users_only": ignoreSetting,
+		"debug": ignoreSetting,
+	}
+}
+
+/*
+ Parses pwquality.conf(5) or pwhistory.conf(5) formatted data ("key = value"
+ or a flag "key") into p. name is used in error messages.
+ */
+func (p *Policy) Parse(r io.Reader, name string) error {
+	return parseConf(r,name,p.settings())
+}
+
+/*
+ Parses "key = value" lines (or a flag "key"), as used by the PAM modules.
+ Unknown keys are skipped, as newer versions of the modules add settings.
+ */
+func parseConf(r io.Reader, name string, set map[string]func(v string) error) error {
+	s := bufio.NewScanner(r)
+	n := 0
+	for s.Scan() {
+		n++
+		l := s.Text()
+		if i := strings.IndexByte(l,'#'); i>=0 { l = l[:i] }
+		l = strings.TrimSpace(l)
+		if l=="" { continue }
+		k,v := l,""
+		if i := strings.IndexByte(l,'='); i>=0 { k,v = strings.TrimSpace(l[:i]),strings.TrimSpace(l[i+1:]) }
+		f,ok := set[k]
+		if !ok { continue }
+		if err := f(v); err!=nil { return fmt.Errorf("%s:%d: %v",name,n,err) }
+	}
+	return s.Err()
+}
+
+func (p *Policy) parseFile(path string) error {
+	f,err := os.Open(path)
+	if err!=nil { return err }
+	defer f.Close()
+	return p.Parse(f,path)
+}
+
+/*
+ Reads the defaults, then /etc/security/pwquality.conf, the *.conf files in
+ /etc/security/pwquality.conf.d and /etc/security/pwhistory.conf. Missing
+ files are not an error.
+ */
+func LoadPolicy() (*Policy,error) {
+	p := DefaultPolicy()
+	fs,err := filepath.Glob(filepath.Join(PwqualityDir,"*.conf"))
+	if err!=nil { return nil,err }
+	sort.Strings(fs)
+	fs = append(append([]string{PwqualityFile},fs...),PwhistoryFile)
+	for _,f := range fs {
+		if err = p.parseFile(f); err!=nil && !os.IsNotExist(err) { return nil,err }
+	}
+	return p,nil
+}
+
+// The user, a new password is checked for.
+type Candidate struct{
+	User    string
+	Gecos   string
+	// The current password, if known; may be nil.
+	Old     []byte
+	/*
+	 crypt(3) hashes of the previous passwords, oldest first; the last
+	 Policy.Remember are checked. If nil, they are read from the opasswd file.
+	 */
+	History []string
+}
+
+// Character classes: digit, upper, lower, other.
+func charClass(c byte) int {
+	switch {
+	case c>='0' && c<='9': return 0
+	case c>='A' && c<='Z': return 1
+	case c>='a' && c<='z': return 2
+	}
+	return 3
+}
+
+func isAlnum(c byte) bool { return charClass(c)!=3 }
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i,j := 0,len(b)-1; i<j; i,j = i+1,j-1 { b[i],b[j] = b[j],b[i] }
+	return string(b)
+}
+
+/*
+ Checks password against the policy. Returns nil, a PolicyError holding all
+ violations, or an error reading the dictionary or opasswd file.
+ */
+func (p *Policy) Check(password []byte, c *Candidate) error {
+	if c==nil { c = new(Candidate) }
+	var res PolicyError
+	add := func(rule, f string, a ...interface{}) { res = append(res,Violation{rule,fmt.Sprintf(f,a...)}) }
+	pw := string(password)
+	lpw := strings.ToLower(pw)
+
+	if c.Old!=nil {
+		old := string(c.Old)
+		if pw==old {
+			add("difok","The password is the same as the old one")
+		} else if strings.ToLower(old)==lpw {
+			add("difok","The password differs from the old one only in case")
+		} else if p.DifOk>0 {
+			n := 0
+			for i := 0; i<len(pw); i++ {
+				if strings.IndexByte(old,pw[i])<0 { n++ }
+			}
+			if n<p.DifOk { add("difok","The password has less than %d characters not in the old one",p.DifOk) }
+		}
+	}
+
+	var count [4]int
+	for i := 0; i<len(pw); i++ { count[charClass(pw[i])]++ }
+	credits := [4]int{p.DCredit,p.UCredit,p.LCredit,p.OCredit}
+	names := [4]string{"digit","uppercase letter","lowercase letter","other character"}
+	rules := [4]string{"dcredit","ucredit","lcredit","ocredit"}
+	size := len(pw)
+	classes := 0
+	for i,n := range count {
+		if n>0 { classes++ }
+		cr := credits[i]
+		if cr>0 {
+			if n<cr { size += n } else { size += cr }
+		} else if cr<0 && n < -cr {
+			add(rules[i],"The password contains less than %d %ss",-cr,names[i])
+		}
+	}
+	if size<p.MinLen { add("minlen","The password is shorter than %d characters",p.MinLen) }
+	if classes<p.MinClass { add("minclass","The password contains less than %d character classes",p.MinClass) }
+
+	rep,seq,crep := 1,1,1
+	maxRep,maxSeq,maxCrep := 0,0,0
+	dir := 0
+	for i := 0; i<len(pw); i++ {
+		if i>0 {
+			if pw[i]==pw[i-1] { rep++ } else { rep = 1 }
+			if charClass(pw[i])==charClass(pw[i-1]) { crep++ } else { crep = 1 }
+			d := int(pw[i])-int(pw[i-1])
+			if isAlnum(pw[i]) && isAlnum(pw[i-1]) && (d==1 || d== -1) {
+				if d==dir { seq++ } else { seq = 2 }
+				dir = d
+			} else {
+				seq,dir = 1,0
+			}
+		}
+		if rep>maxRep { maxRep = rep }
+		if seq>maxSeq { maxSeq = seq }
+		if crep>maxCrep { maxCrep = crep }
+	}
+	if p.MaxRepeat>0 && maxRep>p.MaxRepeat {
+		add("maxrepeat","The password contains more than %d same characters consecutively",p.MaxRepeat)
+	}
+	if p.MaxSequence>0 && maxSeq>p.MaxSequence {
+		add("maxsequence","The password contains a monotonic sequence longer than %d characters",p.MaxSequence)
+	}
+	if p.MaxClassRepeat>0 && maxCrep>p.MaxClassRepeat {
+		add("maxclassrepeat","The password contains more than %d characters of the same class consecutively",p.MaxClassRepeat)
+	}
+
+	user := strings.ToLower(c.User)
+	if p.UserCheck && len(user)>=3 && (strings.Contains(lpw,user) || strings.Contains(lpw,reverse(user))) {
+		add("usercheck","The password contains the user name in some form")
+	} else if p.UserSubstr>=3 {
+		for i := 0; i+p.UserSubstr<=len(user); i++ {
+			if strings.Contains(lpw,user[i:i+p.UserSubstr]) {
+				add("usersubstr","The password contains a part of the user name")
+				break
+			}
+		}
+	}
+	if p.GecosCheck {
+		for _,w := range strings.FieldsFunc(strings.ToLower(c.Gecos),func(r rune) bool { return r==' ' || r==',' }) {
+			if len(w)>=3 && strings.Contains(lpw,w) {
+				add("gecoscheck","The password contains words from the real name of the user")
+				break
+			}
+		}
+	}
+	for _,w := range p.BadWords {
+		if len(w)>0 && strings.Contains(lpw,strings.ToLower(w)) {
+			add("badwords","The password contains forbidden words")
+			break
+		}
+	}
+	if p.DictCheck && p.DictPath!="" && pw!="" {
+		found,err := dictLookup(p.DictPath,lpw)
+		if err!=nil { return err }
+		if found { add("dictcheck","The password is based on a dictionary word") }
+	}
+	if p.Remember>0 {
+		h := c.History
+		if h==nil {
+			var err error
+			h,err = ReadOpasswd(p.OpasswdPath,c.User)
+			if err!=nil { return err }
+		}
+		if len(h)>p.Remember { h = h[len(h)-p.Remember:] }
+		for _,hash := range h {
+			if verifyHash(hash,password)==nil {
+				add("remember","The password has already been used")
+				break
+			}
+		}
+	}
+	if len(res)==0 { return nil }
+	return res
+}
+
+/*
+ Returns true, if the lower-case password, or the password with leading and
+ trailing non-letters removed (like "password123!"), is a word of the list.
+ */
+func dictLookup(path string, lpw string) (bool,error) {
+	stripped := strings.TrimFunc(lpw,func(r rune) bool { return r<'a' || r>'z' })
+	f,err := os.Open(path)
+	if err!=nil { return false,err }
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		w := strings.ToLower(strings.TrimSpace(s.Text()))
+		if w=="" { continue }
+		if w==lpw || w==stripped { return true,nil }
+	}
+	return false,s.Err()
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+/*
+ md5crypt ($1$), its Apache variant ($apr1$), and sha256crypt ($5$) and
+ sha512crypt ($6$), as specified by Ulrich Drepper.
+ */
+
+import "crypto/md5"
+import "crypto/sha256"
+import "crypto/sha512"
+import "hash"
+import "strconv"
+import "strings"
+
+const shaRoundsDefault = 5000
+const shaRoundsMin = 1000
+const shaRoundsMax = 999999999
+
+/*
+ The order, in which the bytes of the digest are encoded, in groups of three
+ (most significant first); -1 is a zero byte.
+ */
+var md5cryptOrder = []int{0,6,12, 1,7,13, 2,8,14, 3,9,15, 4,10,5, -1,-1,11}
+var sha256cryptOrder = []int{
+	0,10,20, 21,1,11, 12,22,2, 3,13,23, 24,4,14, 15,25,5, 6,16,26, 27,7,17,
+	18,28,8, 9,19,29, -1,31,30,
+}
+var sha512cryptOrder = []int{
+	0,21,42, 22,43,1, 44,2,23, 3,24,45, 25,46,4, 47,5,26, 6,27,48, 28,49,7,
+	50,8,29, 9,30,51, 31,52,10, 53,11,32, 12,33,54, 34,55,13, 56,14,35,
+	15,36,57, 37,58,16, 59,17,38, 18,39,60, 40,61,19, 62,20,41, -1,-1,63,
+}
+
+func cryptEncode(b []byte, order []int) string {
+	var dst []byte
+	for i := 0; i<len(order); i += 3 {
+		var w uint32
+		n := 1
+		for _,j := range order[i:i+3] {
+			w <<= 8
+			if j>=0 { w |= uint32(b[j]); n++ }
+		}
+		for ; n>0; n-- {
+			dst = append(dst,itoa64[w&0x3f])
+			w >>= 6
+		}
+	}
+	return string(dst)
+}
+
+// Returns the salt: up to max bytes before '$' or the end of setting.
+func cryptSalt(setting string, max int) (string,bool) {
+	n := strings.IndexAny(setting,"$:\n")
+	if n<0 {
+		n = len(setting)
+	} else if setting[n]!='$' {
+		return "",false
+	}
+	if n>max { n = max }
+	return setting[:n],true
+}
+
+// Appends b repeatedly to h, up to n bytes.
+func writeRepeated(h hash.Hash, b []byte, n int) {
+	for ; n>len(b); n -= len(b) { h.Write(b) }
+	h.Write(b[:n])
+}
+
+/*
+ Computes the crypt(3) hash of password with the setting ($1$ or $apr1$),
+ like md5_crypt() of FreeBSD.
+ */
+func md5Crypt(password []byte, setting string) (string,error) {
+	var magic string
+	switch {
+	case strings.HasPrefix(setting,"$1$"): magic = "$1$"
+	case strings.HasPrefix(setting,"$apr1$"): magic = "$apr1$"
+	default: return "",ErrInvalidHash
+	}
+	salt,ok := cryptSalt(setting[len(magic):],8)
+	if !ok { return "",ErrInvalidHash }
+
+	h := md5.New()
+	h.Write(password); h.Write([]byte(salt)); h.Write(password)
+	final := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password); h.Write([]byte(magic)); h.Write([]byte(salt))
+	writeRepeated(h,final,len(password))
+	for i := len(password); i!=0; i >>= 1 {
+		if i&1!=0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+	final = h.Sum(nil)
+
+	for i := 0; i<1000; i++ {
+		h.Reset()
+		if i&1!=0 { h.Write(password) } else { h.Write(final) }
+		if i%3!=0 { h.Write([]byte(salt)) }
+		if i%7!=0 { h.Write(password) }
+		if i&1!=0 { h.Write(final) } else { h.Write(password) }
+		final = h.Sum(final[:0])
+	}
+	return magic+salt+"$"+cryptEncode(final,md5cryptOrder),nil
+}
+
+/*
+ Computes the crypt(3) hash of password with the setting ($5$ or $6$),
+ like crypt_sha256_rn() and crypt_sha512_rn() in libxcrypt.
+ */
+func shaCrypt(password []byte, setting string) (string,error) {
+	var newHash func() hash.Hash
+	var order []int
+	switch {
+	case strings.HasPrefix(setting,"$5$"): newHash,order = sha256.New,sha256cryptOrder
+	case strings.HasPrefix(setting,"$6$"): newHash,order = sha512.New,sha512cryptOrder
+	default: return "",ErrInvalidHash
+	}
+	prefix := setting[:3]
+	s := setting[3:]
+	rounds := shaRoundsDefault
+	if strings.HasPrefix(s,"rounds=") {
+		// No leading zeroes, no missing '$'.
+		num := s[7:]
+		i := strings.IndexByte(num,'$')
+		if i<1 || num[0]<'1' || num[0]>'9' { return "",ErrInvalidHash }
+		r,err := strconv.ParseUint(num[:i],10,32)
+		if err!=nil || r<shaRoundsMin || r>shaRoundsMax { return "",ErrInvalidHash }
+		rounds = int(r)
+		prefix += s[:7+i+1]
+		s = num[i+1:]
+	}
+	salt,ok := cryptSalt(s,16)
+	if !ok { return "",ErrInvalidHash }
+	bsalt := []byte(salt)
+
+	h := newHash()
+	h.Write(password); h.Write(bsalt); h.Write(password)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password); h.Write(bsalt)
+	writeRepeated(h,b,len(password))
+	for i := len(password); i>0; i >>= 1 {
+		if i&1!=0 { h.Write(b) } else { h.Write(password) }
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range password { h.Write(password) }
+	dp := h.Sum(nil)
+	p := make([]byte,0,len(password))
+	for len(p)<len(password) { p = append(p,dp...) }
+	p = p[:len(password)]
+
+	h.Reset()
+	for i := 0; i<16+int(a[0]); i++ { h.Write(bsalt) }
+	ds := h.Sum(nil)
+	sp := ds[:len(bsalt)]
+
+	c := a
+	for i := 0; i<rounds; i++ {
+		h.Reset()
+		if i&1!=0 { h.Write(p) } else { h.Write(c) }
+		if i%3!=0 { h.Write(sp) }
+		if i%7!=0 { h.Write(p) }
+		if i&1!=0 { h.Write(c) } else { h.Write(p) }
+		c = h.Sum(c[:0])
+	}
+	return prefix+salt+"$"+cryptEncode(c,order),nil
+}
@@ -0,0 +1,293 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/sshlib"
+import "github.com/maxymania/go-system/userdb"
+import "golang.org/x/crypto/ssh"
+import "bytes"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net"
+import "os"
+import "os/exec"
+import "strconv"
+import "strings"
+import "syscall"
+import "time"
+
+// Critical options of user certificates (PROTOCOL.certkeys of OpenSSH).
+const certForceCommand = "force-command"
+const certSourceAddress = "source-address"
+
+var ErrCertRevoked = errors.New("certificate revoked")
+
+/*
+ Authenticates SSH user certificates like sshd with TrustedUserCAKeys (see
+ sshd_config(5)). The files are read at every authentication.
+ */
+type CertAuth struct{
+	// The trusted CA keys, one per line (authorized_keys format, the options are ignored).
+	TrustedUserCAKeys string
+	/*
+	 Like AuthorizedPrincipalsFile: the principals, that may log in as the user,
+	 one per line, optionally preceded by authorized_keys options. %h is replaced
+	 by the home directory, %u by the user name and %% by %; relative paths are
+	 relative to the home directory. If neither this nor the command is set, the
+	 certificate has to name the user itself as a principal.
+	 */
+	AuthorizedPrincipalsFile string
+	/*
+	 Like AuthorizedPrincipalsCommand: a program (absolute path) and its
+	 arguments, that prints principals in the same format. The tokens %% %u %U
+	 (uid) %h %i (key ID) %s (serial) %t %T (certificate and CA key type) %f %F
+	 (fingerprints of the key and the CA key) %k %K (base64 certificate and CA
+	 key) are replaced in the arguments.
+	 */
+	AuthorizedPrincipalsCommand []string
+	// The user, that runs the command; if empty, it runs as the calling user.
+	AuthorizedPrincipalsCommandUser string
+	// Like RevokedKeys: a KRL or a list of public keys.
+	RevokedKeys string
+	// Revoked certificates by serial (never serial 0, like a KRL) and by key ID, of any CA.
+	RevokedSerials []uint64
+	RevokedKeyIDs  []string
+	// The current time; time.Now, if nil.
+	Clock func() time.Time
+}
+
+// A principal, that may log in, and the options, that go with it (or nil).
+type principal struct{
+	name string
+	opts *AuthorizedKey
+}
+
+/*
+ Parses the lines of an AuthorizedPrincipalsFile. Lines with bad options are
+ skipped, as sshd does.
+ */
+func parsePrincipals(data []byte) []principal {
+	var ps []principal
+	for _,l := range strings.Split(string(data),"\n") {
+		l = strings.TrimSpace(l)
+		if l=="" || l[0]=='#' { continue }
+		opts,rest,err := splitOptions(l)
+		if err!=nil { continue }
+		if rest=="" {
+			ps = append(ps,principal{name: l})
+			continue
+		}
+		k := new(AuthorizedKey)
+		for _,o := range opts {
+			if err = k.setOption(o); err!=nil { break }
+		}
+		if err!=nil { continue }
+		ps = append(ps,principal{strings.Fields(rest)[0],k})
+	}
+	return ps
+}
+
+// Returns the options, that a user certificate implies.
+func certOptions(cert *ssh.Certificate) *AuthorizedKey {
+	k := &AuthorizedKey{Key: cert, Command: cert.CriticalOptions[certForceCommand]}
+	permit := func(ext string) bool {
+		_,ok := cert.Extensions[ext]
+		return ok
+	}
+	k.NoPty = !permit("permit-pty")
+	k.NoPortForwarding = !permit("permit-port-forwarding")
+	k.NoAgentForwarding = !permit("permit-agent-forwarding")
+	k.NoX11Forwarding = !permit("permit-X11-forwarding")
+	k.NoUserRC = !permit("permit-user-rc")
+	if sa := cert.CriticalOptions[certSourceAddress]; sa!="" {
+		k.From = strings.Split(sa,",")
+	}
+	return k
+}
+
+// Adds the restrictions of o; both commands must agree, if set.
+func (k *AuthorizedKey) restrictBy(o *AuthorizedKey) error {
+	if o.Command!="" {
+		if k.Command!="" && k.Command!=o.Command { return errors.New("forced commands of certificate and options differ") }
+		k.Command = o.Command
+	}
+	k.Restrict = k.Restrict || o.Restrict
+	k.NoPty = k.NoPty || o.NoPty
+	k.NoPortForwarding = k.NoPortForwarding || o.NoPortForwarding
+	k.NoAgentForwarding = k.NoAgentForwarding || o.NoAgentForwarding
+	k.NoX11Forwarding = k.NoX11Forwarding || o.NoX11Forwarding
+	k.NoUserRC = k.NoUserRC || o.NoUserRC
+	k.PermitOpen = o.PermitOpen
+	k.PermitListen = o.PermitListen
+	k.Tunnel = o.Tunnel
+	k.Environment = userEnvironment(o.Environment)
+	return nil
+}
+
+/*
+ Checks the user certificate, whose CA is already trusted, against the
+ principals, that may log in. Returns the ssh.Permissions of the certificate
+ and the options of the principal; the key ID and the serial are in the
+ Extensions sshlib.CertKeyID and sshlib.CertSerial.
+ */
+func checkUserCert(cc *ssh.CertChecker, cert *ssh.Certificate, allowed []principal, addr net.Addr) (*ssh.Permissions,error) {
+	if cert.CertType!=ssh.UserCert { return nil,fmt.Errorf("certificate has type %d",cert.CertType) }
+	if len(cert.ValidPrincipals)==0 { return nil,errors.New("certificate has no principals") }
+	now := time.Now()
+	if cc.Clock!=nil { now = cc.Clock() }
+	for _,a := range allowed {
+		found := false
+		for _,p := range cert.ValidPrincipals {
+			if p==a.name { found = true }
+		}
+		if !found { continue }
+		if a.opts!=nil && !a.opts.Allows(addr,now) { continue }
+		// The validity window, the signature, the critical options, and revocation.
+		if err := cc.CheckCert(a.name,cert); err!=nil { return nil,err }
+		k := certOptions(cert)
+		if len(k.From)>0 && !MatchFrom(k.From,addr) { return nil,errors.New("source-address of the certificate does not match") }
+		if a.opts!=nil {
+			if err := k.restrictBy(a.opts); err!=nil { return nil,err }
+		}
+		p := k.Permissions()
+		if sa,ok := cert.CriticalOptions[certSourceAddress]; ok { p.CriticalOptions[certSourceAddress] = sa }
+		p.Extensions[sshlib.CertKeyID] = cert.KeyId
+		p.Extensions[sshlib.CertSerial] = strconv.FormatUint(cert.Serial,10)
+		return p,nil
+	}
+	return nil,ErrKeyNotAuthorized
+}
+
+// Returns true, if key is revoked by RevokedKeys or the deny lists.
+func (c *CertAuth) IsRevoked(key ssh.PublicKey) (bool,error) {
+	if cert,ok := key.(*ssh.Certificate); ok {
+		for _,s := range c.RevokedSerials {
+			if cert.Serial==s && s!=0 { return true,nil }
+		}
+		for _,id := range c.RevokedKeyIDs {
+			if cert.KeyId==id { return true,nil }
+		}
+	}
+	if c.RevokedKeys=="" { return false,nil }
+	krl,err := ReadRevokedKeys(c.RevokedKeys)
+	if err!=nil { return true,err }
+	return krl.IsRevoked(key),nil
+}
+
+func (c *CertAuth) isTrusted(ca ssh.PublicKey) (bool,error) {
+	data,err := ioutil.ReadFile(c.TrustedUserCAKeys)
+	if err!=nil { return false,err }
+	b := ca.Marshal()
+	for _,l := range strings.Split(string(data),"\n") {
+		l = strings.TrimSpace(l)
+		if l=="" || l[0]=='#' { continue }
+		k,err := ParseAuthorizedKey(l)
+		if err!=nil { continue }
+		if bytes.Equal(k.Key.Marshal(),b) { return true,nil }
+	}
+	return false,nil
+}
+
+func (c *CertAuth) commandArgs(pw *userdb.Passwd, cert *ssh.Certificate) []string {
+	r := strings.NewReplacer(
+		"%%","%",
+		"%u",pw.Name,
+		"%U",strconv.FormatUint(uint64(pw.Uid),10),
+		"%h",pw.Home,
+		"%i",cert.KeyId,
+		"%s",strconv.FormatUint(cert.Serial,10),
+		"%t",cert.Type(),
+		"%T",cert.SignatureKey.Type(),
+		"%f",ssh.FingerprintSHA256(cert.Key),
+		"%F",ssh.FingerprintSHA256(cert.SignatureKey),
+		"%k",base64.StdEncoding.EncodeToString(cert.Marshal()),
+		"%K",base64.StdEncoding.EncodeToString(cert.SignatureKey.Marshal()),
+	)
+	args := make([]string,len(c.AuthorizedPrincipalsCommand))
+	for i,a := range c.AuthorizedPrincipalsCommand { args[i] = r.Replace(a) }
+	return args
+}
+
+// Runs the AuthorizedPrincipalsCommand and returns its output.
+func (c *CertAuth) runCommand(pw *userdb.Passwd, cert *ssh.Certificate) ([]byte,error) {
+	args := c.commandArgs(pw,cert)
+	if !strings.HasPrefix(args[0],"/") { return nil,fmt.Errorf("%s: not an absolute path",args[0]) }
+	cmd := exec.Command(args[0],args[1:]...)
+	cmd.Env = []string{"PATH=/usr/bin:/bin:/usr/sbin:/sbin"}
+	cmd.Dir = "/"
+	cmd.Stderr = os.Stderr
+	if c.AuthorizedPrincipalsCommandUser!="" {
+		cu,err := new(userdb.DB).LookupUser(c.AuthorizedPrincipalsCommandUser)
+		if err!=nil { return nil,err }
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: cu.Uid, Gid: cu.Gid, Groups: []uint32{}}}
+	}
+	return cmd.Output()
+}
+
+// Returns the principals, that may log in as the user pw.
+func (c *CertAuth) principals(pw *userdb.Passwd, cert *ssh.Certificate) ([]principal,error) {
+	if c.AuthorizedPrincipalsFile=="" && len(c.AuthorizedPrincipalsCommand)==0 {
+		return []principal{{name: pw.Name}},nil
+	}
+	var ps []principal
+	var lerr error
+	if c.AuthorizedPrincipalsFile!="" {
+		data,err := readKeysFile(expandKeysFile(c.AuthorizedPrincipalsFile,pw),pw)
+		if err==nil {
+			ps = append(ps,parsePrincipals(data)...)
+		} else if !os.IsNotExist(err) {
+			lerr = err
+		}
+	}
+	if len(c.AuthorizedPrincipalsCommand)>0 {
+		data,err := c.runCommand(pw,cert)
+		if err==nil {
+			ps = append(ps,parsePrincipals(data)...)
+		} else {
+			lerr = err
+		}
+	}
+	if len(ps)==0 && lerr!=nil { return nil,lerr }
+	return ps,nil
+}
+
+func (c *CertAuth) checker() *ssh.CertChecker {
+	return &ssh.CertChecker{
+		SupportedCriticalOptions: []string{certForceCommand,certSourceAddress},
+		Clock: c.Clock,
+	}
+}
+
+/*
+ Checks, whether the user certificate key may log in as user from remoteAddr:
+ it must be signed by a trusted CA, be valid now, not be revoked, and carry a
+ principal, that may log in as user. Returns the ssh.Permissions, that the
+ certificate (force-command, source-address, permit-* extensions) and the
+ options of the principal imply, with the key ID and the serial in the
+ Extensions sshlib.CertKeyID and sshlib.CertSerial. Plain keys are not
+ accepted (ErrKeyNotAuthorized).
+ */
+func (c *CertAuth) Authenticate(user string, key ssh.PublicKey, remoteAddr net.Addr) (*ssh.Permissions,error) {
+	cert,ok := key.(*ssh.Certificate)
+	if !ok || c.TrustedUserCAKeys=="" { return nil,ErrKeyNotAuthorized }
+	trusted,err := c.isTrusted(cert.SignatureKey)
+	if err!=nil { return nil,err }
+	if !trusted { return nil,ErrKeyNotAuthorized }
+	revoked,err := c.IsRevoked(cert)
+	if err!=nil { return nil,err }
+	if revoked { return nil,ErrCertRevoked }
+	pw,err := new(userdb.DB).LookupUser(user)
+	if err!=nil { return nil,err }
+	ps,err := c.principals(pw,cert)
+	if err!=nil { return nil,err }
+	return checkUserCert(c.checker(),cert,ps,remoteAddr)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+import "github.com/maxymania/go-system/sshlib"
+import "golang.org/x/crypto/ssh"
+import "crypto/rand"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "reflect"
+import "testing"
+import "time"
+
+func TestParsePrincipals(t *testing.T) {
+	ps := parsePrincipals([]byte("# comment\nalice\n\n  bob  \nfrom=\"10.0.0.0/8\",no-pty carol\nbogus-option dave\ncommand=\"id\" erin extra\n"))
+	if len(ps)!=4 { t.Fatalf("got %+v",ps) }
+	for i,n := range []string{"alice","bob","carol","erin"} {
+		if ps[i].name!=n { t.Errorf("%d: %q",i,ps[i].name) }
+	}
+	if ps[0].opts!=nil || ps[1].opts!=nil { t.Errorf("options of plain principals") }
+	if o := ps[2].opts; o==nil || !o.NoPty || !reflect.DeepEqual(o.From,[]string{"10.0.0.0/8"}) { t.Errorf("carol %+v",o) }
+	if o := ps[3].opts; o==nil || o.Command!="id" { t.Errorf("erin %+v",o) }
+}
+
+func TestCertOptions(t *testing.T) {
+	c := &ssh.Certificate{Permissions: ssh.Permissions{
+		CriticalOptions: map[string]string{certForceCommand: "uptime", certSourceAddress: "10.0.0.0/8,192.0.2.1"},
+		Extensions: map[string]string{"permit-pty": "", "permit-agent-forwarding": ""},
+	}}
+	k := certOptions(c)
+	if k.Command!="uptime" || !reflect.DeepEqual(k.From,[]string{"10.0.0.0/8","192.0.2.1"}) { t.Errorf("got %+v",k) }
+	if k.NoPty || k.NoAgentForwarding || !k.NoPortForwarding || !k.NoX11Forwarding || !k.NoUserRC { t.Errorf("permits %+v",k) }
+	// The principal's options restrict further; the commands must agree.
+	o := &AuthorizedKey{Command: "uptime", NoPty: true, PermitOpen: []string{"db:5432"}}
+	if err := k.restrictBy(o); err!=nil { t.Fatal(err) }
+	if !k.NoPty || k.Command!="uptime" || !reflect.DeepEqual(k.PermitOpen,o.PermitOpen) { t.Errorf("restricted %+v",k) }
+	if err := certOptions(c).restrictBy(&AuthorizedKey{Command: "id"}); err==nil { t.Error("different commands accepted") }
+}
+
+func TestCheckUserCert(t *testing.T) {
+	ca,_ := testEdKey(t,1)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 22}
+	cc := (&CertAuth{}).checker()
+	c := testCert(t,ca,7,"alice@laptop","alice","admin")
+	p,err := checkUserCert(cc,c,[]principal{{name: "bob"},{name: "admin"}},addr)
+	if err!=nil { t.Fatal(err) }
+	if p.Extensions[sshlib.CertKeyID]!="alice@laptop" || p.Extensions[sshlib.CertSerial]!="7" { t.Errorf("extensions %q",p.Extensions) }
+	if _,ok := p.Extensions[sshlib.NoPty]; ok { t.Errorf("pty permitted, got %q",p.Extensions) }
+	if _,ok := p.Extensions[sshlib.NoPortForwarding]; !ok { t.Errorf("port forwarding not permitted, got %q",p.Extensions) }
+	if _,err = checkUserCert(cc,c,[]principal{{name: "bob"}},addr); err!=ErrKeyNotAuthorized { t.Errorf("other principal: %v",err) }
+	// A principal, whose from= does not match, is passed over.
+	far := &AuthorizedKey{From: []string{"10.0.0.0/8"}}
+	if _,err = checkUserCert(cc,c,[]principal{{"alice",far}},addr); err!=ErrKeyNotAuthorized { t.Errorf("from=: %v",err) }
+	if p,err = checkUserCert(cc,c,[]principal{{"alice",far},{"admin",&AuthorizedKey{Command: "id"}}},addr); err!=nil || p.CriticalOptions[sshlib.ForceCommand]!="id" {
+		t.Errorf("command=: %+v %v",p,err)
+	}
+	// The source-address of the certificate.
+	_,pub := testEdKey(t,2)
+	sa := &ssh.Certificate{Key: pub, CertType: ssh.UserCert, ValidPrincipals: []string{"alice"}, ValidBefore: ssh.CertTimeInfinity,
+		Permissions: ssh.Permissions{CriticalOptions: map[string]string{certSourceAddress: "10.0.0.0/8"}}}
+	sa.SignCert(rand.Reader,ca)
+	if _,err = checkUserCert(cc,sa,[]principal{{name: "alice"}},addr); err==nil { t.Error("source-address ignored") }
+	if p,err = checkUserCert(cc,sa,[]principal{{name: "alice"}},&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}); err!=nil || p.CriticalOptions[certSourceAddress]!="10.0.0.0/8" {
+		t.Errorf("source-address: %+v %v",p,err)
+	}
+	// The validity window.
+	exp := &ssh.Certificate{Key: pub, CertType: ssh.UserCert, ValidPrincipals: []string{"alice"}, ValidAfter: 1000, ValidBefore: 2000}
+	exp.SignCert(rand.Reader,ca)
+	if _,err = checkUserCert(cc,exp,[]principal{{name: "alice"}},addr); err==nil { t.Error("expired certificate accepted") }
+	cc.Clock = func() time.Time { return time.Unix(1500,0) }
+	if _,err = checkUserCert(cc,exp,[]principal{{name: "alice"}},addr); err!=nil { t.Errorf("valid certificate: %v",err) }
+	// Host certificates and certificates without principals.
+	host := &ssh.Certificate{Key: pub, CertType: ssh.HostCert, ValidPrincipals: []string{"alice"}, ValidBefore: ssh.CertTimeInfinity}
+	host.SignCert(rand.Reader,ca)
+	if _,err = checkUserCert(cc,host,[]principal{{name: "alice"}},addr); err==nil { t.Error("host certificate accepted") }
+	if _,err = checkUserCert(cc,testCert(t,ca,1,"id"),[]principal{{name: "alice"}},addr); err==nil { t.Error("no principals accepted") }
+}
+
+func TestCertAuthIsRevoked(t *testing.T) {
+	ca,_ := testEdKey(t,1)
+	c := &CertAuth{RevokedSerials: []uint64{0,5}, RevokedKeyIDs: []string{"lost"}}
+	for _,tt := range []struct{
+		serial  uint64
+		id      string
+		revoked bool
+	}{
+		{0,"id",false},{5,"id",true},{6,"id",false},{0,"lost",true},
+	} {
+		if r,err := c.IsRevoked(testCert(t,ca,tt.serial,tt.id,"u")); err!=nil || r!=tt.revoked { t.Errorf("%d %q: %v %v",tt.serial,tt.id,r,err) }
+	}
+	c.RevokedKeys = "/nonexistent"
+	if r,err := c.IsRevoked(testCert(t,ca,1,"id","u")); !r || err==nil { t.Errorf("missing RevokedKeys: %v %v",r,err) }
+}
+
+func TestCertAuthAuthenticate(t *testing.T) {
+	d,err := ioutil.TempDir("","certtest")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(d)
+	ca,caPub := testEdKey(t,1)
+	other,_ := testEdKey(t,9)
+	c := &CertAuth{TrustedUserCAKeys: filepath.Join(d,"ca")}
+	ioutil.WriteFile(c.TrustedUserCAKeys,append([]byte("# CAs\nnot a key\n"),ssh.MarshalAuthorizedKey(caPub)...),0644)
+	// Without a principals file, the certificate must name the user.
+	if _,err = c.Authenticate("root",testCert(t,ca,1,"id","root"),nil); err!=nil { t.Fatal(err) }
+	if _,err = c.Authenticate("root",testCert(t,ca,1,"id","alice"),nil); err!=ErrKeyNotAuthorized { t.Errorf("other principal: %v",err) }
+	if _,err = c.Authenticate("root",testCert(t,other,1,"id","root"),nil); err!=ErrKeyNotAuthorized { t.Errorf("untrusted CA: %v",err) }
+	_,pub := testEdKey(t,2)
+	if _,err = c.Authenticate("root",pub,nil); err!=ErrKeyNotAuthorized { t.Errorf("plain key: %v",err) }
+	c.RevokedSerials = []uint64{1}
+	if _,err = c.Authenticate("root",testCert(t,ca,1,"id","root"),nil); err!=ErrCertRevoked { t.Errorf("revoked: %v",err) }
+}
+
+func TestCertAuthPrincipals(t *testing.T) {
+	pw,d := testHome(t)
+	defer os.RemoveAll(d)
+	ca,_ := testEdKey(t,1)
+	cert := testCert(t,ca,1,"id","admin")
+	c := &CertAuth{AuthorizedPrincipalsFile: ".ssh/principals"}
+	if ps,err := c.principals(pw,cert); err!=nil || len(ps)!=0 { t.Errorf("missing file: %+v %v",ps,err) }
+	p := filepath.Join(pw.Home,".ssh","principals")
+	ioutil.WriteFile(p,[]byte("admin\n"),0644)
+	os.Chown(p,4242,4242)
+	if ps,err := c.principals(pw,cert); err!=nil || len(ps)!=1 || ps[0].name!="admin" { t.Errorf("file: %+v %v",ps,err) }
+	c.AuthorizedPrincipalsCommand = []string{"/bin/echo","%u","%U","%h","%i","%s","%t","%%"}
+	args := c.commandArgs(pw,cert)
+	want := []string{"/bin/echo","u","4242",pw.Home,"id","1",ssh.CertAlgoED25519v01,"%"}
+	if !reflect.DeepEqual(args,want) { t.Errorf("args %q",args) }
+	c.AuthorizedPrincipalsCommand = []string{"/bin/echo","from-command"}
+	if ps,err := c.principals(pw,cert); err!=nil || len(ps)!=2 || ps[1].name!="from-command" { t.Errorf("command: %+v %v",ps,err) }
+	c.AuthorizedPrincipalsCommand = []string{"echo","x"}
+	if _,err := c.runCommand(pw,cert); err==nil { t.Error("relative command accepted") }
+}
@@ -0,0 +1,494 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package authen
+
+/*
+ yescrypt ($y$) and scrypt ($7$), as implemented by libxcrypt. This is a port
+ of the yescrypt reference implementation without ROM support, which crypt(3)
+ does not use.
+ */
+
+import "golang.org/x/crypto/pbkdf2"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/binary"
+import "errors"
+import "math/bits"
+import "strings"
+
+var ErrInvalidHash = errors.New("invalid or unsupported password hash")
+
+/*
+ The maximum of memory, a yescrypt or scrypt hash may require for its
+ verification (128*N*r bytes). Hashes exceeding it are rejected with
+ ErrInvalidHash.
+ */
+var MaxYescryptMemory uint64 = 1<<30
+
+const yescrypt_WORM     = 0x001
+const yescrypt_RW       = 0x002
+const yescrypt_DEFAULTS = 0x0b6 // RW, ROUNDS_6, GATHER_4, SIMPLE_2, SBOX_12K
+const yescrypt_RW_FLAVOR_MASK = 0x3fc
+const yescrypt_MODE_MASK = 0x003
+const yescrypt_PREHASH  = 0x10000000
+
+// pwxform parameters of the default flavor.
+const (
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	sWidth    = 8
+	pwxWords  = pwxGather*pwxSimple*2
+	sWords    = 3*(1<<sWidth)*pwxSimple*2
+	sMask     = ((1<<sWidth)-1)*pwxSimple*8
+)
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func atoi64(c byte) uint32 {
+	i := strings.IndexByte(itoa64,c)
+	if i<0 { return 64 }
+	return uint32(i)
+}
+
+// decode64_uint32() of libxcrypt: a variable-length encoded integer.
+func decode64Uint32(src string, min uint32) (uint32,string,bool) {
+	var start,end,chars,bits uint32 = 0,47,1,0
+	if len(src)==0 { return 0,"",false }
+	c := atoi64(src[0])
+	src = src[1:]
+	if c>63 { return 0,"",false }
+	dst := min
+	for c>end {
+		dst += (end+1-start)<<bits
+		start = end+1
+		end = start+(62-end)/2
+		chars++
+		bits += 6
+	}
+	dst += (c-start)<<bits
+	for chars--; chars>0; chars-- {
+		if len(src)==0 { return 0,"",false }
+		c = atoi64(src[0])
+		src = src[1:]
+		if c>63 { return 0,"",false }
+		bits -= 6
+		dst += c<<bits
+	}
+	return dst,src,true
+}
+
+// decode64_uint32_fixed() of libxcrypt: dstbits bits, 6 per character.
+func decode64Fixed(src string, dstbits uint32) (uint32,string,bool) {
+	var dst uint32
+	for b := uint32(0); b<dstbits; b += 6 {
+		if len(src)==0 { return 0,"",false }
+		c := atoi64(src[0])
+		src = src[1:]
+		if c>63 { return 0,"",false }
+		dst |= c<<b
+	}
+	return dst,src,true
+}
+
+/*
+ decode64() of libxcrypt: little-endian groups of 4 characters, 3 bytes each.
+ A final group of 2 or 3 characters is allowed; its unused bits must be 0.
+ */
+func decode64(src string, max int) ([]byte,bool) {
+	var dst []byte
+	for len(src)>0 {
+		var value,n uint32
+		for len(src)>0 && n<24 {
+			c := atoi64(src[0])
+			if c>63 { return nil,false }
+			src = src[1:]
+			value |= c<<n
+			n += 6
+		}
+		if n<12 { return nil,false }
+		for ; n>=8; n -= 8 {
+			if len(dst)>=max { return nil,false }
+			dst = append(dst,byte(value))
+			value >>= 8
+		}
+		if value!=0 { return nil,false }
+	}
+	return dst,true
+}
+
+// encode64() of libxcrypt.
+func encode64(src []byte) string {
+	var dst []byte
+	for i := 0; i<len(src); {
+		var value,n uint32
+		for n<24 && i<len(src) {
+			value |= uint32(src[i])<<n
+			i++
+			n += 8
+		}
+		for b := uint32(0); b<n; b += 6 {
+			dst = append(dst,itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	return string(dst)
+}
+
+type yescryptParams struct{
+	flags   int
+	N       uint64
+	r, p, t uint32
+	g       uint32
+	NROM    uint64
+}
+
+/*
+ Computes the crypt(3) hash of password with the setting ($y$ or $7$),
+ like yescrypt_r() in libxcrypt.
+ */
+func yescryptCrypt(password []byte, setting string) (string,error) {
+	if len(setting)<3 || setting[0]!='$' || (setting[1]!='7' && setting[1]!='y') || setting[2]!='$' {
+		return "",ErrInvalidHash
+	}
+	src := setting[3:]
+	prm := yescryptParams{p: 1}
+	var ok bool
+	if setting[1]=='7' {
+		if len(src)==0 { return "",ErrInvalidHash }
+		nlog2 := atoi64(src[0])
+		src = src[1:]
+		if nlog2<1 || nlog2>63 { return "",ErrInvalidHash }
+		prm.N = 1<<nlog2
+		if prm.r,src,ok = decode64Fixed(src,30); !ok { return "",ErrInvalidHash }
+		if prm.p,src,ok = decode64Fixed(src,30); !ok { return "",ErrInvalidHash }
+	} else {
+		var flavor,nlog2 uint32
+		if flavor,src,ok = decode64Uint32(src,0); !ok { return "",ErrInvalidHash }
+		if flavor<yescrypt_RW {
+			prm.flags = int(flavor)
+		} else if flavor<=yescrypt_RW+(yescrypt_RW_FLAVOR_MASK>>2) {
+			prm.flags = yescrypt_RW+(int(flavor-yescrypt_RW)<<2)
+		} else {
+			return "",ErrInvalidHash
+		}
+		if nlog2,src,ok = decode64Uint32(src,1); !ok || nlog2>63 { return "",ErrInvalidHash }
+		prm.N = 1<<nlog2
+		if prm.r,src,ok = decode64Uint32(src,1); !ok { return "",ErrInvalidHash }
+		if len(src)>0 && src[0]!='$' {
+			var have uint32
+			if have,src,ok = decode64Uint32(src,1); !ok { return "",ErrInvalidHash }
+			if have&1!=0 {
+				if prm.p,src,ok = decode64Uint32(src,2); !ok { return "",ErrInvalidHash }
+			}
+			if have&2!=0 {
+				if prm.t,src,ok = decode64Uint32(src,1); !ok { return "",ErrInvalidHash }
+			}
+			if have&4!=0 {
+				if prm.g,src,ok = decode64Uint32(src,1); !ok { return "",ErrInvalidHash }
+			}
+			if have&8!=0 {
+				var nrom uint32
+				if nrom,src,ok = decode64Uint32(src,1); !ok || nrom>63 { return "",ErrInvalidHash }
+				prm.NROM = 1<<nrom
+			}
+		}
+		if len(src)==0 || src[0]!='$' { return "",ErrInvalidHash }
+		src = src[1:]
+	}
+	prefix := setting[:len(setting)-len(src)]
+	saltstr := src
+	if i := strings.LastIndexByte(saltstr,'$'); i>=0 { saltstr = saltstr[:i] }
+	salt := []byte(saltstr)
+	if setting[1]=='y' {
+		if salt,ok = decode64(saltstr,64); !ok { return "",ErrInvalidHash }
+	}
+	dk,err := yescryptKDF(password,salt,&prm)
+	if err!=nil { return "",err }
+	return prefix+saltstr+"$"+encode64(dk),nil
+}
+
+// yescrypt_kdf(): Computes the 32 byte hash.
+func yescryptKDF(passwd, salt []byte, prm *yescryptParams) ([]byte,error) {
+	N,r,p := prm.N,prm.r,prm.p
+	if prm.g!=0 || prm.NROM!=0 { return nil,ErrInvalidHash }
+	if prm.flags&yescrypt_RW!=0 && p>=1 && N/uint64(p)>=0x100 && N/uint64(p)*uint64(r)>=0x20000 {
+		dk,err := yescryptBody(passwd,salt,prm.flags|yescrypt_PREHASH,N>>6,r,p,0)
+		if err!=nil { return nil,err }
+		passwd = dk
+	}
+	return yescryptBody(passwd,salt,prm.flags,N,r,p,prm.t)
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	m := hmac.New(sha256.New,key)
+	m.Write(msg)
+	return m.Sum(nil)
+}
+
+// yescrypt_kdf_body()
+func yescryptBody(passwd, salt []byte, flags int, N uint64, r, p, t uint32) ([]byte,error) {
+	switch flags&yescrypt_MODE_MASK {
+	case 0:
+		if flags!=0 || t!=0 { return nil,ErrInvalidHash }
+	case yescrypt_WORM:
+		if flags!=yescrypt_WORM { return nil,ErrInvalidHash }
+	case yescrypt_RW:
+		if flags&^yescrypt_PREHASH!=yescrypt_DEFAULTS { return nil,ErrInvalidHash }
+	default:
+		return nil,ErrInvalidHash
+	}
+	if uint64(r)*uint64(p)>=1<<30 { return nil,ErrInvalidHash }
+	// The limits of the optimized implementation in libxcrypt.
+	if N&(N-1)!=0 || N<=3 || r<1 || p<1 { return nil,ErrInvalidHash }
+	if flags&yescrypt_RW!=0 && N/uint64(p)<=3 { return nil,ErrInvalidHash }
+	if N>MaxYescryptMemory/128/uint64(r) || uint64(r)*uint64(p)>MaxYescryptMemory/128 {
+		return nil,ErrInvalidHash
+	}
+	s := 32*int(r)
+	V := make([]uint32,uint64(s)*N)
+	XY := make([]uint32,2*s)
+	var S []uint32
+	if flags&yescrypt_RW!=0 { S = make([]uint32,sWords*int(p)) }
+
+	if flags!=0 {
+		key := "yescrypt-prehash"
+		if flags&yescrypt_PREHASH==0 { key = key[:8] }
+		passwd = hmacSHA256([]byte(key),passwd)
+	}
+	B := pbkdf2.Key(passwd,salt,1,128*int(r)*int(p),sha256.New)
+	if flags!=0 { passwd = append([]byte(nil),B[:32]...) }
+
+	if p==1 || flags&yescrypt_RW!=0 {
+		smix(B,int(r),N,p,t,flags,V,XY,S,passwd)
+	} else {
+		for i := 0; i<int(p); i++ {
+			smix(B[128*int(r)*i:],int(r),N,1,t,flags,V,XY,nil,nil)
+		}
+	}
+	dk := pbkdf2.Key(passwd,B,1,32,sha256.New)
+	if flags!=0 && flags&yescrypt_PREHASH==0 {
+		// ClientKey and StoredKey, as in SCRAM.
+		ck := hmacSHA256(dk,[]byte("Client Key"))
+		sk := sha256.Sum256(ck)
+		dk = sk[:]
+	}
+	return dk,nil
+}
+
+func p2floor(x uint64) uint64 {
+	for y := x&(x-1); y!=0; y = x&(x-1) { x = y }
+	return x
+}
+
+func wrap(x, i uint64) uint64 {
+	n := p2floor(i)
+	return (x&(n-1))+(i-n)
+}
+
+// The state of pwxform: The three S-boxes (as offsets into S) and the write
+// pointer w.
+type pwxformCtx struct{
+	S          []uint32
+	s0, s1, s2 int
+	w          int
+}
+
+func smix(B []byte, r int, N uint64, p, t uint32, flags int, V, XY, S []uint32, passwd []byte) {
+	s := 32*r
+	Nchunk := N/uint64(p)
+	Nloop_all := Nchunk
+	if flags&yescrypt_RW!=0 {
+		if t<=1 {
+			if t!=0 { Nloop_all *= 2 }
+			Nloop_all = (Nloop_all+2)/3
+		} else {
+			Nloop_all *= uint64(t-1)
+		}
+	} else if t!=0 {
+		if t==1 { Nloop_all += (Nloop_all+1)/2 }
+		Nloop_all *= uint64(t)
+	}
+	var Nloop_rw uint64
+	if flags&yescrypt_RW!=0 { Nloop_rw = Nloop_all/uint64(p) }
+	Nchunk &^= 1
+	Nloop_all++; Nloop_all &^= 1
+	Nloop_rw++; Nloop_rw &^= 1
+
+	ctxs := make([]*pwxformCtx,p)
+	var Vchunk uint64
+	for i := 0; i<int(p); i,Vchunk = i+1,Vchunk+Nchunk {
+		Np := Nchunk
+		if i==int(p)-1 { Np = N-Vchunk }
+		Bp := B[128*r*i:128*r*(i+1)]
+		Vp := V[uint64(s)*Vchunk:]
+		var ctx *pwxformCtx
+		if flags&yescrypt_RW!=0 {
+			Si := S[sWords*i:sWords*(i+1)]
+			smix1(Bp,1,sWords/32,0,Si,XY,nil)
+			ctx = &pwxformCtx{S: Si, s2: 0, s1: sWords/3, s0: 2*sWords/3}
+			if i==0 {
+				copy(passwd,hmacSHA256(Bp[128*r-64:],passwd))
+			}
+		}
+		ctxs[i] = ctx
+		smix1(Bp,r,Np,flags,Vp,XY,ctx)
+		smix2(Bp,r,p2floor(Np),Nloop_rw,flags,Vp,XY,ctx)
+	}
+	for i := 0; i<int(p); i++ {
+		smix2(B[128*r*i:128*r*(i+1)],r,N,Nloop_all-Nloop_rw,flags&^yescrypt_RW,V,XY,ctxs[i])
+	}
+}
+
+// Loads B into X; X is kept in the SIMD-shuffled order of the reference.
+func blkLoad(X []uint32, B []byte, r int) {
+	for k := 0; k<2*r; k++ {
+		for i := 0; i<16; i++ {
+			X[k*16+i] = binary.LittleEndian.Uint32(B[4*(k*16+(i*5%16)):])
+		}
+	}
+}
+func blkStore(B []byte, X []uint32, r int) {
+	for k := 0; k<2*r; k++ {
+		for i := 0; i<16; i++ {
+			binary.LittleEndian.PutUint32(B[4*(k*16+(i*5%16)):],X[k*16+i])
+		}
+	}
+}
+func blkXor(d, s []uint32) {
+	for i := range d { d[i] ^= s[i] }
+}
+
+func integerify(X []uint32, r int) uint64 {
+	x := X[(2*r-1)*16:]
+	return uint64(x[13])<<32+uint64(x[0])
+}
+
+func smix1(B []byte, r int, N uint64, flags int, V, XY []uint32, ctx *pwxformCtx) {
+	s := uint64(32*r)
+	X,Y := XY[:s],XY[s:2*s]
+	blkLoad(X,B,r)
+	for i := uint64(0); i<N; i++ {
+		copy(V[i*s:(i+1)*s],X)
+		if flags&yescrypt_RW!=0 && i>1 {
+			j := wrap(integerify(X,r),i)
+			blkXor(X,V[j*s:(j+1)*s])
+		}
+		if ctx!=nil {
+			blockmixPwxform(X,ctx,r)
+		} else {
+			blockmixSalsa8(X,Y,r)
+		}
+	}
+	blkStore(B,X,r)
+}
+
+func smix2(B []byte, r int, N, Nloop uint64, flags int, V, XY []uint32, ctx *pwxformCtx) {
+	if Nloop==0 { return }
+	s := uint64(32*r)
+	X,Y := XY[:s],XY[s:2*s]
+	blkLoad(X,B,r)
+	for i := uint64(0); i<Nloop; i++ {
+		j := integerify(X,r)&(N-1)
+		blkXor(X,V[j*s:(j+1)*s])
+		if flags&yescrypt_RW!=0 { copy(V[j*s:(j+1)*s],X) }
+		if ctx!=nil {
+			blockmixPwxform(X,ctx,r)
+		} else {
+			blockmixSalsa8(X,Y,r)
+		}
+	}
+	blkStore(B,X,r)
+}
+
+// Salsa20 core on a shuffled block.
+func salsa20(B []uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i<16; i++ { x[i*5%16] = B[i] }
+	R := bits.RotateLeft32
+	for i := 0; i<rounds; i += 2 {
+		x[ 4] ^= R(x[ 0]+x[12], 7); x[ 8] ^= R(x[ 4]+x[ 0], 9)
+		x[12] ^= R(x[ 8]+x[ 4],13); x[ 0] ^= R(x[12]+x[ 8],18)
+		x[ 9] ^= R(x[ 5]+x[ 1], 7); x[13] ^= R(x[ 9]+x[ 5], 9)
+		x[ 1] ^= R(x[13]+x[ 9],13); x[ 5] ^= R(x[ 1]+x[13],18)
+		x[14] ^= R(x[10]+x[ 6], 7); x[ 2] ^= R(x[14]+x[10], 9)
+		x[ 6] ^= R(x[ 2]+x[14],13); x[10] ^= R(x[ 6]+x[ 2],18)
+		x[ 3] ^= R(x[15]+x[11], 7); x[ 7] ^= R(x[ 3]+x[15], 9)
+		x[11] ^= R(x[ 7]+x[ 3],13); x[15] ^= R(x[11]+x[ 7],18)
+
+		x[ 1] ^= R(x[ 0]+x[ 3], 7); x[ 2] ^= R(x[ 1]+x[ 0], 9)
+		x[ 3] ^= R(x[ 2]+x[ 1],13); x[ 0] ^= R(x[ 3]+x[ 2],18)
+		x[ 6] ^= R(x[ 5]+x[ 4], 7); x[ 7] ^= R(x[ 6]+x[ 5], 9)
+		x[ 4] ^= R(x[ 7]+x[ 6],13); x[ 5] ^= R(x[ 4]+x[ 7],18)
+		x[11] ^= R(x[10]+x[ 9], 7); x[ 8] ^= R(x[11]+x[10], 9)
+		x[ 9] ^= R(x[ 8]+x[11],13); x[10] ^= R(x[ 9]+x[ 8],18)
+		x[12] ^= R(x[15]+x[14], 7); x[13] ^= R(x[12]+x[15], 9)
+		x[14] ^= R(x[13]+x[12],13); x[15] ^= R(x[14]+x[13],18)
+	}
+	for i := 0; i<16; i++ { B[i] += x[i*5%16] }
+}
+
+func blockmixSalsa8(B, Y []uint32, r int) {
+	var X [16]uint32
+	copy(X[:],B[(2*r-1)*16:])
+	for i := 0; i<2*r; i++ {
+		blkXor(X[:],B[i*16:(i+1)*16])
+		salsa20(X[:],8)
+		copy(Y[i*16:],X[:])
+	}
+	for i := 0; i<r; i++ {
+		copy(B[i*16:(i+1)*16],Y[(i*2)*16:])
+		copy(B[(i+r)*16:(i+r+1)*16],Y[(i*2+1)*16:])
+	}
+}
+
+func pwxform(X []uint32, ctx *pwxformCtx) {
+	S := ctx.S
+	s0,s1,s2,w := ctx.s0,ctx.s1,ctx.s2,ctx.w
+	for i := 0; i<pwxRounds; i++ {
+		for j := 0; j<pwxGather; j++ {
+			xl,xh := X[j*4],X[j*4+1]
+			p0 := s0+int(xl&sMask)/4
+			p1 := s1+int(xh&sMask)/4
+			for k := 0; k<pwxSimple; k++ {
+				sv0 := uint64(S[p0+2*k+1])<<32+uint64(S[p0+2*k])
+				sv1 := uint64(S[p1+2*k+1])<<32+uint64(S[p1+2*k])
+				xl,xh = X[j*4+2*k],X[j*4+2*k+1]
+				x := uint64(xh)*uint64(xl)
+				x += sv0
+				x ^= sv1
+				X[j*4+2*k],X[j*4+2*k+1] = uint32(x),uint32(x>>32)
+				if i!=0 && i!=pwxRounds-1 {
+					S[s2+2*w],S[s2+2*w+1] = uint32(x),uint32(x>>32)
+					w++
+				}
+			}
+		}
+	}
+	ctx.s0,ctx.s1,ctx.s2 = s2,s0,s1
+	ctx.w = w&((1<<sWidth)*pwxSimple-1)
+}
+
+func blockmixPwxform(B []uint32, ctx *pwxformCtx, r int) {
+	var X [pwxWords]uint32
+	r1 := 128*r/(pwxWords*4)
+	copy(X[:],B[(r1-1)*pwxWords:])
+	for i := 0; i<r1; i++ {
+		if r1>1 { blkXor(X[:],B[i*pwxWords:(i+1)*pwxWords]) }
+		pwxform(X[:],ctx)
+		copy(B[i*pwxWords:],X[:])
+	}
+	i := (r1-1)*pwxWords*4/64
+	salsa20(B[i*16:(i+1)*16],2)
+	for i++; i<2*r; i++ {
+		blkXor(B[i*16:(i+1)*16],B[(i-1)*16:i*16])
+		salsa20(B[i*16:(i+1)*16],2)
+	}
+}
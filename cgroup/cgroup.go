@@ -0,0 +1,435 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+/*
+ Management of cgroup v2 (the unified hierarchy): Creates cgroups, sets
+ resource limits, moves processes in, reads statistics and kills cgroups.
+
+	parent,_ := cgroup.Self()
+	c,_ := parent.Create("job1")
+	c.SetMemoryMax(512<<20)
+	c.SetPidsMax(100)
+	done,_ := c.Apply(cmd) // start cmd inside c (CLONE_INTO_CGROUP)
+	cmd.Start()
+	done()
+	...
+	c.Destroy()
+
+ Due to the "no internal processes" rule, controllers can only be enabled for
+ the children of a cgroup, that contains no processes itself. A service, that
+ runs in its own cgroup, should move itself into a leaf (e.g. "service") and
+ create the cgroups for its jobs as siblings of that leaf.
+ */
+package cgroup
+
+import "bufio"
+import "errors"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "syscall"
+import "time"
+
+var ErrNoCgroup2 = errors.New("cgroup: no cgroup2 file system mounted")
+
+// The usual mount point of the unified hierarchy.
+const DefaultMountpoint = "/sys/fs/cgroup"
+
+/*
+ Returns the mount point of the cgroup2 file system; in hybrid setups, this is
+ /sys/fs/cgroup/unified.
+ */
+func Mountpoint() (string,error) {
+	f,err := os.Open("/proc/self/mountinfo")
+	if err!=nil { return "",err }
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fl := strings.Fields(s.Text())
+		for i,x := range fl {
+			if x=="-" && i+1<len(fl) && fl[i+1]=="cgroup2" && len(fl)>4 { return fl[4],nil }
+		}
+	}
+	if s.Err()!=nil { return "",s.Err() }
+	return "",ErrNoCgroup2
+}
+
+// A cgroup, given by its directory in the cgroup2 file system.
+type Cgroup struct{
+	Path string
+}
+
+/*
+ Returns the cgroup name (e.g. "/user.slice/sshd"), relative to the root of
+ the cgroup2 file system.
+ */
+func Open(name string) (*Cgroup,error) {
+	mp,err := Mountpoint()
+	if err!=nil { return nil,err }
+	return &Cgroup{filepath.Join(mp,name)},nil
+}
+
+// Returns the cgroup of the process pid (0 means the calling process).
+func OfProcess(pid int) (*Cgroup,error) {
+	p := "/proc/self/cgroup"
+	if pid!=0 { p = "/proc/"+strconv.Itoa(pid)+"/cgroup" }
+	b,err := ioutil.ReadFile(p)
+	if err!=nil { return nil,err }
+	for _,l := range strings.Split(string(b),"\n") {
+		if strings.HasPrefix(l,"0::") { return Open(l[3:]) }
+	}
+	return nil,ErrNoCgroup2
+}
+
+// Returns the cgroup of the calling process.
+func Self() (*Cgroup,error) { return OfProcess(0) }
+
+func (c *Cgroup) file(name string) string { return filepath.Join(c.Path,name) }
+
+// Returns the child cgroup name (which might not exist).
+func (c *Cgroup) Child(name string) *Cgroup {
+	return &Cgroup{filepath.Join(c.Path,name)}
+}
+
+// Creates the child cgroup name. It is not an error, if it exists.
+func (c *Cgroup) Create(name string) (*Cgroup,error) {
+	n := c.Child(name)
+	err := os.Mkdir(n.Path,0755)
+	if err!=nil && !os.IsExist(err) { return nil,err }
+	return n,nil
+}
+
+// Returns the child cgroups.
+func (c *Cgroup) Children() ([]*Cgroup,error) {
+	fis,err := ioutil.ReadDir(c.Path)
+	if err!=nil { return nil,err }
+	var r []*Cgroup
+	for _,fi := range fis {
+		if fi.IsDir() { r = append(r,c.Child(fi.Name())) }
+	}
+	return r,nil
+}
+
+// Reads the interface file name (e.g. "memory.max"), without trailing newline.
+func (c *Cgroup) Read(name string) (string,error) {
+	b,err := ioutil.ReadFile(c.file(name))
+	if err!=nil { return "",err }
+	return strings.TrimRight(string(b),"\n"),nil
+}
+
+/*
+ Writes value to the interface file name. The value is written with a single
+ write(), as the kernel expects.
+ */
+func (c *Cgroup) Write(name string, value string) error {
+	f,err := os.OpenFile(c.file(name),os.O_WRONLY,0)
+	if err!=nil { return err }
+	_,err = f.Write([]byte(value))
+	err2 := f.Close()
+	if err==nil { err = err2 }
+	return err
+}
+
+// Reads a flat keyed file like "memory.events" or "memory.stat".
+func (c *Cgroup) ReadKV(name string) (map[string]uint64,error) {
+	s,err := c.Read(name)
+	if err!=nil { return nil,err }
+	m := make(map[string]uint64)
+	for _,l := range strings.Split(s,"\n") {
+		f := strings.Fields(l)
+		if len(f)!=2 { continue }
+		v,err := strconv.ParseUint(f[1],10,64)
+		if err!=nil { continue }
+		m[f[0]] = v
+	}
+	return m,nil
+}
+
+// Reads a single-value file like "pids.current". "max" is returned as -1.
+func (c *Cgroup) ReadInt(name string) (int64,error) {
+	s,err := c.Read(name)
+	if err!=nil { return 0,err }
+	if s=="max" { return -1,nil }
+	return strconv.ParseInt(s,10,64)
+}
+
+func fmtMax(v int64) string {
+	if v<0 { return "max" }
+	return strconv.FormatInt(v,10)
+}
+
+// Returns the controllers available in the cgroup.
+func (c *Cgroup) Controllers() ([]string,error) {
+	s,err := c.Read("cgroup.controllers")
+	if err!=nil { return nil,err }
+	return strings.Fields(s),nil
+}
+
+// Enables the controllers (e.g. "memory", "pids") for the children of c.
+func (c *Cgroup) EnableControllers(names ...string) error {
+	if len(names)==0 { return nil }
+	return c.Write("cgroup.subtree_control","+"+strings.Join(names," +"))
+}
+
+/*
+ Enables the controllers for the children of c and of all its ancestors up to
+ the root of the hierarchy, as far as needed.
+ */
+func (c *Cgroup) EnableControllersRecursive(names ...string) error {
+	mp,err := Mountpoint()
+	if err!=nil { return err }
+	var chain []*Cgroup
+	for p := filepath.Clean(c.Path); p!=mp && strings.HasPrefix(p,mp); p = filepath.Dir(p) {
+		chain = append(chain,&Cgroup{filepath.Dir(p)})
+	}
+	for i:=len(chain)-1; i>=0; i-- {
+		err = chain[i].EnableControllers(names...)
+		if err!=nil { return err }
+	}
+	return c.EnableControllers(names...)
+}
+
+// Sets memory.max in bytes. -1 means no limit.
+func (c *Cgroup) SetMemoryMax(bytes int64) error { return c.Write("memory.max",fmtMax(bytes)) }
+
+// Sets memory.high (the throttling limit) in bytes. -1 means no limit.
+func (c *Cgroup) SetMemoryHigh(bytes int64) error { return c.Write("memory.high",fmtMax(bytes)) }
+
+// Sets memory.swap.max in bytes. -1 means no limit.
+func (c *Cgroup) SetSwapMax(bytes int64) error { return c.Write("memory.swap.max",fmtMax(bytes)) }
+
+// Sets pids.max. -1 means no limit.
+func (c *Cgroup) SetPidsMax(n int64) error { return c.Write("pids.max",fmtMax(n)) }
+
+/*
+ Sets cpu.max: The cgroup may run quota per period (e.g. 50ms per 100ms for
+ half a CPU). A negative quota means no limit; a zero period keeps the
+ current period.
+ */
+func (c *Cgroup) SetCPUMax(quota, period time.Duration) error {
+	v := "max"
+	if quota>=0 { v = strconv.FormatInt(int64(quota/time.Microsecond),10) }
+	if period>0 { v += " "+strconv.FormatInt(int64(period/time.Microsecond),10) }
+	return c.Write("cpu.max",v)
+}
+
+// Sets cpu.weight (1-10000, default 100).
+func (c *Cgroup) SetCPUWeight(w int) error { return c.Write("cpu.weight",strconv.Itoa(w)) }
+
+// Limits for io.max. Zero means no limit.
+type IOMax struct{
+	Rbps  uint64
+	Wbps  uint64
+	Riops uint64
+	Wiops uint64
+}
+
+func ioMaxValue(v uint64) string {
+	if v==0 { return "max" }
+	return strconv.FormatUint(v,10)
+}
+
+// Sets io.max for the block device major:minor.
+func (c *Cgroup) SetIOMax(major, minor uint32, l IOMax) error {
+	v := strconv.FormatUint(uint64(major),10)+":"+strconv.FormatUint(uint64(minor),10)+
+		" rbps="+ioMaxValue(l.Rbps)+" wbps="+ioMaxValue(l.Wbps)+
+		" riops="+ioMaxValue(l.Riops)+" wiops="+ioMaxValue(l.Wiops)
+	return c.Write("io.max",v)
+}
+
+// io.max limits of one block device, as used by Limits.
+type IODevice struct{
+	Major uint32
+	Minor uint32
+	IOMax
+}
+
+// Moves the process pid (with all its threads) into c.
+func (c *Cgroup) AddProc(pid int) error {
+	return c.Write("cgroup.procs",strconv.Itoa(pid))
+}
+
+// Returns the processes in c (not in its children).
+func (c *Cgroup) Procs() ([]int,error) {
+	s,err := c.Read("cgroup.procs")
+	if err!=nil { return nil,err }
+	var r []int
+	for _,f := range strings.Fields(s) {
+		p,err := strconv.Atoi(f)
+		if err==nil { r = append(r,p) }
+	}
+	return r,nil
+}
+
+// Reports, whether c or one of its children contains a process.
+func (c *Cgroup) Populated() (bool,error) {
+	m,err := c.ReadKV("cgroup.events")
+	if err!=nil { return false,err }
+	return m["populated"]!=0,nil
+}
+
+// Returns memory.events (e.g. "oom_kill", "max", "high").
+func (c *Cgroup) MemoryEvents() (map[string]uint64,error) { return c.ReadKV("memory.events") }
+
+// Returns memory.stat.
+func (c *Cgroup) MemoryStat() (map[string]uint64,error) { return c.ReadKV("memory.stat") }
+
+// Returns cpu.stat (e.g. "usage_usec", "nr_throttled").
+func (c *Cgroup) CPUStat() (map[string]uint64,error) { return c.ReadKV("cpu.stat") }
+
+// Returns memory.current in bytes.
+func (c *Cgroup) MemoryCurrent() (int64,error) { return c.ReadInt("memory.current") }
+
+// Returns pids.current.
+func (c *Cgroup) PidsCurrent() (int64,error) { return c.ReadInt("pids.current") }
+
+/*
+ Opens the cgroup directory. The fd can be used as SysProcAttr.CgroupFD.
+ */
+func (c *Cgroup) OpenFD() (int,error) {
+	return syscall.Open(c.Path,syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC,0)
+}
+
+/*
+ Makes cmd start inside c: The child is created by clone3() with
+ CLONE_INTO_CGROUP, so it never runs outside of c (Linux 5.7 or newer). Call
+ done after cmd.Start(), to release the cgroup fd.
+ */
+func (c *Cgroup) Apply(cmd *exec.Cmd) (done func(),err error) {
+	fd,err := c.OpenFD()
+	if err!=nil { return nil,err }
+	if cmd.SysProcAttr==nil { cmd.SysProcAttr = new(syscall.SysProcAttr) }
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+	return func() { syscall.Close(fd) },nil
+}
+
+// Freezes (true) or thaws (false) all processes in c and its children.
+func (c *Cgroup) Freeze(frozen bool) error {
+	if frozen { return c.Write("cgroup.freeze","1") }
+	return c.Write("cgroup.freeze","0")
+}
+
+/*
+ Kills all processes in c and its children with SIGKILL. Uses cgroup.kill
+ (Linux 5.14); on older kernels, the cgroups are frozen and their processes
+ are killed one by one.
+ */
+func (c *Cgroup) Kill() error {
+	err := c.Write("cgroup.kill","1")
+	if err==nil || !os.IsNotExist(err) { return err }
+	c.Freeze(true)
+	err = c.killAll()
+	c.Freeze(false)
+	return err
+}
+
+func (c *Cgroup) killAll() error {
+	procs,err := c.Procs()
+	if err!=nil { return err }
+	for _,p := range procs { syscall.Kill(p,syscall.SIGKILL) }
+	ch,err := c.Children()
+	if err!=nil { return err }
+	for _,cc := range ch {
+		err = cc.killAll()
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+ Waits until c and its children contain no processes anymore, or timeout
+ expires (returns syscall.ETIMEDOUT).
+ */
+func (c *Cgroup) WaitEmpty(timeout time.Duration) error {
+	end := time.Now().Add(timeout)
+	for {
+		p,err := c.Populated()
+		if err!=nil { return err }
+		if !p { return nil }
+		if time.Now().After(end) { return syscall.ETIMEDOUT }
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+// Removes c and its children. They must not contain any processes.
+func (c *Cgroup) Remove() error {
+	ch,err := c.Children()
+	if err!=nil {
+		if os.IsNotExist(err) { return nil }
+		return err
+	}
+	for _,cc := range ch {
+		err = cc.Remove()
+		if err!=nil { return err }
+	}
+	err = syscall.Rmdir(c.Path)
+	if err==syscall.ENOENT { return nil }
+	if err!=nil { return &os.PathError{Op: "rmdir", Path: c.Path, Err: err} }
+	return nil
+}
+
+// Kills all processes of c and its children and removes them.
+func (c *Cgroup) Destroy() error {
+	err := c.Kill()
+	if err!=nil && !os.IsNotExist(err) { return err }
+	err = c.WaitEmpty(5*time.Second)
+	if err!=nil && !os.IsNotExist(err) { return err }
+	return c.Remove()
+}
+
+/*
+ Resource limits, as set by Limits.Apply. Zero fields are left alone; use -1
+ to remove a limit.
+ */
+type Limits struct{
+	MemoryMax  int64
+	MemoryHigh int64
+	SwapMax    int64
+	PidsMax    int64
+	// cpu.max: CPUQuota per CPUPeriod (default period 100ms).
+	CPUQuota   time.Duration
+	CPUPeriod  time.Duration
+	CPUWeight  int
+	// io.max per block device.
+	IOMax      []IODevice
+}
+
+// Returns the controllers, the limits need.
+func (l *Limits) Controllers() []string {
+	var r []string
+	if l.MemoryMax!=0 || l.MemoryHigh!=0 || l.SwapMax!=0 { r = append(r,"memory") }
+	if l.PidsMax!=0 { r = append(r,"pids") }
+	if l.CPUQuota!=0 || l.CPUWeight!=0 { r = append(r,"cpu") }
+	if len(l.IOMax)!=0 { r = append(r,"io") }
+	return r
+}
+
+// Sets the limits on c. The controllers must be enabled in the parent of c.
+func (l *Limits) Apply(c *Cgroup) error {
+	set := func(err error, v int64, f func(int64) error) error {
+		if err!=nil || v==0 { return err }
+		return f(v)
+	}
+	var err error
+	err = set(err,l.MemoryMax,c.SetMemoryMax)
+	err = set(err,l.MemoryHigh,c.SetMemoryHigh)
+	err = set(err,l.SwapMax,c.SetSwapMax)
+	err = set(err,l.PidsMax,c.SetPidsMax)
+	if err==nil && l.CPUQuota!=0 { err = c.SetCPUMax(l.CPUQuota,l.CPUPeriod) }
+	if err==nil && l.CPUWeight!=0 { err = c.SetCPUWeight(l.CPUWeight) }
+	for _,d := range l.IOMax {
+		if err!=nil { break }
+		err = c.SetIOMax(d.Major,d.Minor,d.IOMax)
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+/*
+ Security labels (SELinux contexts, SMACK labels) of files and processes.
+
+ File labels are stored in the security.* extended attributes; process labels
+ are read and written through /proc/<pid>/attr/*. Nothing here needs
+ libselinux. Reading and writing file labels works on any file system, that
+ supports security.* xattrs, even if no LSM is active (writing then requires
+ CAP_SYS_ADMIN).
+ */
+package label
+
+import "github.com/maxymania/go-system/syscall_x"
+import "syscall"
+import "strings"
+import "errors"
+import "os"
+
+const XATTR_SELINUX         = "security.selinux"
+const XATTR_SMACK           = "security.SMACK64"
+const XATTR_SMACK_EXEC      = "security.SMACK64EXEC"
+const XATTR_SMACK_MMAP      = "security.SMACK64MMAP"
+const XATTR_SMACK_TRANSMUTE = "security.SMACK64TRANSMUTE"
+
+var ErrInvalidContext = errors.New("label: invalid SELinux context")
+
+/*
+ An SELinux security context "user:role:type[:level]". The level (MLS/MCS
+ range, e.g. "s0-s0:c0.c1023") may itself contain colons.
+ */
+type Context struct{
+	User  string
+	Role  string
+	Type  string
+	Level string
+}
+
+func ParseContext(s string) (Context,error) {
+	s = strings.TrimRight(s,"\x00\n")
+	p := strings.SplitN(s,":",4)
+	if len(p)<3 { return Context{},ErrInvalidContext }
+	for _,e := range p {
+		if e=="" { return Context{},ErrInvalidContext }
+	}
+	c := Context{User: p[0], Role: p[1], Type: p[2]}
+	if len(p)==4 { c.Level = p[3] }
+	return c,nil
+}
+
+func (c Context) String() string {
+	s := c.User+":"+c.Role+":"+c.Type
+	if c.Level!="" { s += ":"+c.Level }
+	return s
+}
+
+// Strips the trailing NUL, the kernel and libselinux append.
+func trim(b []byte) string {
+	return strings.TrimRight(string(b),"\x00")
+}
+
+func getx(get func(dest []byte) (int,error)) (string,error) {
+	for {
+		sz,err := get(nil)
+		if err!=nil { return "",err }
+		buf := make([]byte,sz)
+		sz,err = get(buf)
+		if err==syscall.ERANGE { continue } // grew meanwhile
+		if err!=nil { return "",err }
+		return trim(buf[:sz]),nil
+	}
+}
+
+/*
+ Returns the extended attribute name (e.g. XATTR_SELINUX) of path. If nofollow
+ is true, a symlink is not followed.
+ */
+func Get(path string, name string, nofollow bool) (string,error) {
+	s,err := getx(func(dest []byte) (int,error) {
+		if nofollow { return syscall_x.Lgetxattr(path,name,dest) }
+		return syscall.Getxattr(path,name,dest)
+	})
+	if err!=nil { return "",&os.PathError{Op: "getxattr", Path: path, Err: err} }
+	return s,nil
+}
+
+// Returns the extended attribute name of the open file fd.
+func FGet(fd int, name string) (string,error) {
+	return getx(func(dest []byte) (int,error) { return syscall_x.Fgetxattr(fd,name,dest) })
+}
+
+/*
+ Sets the extended attribute name of path to label. If nofollow is true, the
+ label of a symlink itself is set.
+ */
+func Set(path string, name string, label string, nofollow bool) error {
+	var err error
+	if nofollow {
+		err = syscall_x.Lsetxattr(path,name,[]byte(label),0)
+	} else {
+		err = syscall.Setxattr(path,name,[]byte(label),0)
+	}
+	if err!=nil { return &os.PathError{Op: "setxattr", Path: path, Err: err} }
+	return nil
+}
+
+// Sets the extended attribute name of the open file fd to label.
+func FSet(fd int, name string, label string) error {
+	return syscall_x.Fsetxattr(fd,name,[]byte(label),0)
+}
+
+// Returns the SELinux context of path (like "ls -Z").
+func FileContext(path string) (Context,error) {
+	s,err := Get(path,XATTR_SELINUX,true)
+	if err!=nil { return Context{},err }
+	return ParseContext(s)
+}
+
+// Returns the SELinux context of the open file fd.
+func FileContextFd(fd int) (Context,error) {
+	s,err := FGet(fd,XATTR_SELINUX)
+	if err!=nil { return Context{},err }
+	return ParseContext(s)
+}
+
+// Sets the SELinux context of path (like "chcon -h").
+func SetFileContext(path string, c Context) error {
+	return Set(path,XATTR_SELINUX,c.String(),true)
+}
+
+// Sets the SELinux context of the open file fd.
+func SetFileContextFd(fd int, c Context) error {
+	return FSet(fd,XATTR_SELINUX,c.String())
+}
+
+// Returns the SMACK label of path.
+func SmackLabel(path string) (string,error) {
+	return Get(path,XATTR_SMACK,true)
+}
+
+// Sets the SMACK label of path.
+func SetSmackLabel(path string, label string) error {
+	return Set(path,XATTR_SMACK,label,true)
+}
+
+// Reports, whether SELinux is active (selinuxfs is mounted).
+func SELinuxEnabled() bool {
+	var st syscall.Statfs_t
+	if syscall.Statfs("/sys/fs/selinux",&st)!=nil { return false }
+	return uint32(st.Type)==0xf97cff8c // SELINUX_MAGIC
+}
+
+// Reports, whether SMACK is active (smackfs is mounted).
+func SmackEnabled() bool {
+	var st syscall.Statfs_t
+	if syscall.Statfs("/sys/fs/smackfs",&st)!=nil { return false }
+	return uint32(st.Type)==0x43415d53 // SMACK_MAGIC
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package label
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "syscall"
+import "testing"
+
+func TestParseContext(t *testing.T) {
+	for s,want := range map[string]Context{
+		"system_u:object_r:etc_t": {"system_u","object_r","etc_t",""},
+		"system_u:object_r:etc_t:s0": {"system_u","object_r","etc_t","s0"},
+		"user_u:user_r:user_t:s0-s0:c0.c1023": {"user_u","user_r","user_t","s0-s0:c0.c1023"},
+		"unconfined_u:unconfined_r:unconfined_t:s0\x00": {"unconfined_u","unconfined_r","unconfined_t","s0"},
+		"u:r:t:s0\n": {"u","r","t","s0"},
+	} {
+		c,err := ParseContext(s)
+		if err!=nil { t.Errorf("%q: %v",s,err); continue }
+		if c!=want { t.Errorf("%q: got %+v",s,c) }
+		if s[len(s)-1]!=0 && s[len(s)-1]!='\n' && c.String()!=s { t.Errorf("%q: formatted as %q",s,c.String()) }
+	}
+	for _,s := range []string{"","u:r","u::t","u:r:t:","::",":r:t"} {
+		if _,err := ParseContext(s); err!=ErrInvalidContext { t.Errorf("%q: %v",s,err) }
+	}
+}
+
+// A directory on a tmpfs, which keeps security.* xattrs without an LSM.
+func tmpfsDir(t *testing.T) string {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs("/dev/shm",&st); err!=nil || st.Type!=0x01021994 { t.Skip("no tmpfs at /dev/shm") }
+	d,err := ioutil.TempDir("/dev/shm","labeltest")
+	if err!=nil { t.Skip(err) }
+	return d
+}
+
+func skipUnsupported(t *testing.T, err error) {
+	if pe,ok := err.(*os.PathError); ok { err = pe.Err }
+	if err==syscall.EPERM || err==syscall.EOPNOTSUPP || err==syscall.EACCES || err==syscall.EINVAL {
+		t.Skipf("security xattrs not writable here: %v",err)
+	}
+}
+
+func TestFileContext(t *testing.T) {
+	d := tmpfsDir(t)
+	defer os.RemoveAll(d)
+	p := filepath.Join(d,"f")
+	if err := ioutil.WriteFile(p,nil,0600); err!=nil { t.Fatal(err) }
+	c := Context{"system_u","object_r","tmp_t","s0:c1,c2"}
+	if err := SetFileContext(p,c); err!=nil {
+		skipUnsupported(t,err)
+		t.Fatal(err)
+	}
+	got,err := FileContext(p)
+	if err!=nil { t.Fatal(err) }
+	if got!=c { t.Errorf("got %+v",got) }
+	f,err := os.Open(p)
+	if err!=nil { t.Fatal(err) }
+	defer f.Close()
+	got,err = FileContextFd(int(f.Fd()))
+	if err!=nil || got!=c { t.Errorf("fd: got %+v, %v",got,err) }
+}
+
+func TestSymlinkLabel(t *testing.T) {
+	d := tmpfsDir(t)
+	defer os.RemoveAll(d)
+	p := filepath.Join(d,"f")
+	l := filepath.Join(d,"l")
+	if err := ioutil.WriteFile(p,nil,0600); err!=nil { t.Fatal(err) }
+	if err := os.Symlink(p,l); err!=nil { t.Fatal(err) }
+	if err := Set(p,XATTR_SMACK,"Target",false); err!=nil {
+		skipUnsupported(t,err)
+		t.Fatal(err)
+	}
+	if err := Set(l,XATTR_SMACK,"Link",true); err!=nil {
+		skipUnsupported(t,err)
+		t.Fatal(err)
+	}
+	if s,err := Get(l,XATTR_SMACK,false); err!=nil || s!="Target" { t.Errorf("followed: %q %v",s,err) }
+	if s,err := SmackLabel(l); err!=nil || s!="Link" { t.Errorf("not followed: %q %v",s,err) }
+}
+
+func TestGetMissing(t *testing.T) {
+	_,err := Get("/nonexistent/file",XATTR_SELINUX,true)
+	if pe,ok := err.(*os.PathError); !ok || pe.Err!=syscall.ENOENT { t.Errorf("got %v",err) }
+}
+
+func TestWithExecEmpty(t *testing.T) {
+	called := false
+	err := WithExec("",func() error { called = true; return nil })
+	if err!=nil || !called { t.Errorf("called %v, %v",called,err) }
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package label
+
+import "io/ioutil"
+import "os"
+import "runtime"
+import "strconv"
+import "syscall"
+
+// Process attributes in /proc/<pid>/attr/.
+const ATTR_CURRENT    = "current"
+const ATTR_EXEC       = "exec"
+const ATTR_FSCREATE   = "fscreate"
+const ATTR_KEYCREATE  = "keycreate"
+const ATTR_SOCKCREATE = "sockcreate"
+const ATTR_PREV       = "prev"
+
+func attrPath(pid int, attr string) string {
+	if pid==0 { return "/proc/thread-self/attr/"+attr }
+	return "/proc/"+strconv.Itoa(pid)+"/attr/"+attr
+}
+
+/*
+ Reads the process attribute attr (ATTR_*) of pid, or of the calling thread if
+ pid is 0. Works for the active LSM, be it SELinux or SMACK.
+ */
+func ProcAttr(pid int, attr string) (string,error) {
+	b,err := ioutil.ReadFile(attrPath(pid,attr))
+	if err!=nil { return "",err }
+	return trim(b),nil
+}
+
+/*
+ Writes the attribute attr of the calling thread. Since the kernel keeps these
+ attributes per thread, the caller should hold runtime.LockOSThread.
+ An empty label resets the attribute.
+ */
+func SetProcAttr(attr string, label string) error {
+	f,err := os.OpenFile(attrPath(0,attr),os.O_WRONLY,0)
+	if err!=nil { return err }
+	defer f.Close()
+	// A write of length 0 resets (like setexeccon(NULL)).
+	_,err = syscall.Write(int(f.Fd()),[]byte(label))
+	if err!=nil { return &os.PathError{Op: "write", Path: f.Name(), Err: err} }
+	return nil
+}
+
+// Returns the label of the calling thread.
+func Current() (string,error) { return ProcAttr(0,ATTR_CURRENT) }
+
+// Returns the label of the calling thread as SELinux context.
+func CurrentContext() (Context,error) {
+	s,err := Current()
+	if err!=nil { return Context{},err }
+	return ParseContext(s)
+}
+
+// Returns the label, the next execve() of the calling thread will run with.
+func Exec() (string,error) { return ProcAttr(0,ATTR_EXEC) }
+
+/*
+ Runs fn with the exec label of the calling thread set to label. Every process
+ fn starts (exec.Cmd.Start, os.StartProcess) runs with that label. The label
+ is reset afterwards. Does nothing but fn, if label is empty.
+
+ If the label can not be reset, that error is returned and the calling
+ goroutine stays locked to the thread, so no other goroutine starts processes
+ with the label; the runtime terminates the thread, when the goroutine exits.
+ */
+func WithExec(label string, fn func() error) (err error) {
+	if label=="" { return fn() }
+	runtime.LockOSThread()
+	err = SetProcAttr(ATTR_EXEC,label)
+	if err!=nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer func() {
+		if e := SetProcAttr(ATTR_EXEC,""); e!=nil {
+			err = e
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+	return fn()
+}
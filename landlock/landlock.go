@@ -0,0 +1,227 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+/*
+ A high-level interface to the Landlock LSM: Restricts the file system paths
+ and TCP ports, the process (and its children) can access.
+
+	r := landlock.NewRuleset()
+	r.AllowRead("/usr","/etc")
+	r.AllowWrite("/srv/sftp/alice")
+	r.AllowConnect(443)
+	r.Restrict()
+
+ By default, the ruleset is applied on a best-effort basis: Rights, that the
+ kernel's Landlock ABI does not know, are left out, so older kernels enforce
+ what they can. Set MinABI to fail on kernels, that are too old.
+
+ An exception is LANDLOCK_ACCESS_FS_REFER (part of AllowWrite): ABI 1 denies
+ to rename or link files into another directory in any case, so a ruleset,
+ that allows it, is not applied at all there (like go-landlock does). Use
+ AllowPath without it, if this is not needed.
+ */
+package landlock
+
+import "github.com/maxymania/go-system/syscall_x"
+import "syscall"
+import "errors"
+import "os"
+
+var ErrUnsupported = errors.New("landlock: not supported by the kernel")
+
+const fs_READ  = syscall_x.LANDLOCK_ACCESS_FS_READ_FILE|syscall_x.LANDLOCK_ACCESS_FS_READ_DIR
+const fs_EXEC  = syscall_x.LANDLOCK_ACCESS_FS_EXECUTE
+const fs_WRITE = syscall_x.LANDLOCK_ACCESS_FS_WRITE_FILE|
+	syscall_x.LANDLOCK_ACCESS_FS_REMOVE_DIR|
+	syscall_x.LANDLOCK_ACCESS_FS_REMOVE_FILE|
+	syscall_x.LANDLOCK_ACCESS_FS_MAKE_CHAR|
+	syscall_x.LANDLOCK_ACCESS_FS_MAKE_DIR|
+	syscall_x.LANDLOCK_ACCESS_FS_MAKE_REG|
+	syscall_x.LANDLOCK_ACCESS_FS_MAKE_SOCK|
+	syscall_x.LANDLOCK_ACCESS_FS_MAKE_FIFO|
+	syscall_x.LANDLOCK_ACCESS_FS_MAKE_BLOCK|
+	syscall_x.LANDLOCK_ACCESS_FS_MAKE_SYM|
+	syscall_x.LANDLOCK_ACCESS_FS_REFER|
+	syscall_x.LANDLOCK_ACCESS_FS_TRUNCATE|
+	syscall_x.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+// Rights, that can be granted on regular files (as opposed to directories).
+const fs_FILE = syscall_x.LANDLOCK_ACCESS_FS_EXECUTE|
+	syscall_x.LANDLOCK_ACCESS_FS_WRITE_FILE|
+	syscall_x.LANDLOCK_ACCESS_FS_READ_FILE|
+	syscall_x.LANDLOCK_ACCESS_FS_TRUNCATE|
+	syscall_x.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+/*
+ Returns the file system rights known to the given ABI version.
+ */
+func FsAccessForABI(abi int) uint64 {
+	var a uint64
+	if abi>=1 { a |= (1<<13)-1 }
+	if abi>=2 { a |= syscall_x.LANDLOCK_ACCESS_FS_REFER }
+	if abi>=3 { a |= syscall_x.LANDLOCK_ACCESS_FS_TRUNCATE }
+	if abi>=5 { a |= syscall_x.LANDLOCK_ACCESS_FS_IOCTL_DEV }
+	return a
+}
+
+/*
+ Returns the network rights known to the given ABI version.
+ */
+func NetAccessForABI(abi int) uint64 {
+	if abi>=4 { return syscall_x.LANDLOCK_ACCESS_NET_BIND_TCP|syscall_x.LANDLOCK_ACCESS_NET_CONNECT_TCP }
+	return 0
+}
+
+/*
+ Returns the Landlock ABI version of the kernel, or 0 if Landlock is
+ unavailable.
+ */
+func ABIVersion() int {
+	v,err := syscall_x.LandlockABIVersion()
+	if err!=nil { return 0 }
+	return v
+}
+
+type pathRule struct{
+	path   string
+	access uint64
+}
+type portRule struct{
+	port   uint16
+	access uint64
+}
+
+type Ruleset struct{
+	// Fail, if the Landlock ABI of the kernel is older (1 = Linux 5.13,
+	// 2 = 5.19, 3 = 6.2, 4 = 6.7 (network), 5 = 6.10).
+	MinABI     int
+	// Rights, that are denied unless allowed by a rule. NewRuleset sets all
+	// known rights. Set HandledNet to 0 to leave the network unrestricted.
+	HandledFs  uint64
+	HandledNet uint64
+	paths []pathRule
+	ports []portRule
+}
+
+func NewRuleset() *Ruleset {
+	r := new(Ruleset)
+	r.HandledFs = fs_READ|fs_EXEC|fs_WRITE
+	r.HandledNet = syscall_x.LANDLOCK_ACCESS_NET_BIND_TCP|syscall_x.LANDLOCK_ACCESS_NET_CONNECT_TCP
+	return r
+}
+
+// Allows the given rights (LANDLOCK_ACCESS_FS_*) beneath the paths.
+func (r *Ruleset) AllowPath(access uint64, paths ...string) *Ruleset {
+	for _,p := range paths { r.paths = append(r.paths,pathRule{p,access}) }
+	return r
+}
+// Allows to read files and list directories beneath the paths.
+func (r *Ruleset) AllowRead(paths ...string) *Ruleset {
+	return r.AllowPath(fs_READ,paths...)
+}
+// Allows to read and execute files beneath the paths.
+func (r *Ruleset) AllowReadExec(paths ...string) *Ruleset {
+	return r.AllowPath(fs_READ|fs_EXEC,paths...)
+}
+// Allows to read, create, modify and delete files beneath the paths.
+func (r *Ruleset) AllowWrite(paths ...string) *Ruleset {
+	return r.AllowPath(fs_READ|fs_WRITE,paths...)
+}
+// Allows to bind the TCP ports.
+func (r *Ruleset) AllowBind(ports ...uint16) *Ruleset {
+	for _,p := range ports { r.ports = append(r.ports,portRule{p,syscall_x.LANDLOCK_ACCESS_NET_BIND_TCP}) }
+	return r
+}
+// Allows to connect to the TCP ports.
+func (r *Ruleset) AllowConnect(ports ...uint16) *Ruleset {
+	for _,p := range ports { r.ports = append(r.ports,portRule{p,syscall_x.LANDLOCK_ACCESS_NET_CONNECT_TCP}) }
+	return r
+}
+
+// Reports, whether a rule allows to rename or link files between directories.
+func (r *Ruleset) refers() bool {
+	if r.HandledFs&syscall_x.LANDLOCK_ACCESS_FS_REFER==0 { return false }
+	for _,p := range r.paths {
+		if p.access&syscall_x.LANDLOCK_ACCESS_FS_REFER!=0 { return true }
+	}
+	return false
+}
+
+/*
+ Returns the ABI version to use on a kernel with the given one; 0 means, that
+ nothing is restricted.
+ */
+func (r *Ruleset) abiFor(abi int) (int,error) {
+	if abi<r.MinABI { return abi,ErrUnsupported }
+	// ABI 1 would deny, what REFER allows.
+	if abi<2 && r.refers() {
+		if r.MinABI>0 { return abi,ErrUnsupported }
+		return 0,nil
+	}
+	return abi,nil
+}
+
+/*
+ Creates the ruleset for the given ABI version and returns the fd.
+ */
+func (r *Ruleset) create(abi int) (int,error) {
+	var attr syscall_x.LandlockRulesetAttr
+	attr.Handled_access_fs  = r.HandledFs&FsAccessForABI(abi)
+	attr.Handled_access_net = r.HandledNet&NetAccessForABI(abi)
+	fd,err := syscall_x.LandlockCreateRuleset(&attr,0)
+	if err!=nil { return -1,err }
+	for _,p := range r.paths {
+		access := p.access&attr.Handled_access_fs
+		if access==0 { continue }
+		err = addPath(fd,access,p.path)
+		if err!=nil { syscall.Close(fd); return -1,err }
+	}
+	for _,p := range r.ports {
+		access := p.access&attr.Handled_access_net
+		if access==0 { continue }
+		err = syscall_x.LandlockAddNetRule(fd,access,p.port)
+		if err!=nil { syscall.Close(fd); return -1,err }
+	}
+	return fd,nil
+}
+
+func addPath(fd int, access uint64, path string) error {
+	pfd,err := syscall.Open(path,syscall_x.O_PATH|syscall.O_CLOEXEC,0)
+	if err!=nil { return &os.PathError{Op: "landlock", Path: path, Err: err} }
+	defer syscall.Close(pfd)
+	var st syscall.Stat_t
+	err = syscall.Fstat(pfd,&st)
+	if err!=nil { return &os.PathError{Op: "landlock", Path: path, Err: err} }
+	if (st.Mode&syscall.S_IFMT)!=syscall.S_IFDIR { access &= fs_FILE }
+	if access==0 { return nil }
+	err = syscall_x.LandlockAddPathRule(fd,access,pfd)
+	if err!=nil { return &os.PathError{Op: "landlock", Path: path, Err: err} }
+	return nil
+}
+
+/*
+ Applies the ruleset to every thread of the calling process. The restriction
+ is inherited by all children and can not be undone. no_new_privs is set.
+
+ Returns the ABI version, that has been used. If Landlock is not available
+ (or only ABI 1, and a rule allows LANDLOCK_ACCESS_FS_REFER) and MinABI is 0,
+ nothing is done and 0 is returned.
+ */
+func (r *Ruleset) Restrict() (int,error) {
+	abi,err := r.abiFor(ABIVersion())
+	if err!=nil || abi==0 { return abi,err }
+	fd,err := r.create(abi)
+	if err!=nil { return abi,err }
+	defer syscall.Close(fd)
+	err = syscall_x.SetNoNewPrivs()
+	if err!=nil { return abi,err }
+	err = syscall_x.LandlockRestrictSelf(fd,0)
+	return abi,err
+}
+
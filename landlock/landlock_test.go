@@ -0,0 +1,89 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package landlock
+
+import "github.com/maxymania/go-system/syscall_x"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "testing"
+
+func TestAccessForABI(t *testing.T) {
+	for abi,want := range map[int]uint64{
+		0: 0,
+		1: 0x1fff,
+		2: 0x1fff|syscall_x.LANDLOCK_ACCESS_FS_REFER,
+		3: 0x1fff|syscall_x.LANDLOCK_ACCESS_FS_REFER|syscall_x.LANDLOCK_ACCESS_FS_TRUNCATE,
+		5: fs_READ|fs_EXEC|fs_WRITE,
+	} {
+		if a := FsAccessForABI(abi); a!=want { t.Errorf("fs, ABI %d: %#x",abi,a) }
+	}
+	if NetAccessForABI(3)!=0 || NetAccessForABI(4)==0 { t.Error("net") }
+}
+
+func TestABIFor(t *testing.T) {
+	noRefer := uint64(syscall_x.LANDLOCK_ACCESS_FS_WRITE_FILE|fs_READ)
+	for _,tt := range []struct{
+		name string
+		r    *Ruleset
+		abi  int
+		want int
+		err  error
+	}{
+		{"read only on ABI 1",NewRuleset().AllowRead("/"),1,1,nil},
+		{"refer on ABI 1",NewRuleset().AllowWrite("/tmp"),1,0,nil},
+		{"refer on ABI 1 with MinABI",&Ruleset{MinABI: 1, HandledFs: fs_WRITE, paths: []pathRule{{"/tmp",fs_WRITE}}},1,1,ErrUnsupported},
+		{"refer not handled",&Ruleset{HandledFs: noRefer, paths: []pathRule{{"/tmp",fs_WRITE}}},1,1,nil},
+		{"write without refer on ABI 1",NewRuleset().AllowPath(noRefer,"/tmp"),1,1,nil},
+		{"refer on ABI 2",NewRuleset().AllowWrite("/tmp"),2,2,nil},
+		{"no landlock",NewRuleset().AllowRead("/"),0,0,nil},
+		{"too old",&Ruleset{MinABI: 4},3,3,ErrUnsupported},
+	} {
+		abi,err := tt.r.abiFor(tt.abi)
+		if abi!=tt.want || err!=tt.err { t.Errorf("%s: %d %v",tt.name,abi,err) }
+	}
+}
+
+/*
+ Restrict applies to the whole process for good, so it runs in a child: the
+ test binary again, with the directory in _LANDLOCK_TEST_DIR.
+ */
+func TestRestrict(t *testing.T) {
+	if os.Getenv("_LANDLOCK_TEST_DIR")!="" { return }
+	if ABIVersion()<2 { t.Skip("needs Landlock ABI 2") }
+	d,err := ioutil.TempDir("","landlocktest")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(d)
+	for _,n := range []string{"w/a","w/b","r"} {
+		if err = os.MkdirAll(filepath.Join(d,n),0755); err!=nil { t.Fatal(err) }
+	}
+	if err = ioutil.WriteFile(filepath.Join(d,"r","f"),[]byte("x"),0644); err!=nil { t.Fatal(err) }
+	cmd := exec.Command(os.Args[0],"-test.run=^TestRestrictChild$","-test.v")
+	cmd.Env = append(os.Environ(),"_LANDLOCK_TEST_DIR="+d)
+	out,err := cmd.CombinedOutput()
+	if err!=nil { t.Errorf("%v\n%s",err,out) }
+}
+
+func TestRestrictChild(t *testing.T) {
+	d := os.Getenv("_LANDLOCK_TEST_DIR")
+	if d=="" { t.Skip("run by TestRestrict") }
+	r := NewRuleset()
+	r.HandledNet = 0
+	r.AllowRead(filepath.Join(d,"r")).AllowWrite(filepath.Join(d,"w"))
+	if abi,err := r.Restrict(); err!=nil || abi<2 { t.Fatalf("ABI %d: %v",abi,err) }
+	if _,err := ioutil.ReadFile(filepath.Join(d,"r","f")); err!=nil { t.Errorf("read: %v",err) }
+	if err := ioutil.WriteFile(filepath.Join(d,"r","f"),nil,0644); !os.IsPermission(err) { t.Errorf("write to a read-only path: %v",err) }
+	if _,err := ioutil.ReadFile("/etc/passwd"); !os.IsPermission(err) { t.Errorf("read outside: %v",err) }
+	a := filepath.Join(d,"w","a","f")
+	if err := ioutil.WriteFile(a,[]byte("x"),0644); err!=nil { t.Fatalf("write: %v",err) }
+	// Allowed by LANDLOCK_ACCESS_FS_REFER.
+	if err := os.Rename(a,filepath.Join(d,"w","b","f")); err!=nil { t.Errorf("rename into another directory: %v",err) }
+}
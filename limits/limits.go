@@ -0,0 +1,435 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+/*
+ Per-user resource limits, as configured for pam_limits in
+ /etc/security/limits.conf and /etc/security/limits.d/*.conf.
+
+	cfg,_ := limits.Load()
+	acc,_ := limits.LookupAccount("alice")
+	l := cfg.Compute(acc)
+	l.Start(cmd) // cmd runs with alice's limits from its first instruction
+
+ Start needs syscall_x.ExecSetupMain to be called first in main.
+
+ Entries for a user name or uid range take precedence over entries for a
+ group (@group, @gid range, %group), those over the wildcard (*). Of the
+ entries with the same precedence, the last one wins. Like pam_limits, group
+ and wildcard entries are not applied to root (uid 0).
+ */
+package limits
+
+import "github.com/maxymania/go-system/syscall_x"
+import "bufio"
+import "fmt"
+import "io"
+import "os"
+import "os/exec"
+import "os/user"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "syscall"
+
+const DefaultFile = "/etc/security/limits.conf"
+const DefaultDir  = "/etc/security/limits.d"
+
+// An entry of limits.conf: "<domain> <type> <item> <value>".
+type Rule struct{
+	Domain string
+	// "soft", "hard" or "-" (both).
+	Type   string
+	Item   string
+	Value  string
+	File   string
+	Line   int
+}
+
+// How an item of limits.conf maps to a resource limit.
+type item struct{
+	resource int
+	// Multiplier of the value (KB, minutes).
+	unit     uint64
+}
+
+var items = map[string]item{
+	"core":       {syscall.RLIMIT_CORE,1024},
+	"data":       {syscall.RLIMIT_DATA,1024},
+	"fsize":      {syscall.RLIMIT_FSIZE,1024},
+	"memlock":    {syscall_x.RLIMIT_MEMLOCK,1024},
+	"nofile":     {syscall.RLIMIT_NOFILE,1},
+	"rss":        {syscall_x.RLIMIT_RSS,1024},
+	"stack":      {syscall.RLIMIT_STACK,1024},
+	"cpu":        {syscall.RLIMIT_CPU,60},
+	"nproc":      {syscall_x.RLIMIT_NPROC,1},
+	"as":         {syscall.RLIMIT_AS,1024},
+	"locks":      {syscall_x.RLIMIT_LOCKS,1},
+	"sigpending": {syscall_x.RLIMIT_SIGPENDING,1},
+	"msgqueue":   {syscall_x.RLIMIT_MSGQUEUE,1},
+	"nice":       {syscall_x.RLIMIT_NICE,0},
+	"rtprio":     {syscall_x.RLIMIT_RTPRIO,1},
+}
+
+// Items, that are not resource limits.
+var otherItems = map[string]bool{
+	"nonewprivs": true, "priority": true,
+}
+
+/*
+ Items of pam_limits, that this package does not enforce; they are reported
+ as UnsupportedItem rather than ignored silently.
+ */
+var unsupportedItems = map[string]bool{
+	"maxlogins": true, "maxsyslogins": true, "chroot": true,
+}
+
+// Items supported by this package, resource limits first.
+func Items() []string {
+	var r []string
+	for k := range items { r = append(r,k) }
+	sort.Strings(r)
+	var o []string
+	for k := range otherItems { o = append(o,k) }
+	sort.Strings(o)
+	return append(r,o...)
+}
+
+// A line with an item, that this package does not enforce.
+type UnsupportedItem struct{
+	File string
+	Line int
+	Item string
+}
+
+func (u *UnsupportedItem) Error() string {
+	return fmt.Sprintf("%s:%d: unsupported item %q",u.File,u.Line,u.Item)
+}
+
+/*
+ Parses limits.conf-formatted data. name is used in error messages and
+ Rule.File. Lines with an unsupported item (maxlogins, maxsyslogins, chroot)
+ are left out and returned as unsupported, to be logged; any invalid line is
+ an error.
+ */
+func Parse(r io.Reader, name string) (rules []Rule, unsupported []*UnsupportedItem, err error) {
+	var bad error
+	rules,err = parse(r,name,func(err error) {
+		if u,ok := err.(*UnsupportedItem); ok {
+			unsupported = append(unsupported,u)
+		} else if bad==nil {
+			bad = err
+		}
+	})
+	if err==nil { err = bad }
+	if err!=nil { return nil,nil,err }
+	return rules,unsupported,nil
+}
+
+// Parses data; invalid lines are passed to skip and left out.
+func parse(r io.Reader, name string, skip func(error)) ([]Rule,error) {
+	var rules []Rule
+	s := bufio.NewScanner(r)
+	n := 0
+	for s.Scan() {
+		n++
+		l := s.Text()
+		if i := strings.IndexByte(l,'#'); i>=0 { l = l[:i] }
+		f := strings.Fields(l)
+		if len(f)==0 { continue }
+		if len(f)!=4 { skip(fmt.Errorf("%s:%d: expected 4 fields",name,n)); continue }
+		ru := Rule{f[0],f[1],strings.ToLower(f[2]),f[3],name,n}
+		if ru.Type!="soft" && ru.Type!="hard" && ru.Type!="-" {
+			skip(fmt.Errorf("%s:%d: invalid type %q",name,n,ru.Type))
+			continue
+		}
+		if unsupportedItems[ru.Item] {
+			skip(&UnsupportedItem{name,n,ru.Item})
+			continue
+		}
+		if _,ok := items[ru.Item]; !ok && !otherItems[ru.Item] {
+			skip(fmt.Errorf("%s:%d: unknown item %q",name,n,ru.Item))
+			continue
+		}
+		if _,err := ru.limit(); err!=nil {
+			skip(fmt.Errorf("%s:%d: %v",name,n,err))
+			continue
+		}
+		rules = append(rules,ru)
+	}
+	return rules,s.Err()
+}
+
+// Returns the value of a resource limit rule in the units of setrlimit().
+func (r *Rule) limit() (uint64,error) {
+	it,ok := items[r.Item]
+	if !ok {
+		// priority and nonewprivs are numbers.
+		if _,err := strconv.Atoi(r.Value); err!=nil { return 0,fmt.Errorf("invalid value %q",r.Value) }
+		return 0,nil
+	}
+	v := strings.ToLower(r.Value)
+	if it.unit==0 {
+		// nice: -20..19, stored as 20-nice.
+		n,err := strconv.Atoi(v)
+		if err!=nil || n < -20 || n>19 { return 0,fmt.Errorf("invalid nice value %q",r.Value) }
+		return uint64(20-n),nil
+	}
+	if v=="unlimited" || v=="infinity" || v=="-1" { return syscall_x.RLIM_INFINITY,nil }
+	n,err := strconv.ParseUint(v,10,64)
+	if err!=nil { return 0,fmt.Errorf("invalid value %q",r.Value) }
+	if n>syscall_x.RLIM_INFINITY/it.unit { return syscall_x.RLIM_INFINITY,nil }
+	return n*it.unit,nil
+}
+
+// A parsed set of limits.conf files.
+type Config struct{
+	Rules   []Rule
+	// The lines, that have been skipped by LoadFiles, as errors.
+	Skipped []error
+}
+
+func (c *Config) parseFile(path string) error {
+	f,err := os.Open(path)
+	if err!=nil { return err }
+	defer f.Close()
+	r,err := parse(f,path,func(err error) { c.Skipped = append(c.Skipped,err) })
+	c.Rules = append(c.Rules,r...)
+	return err
+}
+
+/*
+ Reads file and then the *.conf files in dir, in lexical order, like
+ pam_limits. A missing file or dir is not an error. Like pam_limits, invalid
+ lines and lines with unsupported items are skipped; they are recorded in
+ Skipped, to be logged.
+ */
+func LoadFiles(file string, dir string) (*Config,error) {
+	c := new(Config)
+	if file!="" {
+		err := c.parseFile(file)
+		if err!=nil && !os.IsNotExist(err) { return nil,err }
+	}
+	if dir!="" {
+		fs,err := filepath.Glob(filepath.Join(dir,"*.conf"))
+		if err!=nil { return nil,err }
+		sort.Strings(fs)
+		for _,f := range fs {
+			if err := c.parseFile(f); err!=nil { return nil,err }
+		}
+	}
+	return c,nil
+}
+
+// Reads /etc/security/limits.conf and /etc/security/limits.d/*.conf.
+func Load() (*Config,error) {
+	return LoadFiles(DefaultFile,DefaultDir)
+}
+
+// The account, limits are computed for.
+type Account struct{
+	Name   string
+	Uid    uint32
+	Gid    uint32
+	// Names and ids of all groups, including the primary group.
+	Groups []string
+	Gids   []uint32
+}
+
+// Looks up the account name (and its groups) in the user database.
+func LookupAccount(name string) (*Account,error) {
+	u,err := user.Lookup(name)
+	if err!=nil { return nil,err }
+	a := &Account{Name: u.Username}
+	uid,err := strconv.ParseUint(u.Uid,10,32)
+	if err!=nil { return nil,err }
+	gid,err := strconv.ParseUint(u.Gid,10,32)
+	if err!=nil { return nil,err }
+	a.Uid,a.Gid = uint32(uid),uint32(gid)
+	gids,err := u.GroupIds()
+	if err!=nil { gids = []string{u.Gid} }
+	for _,g := range gids {
+		n,err := strconv.ParseUint(g,10,32)
+		if err!=nil { continue }
+		a.Gids = append(a.Gids,uint32(n))
+		if gr,err := user.LookupGroupId(g); err==nil { a.Groups = append(a.Groups,gr.Name) }
+	}
+	return a,nil
+}
+
+// Precedence of a domain; lower is stronger.
+const (
+	prioUser = iota
+	prioGroup
+	prioAll
+	prioNone
+)
+
+// Parses "min:max", ":max" or "min:" (either bound may be left out).
+func parseRange(s string) (lo, hi uint64, ok bool) {
+	i := strings.IndexByte(s,':')
+	if i<0 { return 0,0,false }
+	lo,hi = 0,^uint64(0)
+	var err error
+	if i>0 {
+		lo,err = strconv.ParseUint(s[:i],10,32)
+		if err!=nil { return 0,0,false }
+	}
+	if i+1<len(s) {
+		hi,err = strconv.ParseUint(s[i+1:],10,32)
+		if err!=nil { return 0,0,false }
+	}
+	return lo,hi,true
+}
+
+func (a *Account) inGroup(name string) bool {
+	for _,g := range a.Groups {
+		if g==name { return true }
+	}
+	return false
+}
+func (a *Account) inGids(lo, hi uint64) bool {
+	for _,g := range a.Gids {
+		if uint64(g)>=lo && uint64(g)<=hi { return true }
+	}
+	return uint64(a.Gid)>=lo && uint64(a.Gid)<=hi
+}
+
+// Returns the precedence of domain for a, or prioNone, if it does not match.
+func (a *Account) match(domain string) int {
+	if domain==a.Name { return prioUser }
+	if lo,hi,ok := parseRange(domain); ok {
+		if uint64(a.Uid)>=lo && uint64(a.Uid)<=hi { return prioUser }
+		return prioNone
+	}
+	if a.Uid==0 { return prioNone }
+	if domain=="*" { return prioAll }
+	if strings.HasPrefix(domain,"@") || strings.HasPrefix(domain,"%") {
+		g := domain[1:]
+		if g=="" { return prioNone }
+		if lo,hi,ok := parseRange(g); ok {
+			if a.inGids(lo,hi) { return prioGroup }
+			return prioNone
+		}
+		if a.inGroup(g) { return prioGroup }
+	}
+	return prioNone
+}
+
+// A soft and hard limit, either of which may be unset.
+type Limit struct{
+	Soft, Hard       uint64
+	HasSoft, HasHard bool
+}
+
+// The limits of an account.
+type Limits struct{
+	// Resource limits by RLIMIT_*.
+	Rlimits map[int]*Limit
+	// Values of the other items ("priority", "nonewprivs").
+	Other   map[string]string
+}
+
+/*
+ Computes the limits of the account a: For every item, the value of the
+ strongest matching entry.
+ */
+func (c *Config) Compute(a *Account) *Limits {
+	l := &Limits{Rlimits: make(map[int]*Limit), Other: make(map[string]string)}
+	type key struct{ item string; hard bool }
+	prio := make(map[key]int)
+	set := func(k key, p int) bool {
+		if q,ok := prio[k]; ok && q<p { return false }
+		prio[k] = p
+		return true
+	}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		p := a.match(r.Domain)
+		if p==prioNone { continue }
+		it,ok := items[r.Item]
+		if !ok {
+			// Not a resource limit; soft or hard makes no difference.
+			if set(key{r.Item,false},p) { l.Other[r.Item] = r.Value }
+			continue
+		}
+		v,err := r.limit()
+		if err!=nil { continue }
+		li := l.Rlimits[it.resource]
+		if li==nil {
+			li = new(Limit)
+			l.Rlimits[it.resource] = li
+		}
+		if r.Type!="hard" && set(key{r.Item,false},p) { li.Soft,li.HasSoft = v,true }
+		if r.Type!="soft" && set(key{r.Item,true},p) { li.Hard,li.HasHard = v,true }
+	}
+	return l
+}
+
+/*
+ Applies the limits to the process pid (0 means the calling process). Unset
+ soft or hard limits keep their current value; a soft limit above the hard
+ limit is lowered to it. The "priority" item is applied as nice value. The
+ "nonewprivs" item can only be applied to the calling process; for another
+ process, it is an error.
+ */
+func (l *Limits) Apply(pid int) error {
+	for res,li := range l.Rlimits {
+		cur,err := syscall_x.GetRlimitOf(pid,res)
+		if err!=nil { return err }
+		if li.HasSoft { cur.Cur = li.Soft }
+		if li.HasHard { cur.Max = li.Hard }
+		if cur.Cur>cur.Max { cur.Cur = cur.Max }
+		err = syscall_x.Prlimit(pid,res,&cur,nil)
+		if err!=nil { return fmt.Errorf("prlimit %d: %v",res,err) }
+	}
+	if p,ok := l.Other["priority"]; ok {
+		n,err := strconv.Atoi(p)
+		if err==nil { err = syscall.Setpriority(syscall.PRIO_PROCESS,pid,n) }
+		if err!=nil { return fmt.Errorf("priority: %v",err) }
+	}
+	if l.noNewPrivs() {
+		if pid!=0 && pid!=os.Getpid() { return fmt.Errorf("nonewprivs: can not be set for process %d",pid) }
+		if err := syscall_x.SetNoNewPrivs(); err!=nil { return fmt.Errorf("nonewprivs: %v",err) }
+	}
+	return nil
+}
+
+func (l *Limits) noNewPrivs() bool {
+	n,err := strconv.Atoi(l.Other["nonewprivs"])
+	return err==nil && n>0
+}
+
+/*
+ Returns the limits as a syscall_x.ExecSetup, e.g. to add further settings
+ before the process is started.
+ */
+func (l *Limits) Setup() (*syscall_x.ExecSetup,error) {
+	s := new(syscall_x.ExecSetup)
+	for res,li := range l.Rlimits {
+		s.Rlimits = append(s.Rlimits,syscall_x.ExecRlimit{Resource: res, Cur: li.Soft, Max: li.Hard, HasCur: li.HasSoft, HasMax: li.HasHard})
+	}
+	if p,ok := l.Other["priority"]; ok {
+		n,err := strconv.Atoi(p)
+		if err!=nil { return nil,fmt.Errorf("priority: %v",err) }
+		s.Priority = &n
+	}
+	s.NoNewPrivs = l.noNewPrivs()
+	return s,nil
+}
+
+/*
+ Starts cmd with the limits applied before the program runs (see
+ syscall_x.ExecSetup; main must call syscall_x.ExecSetupMain first).
+ */
+func (l *Limits) Start(cmd *exec.Cmd) error {
+	s,err := l.Setup()
+	if err!=nil { return err }
+	return s.Start(cmd)
+}
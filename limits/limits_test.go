@@ -0,0 +1,152 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package limits
+
+import "github.com/maxymania/go-system/syscall_x"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "syscall"
+import "testing"
+
+func TestParse(t *testing.T) {
+	data := "# comment\n*  soft  core  0\n\n@users hard nofile 4096 # trailing\nalice - NPROC 100\n1000:1999 soft priority 5\n"
+	rules,unsup,err := Parse(strings.NewReader(data),"limits.conf")
+	if err!=nil || len(unsup)!=0 { t.Fatal(err,unsup) }
+	want := []Rule{
+		{"*","soft","core","0","limits.conf",2},
+		{"@users","hard","nofile","4096","limits.conf",4},
+		{"alice","-","nproc","100","limits.conf",5},
+		{"1000:1999","soft","priority","5","limits.conf",6},
+	}
+	if !reflect.DeepEqual(rules,want) { t.Errorf("got %+v",rules) }
+}
+
+func TestParseErrors(t *testing.T) {
+	for _,tt := range []struct{
+		data, err string
+	}{
+		{"* soft core\n","limits.conf:1: expected 4 fields"},
+		{"*\tsoft core 0 1\n","limits.conf:1: expected 4 fields"},
+		{"\n* both core 0\n","limits.conf:2: invalid type \"both\""},
+		{"* soft bogus 0\n","limits.conf:1: unknown item \"bogus\""},
+		{"* soft nofile many\n","limits.conf:1: invalid value \"many\""},
+		{"* soft nice 20\n","limits.conf:1: invalid nice value \"20\""},
+		{"* soft priority x\n","limits.conf:1: invalid value \"x\""},
+	} {
+		_,_,err := Parse(strings.NewReader(tt.data),"limits.conf")
+		if err==nil || err.Error()!=tt.err { t.Errorf("%q: %v",tt.data,err) }
+	}
+}
+
+func TestParseUnsupported(t *testing.T) {
+	data := "* hard maxlogins 4\n@admin - maxsyslogins 10\nalice - chroot /srv/alice\nalice soft nofile 64\n"
+	rules,unsup,err := Parse(strings.NewReader(data),"limits.conf")
+	if err!=nil { t.Fatal(err) }
+	if len(rules)!=1 || rules[0].Item!="nofile" { t.Errorf("rules %+v",rules) }
+	want := []*UnsupportedItem{
+		{"limits.conf",1,"maxlogins"},
+		{"limits.conf",2,"maxsyslogins"},
+		{"limits.conf",3,"chroot"},
+	}
+	if !reflect.DeepEqual(unsup,want) { t.Errorf("unsupported %+v",unsup) }
+	if s := unsup[0].Error(); s!="limits.conf:1: unsupported item \"maxlogins\"" { t.Errorf("error %q",s) }
+	// An invalid line is still an error.
+	if _,_,err = Parse(strings.NewReader(data+"x\n"),"limits.conf"); err==nil { t.Error("no error") }
+}
+
+func TestLimitValues(t *testing.T) {
+	for _,tt := range []struct{
+		item, value string
+		v uint64
+	}{
+		{"core","10",10*1024},
+		{"cpu","2",120},
+		{"nofile","unlimited",syscall_x.RLIM_INFINITY},
+		{"stack","-1",syscall_x.RLIM_INFINITY},
+		{"as","infinity",syscall_x.RLIM_INFINITY},
+		{"fsize","18446744073709551615",syscall_x.RLIM_INFINITY},
+		{"nice","-20",40},
+		{"nice","19",1},
+	} {
+		r := Rule{Item: tt.item, Value: tt.value}
+		v,err := r.limit()
+		if err!=nil || v!=tt.v { t.Errorf("%s %s: %d %v",tt.item,tt.value,v,err) }
+	}
+}
+
+func TestLoadFiles(t *testing.T) {
+	d,err := ioutil.TempDir("","limitstest")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(d)
+	dir := filepath.Join(d,"limits.d")
+	os.Mkdir(dir,0755)
+	ioutil.WriteFile(filepath.Join(d,"limits.conf"),[]byte("* soft nofile 100\n* hard maxlogins 2\n"),0644)
+	ioutil.WriteFile(filepath.Join(dir,"20-b.conf"),[]byte("* soft nofile 300\n"),0644)
+	ioutil.WriteFile(filepath.Join(dir,"10-a.conf"),[]byte("* soft nofile 200\nbad line\n"),0644)
+	ioutil.WriteFile(filepath.Join(dir,"30-c.disabled"),[]byte("* soft nofile 400\n"),0644)
+	c,err := LoadFiles(filepath.Join(d,"limits.conf"),dir)
+	if err!=nil { t.Fatal(err) }
+	if len(c.Rules)!=3 || c.Rules[1].Value!="200" || c.Rules[2].Value!="300" { t.Errorf("rules %+v",c.Rules) }
+	if len(c.Skipped)!=2 { t.Errorf("skipped %v",c.Skipped) }
+	l := c.Compute(&Account{Name: "alice", Uid: 1000})
+	if li := l.Rlimits[syscall.RLIMIT_NOFILE]; li==nil || li.Soft!=300 || li.HasHard { t.Errorf("nofile %+v",li) }
+	if c,err = LoadFiles(filepath.Join(d,"missing"),filepath.Join(d,"missing.d")); err!=nil || len(c.Rules)!=0 { t.Errorf("missing: %+v %v",c,err) }
+}
+
+func TestCompute(t *testing.T) {
+	data := `*          -     nofile    100
+@users     -     nofile    200
+alice      soft  nofile    300
+%staff     hard  core      0
+@1000:1999 soft  core      10
+500:       hard  nproc     50
+*          -     priority  10
+@users     -     priority  5
+*          -     nonewprivs 1
+`
+	rules,_,err := Parse(strings.NewReader(data),"limits.conf")
+	if err!=nil { t.Fatal(err) }
+	c := &Config{Rules: rules}
+	lim := func(l *Limits, res int) Limit {
+		if li := l.Rlimits[res]; li!=nil { return *li }
+		return Limit{}
+	}
+	// User entries before group entries before the wildcard.
+	a := &Account{Name: "alice", Uid: 1000, Gid: 1000, Groups: []string{"alice","users"}, Gids: []uint32{1000,100}}
+	l := c.Compute(a)
+	if li := lim(l,syscall.RLIMIT_NOFILE); li!=(Limit{300,200,true,true}) { t.Errorf("alice nofile %+v",li) }
+	if li := lim(l,syscall.RLIMIT_CORE); li!=(Limit{10*1024,0,true,false}) { t.Errorf("alice core %+v",li) }
+	if li := lim(l,syscall_x.RLIMIT_NPROC); li!=(Limit{0,50,false,true}) { t.Errorf("alice nproc %+v",li) }
+	if !reflect.DeepEqual(l.Other,map[string]string{"priority": "5", "nonewprivs": "1"}) { t.Errorf("alice other %v",l.Other) }
+	// Only the wildcard matches.
+	b := &Account{Name: "bob", Uid: 400, Gid: 400, Groups: []string{"bob"}, Gids: []uint32{400}}
+	l = c.Compute(b)
+	if li := lim(l,syscall.RLIMIT_NOFILE); li!=(Limit{100,100,true,true}) { t.Errorf("bob nofile %+v",li) }
+	if _,ok := l.Rlimits[syscall.RLIMIT_CORE]; ok { t.Errorf("bob core %+v",l.Rlimits) }
+	// Group and wildcard entries do not apply to root.
+	l = c.Compute(&Account{Name: "root", Uid: 0, Gid: 0, Groups: []string{"root","staff","users"}})
+	if len(l.Rlimits)!=0 || len(l.Other)!=0 { t.Errorf("root %+v %v",l.Rlimits,l.Other) }
+}
+
+func TestSetup(t *testing.T) {
+	l := &Limits{
+		Rlimits: map[int]*Limit{syscall.RLIMIT_NOFILE: {64,128,true,true}},
+		Other:   map[string]string{"priority": "3", "nonewprivs": "1"},
+	}
+	s,err := l.Setup()
+	if err!=nil { t.Fatal(err) }
+	if len(s.Rlimits)!=1 || s.Rlimits[0]!=(syscall_x.ExecRlimit{Resource: syscall.RLIMIT_NOFILE, Cur: 64, Max: 128, HasCur: true, HasMax: true}) { t.Errorf("rlimits %+v",s.Rlimits) }
+	if s.Priority==nil || *s.Priority!=3 || !s.NoNewPrivs { t.Errorf("setup %+v",s) }
+	l.Other["priority"] = "x"
+	if _,err = l.Setup(); err==nil { t.Error("invalid priority accepted") }
+}
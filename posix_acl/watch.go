@@ -0,0 +1,355 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package posix_acl
+
+import "github.com/maxymania/go-system/syscall_x"
+import "os"
+import "path/filepath"
+import "sync"
+import "syscall"
+
+/*
+ A change of an ACL. Before or After is nil, if the ACL did not exist.
+ */
+type Change struct{
+	Path    string
+	Type    AclType
+	Before  *Acl
+	After   *Acl
+	// Entries of After, that are not in Before, and vice versa. A changed
+	// permission shows up as removed and added entry.
+	Added   []AclElement
+	Removed []AclElement
+}
+
+// Returns the entries of a, that are not in b.
+func aclMinus(a, b *Acl) []AclElement {
+	if a==nil { return nil }
+	var r []AclElement
+	outer:
+	for _,e := range a.List {
+		if b!=nil {
+			for _,f := range b.List {
+				if e==f { continue outer }
+			}
+		}
+		r = append(r,e)
+	}
+	return r
+}
+
+/*
+ Compares two versions of an ACL. Returns nil, if they are equal.
+ */
+func Diff(path string, t AclType, before, after *Acl) *Change {
+	c := &Change{Path: path, Type: t, Before: before, After: after}
+	c.Added = aclMinus(after,before)
+	c.Removed = aclMinus(before,after)
+	if len(c.Added)==0 && len(c.Removed)==0 && (before==nil)==(after==nil) { return nil }
+	return c
+}
+
+/*
+ Like Load, but does not follow symlinks, and returns nil (and no error), if
+ the file has no such ACL.
+ */
+func LoadL(fn string, t AclType) (*Acl,error) {
+	sz,err := syscall_x.Lgetxattr(fn,string(t),nil)
+	if err==nil {
+		buffer := make([]byte,sz)
+		sz,err = syscall_x.Lgetxattr(fn,string(t),buffer)
+		if err==nil {
+			a := new(Acl)
+			a.Decode(buffer[:sz])
+			return a,nil
+		}
+	}
+	switch err {
+	case syscall.ENODATA,syscall.ENOTSUP,syscall.ENOENT: return nil,nil
+	}
+	return nil,err
+}
+
+type aclPair [2]*Acl
+
+func loadPair(path string) (aclPair,error) {
+	var p aclPair
+	var err error
+	p[0],err = LoadL(path,ACL_ACCESS)
+	if err!=nil { return p,err }
+	p[1],err = LoadL(path,ACL_DEFAULTS)
+	return p,err
+}
+
+// The event source of a Watcher.
+type backend interface{
+	// Watches a file or directory; on directories, the entries, too.
+	add(path string, dir bool) error
+	// Reads the next events; returns the paths, that changed, and the
+	// directories, that have been created.
+	read(buf []byte) (changed []string, created []string, err error)
+	close() error
+}
+
+/*
+ Watches files and directory trees for changes of their ACLs. Whenever the
+ attributes of a watched file change, its access and default ACL are re-read
+ and compared to the previous version; differences are sent to Changes.
+
+ Uses fanotify (with FAN_REPORT_DFID_NAME, which does not require privileges
+ since Linux 5.13), or inotify, where fanotify is not available.
+ */
+type Watcher struct{
+	Changes chan Change
+	Errors  chan error
+	b       backend
+	mu      sync.Mutex
+	acls    map[string]aclPair
+	trees   map[string]bool
+}
+
+// Creates a Watcher using fanotify, or inotify as fallback.
+func NewWatcher() (*Watcher,error) {
+	b,err := newFanotify()
+	if err!=nil {
+		b,err = newInotify()
+		if err!=nil { return nil,err }
+	}
+	return newWatcher(b),nil
+}
+
+// Creates a Watcher using inotify.
+func NewInotifyWatcher() (*Watcher,error) {
+	b,err := newInotify()
+	if err!=nil { return nil,err }
+	return newWatcher(b),nil
+}
+
+func newWatcher(b backend) *Watcher {
+	w := &Watcher{
+		Changes: make(chan Change,64),
+		Errors: make(chan error,1),
+		b: b,
+		acls: make(map[string]aclPair),
+		trees: make(map[string]bool),
+	}
+	go w.run()
+	return w
+}
+
+func (w *Watcher) snapshot(path string) {
+	p,err := loadPair(path)
+	if err==nil { w.acls[path] = p }
+}
+
+func (w *Watcher) add(path string, tree bool) error {
+	path = filepath.Clean(path)
+	fi,err := os.Lstat(path)
+	if err!=nil { return err }
+	dir := fi.IsDir()
+	err = w.b.add(path,dir)
+	if err!=nil { return err }
+	w.snapshot(path)
+	if !dir { return nil }
+	if tree { w.trees[path] = true }
+	f,err := os.Open(path)
+	if err!=nil { return err }
+	names,err := f.Readdirnames(-1)
+	f.Close()
+	if err!=nil { return err }
+	for _,n := range names {
+		p := filepath.Join(path,n)
+		w.snapshot(p)
+		if tree {
+			if fi,err := os.Lstat(p); err==nil && fi.IsDir() {
+				err = w.add(p,true)
+				if err!=nil { return err }
+			}
+		}
+	}
+	return nil
+}
+
+// Watches a file, or a directory and its entries.
+func (w *Watcher) Add(path string) error {
+	w.mu.Lock(); defer w.mu.Unlock()
+	return w.add(path,false)
+}
+
+/*
+ Watches a directory tree. Directories, that are created later, are watched
+ as well.
+ */
+func (w *Watcher) AddTree(path string) error {
+	w.mu.Lock(); defer w.mu.Unlock()
+	return w.add(path,true)
+}
+
+// Stops the Watcher. Changes and Errors are closed.
+func (w *Watcher) Close() error {
+	return w.b.close()
+}
+
+func (w *Watcher) check(path string, r []Change) []Change {
+	p,err := loadPair(path)
+	if err!=nil { return r }
+	old := w.acls[path]
+	w.acls[path] = p
+	for i,t := range []AclType{ACL_ACCESS,ACL_DEFAULTS} {
+		if c := Diff(path,t,old[i],p[i]); c!=nil { r = append(r,*c) }
+	}
+	return r
+}
+
+func (w *Watcher) run() {
+	defer close(w.Errors)
+	defer close(w.Changes)
+	buf := make([]byte,1<<16)
+	for {
+		changed,created,err := w.b.read(buf)
+		if err!=nil {
+			if pe,ok := err.(*os.PathError); ok && pe.Err==os.ErrClosed { return }
+			w.Errors <- err
+			return
+		}
+		var cs []Change
+		w.mu.Lock()
+		for _,d := range created {
+			if w.trees[filepath.Dir(d)] { w.add(d,true) }
+		}
+		for _,p := range changed { cs = w.check(p,cs) }
+		w.mu.Unlock()
+		for _,c := range cs { w.Changes <- c }
+	}
+}
+
+/* -------------------------------- fanotify -------------------------------- */
+
+type fanotifyBackend struct{
+	fd   int
+	// Wraps fd, so that Close() interrupts a pending read.
+	f    *os.File
+	mu   sync.Mutex
+	// Directories by handle (FileHandle.Key).
+	dirs map[string]string
+}
+
+func newFanotify() (backend,error) {
+	fd,err := syscall_x.FanotifyInit(syscall_x.FAN_CLASS_NOTIF|syscall_x.FAN_CLOEXEC|syscall_x.FAN_NONBLOCK|
+		syscall_x.FAN_REPORT_DFID_NAME,syscall.O_RDONLY|syscall.O_CLOEXEC)
+	if err!=nil { return nil,err }
+	return &fanotifyBackend{fd: fd, f: os.NewFile(uintptr(fd),"fanotify"), dirs: make(map[string]string)},nil
+}
+
+func fsid(st *syscall.Statfs_t) [2]int32 {
+	return [2]int32{st.Fsid.X__val[0],st.Fsid.X__val[1]}
+}
+
+func handleKey(path string) (string,error) {
+	h,_,err := syscall_x.NameToHandleAt(syscall_x.AT_FDCWD,path,0)
+	if err!=nil { return "",err }
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path,&st)
+	if err!=nil { return "",err }
+	return h.Key(fsid(&st)),nil
+}
+
+func (b *fanotifyBackend) add(path string, dir bool) error {
+	// Events are reported with the handle of the parent directory and the
+	// name, or for directories with their own handle and ".".
+	d := path
+	if !dir { d = filepath.Dir(path) }
+	k,err := handleKey(d)
+	if err!=nil { return err }
+	var mask uint64 = syscall_x.FAN_ATTRIB
+	if dir { mask |= syscall_x.FAN_ONDIR|syscall_x.FAN_EVENT_ON_CHILD|syscall_x.FAN_CREATE }
+	err = syscall_x.FanotifyMark(b.fd,syscall_x.FAN_MARK_ADD|syscall_x.FAN_MARK_DONT_FOLLOW,mask,syscall_x.AT_FDCWD,path)
+	if err!=nil { return err }
+	b.mu.Lock()
+	b.dirs[k] = d
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *fanotifyBackend) read(buf []byte) ([]string,[]string,error) {
+	n,err := b.f.Read(buf)
+	if err!=nil { return nil,nil,err }
+	evs,err := syscall_x.ParseFanotifyEvents(buf[:n])
+	if err!=nil { return nil,nil,err }
+	var changed,created []string
+	b.mu.Lock(); defer b.mu.Unlock()
+	for i := range evs {
+		ev := &evs[i]
+		if ev.Fd>=0 { syscall.Close(ev.Fd) }
+		in := ev.Info(syscall_x.FAN_EVENT_INFO_TYPE_DFID_NAME)
+		if in==nil { continue }
+		d,ok := b.dirs[in.Handle.Key(in.Fsid)]
+		if !ok { continue }
+		p := d
+		if in.Name!="." && in.Name!="" { p = filepath.Join(d,in.Name) }
+		if ev.Mask&syscall_x.FAN_CREATE!=0 {
+			if ev.Mask&syscall_x.FAN_ONDIR!=0 { created = append(created,p) }
+			// A new file may carry a default ACL of the directory.
+			changed = append(changed,p)
+		}
+		if ev.Mask&syscall_x.FAN_ATTRIB!=0 { changed = append(changed,p) }
+	}
+	return changed,created,nil
+}
+
+func (b *fanotifyBackend) close() error { return b.f.Close() }
+
+/* -------------------------------- inotify --------------------------------- */
+
+type inotifyBackend struct{
+	fd    int
+	f     *os.File
+	mu    sync.Mutex
+	paths map[int]string
+}
+
+func newInotify() (backend,error) {
+	fd,err := syscall.InotifyInit1(syscall.IN_CLOEXEC|syscall.IN_NONBLOCK)
+	if err!=nil { return nil,err }
+	return &inotifyBackend{fd: fd, f: os.NewFile(uintptr(fd),"inotify"), paths: make(map[int]string)},nil
+}
+
+func (b *inotifyBackend) add(path string, dir bool) error {
+	var mask uint32 = syscall.IN_ATTRIB|syscall.IN_DONT_FOLLOW
+	if dir { mask |= syscall.IN_CREATE }
+	wd,err := syscall.InotifyAddWatch(b.fd,path,mask)
+	if err!=nil { return err }
+	b.mu.Lock()
+	b.paths[wd] = path
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *inotifyBackend) read(buf []byte) ([]string,[]string,error) {
+	n,err := b.f.Read(buf)
+	if err!=nil { return nil,nil,err }
+	var changed,created []string
+	b.mu.Lock(); defer b.mu.Unlock()
+	for _,ev := range syscall_x.ParseInotifyEvents(buf[:n]) {
+		d,ok := b.paths[ev.Wd]
+		if !ok { continue }
+		if ev.Mask&syscall.IN_IGNORED!=0 { delete(b.paths,ev.Wd); continue }
+		p := d
+		if ev.Name!="" { p = filepath.Join(d,ev.Name) }
+		if ev.Mask&syscall.IN_CREATE!=0 {
+			if ev.Mask&syscall.IN_ISDIR!=0 { created = append(created,p) }
+			changed = append(changed,p)
+		}
+		if ev.Mask&syscall.IN_ATTRIB!=0 { changed = append(changed,p) }
+	}
+	return changed,created,nil
+}
+
+func (b *inotifyBackend) close() error { return b.f.Close() }
@@ -0,0 +1,86 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package seccomp
+
+import "syscall"
+import "errors"
+
+var ErrTooComplex = errors.New("seccomp: rule too complex (jump out of range)")
+
+const op_LD  = syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS
+const op_AND = syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K
+const op_JA  = syscall.BPF_JMP|syscall.BPF_JA
+const op_JEQ = syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K
+const op_JGT = syscall.BPF_JMP|syscall.BPF_JGT|syscall.BPF_K
+const op_JGE = syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K
+const op_RET = syscall.BPF_RET|syscall.BPF_K
+
+// A jump target. next means "the following instruction".
+type label int
+const next = label(-1)
+
+type insn struct{
+	code   uint16
+	k      uint32
+	jt, jf label
+}
+
+// A tiny assembler for classic BPF with symbolic jump targets.
+type assembler struct{
+	code   []insn
+	labels []int
+}
+
+func (a *assembler) newLabel() label {
+	a.labels = append(a.labels,-1)
+	return label(len(a.labels)-1)
+}
+func (a *assembler) bind(l label) {
+	a.labels[l] = len(a.code)
+}
+func (a *assembler) stmt(code uint16, k uint32) {
+	a.code = append(a.code,insn{code,k,next,next})
+}
+func (a *assembler) jump(code uint16, k uint32, jt, jf label) {
+	a.code = append(a.code,insn{code,k,jt,jf})
+}
+// Unconditional jump; jt holds the target, the offset is 32 bit.
+func (a *assembler) ja(l label) {
+	a.code = append(a.code,insn{op_JA,0,l,next})
+}
+
+func (a *assembler) offset(i int, l label) (uint32,error) {
+	if l==next { return 0,nil }
+	t := a.labels[l]
+	if t<=i { return 0,ErrTooComplex }
+	return uint32(t-i-1),nil
+}
+
+func (a *assembler) assemble() ([]syscall.SockFilter,error) {
+	if len(a.code)>0xffff { return nil,ErrTooComplex }
+	r := make([]syscall.SockFilter,len(a.code))
+	for i,c := range a.code {
+		r[i].Code = c.code
+		r[i].K = c.k
+		jt,err := a.offset(i,c.jt)
+		if err!=nil { return nil,err }
+		if c.code==op_JA {
+			r[i].K = jt
+			continue
+		}
+		jf,err := a.offset(i,c.jf)
+		if err!=nil { return nil,err }
+		if jt>255 || jf>255 { return nil,ErrTooComplex }
+		r[i].Jt = uint8(jt)
+		r[i].Jf = uint8(jf)
+	}
+	return r,nil
+}
+
@@ -0,0 +1,285 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+/*
+ A seccomp-BPF filter builder and loader in pure Go (no cgo, no libseccomp).
+
+	f := seccomp.NewFilter(seccomp.ActErrno(syscall.EPERM))
+	f.Allow(syscall.SYS_READ,syscall.SYS_WRITE,syscall.SYS_EXIT_GROUP)
+	f.Add(syscall.SYS_SOCKET,seccomp.ActAllow,seccomp.Arg(0).Eq(syscall.AF_UNIX))
+	f.Load(syscall_x.SECCOMP_FILTER_FLAG_TSYNC)
+
+ Rules are evaluated in the order, they were added. The first rule, that
+ matches the system call and all of its conditions, decides. If no rule
+ matches, the default action is taken. System calls are given as numbers of
+ the current architecture (syscall.SYS_*).
+ */
+package seccomp
+
+import "github.com/maxymania/go-system/syscall_x"
+import "syscall"
+import "runtime"
+import "unsafe"
+
+// A seccomp return value (SECCOMP_RET_*).
+type Action uint32
+
+const ActKillProcess = Action(syscall_x.SECCOMP_RET_KILL_PROCESS)
+const ActKillThread  = Action(syscall_x.SECCOMP_RET_KILL_THREAD)
+const ActTrap        = Action(syscall_x.SECCOMP_RET_TRAP)
+const ActNotify      = Action(syscall_x.SECCOMP_RET_USER_NOTIF)
+const ActLog         = Action(syscall_x.SECCOMP_RET_LOG)
+const ActAllow       = Action(syscall_x.SECCOMP_RET_ALLOW)
+
+// Fails the system call with the given error.
+func ActErrno(e syscall.Errno) Action {
+	return Action(syscall_x.SECCOMP_RET_ERRNO|(uint32(e)&syscall_x.SECCOMP_RET_DATA))
+}
+// Notifies a ptrace()-tracer with the given message.
+func ActTrace(msg uint16) Action {
+	return Action(syscall_x.SECCOMP_RET_TRACE|uint32(msg))
+}
+
+// Comparison operators. Values are compared unsigned and 64 bit wide.
+type Op int
+const (
+	EQ Op = iota
+	NE
+	LT
+	LE
+	GT
+	GE
+	// (arg & Mask) == Value
+	MaskedEQ
+)
+
+// A condition on a system call argument.
+type Cond struct{
+	Arg   uint
+	Op    Op
+	Value uint64
+	Mask  uint64
+}
+
+// The n-th argument (0-5) of a system call.
+type Arg uint
+
+func (a Arg) Eq(v uint64) Cond { return Cond{uint(a),EQ,v,0} }
+func (a Arg) Ne(v uint64) Cond { return Cond{uint(a),NE,v,0} }
+func (a Arg) Lt(v uint64) Cond { return Cond{uint(a),LT,v,0} }
+func (a Arg) Le(v uint64) Cond { return Cond{uint(a),LE,v,0} }
+func (a Arg) Gt(v uint64) Cond { return Cond{uint(a),GT,v,0} }
+func (a Arg) Ge(v uint64) Cond { return Cond{uint(a),GE,v,0} }
+func (a Arg) MaskedEq(mask, v uint64) Cond { return Cond{uint(a),MaskedEQ,v,mask} }
+
+type rule struct{
+	act   Action
+	conds []Cond
+}
+
+type Filter struct{
+	// Taken, if no rule matches.
+	Default Action
+	// Taken for system calls of a foreign architecture (e.g. i386 or x32
+	// system calls of an amd64 process). Defaults to ActKillProcess.
+	BadArch Action
+	order   []int
+	rules   map[int][]rule
+}
+
+func NewFilter(def Action) *Filter {
+	f := new(Filter)
+	f.Default = def
+	f.BadArch = ActKillProcess
+	f.rules = make(map[int][]rule)
+	return f
+}
+
+/*
+ Adds a rule: If system call nr is invoked and all conditions are met, act is
+ taken.
+ */
+func (f *Filter) Add(nr int, act Action, conds ...Cond) *Filter {
+	if _,ok := f.rules[nr]; !ok { f.order = append(f.order,nr) }
+	f.rules[nr] = append(f.rules[nr],rule{act,conds})
+	return f
+}
+// Allows the system calls unconditionally.
+func (f *Filter) Allow(nrs ...int) *Filter {
+	for _,nr := range nrs { f.Add(nr,ActAllow) }
+	return f
+}
+// Fails the system calls with the error e.
+func (f *Filter) Deny(e syscall.Errno, nrs ...int) *Filter {
+	for _,nr := range nrs { f.Add(nr,ActErrno(e)) }
+	return f
+}
+// Kills the process, if one of the system calls is invoked.
+func (f *Filter) Kill(nrs ...int) *Filter {
+	for _,nr := range nrs { f.Add(nr,ActKillProcess) }
+	return f
+}
+// Logs the system calls and allows them.
+func (f *Filter) Log(nrs ...int) *Filter {
+	for _,nr := range nrs { f.Add(nr,ActLog) }
+	return f
+}
+// Passes the system calls to the supervisor (the notification fd).
+func (f *Filter) Notify(nrs ...int) *Filter {
+	for _,nr := range nrs { f.Add(nr,ActNotify) }
+	return f
+}
+
+func (f *Filter) uses(act Action) bool {
+	if f.Default==act || f.BadArch==act { return true }
+	for _,rs := range f.rules {
+		for _,r := range rs {
+			if r.act==act { return true }
+		}
+	}
+	return false
+}
+
+func isBigEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x))==0
+}
+
+// Returns the offsets of the low and high word of an argument.
+func argOffsets(n uint) (lo,hi uint32) {
+	off := uint32(syscall_x.SECCOMP_DATA_ARGS+8*n)
+	if isBigEndian() { return off+4,off }
+	return off,off+4
+}
+
+func emitCond(a *assembler, c Cond, fail label) {
+	lo,hi := argOffsets(c.Arg)
+	vlo,vhi := uint32(c.Value),uint32(c.Value>>32)
+	ok := a.newLabel()
+	switch c.Op {
+	case EQ,MaskedEQ:
+		a.stmt(op_LD,hi)
+		if c.Op==MaskedEQ { a.stmt(op_AND,uint32(c.Mask>>32)) }
+		a.jump(op_JEQ,vhi,next,fail)
+		a.stmt(op_LD,lo)
+		if c.Op==MaskedEQ { a.stmt(op_AND,uint32(c.Mask)) }
+		a.jump(op_JEQ,vlo,next,fail)
+	case NE:
+		a.stmt(op_LD,hi)
+		a.jump(op_JEQ,vhi,next,ok)
+		a.stmt(op_LD,lo)
+		a.jump(op_JEQ,vlo,fail,next)
+	case GT,GE:
+		a.stmt(op_LD,hi)
+		a.jump(op_JGT,vhi,ok,next)
+		a.jump(op_JEQ,vhi,next,fail)
+		a.stmt(op_LD,lo)
+		if c.Op==GT {
+			a.jump(op_JGT,vlo,next,fail)
+		} else {
+			a.jump(op_JGE,vlo,next,fail)
+		}
+	case LT,LE:
+		a.stmt(op_LD,hi)
+		a.jump(op_JGT,vhi,fail,next)
+		a.jump(op_JEQ,vhi,next,ok)
+		a.stmt(op_LD,lo)
+		if c.Op==LT {
+			a.jump(op_JGE,vlo,fail,next)
+		} else {
+			a.jump(op_JGT,vlo,fail,next)
+		}
+	default:
+		// Unknown operator, never matches.
+		a.ja(fail)
+	}
+	a.bind(ok)
+}
+
+/*
+ Compiles the filter to classic BPF for the current architecture.
+ */
+func (f *Filter) Compile() ([]syscall.SockFilter,error) {
+	a := new(assembler)
+	// Returns right away, as conditional jumps reach 255 instructions only.
+	archOk := a.newLabel()
+	a.stmt(op_LD,syscall_x.SECCOMP_DATA_ARCH)
+	a.jump(op_JEQ,syscall_x.AUDIT_ARCH_NATIVE,archOk,next)
+	a.stmt(op_RET,uint32(f.BadArch))
+	a.bind(archOk)
+	a.stmt(op_LD,syscall_x.SECCOMP_DATA_NR)
+	if runtime.GOARCH=="amd64" {
+		// x32 system calls have the same AUDIT_ARCH.
+		nrOk := a.newLabel()
+		a.jump(op_JGE,0x40000000,next,nrOk)
+		a.stmt(op_RET,uint32(f.BadArch))
+		a.bind(nrOk)
+	}
+	blocks := make([]label,len(f.order))
+	for i,nr := range f.order {
+		blocks[i] = a.newLabel()
+		skip := a.newLabel()
+		a.jump(op_JEQ,uint32(nr),next,skip)
+		a.ja(blocks[i])
+		a.bind(skip)
+	}
+	a.stmt(op_RET,uint32(f.Default))
+	for i,nr := range f.order {
+		a.bind(blocks[i])
+		for _,r := range f.rules[nr] {
+			fail := a.newLabel()
+			for _,c := range r.conds {
+				emitCond(a,c,fail)
+			}
+			a.stmt(op_RET,uint32(r.act))
+			a.bind(fail)
+		}
+		a.stmt(op_RET,uint32(f.Default))
+	}
+	return a.assemble()
+}
+
+/*
+ Compiles and loads the filter. flags are SECCOMP_FILTER_FLAG_* (see
+ syscall_x); with SECCOMP_FILTER_FLAG_TSYNC the filter is applied to all
+ threads of the process, otherwise only to the calling one
+ (use runtime.LockOSThread).
+
+ no_new_privs is set before. If the filter uses ActNotify,
+ SECCOMP_FILTER_FLAG_NEW_LISTENER is implied and the notification fd is
+ returned.
+ */
+func (f *Filter) Load(flags int) (int,error) {
+	prog,err := f.Compile()
+	if err!=nil { return -1,err }
+	if f.uses(ActNotify) {
+		flags |= syscall_x.SECCOMP_FILTER_FLAG_NEW_LISTENER
+		if (flags&syscall_x.SECCOMP_FILTER_FLAG_TSYNC)!=0 {
+			flags |= syscall_x.SECCOMP_FILTER_FLAG_TSYNC_ESRCH
+		}
+	}
+	err = syscall_x.SetNoNewPrivs()
+	if err!=nil { return -1,err }
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	return syscall_x.SeccompSetFilter(flags,&fprog)
+}
+
+/*
+ Loads the filter on the calling thread and replaces the process by argv0.
+ Useful for a small wrapper, that runs forced commands or restricted shells.
+ Only returns on error.
+ */
+func (f *Filter) Exec(argv0 string, argv []string, envv []string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	_,err := f.Load(0)
+	if err!=nil { return err }
+	return syscall.Exec(argv0,argv,envv)
+}
+
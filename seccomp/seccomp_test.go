@@ -0,0 +1,120 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package seccomp
+
+import "github.com/maxymania/go-system/syscall_x"
+import "runtime"
+import "syscall"
+import "testing"
+import "unsafe"
+
+// struct seccomp_data
+type seccompData struct{
+	nr   int32
+	arch uint32
+	ip   uint64
+	args [6]uint64
+}
+
+// Runs the program like the kernel does, for the instructions the compiler emits.
+func run(t *testing.T, prog []syscall.SockFilter, d seccompData) Action {
+	b := (*[64]byte)(unsafe.Pointer(&d))
+	var acc uint32
+	for pc := 0; pc<len(prog); pc++ {
+		in := prog[pc]
+		switch in.Code {
+		case op_LD:
+			if in.K%4!=0 || in.K>=64 { t.Fatalf("%d: load from %d",pc,in.K) }
+			acc = *(*uint32)(unsafe.Pointer(&b[in.K]))
+		case op_AND:
+			acc &= in.K
+		case op_JA:
+			pc += int(in.K)
+		case op_JEQ,op_JGT,op_JGE:
+			c := acc==in.K
+			if in.Code==op_JGT { c = acc>in.K }
+			if in.Code==op_JGE { c = acc>=in.K }
+			if c { pc += int(in.Jt) } else { pc += int(in.Jf) }
+		case op_RET:
+			return Action(in.K)
+		default:
+			t.Fatalf("%d: unknown instruction %#x",pc,in.Code)
+		}
+	}
+	t.Fatal("no return")
+	return 0
+}
+
+func call(nr int, args ...uint64) seccompData {
+	d := seccompData{nr: int32(nr), arch: syscall_x.AUDIT_ARCH_NATIVE}
+	copy(d.args[:],args)
+	return d
+}
+
+func TestCompileLargeAllowlist(t *testing.T) {
+	f := NewFilter(ActErrno(syscall.EPERM))
+	for nr := 0; nr<400; nr++ { f.Allow(nr) }
+	f.Add(1000,ActLog,Arg(0).Eq(1))
+	prog,err := f.Compile()
+	if err!=nil { t.Fatal(err) }
+	for _,nr := range []int{0,1,199,399} {
+		if a := run(t,prog,call(nr)); a!=ActAllow { t.Errorf("%d: %#x",nr,a) }
+	}
+	if a := run(t,prog,call(400)); a!=ActErrno(syscall.EPERM) { t.Errorf("400: %#x",a) }
+	if a := run(t,prog,call(1000,1)); a!=ActLog { t.Errorf("1000: %#x",a) }
+	d := call(0)
+	d.arch = 0x12345678
+	if a := run(t,prog,d); a!=ActKillProcess { t.Errorf("foreign arch: %#x",a) }
+}
+
+func TestCompileArch(t *testing.T) {
+	f := NewFilter(ActAllow)
+	f.BadArch = ActErrno(syscall.ENOSYS)
+	prog,err := f.Compile()
+	if err!=nil { t.Fatal(err) }
+	d := call(syscall.SYS_GETPID)
+	if a := run(t,prog,d); a!=ActAllow { t.Errorf("native: %#x",a) }
+	d.arch = 0x40000003 // i386
+	if runtime.GOARCH=="386" { d.arch = 0xC000003E }
+	if a := run(t,prog,d); a!=f.BadArch { t.Errorf("foreign arch: %#x",a) }
+	// x32 system calls set bit 30 of the number.
+	d = call(0x40000000|syscall.SYS_GETPID)
+	want := ActAllow
+	if runtime.GOARCH=="amd64" { want = f.BadArch }
+	if a := run(t,prog,d); a!=want { t.Errorf("x32: %#x",a) }
+}
+
+func TestCompileConds(t *testing.T) {
+	f := NewFilter(ActErrno(syscall.EPERM))
+	f.Add(1,ActAllow,Arg(0).Eq(1<<32|5),Arg(1).Ne(7))
+	f.Add(1,ActLog,Arg(2).MaskedEq(0xff00,0x1200))
+	f.Add(2,ActAllow,Arg(0).Lt(10))
+	f.Add(2,ActLog,Arg(0).Ge(1<<32))
+	f.Add(3,ActAllow,Arg(5).Gt(1<<32),Arg(5).Le(2<<32))
+	prog,err := f.Compile()
+	if err!=nil { t.Fatal(err) }
+	eperm := ActErrno(syscall.EPERM)
+	for _,tt := range []struct{ d seccompData; want Action }{
+		{call(1,1<<32|5,0),ActAllow},
+		{call(1,5,0),eperm},
+		{call(1,1<<32|5,7),eperm},
+		{call(1,0,0,0x12ab),ActLog},
+		{call(2,9),ActAllow},
+		{call(2,10),eperm},
+		{call(2,1<<32),ActLog},
+		{call(3,0,0,0,0,0,1<<32),eperm},
+		{call(3,0,0,0,0,0,1<<32+1),ActAllow},
+		{call(3,0,0,0,0,0,2<<32),ActAllow},
+		{call(3,0,0,0,0,0,2<<32+1),eperm},
+		{call(4),eperm},
+	} {
+		if a := run(t,prog,tt.d); a!=tt.want { t.Errorf("%+v: %#x, want %#x",tt.d,a,tt.want) }
+	}
+}
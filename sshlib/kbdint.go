@@ -0,0 +1,41 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package sshlib
+
+import "golang.org/x/crypto/ssh"
+import "errors"
+
+// A question of a keyboard-interactive challenge.
+type Question struct{
+	Prompt string
+	// The answer may be shown, as it is typed.
+	Echo   bool
+}
+
+var errAnswers = errors.New("ssh: wrong number of answers")
+
+/*
+ Returns a ssh.ServerConfig.KeyboardInteractiveCallback, that asks all the
+ questions in one challenge, and passes the answers to check, e.g.
+ "Password: " and "Verification code: " for a password plus a one-time code.
+ */
+func KeyboardInteractive(instruction string, questions []Question, check func(conn ssh.ConnMetadata, answers []string) (*ssh.Permissions, error)) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	prompts := make([]string,len(questions))
+	echos := make([]bool,len(questions))
+	for i,q := range questions {
+		prompts[i],echos[i] = q.Prompt,q.Echo
+	}
+	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers,err := client("",instruction,prompts,echos)
+		if err!=nil { return nil,err }
+		if len(answers)!=len(questions) { return nil,errAnswers }
+		return check(conn,answers)
+	}
+}
@@ -17,6 +17,41 @@ import "net"
 import "golang.org/x/crypto/ssh"
 
 import "encoding/binary"
+import "strings"
+
+/*
+ Restrictions in ssh.Permissions, named like the options of authorized_keys.
+ The Extensions NoPty, NoPortForwarding, NoAgentForwarding, NoX11Forwarding and
+ NoUserRC deny, if present; Handle refuses pseudo-terminals, and supports
+ neither forwarding nor user rc files anyway.
+ */
+const NoPty             = "no-pty"
+const NoPortForwarding  = "no-port-forwarding"
+const NoAgentForwarding = "no-agent-forwarding"
+const NoX11Forwarding   = "no-x11-forwarding"
+const NoUserRC          = "no-user-rc"
+
+// Extension: the permitted forwarding destinations, "host:port,...".
+const PermitOpen        = "permitopen"
+
+// Extension: the permitted remote forwarding listen addresses, "[host:]port,...".
+const PermitListen      = "permitlisten"
+
+// Extension: the only tun(4) device number, that may be forwarded.
+const Tunnel            = "tunnel"
+
+/*
+ Extension: environment variables of the session, "NAME=value" lines. Those,
+ that UnsafeEnv reports, are left out.
+ */
+const Environment       = "environment"
+
+// Critical option: the command to run instead of the requested one, as in certificates.
+const ForceCommand      = "force-command"
+
+// Extensions: the key ID and serial of the certificate, the user logged in with (for auditing).
+const CertKeyID         = "cert-key-id"
+const CertSerial        = "cert-serial"
 
 // A shell session.
 type ShellSession struct{
@@ -28,6 +63,15 @@ type ShellSession struct{
 	// emits a value, if with or height changes.
 	ChSize      <- chan int
 	chs         chan int
+	// True, if a pseudo-terminal was requested.
+	Pty         bool
+	/*
+	 The command to run ("exec" request or force-command); empty for a shell.
+	 With a force-command, the requested one is in SSH_ORIGINAL_COMMAND.
+	 */
+	Command     string
+	// Environment variables for the command ("NAME=value").
+	Env         []string
 }
 func (s *ShellSession) init() {
 	s.chs = make(chan int,1)
@@ -40,6 +84,58 @@ func (s *ShellSession) signal() {
 	}
 }
 
+// Sends the exit status of the command to the client.
+func (s *ShellSession) SendExitStatus(code int) error {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:],uint32(code))
+	_,err := s.Ch.SendRequest("exit-status",false,b[:])
+	return err
+}
+
+// Returns true, if the restriction (e.g. NoPty) is present in p.
+func Denies(p *ssh.Permissions, restriction string) bool {
+	if p==nil { return false }
+	_,ok := p.Extensions[restriction]
+	return ok
+}
+
+// Sets Command and Env of the session from the request and the Permissions.
+func (s *ShellSession) setCommand(cmd string) {
+	s.Command = cmd
+	p := s.Permission
+	if p==nil { return }
+	if fc,ok := p.CriticalOptions[ForceCommand]; ok {
+		if cmd!="" { s.Env = append(s.Env,"SSH_ORIGINAL_COMMAND="+cmd) }
+		s.Command = fc
+	}
+	if env := p.Extensions[Environment]; env!="" {
+		for _,v := range strings.Split(env,"\n") {
+			if !UnsafeEnv(v) { s.Env = append(s.Env,v) }
+		}
+	}
+}
+
+/*
+ Variables, that the dynamic loader and the C library honour, but ignore in
+ setuid programs (glibc's UNSECURE_ENVVARS). A session process is started by
+ root without that protection, so they must not come from the user.
+ */
+var unsafeEnv = map[string]bool{
+	"GCONV_PATH": true, "GETCONF_DIR": true, "GLIBC_TUNABLES": true, "HOSTALIASES": true,
+	"LOCALDOMAIN": true, "LOCPATH": true, "MALLOC_TRACE": true, "NIS_PATH": true,
+	"NLSPATH": true, "RESOLV_HOST_CONF": true, "RES_OPTIONS": true, "TMPDIR": true,
+	"TZDIR": true,
+}
+
+/*
+ Reports, whether the variable v ("NAME=value" or "NAME") would let the user
+ change the code, that a privileged process loads: LD_* and the like.
+ */
+func UnsafeEnv(v string) bool {
+	if i := strings.IndexByte(v,'='); i>=0 { v = v[:i] }
+	return strings.HasPrefix(v,"LD_") || unsafeEnv[v]
+}
+
 func read32(b []byte) ([]byte,int) {
 	if len(b)<4 { return nil,0 }
 	i := int(binary.BigEndian.Uint32(b))
@@ -59,13 +155,30 @@ func handlePCR_R(n int,r <-chan *ssh.Request,ses ssh.Channel, sc chan *ShellSess
 	defer func() { if ses!=nil { ses.Close() } }()
 	for re := range r {
 		switch re.Type {
-		case "shell":
-			if sc!=nil {
-				sc <- s
-				sc = nil
+		case "shell","exec":
+			if sc==nil {
+				if re.WantReply { re.Reply(false,nil) }
+				continue
+			}
+			cmd := ""
+			if re.Type=="exec" {
+				buf,l := read32(re.Payload)
+				if l>len(buf) {
+					if re.WantReply { re.Reply(false,nil) }
+					continue
+				}
+				_,cmd = nString(buf,l)
 			}
+			s.setCommand(cmd)
+			sc <- s
+			sc = nil
 			if re.WantReply { re.Reply(true,nil) }
 		case "pty-req":{
+				if Denies(p,NoPty) {
+					if re.WantReply { re.Reply(false,nil) }
+					continue
+				}
+				s.Pty = true
 				buf,tl := read32(re.Payload)
 				buf,s.Term   = nString(buf,tl)
 				buf,s.Width  = read32(buf)
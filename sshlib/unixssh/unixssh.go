@@ -14,10 +14,17 @@ package unixssh
 
 import "github.com/maxymania/go-system/sshlib"
 import "github.com/maxymania/go-system/syscall_x"
-import "github.com/kr/pty"
+import "github.com/maxymania/go-system/label"
+import "github.com/maxymania/go-system/cgroup"
+import "github.com/maxymania/go-system/limits"
 
 import "os/exec"
 import "io"
+import "os"
+import "syscall"
+import "time"
+import "fmt"
+import "sync/atomic"
 
 func handleSessResize(sess *sshlib.ShellSession,fd int, end chan struct{}) {
 	for {
@@ -28,20 +35,159 @@ func handleSessResize(sess *sshlib.ShellSession,fd int, end chan struct{}) {
 	}
 }
 
+func handleSessReap(r *syscall_x.Reaper, end chan struct{}) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <- t.C: r.Collect()
+		case <- end: return
+		}
+	}
+}
+
 /*
  Runns a Shell session.
+
+ All processes started within the session are killed, when the session ends.
+ If the process is a child subreaper (syscall_x.SetChildSubreaper), orphans of
+ the session, that have been collected, are waited for as well; others must be
+ reaped by the caller. Processes, that escape, are caught by a session cgroup
+ (see Options).
  */
 func HandleSess(sess *sshlib.ShellSession, cmd *exec.Cmd) {
+	HandleSessOpts(sess,cmd,&Options{})
+}
+
+/*
+ Like HandleSess, but the session process is started with the security label
+ execLabel (e.g. the SELinux context "user_u:user_r:user_t:s0" of the user).
+ If execLabel is empty, the label is determined by the policy as usual. If it
+ can not be set, the session is not started.
+ */
+func HandleSessLabel(sess *sshlib.ShellSession, cmd *exec.Cmd, execLabel string) {
+	HandleSessOpts(sess,cmd,&Options{ExecLabel: execLabel})
+}
+
+// Options for HandleSessOpts.
+type Options struct{
+	// The security label of the session process, see HandleSessLabel.
+	ExecLabel string
+	// If not nil, every session runs in a cgroup of its own, beneath this
+	// one. The session cgroup is killed and removed, when the session ends.
+	Cgroup    *cgroup.Cgroup
+	// Limits of the session cgroup. The needed controllers are enabled in
+	// Cgroup, which therefore must not contain processes itself.
+	Limits    *cgroup.Limits
+	// Resource limits of the session process (e.g. from limits.conf),
+	// applied before it runs. main must call syscall_x.ExecSetupMain first.
+	Rlimits   *limits.Limits
+}
+
+var sessCount uint64
+
+// Starts the session process with the label and the resource limits.
+func (o *Options) start(cmd *exec.Cmd) error {
+	if o.Rlimits==nil {
+		return label.WithExec(o.ExecLabel,cmd.Start)
+	}
+	s,err := o.Rlimits.Setup()
+	if err!=nil { return err }
+	s.ExecLabel = o.ExecLabel
+	return s.Start(cmd)
+}
+
+func sessCgroup(o *Options) (*cgroup.Cgroup,error) {
+	n := atomic.AddUint64(&sessCount,1)
+	c,err := o.Cgroup.Create(fmt.Sprintf("session-%d-%d",os.Getpid(),n))
+	if err!=nil { return nil,err }
+	if o.Limits!=nil {
+		err = o.Cgroup.EnableControllers(o.Limits.Controllers()...)
+		if err==nil { err = o.Limits.Apply(c) }
+		if err!=nil { c.Remove(); return nil,err }
+	}
+	return c,nil
+}
+
+/*
+ Like HandleSess, with options. If the session cgroup or the label can not be
+ set up, the session is not started.
+ */
+func HandleSessOpts(sess *sshlib.ShellSession, cmd *exec.Cmd, o *Options) {
 	end := make(chan struct{})
 	defer close(end)
 	defer sess.Ch.Close()
-	p,e := pty.Start(cmd)
+	done := func() {}
+	if o.Cgroup!=nil {
+		c,e := sessCgroup(o)
+		if e!=nil { return }
+		defer c.Destroy()
+		done,e = c.Apply(cmd)
+		if e!=nil { return }
+	}
+	if !sess.Pty {
+		handleSessPipes(sess,cmd,o,done)
+		return
+	}
+	p,e := syscall_x.StartPtyFunc(cmd,o.start)
+	done()
 	if e!=nil { return }
 	defer p.Close()
-	go io.Copy(p,sess.Ch)
-	go io.Copy(sess.Ch,p)
+	r := syscall_x.NewReaper(cmd.Process.Pid)
+	defer r.Kill(syscall.SIGKILL)
+	go func() {
+		io.Copy(p,sess.Ch)
+		// The client has gone, hang up.
+		r.Kill(syscall.SIGHUP)
+	}()
+	out := make(chan struct{})
+	go func() {
+		io.Copy(sess.Ch,p)
+		close(out)
+	}()
 	go handleSessResize(sess,int(p.Fd()),end)
-	cmd.Wait()
+	go handleSessReap(r,end)
+	e = cmd.Wait()
+	// The output, that is still in the pty; orphans may keep it open.
+	select {
+	case <- out:
+	case <- time.After(time.Second):
+	}
+	sendExit(sess,e)
 }
 
+// A session without a pseudo-terminal: stdin, stdout and stderr are pipes.
+func handleSessPipes(sess *sshlib.ShellSession, cmd *exec.Cmd, o *Options, done func()) {
+	end := make(chan struct{})
+	defer close(end)
+	in,e := cmd.StdinPipe()
+	if e!=nil { done(); return }
+	cmd.Stdout = sess.Ch
+	cmd.Stderr = sess.Ch.Stderr()
+	e = o.start(cmd)
+	done()
+	if e!=nil { return }
+	r := syscall_x.NewReaper(cmd.Process.Pid)
+	defer r.Kill(syscall.SIGKILL)
+	go func() {
+		io.Copy(in,sess.Ch)
+		// EOF from the client.
+		in.Close()
+	}()
+	go handleSessReap(r,end)
+	sendExit(sess,cmd.Wait())
+}
 
+func sendExit(sess *sshlib.ShellSession, err error) {
+	code := 0
+	if err!=nil {
+		code = 255
+		if ee,ok := err.(*exec.ExitError); ok {
+			if ws,ok := ee.Sys().(syscall.WaitStatus); ok {
+				code = ws.ExitStatus()
+				if ws.Signaled() { code = 128+int(ws.Signal()) }
+			}
+		}
+	}
+	sess.SendExitStatus(code)
+}
@@ -0,0 +1,338 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+import "io/ioutil"
+import "strconv"
+import "strings"
+
+const CAP_CHOWN              = 0
+const CAP_DAC_OVERRIDE       = 1
+const CAP_DAC_READ_SEARCH    = 2
+const CAP_FOWNER             = 3
+const CAP_FSETID             = 4
+const CAP_KILL               = 5
+const CAP_SETGID             = 6
+const CAP_SETUID             = 7
+const CAP_SETPCAP            = 8
+const CAP_LINUX_IMMUTABLE    = 9
+const CAP_NET_BIND_SERVICE   = 10
+const CAP_NET_BROADCAST      = 11
+const CAP_NET_ADMIN          = 12
+const CAP_NET_RAW            = 13
+const CAP_IPC_LOCK           = 14
+const CAP_IPC_OWNER          = 15
+const CAP_SYS_MODULE         = 16
+const CAP_SYS_RAWIO          = 17
+const CAP_SYS_CHROOT         = 18
+const CAP_SYS_PTRACE         = 19
+const CAP_SYS_PACCT          = 20
+const CAP_SYS_ADMIN          = 21
+const CAP_SYS_BOOT           = 22
+const CAP_SYS_NICE           = 23
+const CAP_SYS_RESOURCE       = 24
+const CAP_SYS_TIME           = 25
+const CAP_SYS_TTY_CONFIG     = 26
+const CAP_MKNOD              = 27
+const CAP_LEASE              = 28
+const CAP_AUDIT_WRITE        = 29
+const CAP_AUDIT_CONTROL      = 30
+const CAP_SETFCAP            = 31
+const CAP_MAC_OVERRIDE       = 32
+const CAP_MAC_ADMIN          = 33
+const CAP_SYSLOG             = 34
+const CAP_WAKE_ALARM         = 35
+const CAP_BLOCK_SUSPEND      = 36
+const CAP_AUDIT_READ         = 37
+const CAP_PERFMON            = 38
+const CAP_BPF                = 39
+const CAP_CHECKPOINT_RESTORE = 40
+
+// The highest capability known to this package.
+const CAP_LAST_CAP = CAP_CHECKPOINT_RESTORE
+
+const SECBIT_NOROOT                        = 1<<0
+const SECBIT_NOROOT_LOCKED                 = 1<<1
+const SECBIT_NO_SETUID_FIXUP               = 1<<2
+const SECBIT_NO_SETUID_FIXUP_LOCKED        = 1<<3
+const SECBIT_KEEP_CAPS                     = 1<<4
+const SECBIT_KEEP_CAPS_LOCKED              = 1<<5
+const SECBIT_NO_CAP_AMBIENT_RAISE          = 1<<6
+const SECBIT_NO_CAP_AMBIENT_RAISE_LOCKED   = 1<<7
+
+const _LINUX_CAPABILITY_VERSION_3 = 0x20080522
+
+var capNames = [...]string{
+	"cap_chown",
+	"cap_dac_override",
+	"cap_dac_read_search",
+	"cap_fowner",
+	"cap_fsetid",
+	"cap_kill",
+	"cap_setgid",
+	"cap_setuid",
+	"cap_setpcap",
+	"cap_linux_immutable",
+	"cap_net_bind_service",
+	"cap_net_broadcast",
+	"cap_net_admin",
+	"cap_net_raw",
+	"cap_ipc_lock",
+	"cap_ipc_owner",
+	"cap_sys_module",
+	"cap_sys_rawio",
+	"cap_sys_chroot",
+	"cap_sys_ptrace",
+	"cap_sys_pacct",
+	"cap_sys_admin",
+	"cap_sys_boot",
+	"cap_sys_nice",
+	"cap_sys_resource",
+	"cap_sys_time",
+	"cap_sys_tty_config",
+	"cap_mknod",
+	"cap_lease",
+	"cap_audit_write",
+	"cap_audit_control",
+	"cap_setfcap",
+	"cap_mac_override",
+	"cap_mac_admin",
+	"cap_syslog",
+	"cap_wake_alarm",
+	"cap_block_suspend",
+	"cap_audit_read",
+	"cap_perfmon",
+	"cap_bpf",
+	"cap_checkpoint_restore",
+}
+
+/*
+ Returns the name of a capability as used by libcap ("cap_net_bind_service").
+ */
+func CapName(c int) string {
+	if c>=0 && c<len(capNames) { return capNames[c] }
+	return "cap_"+strconv.Itoa(c)
+}
+
+/*
+ Parses a capability name. Both "CAP_NET_BIND_SERVICE" and
+ "cap_net_bind_service" are accepted, as are numbers. Returns -1 if the
+ name is unknown.
+ */
+func CapByName(name string) int {
+	name = strings.ToLower(name)
+	for i,n := range capNames {
+		if n==name { return i }
+	}
+	if i,e := strconv.Atoi(strings.TrimPrefix(name,"cap_")); e==nil && i>=0 && i<64 {
+		return i
+	}
+	return -1
+}
+
+/*
+ Returns the highest capability supported by the running kernel
+ (/proc/sys/kernel/cap_last_cap). Falls back to CAP_LAST_CAP.
+ */
+func CapLastCap() int {
+	b,e := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if e!=nil { return CAP_LAST_CAP }
+	i,e := strconv.Atoi(strings.TrimSpace(string(b)))
+	if e!=nil || i<0 || i>63 { return CAP_LAST_CAP }
+	return i
+}
+
+// A set of capabilities, bit n stands for capability n.
+type CapSet uint64
+
+func NewCapSet(caps ...int) (s CapSet) {
+	for _,c := range caps { s = s.Add(c) }
+	return
+}
+func (s CapSet) Has(c int) bool {
+	if c<0 || c>63 { return false }
+	return (s>>uint(c))&1 != 0
+}
+func (s CapSet) Add(c int) CapSet {
+	if c<0 || c>63 { return s }
+	return s | (1<<uint(c))
+}
+func (s CapSet) Drop(c int) CapSet {
+	if c<0 || c>63 { return s }
+	return s &^ (1<<uint(c))
+}
+// Returns the capabilities in the set, usable as SysProcAttr.AmbientCaps.
+func (s CapSet) List() []uintptr {
+	var l []uintptr
+	for i:=0 ; i<64 ; i++ {
+		if s.Has(i) { l = append(l,uintptr(i)) }
+	}
+	return l
+}
+func (s CapSet) String() string {
+	var l []string
+	for _,c := range s.List() { l = append(l,CapName(int(c))) }
+	return strings.Join(l,",")
+}
+
+type CapUserHeader struct{
+	Version uint32
+	Pid     int32
+}
+type CapUserData struct{
+	Effective   uint32
+	Permitted   uint32
+	Inheritable uint32
+}
+
+/*
+ Does capget(hdr,data). hdr.Version should be 0x20080522
+ (_LINUX_CAPABILITY_VERSION_3), which uses two data elements.
+ */
+func Capget(hdr *CapUserHeader, data *[2]CapUserData) error {
+	_,_,e := syscall.Syscall(syscall.SYS_CAPGET,
+		uintptr(unsafe.Pointer(hdr)),
+		uintptr(unsafe.Pointer(data)),0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Does capset(hdr,data). Note that capabilities are a per-thread attribute.
+ */
+func Capset(hdr *CapUserHeader, data *[2]CapUserData) error {
+	_,_,e := syscall.Syscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(hdr)),
+		uintptr(unsafe.Pointer(data)),0)
+	if e!=0 { return e }
+	return nil
+}
+
+// The capability sets of a thread.
+type Caps struct{
+	Effective   CapSet
+	Permitted   CapSet
+	Inheritable CapSet
+}
+
+/*
+ Reads the capabilities of the given process (0 = the calling thread).
+ */
+func GetCaps(pid int) (c Caps,err error) {
+	var data [2]CapUserData
+	hdr := CapUserHeader{_LINUX_CAPABILITY_VERSION_3,int32(pid)}
+	err = Capget(&hdr,&data)
+	if err!=nil { return }
+	c.Effective   = CapSet(data[0].Effective)   | CapSet(data[1].Effective)<<32
+	c.Permitted   = CapSet(data[0].Permitted)   | CapSet(data[1].Permitted)<<32
+	c.Inheritable = CapSet(data[0].Inheritable) | CapSet(data[1].Inheritable)<<32
+	return
+}
+
+/*
+ Sets the capabilities of every thread of the process. If the program uses
+ cgo, syscall.ENOTSUP is returned (see PrctlAllThreads). For a child process,
+ set SysProcAttr.AmbientCaps instead (see CapSet.List).
+ */
+func SetCaps(c Caps) error {
+	var data [2]CapUserData
+	hdr := CapUserHeader{_LINUX_CAPABILITY_VERSION_3,0}
+	data[0].Effective   = uint32(c.Effective)
+	data[1].Effective   = uint32(c.Effective>>32)
+	data[0].Permitted   = uint32(c.Permitted)
+	data[1].Permitted   = uint32(c.Permitted>>32)
+	data[0].Inheritable = uint32(c.Inheritable)
+	data[1].Inheritable = uint32(c.Inheritable>>32)
+	_,err := allThreads(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)),
+		uintptr(unsafe.Pointer(&data)),0,0,0,0)
+	return err
+}
+
+// Reports, whether c is in the bounding set.
+func CapBoundingRead(c int) (bool,error) {
+	r,err := Prctl(PR_CAPBSET_READ,uintptr(c),0,0,0)
+	return r==1,err
+}
+// Removes c from the bounding set of all threads. Requires CAP_SETPCAP.
+func CapBoundingDrop(c int) error {
+	_,err := PrctlAllThreads(PR_CAPBSET_DROP,uintptr(c),0,0,0)
+	return err
+}
+// Reports, whether c is in the ambient set.
+func CapAmbientIsSet(c int) (bool,error) {
+	r,err := Prctl(PR_CAP_AMBIENT,PR_CAP_AMBIENT_IS_SET,uintptr(c),0,0)
+	return r==1,err
+}
+// Adds c to the ambient set. c must be permitted and inheritable.
+func CapAmbientRaise(c int) error {
+	_,err := PrctlAllThreads(PR_CAP_AMBIENT,PR_CAP_AMBIENT_RAISE,uintptr(c),0,0)
+	return err
+}
+func CapAmbientLower(c int) error {
+	_,err := PrctlAllThreads(PR_CAP_AMBIENT,PR_CAP_AMBIENT_LOWER,uintptr(c),0,0)
+	return err
+}
+func CapAmbientClearAll() error {
+	_,err := PrctlAllThreads(PR_CAP_AMBIENT,PR_CAP_AMBIENT_CLEAR_ALL,0,0,0)
+	return err
+}
+
+// Returns the securebits (SECBIT_*).
+func GetSecurebits() (int,error) {
+	return Prctl(PR_GET_SECUREBITS,0,0,0,0)
+}
+// Sets the securebits (SECBIT_*). Requires CAP_SETPCAP.
+func SetSecurebits(bits int) error {
+	_,err := PrctlAllThreads(PR_SET_SECUREBITS,uintptr(bits),0,0,0)
+	return err
+}
+
+/*
+ Reduces the privileges of the process to the given capabilities:
+ Every other capability is dropped from the bounding set, the effective,
+ permitted and inheritable sets become exactly caps, and the ambient set is
+ set to caps, so they survive an execve() of a non-setuid program.
+
+ KeepOnly(CAP_NET_BIND_SERVICE)
+
+ If a capability has to be dropped from the bounding set, CAP_SETPCAP is
+ required; without it, syscall.EPERM is returned and nothing is changed.
+ */
+func KeepOnly(caps ...int) error {
+	set := NewCapSet(caps...)
+	last := CapLastCap()
+	cur,err := GetCaps(0)
+	if err!=nil { return err }
+	var drop []int
+	for i:=0 ; i<=last ; i++ {
+		if set.Has(i) { continue }
+		ok,err := CapBoundingRead(i)
+		if err!=nil { return err }
+		if ok { drop = append(drop,i) }
+	}
+	if len(drop)>0 && !cur.Effective.Has(CAP_SETPCAP) { return syscall.EPERM }
+	for _,i := range drop {
+		err = CapBoundingDrop(i)
+		if err!=nil { return err }
+	}
+	err = CapAmbientClearAll()
+	if err!=nil && err!=syscall.EINVAL { return err }
+	err = SetCaps(Caps{set,set,set})
+	if err!=nil { return err }
+	for _,c := range set.List() {
+		err = CapAmbientRaise(int(c))
+		if err!=nil { return err }
+	}
+	return nil
+}
+
@@ -0,0 +1,66 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "os"
+import "os/exec"
+import "reflect"
+import "syscall"
+import "testing"
+
+func TestCapSet(t *testing.T) {
+	s := NewCapSet(CAP_NET_BIND_SERVICE,CAP_CHOWN,CAP_CHECKPOINT_RESTORE,64,-1)
+	if s!=1<<CAP_CHOWN|1<<CAP_NET_BIND_SERVICE|1<<CAP_CHECKPOINT_RESTORE { t.Errorf("set %#x",uint64(s)) }
+	if !s.Has(CAP_CHOWN) || s.Has(CAP_SYS_ADMIN) || s.Has(64) || s.Has(-1) { t.Error("Has") }
+	if s.Drop(CAP_CHOWN).Has(CAP_CHOWN) || s.Drop(70)!=s || s.Add(64)!=s { t.Error("Add/Drop") }
+	if !reflect.DeepEqual(s.List(),[]uintptr{CAP_CHOWN,CAP_NET_BIND_SERVICE,CAP_CHECKPOINT_RESTORE}) { t.Errorf("List %v",s.List()) }
+	if s.String()!="cap_chown,cap_net_bind_service,cap_checkpoint_restore" { t.Errorf("String %q",s.String()) }
+	if CapSet(0).String()!="" { t.Error("empty set") }
+	for n,want := range map[string]int{"CAP_NET_RAW": CAP_NET_RAW, "cap_bpf": CAP_BPF, "cap_41": 41, "12": 12, "cap_64": -1, "cap_bogus": -1} {
+		if c := CapByName(n); c!=want { t.Errorf("%s: %d",n,c) }
+	}
+	if CapName(CAP_SYS_ADMIN)!="cap_sys_admin" || CapName(50)!="cap_50" { t.Error("CapName") }
+}
+
+/*
+ KeepOnly changes the whole process for good, so it runs in a child: the test
+ binary again, with _SYSCALL_X_TEST_CAPS set.
+ */
+func TestKeepOnly(t *testing.T) {
+	if os.Getenv("_SYSCALL_X_TEST_CAPS")=="1" { return }
+	c,err := GetCaps(0)
+	if err!=nil { t.Fatal(err) }
+	if !c.Effective.Has(CAP_SETPCAP) || !c.Effective.Has(CAP_NET_BIND_SERVICE) { t.Skip("needs CAP_SETPCAP and CAP_NET_BIND_SERVICE") }
+	cmd := exec.Command(os.Args[0],"-test.run=^TestKeepOnlyChild$","-test.v")
+	cmd.Env = append(os.Environ(),"_SYSCALL_X_TEST_CAPS=1")
+	out,err := cmd.CombinedOutput()
+	if err!=nil { t.Errorf("%v\n%s",err,out) }
+}
+
+func TestKeepOnlyChild(t *testing.T) {
+	if os.Getenv("_SYSCALL_X_TEST_CAPS")!="1" { t.Skip("run by TestKeepOnly") }
+	c,err := GetCaps(0)
+	if err!=nil { t.Fatal(err) }
+	// Without CAP_SETPCAP, nothing is dropped.
+	if err = SetCaps(Caps{c.Effective.Drop(CAP_SETPCAP),c.Permitted,c.Inheritable}); err!=nil { t.Fatal(err) }
+	if err = KeepOnly(CAP_NET_BIND_SERVICE); err!=syscall.EPERM { t.Fatalf("without CAP_SETPCAP: %v",err) }
+	if ok,_ := CapBoundingRead(CAP_SYS_ADMIN); !ok { t.Fatal("bounding set changed") }
+	if cur,_ := GetCaps(0); cur.Permitted!=c.Permitted { t.Fatalf("permitted set changed: %v",cur.Permitted) }
+
+	if err = SetCaps(c); err!=nil { t.Fatal(err) }
+	if err = KeepOnly(CAP_NET_BIND_SERVICE); err!=nil { t.Fatal(err) }
+	set := NewCapSet(CAP_NET_BIND_SERVICE)
+	if cur,_ := GetCaps(0); cur!=(Caps{set,set,set}) { t.Errorf("caps %+v",cur) }
+	if ok,_ := CapBoundingRead(CAP_SYS_ADMIN); ok { t.Error("CAP_SYS_ADMIN still in the bounding set") }
+	if ok,_ := CapBoundingRead(CAP_NET_BIND_SERVICE); !ok { t.Error("CAP_NET_BIND_SERVICE dropped from the bounding set") }
+	if ok,err := CapAmbientIsSet(CAP_NET_BIND_SERVICE); !ok || err!=nil { t.Errorf("ambient %v %v",ok,err) }
+	// Keeping the same set again needs no CAP_SETPCAP.
+	if err = KeepOnly(CAP_NET_BIND_SERVICE); err!=nil { t.Errorf("again: %v",err) }
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "runtime"
+import "syscall"
+import "unsafe"
+
+// The environment variable, that carries the ExecSetup to the helper.
+const execSetupEnv = "_SYSCALL_X_EXEC_SETUP"
+
+// AT_SECURE of the auxiliary vector.
+const _AT_SECURE = 23
+
+/*
+ A resource limit for ExecSetup. If HasCur or HasMax is false, the current
+ soft or hard limit is kept; a soft limit above the hard limit is lowered to
+ it.
+ */
+type ExecRlimit struct{
+	Resource int
+	Cur, Max uint64
+	HasCur   bool
+	HasMax   bool
+}
+
+/*
+ Settings, that are applied to a process between fork() and the execve() of
+ its program, so the program runs with them from its first instruction on
+ (RLIMIT_STACK and RLIMIT_AS already apply to the memory layout of execve()).
+
+ The child first executes the calling program again (/proc/self/exe), where
+ ExecSetupMain applies the settings and executes the real program. So main
+ must call ExecSetupMain first, before anything, that can not be done twice
+ (all package init functions run in the helper as well).
+ */
+type ExecSetup struct{
+	Rlimits    []ExecRlimit
+	// The nice value of the process, if not nil (setpriority()).
+	Priority   *int
+	/*
+	 The credentials of the program; set by Start from
+	 cmd.SysProcAttr.Credential, so they are changed after the limits (which
+	 may need CAP_SYS_RESOURCE).
+	 */
+	Credential *syscall.Credential
+	/*
+	 If not nil, the program keeps only these capabilities, like with KeepOnly:
+	 the others are dropped from the bounding set (which requires CAP_SETPCAP),
+	 and the capabilities are kept across the change of the Credential and
+	 raised in the ambient set. E.g. for a session process, that runs as a
+	 user, but may bind privileged ports.
+	 */
+	KeepCaps   *CapSet
+	// Sets no_new_privs (see SetNoNewPrivs).
+	NoNewPrivs bool
+	// The security label of the program (/proc/thread-self/attr/exec), if not empty.
+	ExecLabel  string
+
+	// Set by Start.
+	Path       string
+	StatusFd   int
+}
+
+/*
+ Starts cmd with the settings applied before its program runs. If they can
+ not be applied, the process exits, and the error is returned (cmd.Wait must
+ not be called then). Other SysProcAttr fields (Setsid, Setctty, UseCgroupFD,
+ ...) apply as usual.
+ */
+func (s *ExecSetup) Start(cmd *exec.Cmd) error {
+	if !execSetupMain { return errors.New("syscall_x: exec setup needs ExecSetupMain in main") }
+	if secureExec() { return errors.New("syscall_x: exec setup is not available in a setuid program") }
+	r,w,err := os.Pipe()
+	if err!=nil { return err }
+	defer r.Close()
+	c := *s
+	c.Path = cmd.Path
+	c.StatusFd = 3+len(cmd.ExtraFiles)
+	if cmd.SysProcAttr!=nil && cmd.SysProcAttr.Credential!=nil {
+		c.Credential = cmd.SysProcAttr.Credential
+	}
+	data,err := json.Marshal(&c)
+	if err!=nil { w.Close(); return err }
+	env := cmd.Env
+	if env==nil { env = os.Environ() }
+	path,extra,cred := cmd.Path,cmd.ExtraFiles,(*syscall.Credential)(nil)
+	cmd.Path = "/proc/self/exe"
+	cmd.Env = append(append([]string(nil),env...),execSetupEnv+"="+string(data))
+	cmd.ExtraFiles = append(append([]*os.File(nil),extra...),w)
+	if cmd.SysProcAttr!=nil {
+		cred = cmd.SysProcAttr.Credential
+		cmd.SysProcAttr.Credential = nil
+	}
+	err = cmd.Start()
+	cmd.Path,cmd.Env,cmd.ExtraFiles = path,env,extra
+	if cmd.SysProcAttr!=nil { cmd.SysProcAttr.Credential = cred }
+	w.Close()
+	if err!=nil { return err }
+	// The write end is close-on-exec in the helper: EOF means success.
+	msg,_ := ioutil.ReadAll(r)
+	if len(msg)>0 {
+		cmd.Wait()
+		return fmt.Errorf("exec setup: %s",msg)
+	}
+	return nil
+}
+
+// Reports, whether the program runs with elevated privileges (AT_SECURE).
+func secureExec() bool {
+	b,err := ioutil.ReadFile("/proc/self/auxv")
+	if err!=nil { return true }
+	w := 8
+	if ^uint(0)>>32==0 { w = 4 }
+	get := func(p []byte) uint64 {
+		if w==4 { return uint64(nativeEndian.Uint32(p)) }
+		return nativeEndian.Uint64(p)
+	}
+	for ; len(b)>=2*w; b = b[2*w:] {
+		if get(b)==_AT_SECURE { return get(b[w:])!=0 }
+	}
+	return false
+}
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one))==0 { nativeEndian = binary.BigEndian }
+}
+
+// Whether ExecSetupMain has been called.
+var execSetupMain bool
+
+/*
+ Enables ExecSetup.Start. It must be called first in main: in the helper
+ process started by ExecSetup.Start, it applies the settings and executes the
+ real program, and does not return. Otherwise it returns immediately.
+ */
+func ExecSetupMain() {
+	execSetupMain = true
+	v,ok := syscall.Getenv(execSetupEnv)
+	if !ok { return }
+	syscall.Unsetenv(execSetupEnv)
+	// Not for a setuid program: the environment is not to be trusted.
+	if secureExec() { return }
+	runtime.LockOSThread()
+	var s ExecSetup
+	if err := json.Unmarshal([]byte(v),&s); err!=nil { os.Exit(127) }
+	syscall.CloseOnExec(s.StatusFd)
+	err := s.exec()
+	syscall.Write(s.StatusFd,[]byte(err.Error()))
+	os.Exit(127)
+}
+
+// Applies the settings on the calling thread, and executes the program.
+func (s *ExecSetup) exec() error {
+	for _,l := range s.Rlimits {
+		var cur syscall.Rlimit
+		if err := Prlimit(0,l.Resource,nil,&cur); err!=nil { return err }
+		if l.HasCur { cur.Cur = l.Cur }
+		if l.HasMax { cur.Max = l.Max }
+		if cur.Cur>cur.Max { cur.Cur = cur.Max }
+		if err := Prlimit(0,l.Resource,&cur,nil); err!=nil { return fmt.Errorf("rlimit %d: %v",l.Resource,err) }
+	}
+	if s.Priority!=nil {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS,0,*s.Priority); err!=nil { return fmt.Errorf("priority: %v",err) }
+	}
+	if s.KeepCaps!=nil {
+		if err := boundingKeepOnly(*s.KeepCaps); err!=nil { return err }
+		if _,err := Prctl(PR_SET_KEEPCAPS,1,0,0,0); err!=nil { return fmt.Errorf("keepcaps: %v",err) }
+	}
+	if err := s.setCredential(); err!=nil { return err }
+	if s.KeepCaps!=nil {
+		if err := threadKeepOnly(*s.KeepCaps); err!=nil { return err }
+	}
+	if s.NoNewPrivs {
+		if _,err := Prctl(PR_SET_NO_NEW_PRIVS,1,0,0,0); err!=nil { return fmt.Errorf("no_new_privs: %v",err) }
+	}
+	if s.ExecLabel!="" {
+		if err := ioutil.WriteFile("/proc/thread-self/attr/exec",[]byte(s.ExecLabel),0); err!=nil { return err }
+	}
+	argv := os.Args
+	if len(argv)==0 { argv = []string{s.Path} }
+	if err := syscall.Exec(s.Path,argv,os.Environ()); err!=nil { return &os.PathError{Op: "exec", Path: s.Path, Err: err} }
+	return nil
+}
+
+func (s *ExecSetup) setCredential() error {
+	c := s.Credential
+	if c==nil { return nil }
+	if !c.NoSetGroups {
+		gids := make([]int,len(c.Groups))
+		for i,g := range c.Groups { gids[i] = int(g) }
+		if err := syscall.Setgroups(gids); err!=nil { return fmt.Errorf("setgroups: %v",err) }
+	}
+	if err := syscall.Setgid(int(c.Gid)); err!=nil { return fmt.Errorf("setgid: %v",err) }
+	if err := syscall.Setuid(int(c.Uid)); err!=nil { return fmt.Errorf("setuid: %v",err) }
+	return nil
+}
+
+// Drops every capability but set from the bounding set of the calling thread.
+func boundingKeepOnly(set CapSet) error {
+	last := CapLastCap()
+	for i:=0 ; i<=last ; i++ {
+		if set.Has(i) { continue }
+		ok,err := CapBoundingRead(i)
+		if err!=nil { return err }
+		if !ok { continue }
+		if _,err = Prctl(PR_CAPBSET_DROP,uintptr(i),0,0,0); err!=nil { return fmt.Errorf("bounding set: %v",err) }
+	}
+	return nil
+}
+
+// Sets the capabilities of the calling thread to set, including the ambient set.
+func threadKeepOnly(set CapSet) error {
+	var data [2]CapUserData
+	hdr := CapUserHeader{_LINUX_CAPABILITY_VERSION_3,0}
+	for i := range data {
+		v := uint32(set>>(32*uint(i)))
+		data[i] = CapUserData{v,v,v}
+	}
+	if err := Capset(&hdr,&data); err!=nil { return fmt.Errorf("capset: %v",err) }
+	_,err := Prctl(PR_CAP_AMBIENT,PR_CAP_AMBIENT_CLEAR_ALL,0,0,0)
+	if err!=nil && err!=syscall.EINVAL { return fmt.Errorf("ambient set: %v",err) }
+	for _,c := range set.List() {
+		if _,err = Prctl(PR_CAP_AMBIENT,PR_CAP_AMBIENT_RAISE,c,0,0); err!=nil { return fmt.Errorf("ambient set: %v",err) }
+	}
+	return nil
+}
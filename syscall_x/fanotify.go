@@ -0,0 +1,299 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+import "encoding/binary"
+import "bytes"
+
+// fanotify_init() flags.
+const FAN_CLOEXEC         = 0x1
+const FAN_NONBLOCK        = 0x2
+const FAN_CLASS_NOTIF     = 0x0
+const FAN_CLASS_CONTENT   = 0x4
+const FAN_CLASS_PRE_CONTENT = 0x8
+const FAN_UNLIMITED_QUEUE = 0x10
+const FAN_UNLIMITED_MARKS = 0x20
+const FAN_ENABLE_AUDIT    = 0x40
+const FAN_REPORT_PIDFD    = 0x80
+const FAN_REPORT_TID      = 0x100
+const FAN_REPORT_FID      = 0x200
+const FAN_REPORT_DIR_FID  = 0x400
+const FAN_REPORT_NAME     = 0x800
+const FAN_REPORT_TARGET_FID = 0x1000
+const FAN_REPORT_DFID_NAME  = FAN_REPORT_DIR_FID|FAN_REPORT_NAME
+const FAN_REPORT_DFID_NAME_TARGET = FAN_REPORT_DFID_NAME|FAN_REPORT_FID|FAN_REPORT_TARGET_FID
+
+// fanotify_mark() flags.
+const FAN_MARK_ADD        = 0x1
+const FAN_MARK_REMOVE     = 0x2
+const FAN_MARK_DONT_FOLLOW = 0x4
+const FAN_MARK_ONLYDIR    = 0x8
+const FAN_MARK_MOUNT      = 0x10
+const FAN_MARK_IGNORED_MASK = 0x20
+const FAN_MARK_IGNORED_SURV_MODIFY = 0x40
+const FAN_MARK_FLUSH      = 0x80
+const FAN_MARK_FILESYSTEM = 0x100
+const FAN_MARK_EVICTABLE  = 0x200
+const FAN_MARK_IGNORE     = 0x400
+const FAN_MARK_INODE      = 0x0
+
+// Event mask bits.
+const FAN_ACCESS         = 0x1
+const FAN_MODIFY         = 0x2
+const FAN_ATTRIB         = 0x4
+const FAN_CLOSE_WRITE    = 0x8
+const FAN_CLOSE_NOWRITE  = 0x10
+const FAN_OPEN           = 0x20
+const FAN_MOVED_FROM     = 0x40
+const FAN_MOVED_TO       = 0x80
+const FAN_CREATE         = 0x100
+const FAN_DELETE         = 0x200
+const FAN_DELETE_SELF    = 0x400
+const FAN_MOVE_SELF      = 0x800
+const FAN_OPEN_EXEC      = 0x1000
+const FAN_Q_OVERFLOW     = 0x4000
+const FAN_FS_ERROR       = 0x8000
+const FAN_OPEN_PERM      = 0x10000
+const FAN_ACCESS_PERM    = 0x20000
+const FAN_OPEN_EXEC_PERM = 0x40000
+const FAN_EVENT_ON_CHILD = 0x8000000
+const FAN_RENAME         = 0x10000000
+const FAN_ONDIR          = 0x40000000
+const FAN_CLOSE          = FAN_CLOSE_WRITE|FAN_CLOSE_NOWRITE
+const FAN_MOVE           = FAN_MOVED_FROM|FAN_MOVED_TO
+
+// Types of the information records, that follow the event metadata.
+const FAN_EVENT_INFO_TYPE_FID           = 1
+const FAN_EVENT_INFO_TYPE_DFID_NAME     = 2
+const FAN_EVENT_INFO_TYPE_DFID          = 3
+const FAN_EVENT_INFO_TYPE_PIDFD         = 4
+const FAN_EVENT_INFO_TYPE_ERROR         = 5
+const FAN_EVENT_INFO_TYPE_OLD_DFID_NAME = 10
+const FAN_EVENT_INFO_TYPE_NEW_DFID_NAME = 12
+
+const FANOTIFY_METADATA_VERSION = 3
+
+// FanotifyEvent.Fd, if the event reports file handles instead of fds.
+const FAN_NOFD = -1
+
+/*
+ Does fanotify_init(flags,eventFlags). eventFlags are the open() flags of the
+ event fds (O_RDONLY|O_CLOEXEC...). Unprivileged callers (Linux 5.13) must use
+ FAN_REPORT_FID or FAN_REPORT_DFID_NAME and inode marks.
+ */
+func FanotifyInit(flags int, eventFlags int) (int,error) {
+	return sysResult(syscall.Syscall(syscall.SYS_FANOTIFY_INIT,uintptr(flags),uintptr(eventFlags),0))
+}
+
+/*
+ Does fanotify_mark(fd,flags,mask,dirfd,path). An empty path marks dirfd.
+ */
+func FanotifyMark(fd int, flags int, mask uint64, dirfd int, path string) error {
+	var p *byte
+	if path!="" {
+		var err error
+		p,err = syscall.BytePtrFromString(path)
+		if err!=nil { return err }
+	}
+	var e syscall.Errno
+	if unsafe.Sizeof(uintptr(0))==8 {
+		_,_,e = syscall.Syscall6(syscall.SYS_FANOTIFY_MARK,uintptr(fd),uintptr(flags),uintptr(mask),
+			uintptr(dirfd),uintptr(unsafe.Pointer(p)),0)
+	} else {
+		// The 64 bit mask occupies two argument registers.
+		a,b := uintptr(uint32(mask)),uintptr(uint32(mask>>32))
+		if isBigEndian() { a,b = b,a }
+		_,_,e = syscall.Syscall6(syscall.SYS_FANOTIFY_MARK,uintptr(fd),uintptr(flags),a,b,
+			uintptr(dirfd),uintptr(unsafe.Pointer(p)))
+	}
+	if e!=0 { return e }
+	return nil
+}
+
+func isBigEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x))==0
+}
+
+// struct fanotify_event_metadata
+type FanotifyEventMetadata struct{
+	Event_len    uint32
+	Vers         uint8
+	Reserved     uint8
+	Metadata_len uint16
+	Mask         uint64
+	Fd           int32
+	Pid          int32
+}
+
+// An information record of a fanotify event.
+type FanotifyInfo struct{
+	// FAN_EVENT_INFO_TYPE_*
+	Type   int
+	// FID records: The file system id and the file handle.
+	Fsid   [2]int32
+	Handle FileHandle
+	// DFID_NAME records: The entry name in the directory Handle.
+	Name   string
+	// PIDFD record
+	Pidfd  int
+	// ERROR record
+	Error  int
+}
+
+// A decoded fanotify event.
+type FanotifyEvent struct{
+	Mask  uint64
+	// FAN_NOFD with FAN_REPORT_FID and friends.
+	Fd    int
+	Pid   int
+	Infos []FanotifyInfo
+}
+
+// Returns the first record of the given type (FAN_EVENT_INFO_TYPE_*), or nil.
+func (e *FanotifyEvent) Info(typ int) *FanotifyInfo {
+	for i := range e.Infos {
+		if e.Infos[i].Type==typ { return &e.Infos[i] }
+	}
+	return nil
+}
+
+func parseFanotifyInfo(b []byte) (FanotifyInfo,error) {
+	var fi FanotifyInfo
+	fi.Type = int(b[0])
+	switch fi.Type {
+	case FAN_EVENT_INFO_TYPE_FID,FAN_EVENT_INFO_TYPE_DFID,FAN_EVENT_INFO_TYPE_DFID_NAME,
+		FAN_EVENT_INFO_TYPE_OLD_DFID_NAME,FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+		// header, fsid, struct file_handle {handle_bytes, handle_type, f_handle}
+		if len(b)<20 { return fi,syscall.EINVAL }
+		fi.Fsid[0] = int32(nativeUint32(b[4:]))
+		fi.Fsid[1] = int32(nativeUint32(b[8:]))
+		hb := int(nativeUint32(b[12:]))
+		fi.Handle.Type = int32(nativeUint32(b[16:]))
+		if 20+hb>len(b) { return fi,syscall.EINVAL }
+		fi.Handle.Bytes = append([]byte(nil),b[20:20+hb]...)
+		if fi.Type!=FAN_EVENT_INFO_TYPE_FID && fi.Type!=FAN_EVENT_INFO_TYPE_DFID {
+			n := b[20+hb:]
+			if i := bytes.IndexByte(n,0); i>=0 { n = n[:i] }
+			fi.Name = string(n)
+		}
+	case FAN_EVENT_INFO_TYPE_PIDFD,FAN_EVENT_INFO_TYPE_ERROR:
+		if len(b)<8 { return fi,syscall.EINVAL }
+		v := int32(nativeUint32(b[4:]))
+		if fi.Type==FAN_EVENT_INFO_TYPE_PIDFD { fi.Pidfd = int(v) } else { fi.Error = int(v) }
+	}
+	return fi,nil
+}
+
+func nativeUint32(b []byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&b[0]))
+}
+
+/*
+ Decodes the events, read() returned from a fanotify fd.
+ */
+func ParseFanotifyEvents(buf []byte) ([]FanotifyEvent,error) {
+	var r []FanotifyEvent
+	msz := int(unsafe.Sizeof(FanotifyEventMetadata{}))
+	for len(buf)>=msz {
+		md := (*FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+		el := int(md.Event_len)
+		if md.Vers!=FANOTIFY_METADATA_VERSION || el<msz || el>len(buf) { return r,syscall.EINVAL }
+		ev := FanotifyEvent{Mask: md.Mask, Fd: int(md.Fd), Pid: int(md.Pid)}
+		info := buf[int(md.Metadata_len):el]
+		for len(info)>=4 {
+			il := int(*(*uint16)(unsafe.Pointer(&info[2])))
+			if il<4 || il>len(info) { return r,syscall.EINVAL }
+			fi,err := parseFanotifyInfo(info[:il])
+			if err!=nil { return r,err }
+			ev.Infos = append(ev.Infos,fi)
+			info = info[il:]
+		}
+		r = append(r,ev)
+		buf = buf[el:]
+	}
+	return r,nil
+}
+
+// A decoded inotify event.
+type InotifyEventRec struct{
+	Wd     int
+	Mask   uint32
+	Cookie uint32
+	Name   string
+}
+
+// Decodes the events, read() returned from an inotify fd.
+func ParseInotifyEvents(buf []byte) []InotifyEventRec {
+	var r []InotifyEventRec
+	hsz := syscall.SizeofInotifyEvent
+	for len(buf)>=hsz {
+		ie := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		n := hsz+int(ie.Len)
+		if n>len(buf) { break }
+		name := buf[hsz:n]
+		if i := bytes.IndexByte(name,0); i>=0 { name = name[:i] }
+		r = append(r,InotifyEventRec{int(ie.Wd),ie.Mask,ie.Cookie,string(name)})
+		buf = buf[n:]
+	}
+	return r
+}
+
+// A file handle (struct file_handle without the size).
+type FileHandle struct{
+	Type  int32
+	Bytes []byte
+}
+
+// A string, that identifies the handle together with the file system id.
+func (h *FileHandle) Key(fsid [2]int32) string {
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:],uint32(fsid[0]))
+	binary.LittleEndian.PutUint32(b[4:],uint32(fsid[1]))
+	binary.LittleEndian.PutUint32(b[8:],uint32(h.Type))
+	return string(b[:])+string(h.Bytes)
+}
+
+// MAX_HANDLE_SZ
+const MAX_HANDLE_SZ = 128
+
+// AT_HANDLE_FID: A handle to identify the file only (Linux 6.5).
+const AT_HANDLE_FID = 0x200
+
+/*
+ Does name_to_handle_at(dirfd,path,...,flags). Returns the handle and the mount
+ id. flags are AT_EMPTY_PATH, AT_SYMLINK_FOLLOW and AT_HANDLE_FID.
+ */
+func NameToHandleAt(dirfd int, path string, flags int) (FileHandle,int,error) {
+	p,err := syscall.BytePtrFromString(path)
+	if err!=nil { return FileHandle{},0,err }
+	var buf [8+MAX_HANDLE_SZ]byte
+	*(*uint32)(unsafe.Pointer(&buf[0])) = MAX_HANDLE_SZ
+	var mnt int32
+	_,_,e := syscall.Syscall6(sys_NAME_TO_HANDLE_AT,uintptr(dirfd),uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&buf[0])),uintptr(unsafe.Pointer(&mnt)),uintptr(flags),0)
+	if e!=0 { return FileHandle{},0,e }
+	n := *(*uint32)(unsafe.Pointer(&buf[0]))
+	h := FileHandle{Type: *(*int32)(unsafe.Pointer(&buf[4])), Bytes: append([]byte(nil),buf[8:8+n]...)}
+	return h,int(mnt),nil
+}
+
+/*
+ Does open_by_handle_at(mountfd,h,flags). Requires CAP_DAC_READ_SEARCH.
+ */
+func OpenByHandleAt(mountfd int, h FileHandle, flags int) (int,error) {
+	buf := make([]byte,8+len(h.Bytes))
+	*(*uint32)(unsafe.Pointer(&buf[0])) = uint32(len(h.Bytes))
+	*(*int32)(unsafe.Pointer(&buf[4])) = h.Type
+	copy(buf[8:],h.Bytes)
+	return sysResult(syscall.Syscall(sys_OPEN_BY_HANDLE_AT,uintptr(mountfd),uintptr(unsafe.Pointer(&buf[0])),uintptr(flags)))
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+import "strings"
+import "fmt"
+
+// _IOR('f',1,long), _IOW('f',2,long). The kernel reads and writes an int.
+const FS_IOC_GETFLAGS = ioc_READ |(unsafe.Sizeof(uintptr(0))<<16)|('f'<<8)|1
+const FS_IOC_SETFLAGS = ioc_WRITE|(unsafe.Sizeof(uintptr(0))<<16)|('f'<<8)|2
+
+// _IOR('X',31,struct fsxattr), _IOW('X',32,struct fsxattr)
+const FS_IOC_FSGETXATTR = ioc_READ |(unsafe.Sizeof(Fsxattr{})<<16)|('X'<<8)|31
+const FS_IOC_FSSETXATTR = ioc_WRITE|(unsafe.Sizeof(Fsxattr{})<<16)|('X'<<8)|32
+
+// Inode flags (chattr(1)).
+const FS_SECRM_FL        = 0x00000001
+const FS_UNRM_FL         = 0x00000002
+const FS_COMPR_FL        = 0x00000004
+const FS_SYNC_FL         = 0x00000008
+const FS_IMMUTABLE_FL    = 0x00000010
+const FS_APPEND_FL       = 0x00000020
+const FS_NODUMP_FL       = 0x00000040
+const FS_NOATIME_FL      = 0x00000080
+const FS_DIRTY_FL        = 0x00000100
+const FS_COMPRBLK_FL     = 0x00000200
+const FS_NOCOMP_FL       = 0x00000400
+const FS_ENCRYPT_FL      = 0x00000800
+const FS_INDEX_FL        = 0x00001000
+const FS_IMAGIC_FL       = 0x00002000
+const FS_JOURNAL_DATA_FL = 0x00004000
+const FS_NOTAIL_FL       = 0x00008000
+const FS_DIRSYNC_FL      = 0x00010000
+const FS_TOPDIR_FL       = 0x00020000
+const FS_HUGE_FILE_FL    = 0x00040000
+const FS_EXTENT_FL       = 0x00080000
+const FS_VERITY_FL       = 0x00100000
+const FS_EA_INODE_FL     = 0x00200000
+const FS_EOFBLOCKS_FL    = 0x00400000
+const FS_NOCOW_FL        = 0x00800000
+const FS_DAX_FL          = 0x02000000
+const FS_INLINE_DATA_FL  = 0x10000000
+const FS_PROJINHERIT_FL  = 0x20000000
+const FS_CASEFOLD_FL     = 0x40000000
+
+// Flags, that may be changed with FS_IOC_SETFLAGS.
+const FS_FL_USER_MODIFIABLE = 0x604bc0ff
+
+// Extended inode flags (Fsxattr.Xflags).
+const FS_XFLAG_REALTIME     = 0x00000001
+const FS_XFLAG_PREALLOC     = 0x00000002
+const FS_XFLAG_IMMUTABLE    = 0x00000008
+const FS_XFLAG_APPEND       = 0x00000010
+const FS_XFLAG_SYNC         = 0x00000020
+const FS_XFLAG_NOATIME      = 0x00000040
+const FS_XFLAG_NODUMP       = 0x00000080
+const FS_XFLAG_RTINHERIT    = 0x00000100
+const FS_XFLAG_PROJINHERIT  = 0x00000200
+const FS_XFLAG_NOSYMLINKS   = 0x00000400
+const FS_XFLAG_EXTSIZE      = 0x00000800
+const FS_XFLAG_EXTSZINHERIT = 0x00001000
+const FS_XFLAG_NODEFRAG     = 0x00002000
+const FS_XFLAG_FILESTREAM   = 0x00004000
+const FS_XFLAG_DAX          = 0x00008000
+const FS_XFLAG_COWEXTSIZE   = 0x00010000
+const FS_XFLAG_HASATTR      = 0x80000000
+
+// struct fsxattr
+type Fsxattr struct{
+	Xflags     uint32
+	Extsize    uint32 // extent size hint
+	Nextents   uint32 // read only
+	Projid     uint32 // project ID (quotas)
+	Cowextsize uint32
+	_          [8]byte
+}
+
+// Inode flags (FS_*_FL).
+type InodeFlags uint32
+
+type inodeFlagName struct{
+	flag  InodeFlags
+	short byte
+	long  string
+}
+
+// In the order of lsattr(1).
+var inodeFlagNames = []inodeFlagName{
+	{FS_SECRM_FL       ,'s',"Secure_Deletion"},
+	{FS_UNRM_FL        ,'u',"Undelete"},
+	{FS_SYNC_FL        ,'S',"Synchronous_Updates"},
+	{FS_DIRSYNC_FL     ,'D',"Synchronous_Directory_Updates"},
+	{FS_IMMUTABLE_FL   ,'i',"Immutable"},
+	{FS_APPEND_FL      ,'a',"Append_Only"},
+	{FS_NODUMP_FL      ,'d',"No_Dump"},
+	{FS_NOATIME_FL     ,'A',"No_Atime"},
+	{FS_COMPR_FL       ,'c',"Compression_Requested"},
+	{FS_ENCRYPT_FL     ,'E',"Encrypted"},
+	{FS_JOURNAL_DATA_FL,'j',"Journaled_Data"},
+	{FS_INDEX_FL       ,'I',"Indexed_directory"},
+	{FS_NOTAIL_FL      ,'t',"No_Tailmerging"},
+	{FS_TOPDIR_FL      ,'T',"Top_of_Directory_Hierarchies"},
+	{FS_EXTENT_FL      ,'e',"Extents"},
+	{FS_NOCOW_FL       ,'C',"No_COW"},
+	{FS_DAX_FL         ,'x',"DAX"},
+	{FS_CASEFOLD_FL    ,'F',"Casefold"},
+	{FS_INLINE_DATA_FL ,'N',"Inline_Data"},
+	{FS_PROJINHERIT_FL ,'P',"Project_Hierarchy"},
+	{FS_VERITY_FL      ,'V',"Verity"},
+	{FS_NOCOMP_FL      ,'m',"Dont_Compress"},
+}
+
+// Returns true, if all flags in f are set.
+func (i InodeFlags) Has(f InodeFlags) bool { return (i&f)==f }
+
+/*
+ Formats the flags like lsattr(1): One letter or '-' per known flag, e.g.
+ "----i---------e-------".
+ */
+func (i InodeFlags) String() string {
+	b := make([]byte,len(inodeFlagNames))
+	for j,n := range inodeFlagNames {
+		b[j] = '-'
+		if (i&n.flag)!=0 { b[j] = n.short }
+	}
+	return string(b)
+}
+
+/*
+ Formats the flags like "lsattr -l", e.g. "Immutable, Extents", or "---" if
+ no flag is set.
+ */
+func (i InodeFlags) Long() string {
+	var s []string
+	for _,n := range inodeFlagNames {
+		if (i&n.flag)!=0 { s = append(s,n.long) }
+	}
+	if len(s)==0 { return "---" }
+	return strings.Join(s,", ")
+}
+
+// Returns the flag for the chattr(1) letter c, or 0.
+func InodeFlagByLetter(c byte) InodeFlags {
+	for _,n := range inodeFlagNames {
+		if n.short==c { return n.flag }
+	}
+	return 0
+}
+
+/*
+ Parses a chattr(1) mode like "+ia", "-a" or "=e". Returns the flags to set
+ and to clear. With '=', clear holds all modifiable flags, not given.
+ */
+func ParseInodeFlags(mode string) (set, clear InodeFlags, err error) {
+	if len(mode)<2 { return 0,0,fmt.Errorf("invalid inode flags %q",mode) }
+	var f InodeFlags
+	for j:=1; j<len(mode); j++ {
+		n := InodeFlagByLetter(mode[j])
+		if n==0 { return 0,0,fmt.Errorf("invalid inode flag %q",mode[j]) }
+		f |= n
+	}
+	switch mode[0] {
+	case '+': return f,0,nil
+	case '-': return 0,f,nil
+	case '=': return f,FS_FL_USER_MODIFIABLE&^f,nil
+	}
+	return 0,0,fmt.Errorf("invalid inode flags %q",mode)
+}
+
+/*
+ Does ioctl(fd,FS_IOC_GETFLAGS). Fails with ENOTTY, if the file system has no
+ inode flags.
+ */
+func GetInodeFlags(fd int) (InodeFlags,error) {
+	var f int32
+	err := ioctlPtr(fd,FS_IOC_GETFLAGS,unsafe.Pointer(&f))
+	return InodeFlags(uint32(f)),err
+}
+
+/*
+ Does ioctl(fd,FS_IOC_SETFLAGS). Setting or clearing FS_IMMUTABLE_FL or
+ FS_APPEND_FL requires CAP_LINUX_IMMUTABLE.
+ */
+func SetInodeFlags(fd int, f InodeFlags) error {
+	v := int32(f)
+	return ioctlPtr(fd,FS_IOC_SETFLAGS,unsafe.Pointer(&v))
+}
+
+// Opens path like chattr(1) does: Read only, without following symlinks.
+func openForFlags(path string) (int,error) {
+	return syscall.Open(path,syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,0)
+}
+
+// Returns the inode flags of path (lsattr).
+func GetInodeFlagsPath(path string) (InodeFlags,error) {
+	fd,err := openForFlags(path)
+	if err!=nil { return 0,err }
+	defer syscall.Close(fd)
+	return GetInodeFlags(fd)
+}
+
+/*
+ Sets and clears inode flags of path (chattr). Nothing is written, if the
+ flags would not change.
+ */
+func ChangeInodeFlags(path string, set, clear InodeFlags) error {
+	fd,err := openForFlags(path)
+	if err!=nil { return err }
+	defer syscall.Close(fd)
+	f,err := GetInodeFlags(fd)
+	if err!=nil { return err }
+	nf := (f|set)&^clear
+	if nf==f { return nil }
+	return SetInodeFlags(fd,nf)
+}
+
+// Does ioctl(fd,FS_IOC_FSGETXATTR).
+func FsGetXattr(fd int) (Fsxattr,error) {
+	var x Fsxattr
+	err := ioctlPtr(fd,FS_IOC_FSGETXATTR,unsafe.Pointer(&x))
+	return x,err
+}
+
+/*
+ Does ioctl(fd,FS_IOC_FSSETXATTR). Nextents is ignored. Changing the project ID
+ requires CAP_FOWNER or, in a user namespace, the initial namespace.
+ */
+func FsSetXattr(fd int, x *Fsxattr) error {
+	return ioctlPtr(fd,FS_IOC_FSSETXATTR,unsafe.Pointer(x))
+}
+
+// Sets the project ID of fd and, if inherit is true, FS_XFLAG_PROJINHERIT.
+func SetProjectID(fd int, projid uint32, inherit bool) error {
+	x,err := FsGetXattr(fd)
+	if err!=nil { return err }
+	x.Projid = projid
+	if inherit { x.Xflags |= FS_XFLAG_PROJINHERIT }
+	return FsSetXattr(fd,&x)
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "syscall"
+import "testing"
+
+func TestInodeFlagsFormat(t *testing.T) {
+	f := InodeFlags(FS_IMMUTABLE_FL|FS_EXTENT_FL)
+	if s := f.String(); s!="----i---------e-------" { t.Errorf("String %q",s) }
+	if s := f.Long(); s!="Immutable, Extents" { t.Errorf("Long %q",s) }
+	if s := InodeFlags(0).Long(); s!="---" { t.Errorf("Long of 0 %q",s) }
+	if !f.Has(FS_IMMUTABLE_FL) || f.Has(FS_IMMUTABLE_FL|FS_APPEND_FL) { t.Error("Has") }
+	for _,tt := range []struct{ mode string; set, clear InodeFlags }{
+		{"+ia",FS_IMMUTABLE_FL|FS_APPEND_FL,0},
+		{"-A",0,FS_NOATIME_FL},
+		{"=d",FS_NODUMP_FL,FS_FL_USER_MODIFIABLE&^FS_NODUMP_FL},
+	} {
+		set,clear,err := ParseInodeFlags(tt.mode)
+		if err!=nil || set!=tt.set || clear!=tt.clear { t.Errorf("%q: %#x %#x %v",tt.mode,set,clear,err) }
+	}
+	for _,m := range []string{"","+","i","+Q","*i"} {
+		if _,_,err := ParseInodeFlags(m); err==nil { t.Errorf("%q: no error",m) }
+	}
+}
+
+// Mounts a new tmpfs in a temporary directory; needs root.
+func testTmpfs(t *testing.T) string {
+	d,err := ioutil.TempDir("","fsflagstest")
+	if err!=nil { t.Fatal(err) }
+	if err = syscall.Mount("tmpfs",d,"tmpfs",0,"size=1m"); err!=nil {
+		os.Remove(d)
+		t.Skipf("can not mount a tmpfs: %v",err)
+	}
+	return d
+}
+
+func removeMount(d string) {
+	syscall.Unmount(d,syscall.MNT_DETACH)
+	os.RemoveAll(d)
+}
+
+func TestInodeFlags(t *testing.T) {
+	d := testTmpfs(t)
+	defer removeMount(d)
+	p := filepath.Join(d,"f")
+	if err := ioutil.WriteFile(p,nil,0644); err!=nil { t.Fatal(err) }
+	if err := ChangeInodeFlags(p,FS_NOATIME_FL|FS_NODUMP_FL,0); err!=nil {
+		if err==syscall.ENOTTY || err==syscall.EOPNOTSUPP { t.Skipf("no inode flags on tmpfs: %v",err) }
+		t.Fatal(err)
+	}
+	f,err := GetInodeFlagsPath(p)
+	if err!=nil || f!=FS_NOATIME_FL|FS_NODUMP_FL { t.Errorf("flags %v %v",f,err) }
+	fd,err := openForFlags(p)
+	if err!=nil { t.Fatal(err) }
+	x,err := FsGetXattr(fd)
+	syscall.Close(fd)
+	if err!=nil || x.Xflags&(FS_XFLAG_NOATIME|FS_XFLAG_NODUMP)!=FS_XFLAG_NOATIME|FS_XFLAG_NODUMP { t.Errorf("xflags %#x %v",x.Xflags,err) }
+
+	if err = ChangeInodeFlags(p,FS_IMMUTABLE_FL,FS_NODUMP_FL); err==syscall.EPERM { t.Skip("no CAP_LINUX_IMMUTABLE") }
+	if err!=nil { t.Fatal(err) }
+	if f,_ = GetInodeFlagsPath(p); f!=FS_NOATIME_FL|FS_IMMUTABLE_FL { t.Errorf("flags %v",f) }
+	if err = ioutil.WriteFile(p,[]byte("x"),0644); !os.IsPermission(err) { t.Errorf("immutable file written: %v",err) }
+	if err = ChangeInodeFlags(p,0,FS_IMMUTABLE_FL|FS_NOATIME_FL); err!=nil { t.Fatal(err) }
+	if err = ioutil.WriteFile(p,[]byte("x"),0644); err!=nil { t.Errorf("write after clearing: %v",err) }
+
+	l := filepath.Join(d,"l")
+	if err = os.Symlink(p,l); err!=nil { t.Fatal(err) }
+	if _,err = GetInodeFlagsPath(l); err!=syscall.ELOOP { t.Errorf("symlink followed: %v",err) }
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "bufio"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+// Directories, that are bind-mounted read-only by MakeMinimalRoot, if present.
+var MinimalRootDirs = []string{"/bin","/sbin","/lib","/lib32","/lib64","/usr"}
+
+// Device nodes in /dev, that are bind-mounted by MakeMinimalRoot.
+var MinimalRootDevs = []string{"null","zero","full","random","urandom","tty"}
+
+/*
+ Mounts a new tmpfs on dst. mode is the mode of the root directory
+ (e.g. "1777"), attrFlags are MOUNT_ATTR_*. Uses fsopen/fsmount and falls back
+ to mount(2).
+ */
+func MountTmpfs(dst string, attrFlags int, mode string) error {
+	fs,err := Fsopen("tmpfs",FSOPEN_CLOEXEC)
+	if err==syscall.ENOSYS {
+		// MOUNT_ATTR_RDONLY..MOUNT_ATTR_NOEXEC equal the MS_* flags.
+		return syscall.Mount("tmpfs",dst,"tmpfs",uintptr(attrFlags&0xf),"mode="+mode)
+	}
+	if err!=nil { return err }
+	defer syscall.Close(fs)
+	err = FsconfigSetString(fs,"mode",mode)
+	if err!=nil { return err }
+	err = FsconfigCreate(fs)
+	if err!=nil { return err }
+	mnt,err := Fsmount(fs,FSMOUNT_CLOEXEC,attrFlags)
+	if err!=nil { return err }
+	defer syscall.Close(mnt)
+	return MoveMount(mnt,"",AT_FDCWD,dst,MOVE_MOUNT_F_EMPTY_PATH)
+}
+
+/*
+ Bind-mounts src on dst. If readonly is true, the mount (and all submounts)
+ are made read-only. Uses open_tree/mount_setattr/move_mount and falls back to
+ mount(2).
+
+ Within a user namespace, flags like nosuid or nodev of the source mount are
+ locked; they are preserved in both cases.
+ */
+func BindMount(src, dst string, readonly bool) error {
+	var attr *MountAttr
+	if readonly { attr = &MountAttr{Attr_set: MOUNT_ATTR_RDONLY} }
+	fd,err := CloneTree(src,attr)
+	if err==syscall.ENOSYS {
+		return bindMountOld(src,dst,readonly)
+	}
+	if err!=nil { return err }
+	defer syscall.Close(fd)
+	return MoveMount(fd,"",AT_FDCWD,dst,MOVE_MOUNT_F_EMPTY_PATH)
+}
+
+/*
+ The flags of statfs() (ST_*), that a remount must keep, and the mount flags
+ (MS_*), they stand for. Their values differ: ST_RELATIME is 0x1000, but
+ MS_RELATIME is 0x200000.
+ */
+var stMountFlags = [...]struct{
+	st int64
+	ms uintptr
+}{
+	{0x0002,syscall.MS_NOSUID},
+	{0x0004,syscall.MS_NODEV},
+	{0x0008,syscall.MS_NOEXEC},
+	{0x0400,syscall.MS_NOATIME},
+	{0x0800,syscall.MS_NODIRATIME},
+	{0x1000,syscall.MS_RELATIME},
+}
+
+// Returns the mount flags for the statfs() flags f.
+func mountFlags(f int64) uintptr {
+	var r uintptr
+	for _,m := range stMountFlags {
+		if (f&m.st)!=0 { r |= m.ms }
+	}
+	// Neither relatime nor noatime: a remount would default to relatime.
+	if (r&(syscall.MS_NOATIME|syscall.MS_RELATIME))==0 { r |= syscall.MS_STRICTATIME }
+	return r
+}
+
+func bindMountOld(src, dst string, readonly bool) error {
+	err := syscall.Mount(src,dst,"",syscall.MS_BIND|syscall.MS_REC,"")
+	if err!=nil || !readonly { return err }
+	// MS_RDONLY only applies to the mount given, so every submount is remounted.
+	mps,err := submounts(dst)
+	if err!=nil { return err }
+	for _,mp := range mps {
+		var st syscall.Statfs_t
+		err = syscall.Statfs(mp,&st)
+		if err!=nil { return err }
+		flags := mountFlags(int64(st.Flags))
+		err = syscall.Mount("",mp,"",flags|syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY,"")
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+// Unescapes the octal escapes (e.g. "\040") of /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	if strings.IndexByte(s,'\\')<0 { return s }
+	b := make([]byte,0,len(s))
+	for i := 0; i<len(s); i++ {
+		if s[i]=='\\' && i+3<len(s) {
+			if n,err := strconv.ParseUint(s[i+1:i+4],8,8); err==nil {
+				b = append(b,byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b,s[i])
+	}
+	return string(b)
+}
+
+/*
+ Returns the mount points at or below dir, parents first, from
+ /proc/self/mountinfo. A mount point covered by another one is returned once.
+ */
+func submounts(dir string) ([]string,error) {
+	dir,err := filepath.EvalSymlinks(dir)
+	if err!=nil { return nil,err }
+	dir,err = filepath.Abs(dir)
+	if err!=nil { return nil,err }
+	f,err := os.Open("/proc/self/mountinfo")
+	if err!=nil { return nil,err }
+	defer f.Close()
+	var r []string
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fl := strings.Fields(s.Text())
+		if len(fl)<5 { continue }
+		mp := unescapeMountinfo(fl[4])
+		if mp!=dir && !strings.HasPrefix(mp,dir+"/") && dir!="/" { continue }
+		if seen[mp] { continue }
+		seen[mp] = true
+		r = append(r,mp)
+	}
+	return r,s.Err()
+}
+
+// Recreates src within root: a symlink stays a symlink, a directory is bind-mounted.
+func minimalRootDir(root, src string) error {
+	fi,err := os.Lstat(src)
+	if os.IsNotExist(err) { return nil }
+	if err!=nil { return err }
+	dst := filepath.Join(root,src)
+	if fi.Mode()&os.ModeSymlink!=0 {
+		l,err := os.Readlink(src)
+		if err!=nil { return err }
+		return os.Symlink(l,dst)
+	}
+	err = os.MkdirAll(dst,0755)
+	if err!=nil { return err }
+	return BindMount(src,dst,true)
+}
+
+/*
+ Builds a minimal root file system in the (empty) directory root:
+ A tmpfs is mounted on root, MinimalRootDirs are bind-mounted read-only, a
+ private tmpfs is mounted on /tmp and /dev contains bind-mounts of the devices
+ in MinimalRootDevs.
+
+ The calling process should be in its own mount namespace (and user namespace,
+ if unprivileged), as mount propagation of / is made private.
+ */
+func MakeMinimalRoot(root string) error {
+	err := syscall.Mount("","/","",syscall.MS_REC|syscall.MS_PRIVATE,"")
+	if err!=nil { return err }
+	err = MountTmpfs(root,MOUNT_ATTR_NOSUID|MOUNT_ATTR_NODEV,"0755")
+	if err!=nil { return err }
+	for _,d := range MinimalRootDirs {
+		err = minimalRootDir(root,d)
+		if err!=nil { return err }
+	}
+	tmp := filepath.Join(root,"tmp")
+	err = os.Mkdir(tmp,0755)
+	if err!=nil { return err }
+	err = MountTmpfs(tmp,MOUNT_ATTR_NOSUID|MOUNT_ATTR_NODEV,"1777")
+	if err!=nil { return err }
+	dev := filepath.Join(root,"dev")
+	err = os.Mkdir(dev,0755)
+	if err!=nil { return err }
+	err = MountTmpfs(dev,MOUNT_ATTR_NOSUID|MOUNT_ATTR_NOEXEC,"0755")
+	if err!=nil { return err }
+	for _,n := range MinimalRootDevs {
+		src := filepath.Join("/dev",n)
+		if _,err := os.Stat(src); err!=nil { continue }
+		dst := filepath.Join(dev,n)
+		f,err := os.OpenFile(dst,os.O_CREATE|os.O_WRONLY,0666)
+		if err!=nil { return err }
+		f.Close()
+		err = BindMount(src,dst,false)
+		if err!=nil { return err }
+	}
+	for n,l := range map[string]string{
+		"fd":"/proc/self/fd",
+		"stdin":"/proc/self/fd/0",
+		"stdout":"/proc/self/fd/1",
+		"stderr":"/proc/self/fd/2",
+	} {
+		err = os.Symlink(l,filepath.Join(dev,n))
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+ Makes root the new root directory of the mount namespace, using
+ pivot_root(2), and detaches the old root. root must be a mount point.
+ */
+func PivotInto(root string) error {
+	err := syscall.Chdir(root)
+	if err!=nil { return err }
+	err = PivotRoot(".",".")
+	if err!=nil { return err }
+	err = syscall.Unmount(".",syscall.MNT_DETACH)
+	if err!=nil { return err }
+	return syscall.Chdir("/")
+}
+
+/*
+ Does MakeMinimalRoot(root) followed by PivotInto(root).
+ */
+func EnterMinimalRoot(root string) error {
+	err := MakeMinimalRoot(root)
+	if err!=nil { return err }
+	return PivotInto(root)
+}
+
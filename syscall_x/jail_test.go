@@ -0,0 +1,29 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "testing"
+
+func TestMountFlags(t *testing.T) {
+	for _,tt := range []struct{
+		st int64
+		ms uintptr
+	}{
+		{0,syscall.MS_STRICTATIME},
+		// ST_RDONLY and ST_SYNCHRONOUS are not kept.
+		{0x0001|0x0010|0x1000,syscall.MS_RELATIME},
+		{0x0002|0x0004|0x0008|0x1000,syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC|syscall.MS_RELATIME},
+		{0x0400|0x0800,syscall.MS_NOATIME|syscall.MS_NODIRATIME},
+		{0x0800,syscall.MS_NODIRATIME|syscall.MS_STRICTATIME},
+	} {
+		if ms := mountFlags(tt.st); ms!=tt.ms { t.Errorf("%#x: %#x, want %#x",tt.st,ms,tt.ms) }
+	}
+}
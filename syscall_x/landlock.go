@@ -0,0 +1,114 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+
+const LANDLOCK_CREATE_RULESET_VERSION = 1<<0
+
+const LANDLOCK_RULE_PATH_BENEATH = 1
+const LANDLOCK_RULE_NET_PORT     = 2
+
+// ABI 1
+const LANDLOCK_ACCESS_FS_EXECUTE     = 1<<0
+const LANDLOCK_ACCESS_FS_WRITE_FILE  = 1<<1
+const LANDLOCK_ACCESS_FS_READ_FILE   = 1<<2
+const LANDLOCK_ACCESS_FS_READ_DIR    = 1<<3
+const LANDLOCK_ACCESS_FS_REMOVE_DIR  = 1<<4
+const LANDLOCK_ACCESS_FS_REMOVE_FILE = 1<<5
+const LANDLOCK_ACCESS_FS_MAKE_CHAR   = 1<<6
+const LANDLOCK_ACCESS_FS_MAKE_DIR    = 1<<7
+const LANDLOCK_ACCESS_FS_MAKE_REG    = 1<<8
+const LANDLOCK_ACCESS_FS_MAKE_SOCK   = 1<<9
+const LANDLOCK_ACCESS_FS_MAKE_FIFO   = 1<<10
+const LANDLOCK_ACCESS_FS_MAKE_BLOCK  = 1<<11
+const LANDLOCK_ACCESS_FS_MAKE_SYM    = 1<<12
+// ABI 2
+const LANDLOCK_ACCESS_FS_REFER       = 1<<13
+// ABI 3
+const LANDLOCK_ACCESS_FS_TRUNCATE    = 1<<14
+// ABI 5
+const LANDLOCK_ACCESS_FS_IOCTL_DEV   = 1<<15
+
+// ABI 4
+const LANDLOCK_ACCESS_NET_BIND_TCP    = 1<<0
+const LANDLOCK_ACCESS_NET_CONNECT_TCP = 1<<1
+
+// ABI 6
+const LANDLOCK_SCOPE_ABSTRACT_UNIX_SOCKET = 1<<0
+const LANDLOCK_SCOPE_SIGNAL               = 1<<1
+
+// struct landlock_ruleset_attr. Fields unknown to the kernel must be zero.
+type LandlockRulesetAttr struct{
+	Handled_access_fs  uint64
+	Handled_access_net uint64
+	Scoped             uint64
+}
+
+// struct landlock_path_beneath_attr (packed, the kernel reads 12 bytes).
+type LandlockPathBeneathAttr struct{
+	Allowed_access uint64
+	Parent_fd      int32
+}
+
+// struct landlock_net_port_attr
+type LandlockNetPortAttr struct{
+	Allowed_access uint64
+	Port           uint64
+}
+
+/*
+ Does landlock_create_ruleset(attr,sizeof(*attr),flags). Returns the ruleset fd.
+ */
+func LandlockCreateRuleset(attr *LandlockRulesetAttr, flags int) (int,error) {
+	return sysResult(syscall.Syscall(sys_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(attr)),unsafe.Sizeof(*attr),uintptr(flags)))
+}
+
+/*
+ Returns the highest Landlock ABI version supported by the kernel. Fails with
+ ENOSYS or EOPNOTSUPP, if Landlock is not available.
+ */
+func LandlockABIVersion() (int,error) {
+	return sysResult(syscall.Syscall(sys_LANDLOCK_CREATE_RULESET,0,0,LANDLOCK_CREATE_RULESET_VERSION))
+}
+
+/*
+ Does landlock_add_rule(rulesetFd,ruleType,attr,flags).
+ */
+func LandlockAddRule(rulesetFd int, ruleType int, attr unsafe.Pointer, flags int) error {
+	_,_,e := syscall.Syscall6(sys_LANDLOCK_ADD_RULE,uintptr(rulesetFd),uintptr(ruleType),uintptr(attr),uintptr(flags),0,0)
+	if e!=0 { return e }
+	return nil
+}
+
+// Allows access beneath the directory (or to the file) parentFd.
+func LandlockAddPathRule(rulesetFd int, access uint64, parentFd int) error {
+	attr := LandlockPathBeneathAttr{access,int32(parentFd)}
+	return LandlockAddRule(rulesetFd,LANDLOCK_RULE_PATH_BENEATH,unsafe.Pointer(&attr),0)
+}
+
+// Allows access (LANDLOCK_ACCESS_NET_*) to the TCP port.
+func LandlockAddNetRule(rulesetFd int, access uint64, port uint16) error {
+	attr := LandlockNetPortAttr{access,uint64(port)}
+	return LandlockAddRule(rulesetFd,LANDLOCK_RULE_NET_PORT,unsafe.Pointer(&attr),0)
+}
+
+/*
+ Does landlock_restrict_self(rulesetFd,flags) on every thread of the process
+ (see PrctlAllThreads; with cgo, syscall.ENOTSUP is returned). no_new_privs
+ must be set (SetNoNewPrivs) or the caller needs CAP_SYS_ADMIN.
+ */
+func LandlockRestrictSelf(rulesetFd int, flags int) error {
+	_,err := allThreads(sys_LANDLOCK_RESTRICT_SELF,uintptr(rulesetFd),uintptr(flags),0,0,0,0)
+	return err
+}
+
@@ -0,0 +1,223 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+
+const O_PATH              = 0x200000
+
+const AT_FDCWD            = -100
+const AT_SYMLINK_NOFOLLOW = 0x100
+const AT_NO_AUTOMOUNT     = 0x800
+const AT_EMPTY_PATH       = 0x1000
+const AT_RECURSIVE        = 0x8000
+
+const FSOPEN_CLOEXEC  = 1
+const FSPICK_CLOEXEC          = 1
+const FSPICK_SYMLINK_NOFOLLOW = 2
+const FSPICK_NO_AUTOMOUNT     = 4
+const FSPICK_EMPTY_PATH       = 8
+const FSMOUNT_CLOEXEC = 1
+
+const FSCONFIG_SET_FLAG        = 0
+const FSCONFIG_SET_STRING      = 1
+const FSCONFIG_SET_BINARY      = 2
+const FSCONFIG_SET_PATH        = 3
+const FSCONFIG_SET_PATH_EMPTY  = 4
+const FSCONFIG_SET_FD          = 5
+const FSCONFIG_CMD_CREATE      = 6
+const FSCONFIG_CMD_RECONFIGURE = 7
+const FSCONFIG_CMD_CREATE_EXCL = 8
+
+const MOVE_MOUNT_F_SYMLINKS   = 0x001
+const MOVE_MOUNT_F_AUTOMOUNTS = 0x002
+const MOVE_MOUNT_F_EMPTY_PATH = 0x004
+const MOVE_MOUNT_T_SYMLINKS   = 0x010
+const MOVE_MOUNT_T_AUTOMOUNTS = 0x020
+const MOVE_MOUNT_T_EMPTY_PATH = 0x040
+const MOVE_MOUNT_SET_GROUP    = 0x100
+const MOVE_MOUNT_BENEATH      = 0x200
+
+const OPEN_TREE_CLONE   = 1
+const OPEN_TREE_CLOEXEC = syscall.O_CLOEXEC
+
+const MOUNT_ATTR_RDONLY      = 0x000001
+const MOUNT_ATTR_NOSUID      = 0x000002
+const MOUNT_ATTR_NODEV       = 0x000004
+const MOUNT_ATTR_NOEXEC      = 0x000008
+const MOUNT_ATTR__ATIME      = 0x000070
+const MOUNT_ATTR_RELATIME    = 0x000000
+const MOUNT_ATTR_NOATIME     = 0x000010
+const MOUNT_ATTR_STRICTATIME = 0x000020
+const MOUNT_ATTR_NODIRATIME  = 0x000080
+const MOUNT_ATTR_IDMAP       = 0x100000
+const MOUNT_ATTR_NOSYMFOLLOW = 0x200000
+
+// struct mount_attr (MOUNT_ATTR_SIZE_VER0)
+type MountAttr struct{
+	Attr_set    uint64
+	Attr_clr    uint64
+	Propagation uint64
+	Userns_fd   uint64
+}
+
+func sysResult(r, _ uintptr, e syscall.Errno) (int,error) {
+	if e!=0 { return -1,e }
+	return int(r),nil
+}
+
+func pathPtr(path string) (*byte,error) {
+	return syscall.BytePtrFromString(path)
+}
+
+/*
+ Does fsopen(fsname,flags). Returns a filesystem context (Linux 5.2 or newer).
+ */
+func Fsopen(fsname string, flags int) (int,error) {
+	p,err := pathPtr(fsname)
+	if err!=nil { return -1,err }
+	return sysResult(syscall.Syscall(sys_FSOPEN,uintptr(unsafe.Pointer(p)),uintptr(flags),0))
+}
+
+/*
+ Does fspick(dirfd,path,flags). Returns a filesystem context for the
+ reconfiguration of an existing mount.
+ */
+func Fspick(dirfd int, path string, flags int) (int,error) {
+	p,err := pathPtr(path)
+	if err!=nil { return -1,err }
+	return sysResult(syscall.Syscall(sys_FSPICK,uintptr(dirfd),uintptr(unsafe.Pointer(p)),uintptr(flags)))
+}
+
+/*
+ Does fsconfig(fd,cmd,key,value,aux).
+ */
+func Fsconfig(fd int, cmd int, key string, value unsafe.Pointer, aux int) error {
+	var k *byte
+	if key!="" {
+		var err error
+		k,err = pathPtr(key)
+		if err!=nil { return err }
+	}
+	_,_,e := syscall.Syscall6(sys_FSCONFIG,uintptr(fd),uintptr(cmd),uintptr(unsafe.Pointer(k)),uintptr(value),uintptr(aux),0)
+	if e!=0 { return e }
+	return nil
+}
+
+func FsconfigSetFlag(fd int, key string) error {
+	return Fsconfig(fd,FSCONFIG_SET_FLAG,key,nil,0)
+}
+func FsconfigSetString(fd int, key, value string) error {
+	v,err := pathPtr(value)
+	if err!=nil { return err }
+	return Fsconfig(fd,FSCONFIG_SET_STRING,key,unsafe.Pointer(v),0)
+}
+func FsconfigSetFd(fd int, key string, value int) error {
+	return Fsconfig(fd,FSCONFIG_SET_FD,key,nil,value)
+}
+func FsconfigCreate(fd int) error {
+	return Fsconfig(fd,FSCONFIG_CMD_CREATE,"",nil,0)
+}
+func FsconfigReconfigure(fd int) error {
+	return Fsconfig(fd,FSCONFIG_CMD_RECONFIGURE,"",nil,0)
+}
+
+/*
+ Does fsmount(fsfd,flags,attrFlags). attrFlags are MOUNT_ATTR_*. Returns a
+ detached mount, that can be attached with MoveMount.
+ */
+func Fsmount(fsfd int, flags int, attrFlags int) (int,error) {
+	return sysResult(syscall.Syscall(sys_FSMOUNT,uintptr(fsfd),uintptr(flags),uintptr(attrFlags)))
+}
+
+/*
+ Does move_mount(fromDirfd,fromPath,toDirfd,toPath,flags).
+ */
+func MoveMount(fromDirfd int, fromPath string, toDirfd int, toPath string, flags int) error {
+	f,err := pathPtr(fromPath)
+	if err!=nil { return err }
+	t,err := pathPtr(toPath)
+	if err!=nil { return err }
+	_,_,e := syscall.Syscall6(sys_MOVE_MOUNT,
+		uintptr(fromDirfd),uintptr(unsafe.Pointer(f)),
+		uintptr(toDirfd),uintptr(unsafe.Pointer(t)),
+		uintptr(flags),0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Does open_tree(dirfd,path,flags). With OPEN_TREE_CLONE (and AT_RECURSIVE),
+ a detached copy of the mount (tree) is created, like a bind mount.
+ */
+func OpenTree(dirfd int, path string, flags int) (int,error) {
+	p,err := pathPtr(path)
+	if err!=nil { return -1,err }
+	return sysResult(syscall.Syscall(sys_OPEN_TREE,uintptr(dirfd),uintptr(unsafe.Pointer(p)),uintptr(flags)))
+}
+
+/*
+ Does mount_setattr(dirfd,path,flags,attr,sizeof(*attr)) (Linux 5.12 or newer).
+ */
+func MountSetattr(dirfd int, path string, flags int, attr *MountAttr) error {
+	p,err := pathPtr(path)
+	if err!=nil { return err }
+	_,_,e := syscall.Syscall6(sys_MOUNT_SETATTR,
+		uintptr(dirfd),uintptr(unsafe.Pointer(p)),uintptr(flags),
+		uintptr(unsafe.Pointer(attr)),unsafe.Sizeof(*attr),0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Does pivot_root(newroot,putold). newroot and putold may be the same
+ directory, the old root is then stacked on top of the new one and can be
+ unmounted with umount2(".",MNT_DETACH).
+ */
+func PivotRoot(newroot, putold string) error {
+	n,err := pathPtr(newroot)
+	if err!=nil { return err }
+	o,err := pathPtr(putold)
+	if err!=nil { return err }
+	_,_,e := syscall.Syscall(syscall.SYS_PIVOT_ROOT,uintptr(unsafe.Pointer(n)),uintptr(unsafe.Pointer(o)),0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Creates a detached, recursive bind mount of src and applies attr to it.
+ Returns the mount fd, which can be attached with MoveMount.
+ */
+func CloneTree(src string, attr *MountAttr) (int,error) {
+	fd,err := OpenTree(AT_FDCWD,src,OPEN_TREE_CLONE|OPEN_TREE_CLOEXEC|AT_RECURSIVE)
+	if err!=nil { return -1,err }
+	if attr!=nil {
+		err = MountSetattr(fd,"",AT_EMPTY_PATH|AT_RECURSIVE,attr)
+		if err!=nil { syscall.Close(fd); return -1,err }
+	}
+	return fd,nil
+}
+
+/*
+ Bind-mounts src onto dst, with the ownership mapped through the user
+ namespace usernsFd (a file /proc/[pid]/ns/user). The filesystem of src must
+ support idmapped mounts.
+ */
+func IdmappedBind(src, dst string, usernsFd int, attrFlags int) error {
+	attr := &MountAttr{Attr_set: uint64(attrFlags)|MOUNT_ATTR_IDMAP, Userns_fd: uint64(usernsFd)}
+	fd,err := OpenTree(AT_FDCWD,src,OPEN_TREE_CLONE|OPEN_TREE_CLOEXEC)
+	if err!=nil { return err }
+	defer syscall.Close(fd)
+	err = MountSetattr(fd,"",AT_EMPTY_PATH,attr)
+	if err!=nil { return err }
+	return MoveMount(fd,"",AT_FDCWD,dst,MOVE_MOUNT_F_EMPTY_PATH)
+}
+
@@ -0,0 +1,198 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "os"
+import "os/exec"
+import "fmt"
+import "bytes"
+import "strconv"
+
+/*
+ The time namespace flag only works with Unshare (and Setns): clone() uses the
+ low byte of its flags for the exit signal, so it can not be passed there (nor
+ in NsAttr.Cloneflags or SysProcAttr.Cloneflags). After Unshare, the children
+ of the caller get the new time namespace.
+ */
+const CLONE_NEWTIME   = 0x00000080
+const CLONE_NEWNS     = 0x00020000
+const CLONE_NEWCGROUP = 0x02000000
+const CLONE_NEWUTS    = 0x04000000
+const CLONE_NEWIPC    = 0x08000000
+const CLONE_NEWUSER   = 0x10000000
+const CLONE_NEWPID    = 0x20000000
+const CLONE_NEWNET    = 0x40000000
+
+const PIDFD_NONBLOCK = syscall.O_NONBLOCK
+
+/*
+ Does unshare(flags). Note, that most namespaces are a per-thread attribute,
+ use runtime.LockOSThread() before.
+ */
+func Unshare(flags int) error {
+	_,_,e := syscall.Syscall(syscall.SYS_UNSHARE,uintptr(flags),0,0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Does setns(fd,nstype). fd is either a file in /proc/[pid]/ns/ or a pidfd.
+ nstype is 0 or one or more CLONE_NEW*-Flags.
+ */
+func Setns(fd int, nstype int) error {
+	_,_,e := syscall.Syscall(sys_SETNS,uintptr(fd),uintptr(nstype),0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Does pidfd_open(pid,flags). Returns a file descriptor referring to the
+ process. Linux 5.3 or newer.
+ */
+func PidfdOpen(pid int, flags int) (int,error) {
+	fd,_,e := syscall.Syscall(sys_PIDFD_OPEN,uintptr(pid),uintptr(flags),0)
+	if e!=0 { return -1,e }
+	return int(fd),nil
+}
+
+/*
+ Does pidfd_send_signal(pidfd,sig,NULL,flags).
+ */
+func PidfdSendSignal(pidfd int, sig syscall.Signal, flags int) error {
+	_,_,e := syscall.Syscall6(sys_PIDFD_SEND_SIGNAL,uintptr(pidfd),uintptr(sig),0,uintptr(flags),0,0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Does pidfd_getfd(pidfd,targetfd,flags). Duplicates the file descriptor
+ targetfd of the process referred to by pidfd. Linux 5.6 or newer.
+ */
+func PidfdGetfd(pidfd int, targetfd int, flags int) (int,error) {
+	fd,_,e := syscall.Syscall(sys_PIDFD_GETFD,uintptr(pidfd),uintptr(targetfd),uintptr(flags))
+	if e!=0 { return -1,e }
+	return int(fd),nil
+}
+
+// Opens /proc/[pid]/ns/[name]. Use pid=0 for the own process.
+func OpenNs(pid int, name string) (*os.File,error) {
+	return os.Open(procPath(pid,"ns/"+name))
+}
+
+func procPath(pid int, name string) string {
+	if pid==0 { return "/proc/self/"+name }
+	return "/proc/"+strconv.Itoa(pid)+"/"+name
+}
+
+// One line of an uid_map or gid_map.
+type IDMap struct{
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+func writeProc(pid int, name string, data []byte) error {
+	f,err := os.OpenFile(procPath(pid,name),os.O_WRONLY,0)
+	if err!=nil { return err }
+	// The kernel wants the map in a single write.
+	_,err = f.Write(data)
+	e2 := f.Close()
+	if err==nil { err = e2 }
+	return err
+}
+
+func formatIDMap(m []IDMap) []byte {
+	buf := new(bytes.Buffer)
+	for _,e := range m { fmt.Fprintf(buf,"%d %d %d\n",e.ContainerID,e.HostID,e.Size) }
+	return buf.Bytes()
+}
+
+// Writes /proc/[pid]/uid_map. Use pid=0 for the own process.
+func WriteUidMap(pid int, m []IDMap) error {
+	return writeProc(pid,"uid_map",formatIDMap(m))
+}
+
+/*
+ Writes /proc/[pid]/gid_map. Use pid=0 for the own process. An unprivileged
+ process must call WriteSetgroups(pid,false) first.
+ */
+func WriteGidMap(pid int, m []IDMap) error {
+	return writeProc(pid,"gid_map",formatIDMap(m))
+}
+
+// Writes "allow" or "deny" to /proc/[pid]/setgroups.
+func WriteSetgroups(pid int, allow bool) error {
+	s := "deny"
+	if allow { s = "allow" }
+	err := writeProc(pid,"setgroups",[]byte(s))
+	if os.IsNotExist(err) { err = nil } // Kernel older than 3.19
+	return err
+}
+
+/*
+ Describes the namespaces, a command is started in.
+ */
+type NsAttr struct{
+	// CLONE_NEW*-Flags
+	Cloneflags uintptr
+	UidMap     []IDMap
+	GidMap     []IDMap
+	// Allow setgroups(2) in the new user namespace. Must be false,
+	// if the caller is unprivileged.
+	Setgroups  bool
+}
+
+/*
+ Returns an NsAttr for the given CLONE_NEW*-Flags, that works without
+ privileges: It adds CLONE_NEWUSER and maps the current user and group to root
+ in the new user namespace.
+ */
+func RootlessNsAttr(flags uintptr) *NsAttr {
+	return &NsAttr{
+		Cloneflags: flags|CLONE_NEWUSER,
+		UidMap: []IDMap{{0,os.Geteuid(),1}},
+		GidMap: []IDMap{{0,os.Getegid(),1}},
+	}
+}
+
+func toSysProcIDMap(m []IDMap) []syscall.SysProcIDMap {
+	if len(m)==0 { return nil }
+	r := make([]syscall.SysProcIDMap,len(m))
+	for i,e := range m { r[i] = syscall.SysProcIDMap{ContainerID:e.ContainerID,HostID:e.HostID,Size:e.Size} }
+	return r
+}
+
+/*
+ Sets cmd.SysProcAttr, so that cmd is started in the namespaces described by n.
+ Other fields of SysProcAttr are preserved.
+
+ If mappings are given, CLONE_NEWUSER is implied. Without CLONE_NEWUSER in n,
+ the mappings of n are ignored and those of SysProcAttr are kept. With
+ CLONE_NEWPID, Pdeathsig defaults to SIGKILL. CLONE_NEWTIME must not be used
+ (see there).
+ */
+func (n *NsAttr) Apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr==nil { cmd.SysProcAttr = new(syscall.SysProcAttr) }
+	a := cmd.SysProcAttr
+	flags := n.Cloneflags
+	if len(n.UidMap)>0 || len(n.GidMap)>0 { flags |= CLONE_NEWUSER }
+	a.Cloneflags |= flags
+	if (flags&CLONE_NEWUSER)!=0 {
+		a.UidMappings = toSysProcIDMap(n.UidMap)
+		a.GidMappings = toSysProcIDMap(n.GidMap)
+		a.GidMappingsEnableSetgroups = n.Setgroups
+	}
+	if (flags&CLONE_NEWPID)!=0 {
+		// The child is PID 1 of its namespace; it should not outlive us.
+		if a.Pdeathsig==0 { a.Pdeathsig = syscall.SIGKILL }
+	}
+}
+
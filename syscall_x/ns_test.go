@@ -0,0 +1,60 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "os"
+import "os/exec"
+import "reflect"
+import "syscall"
+import "testing"
+
+func TestNsAttrApply(t *testing.T) {
+	callerMap := []syscall.SysProcIDMap{{ContainerID: 0, HostID: 1000, Size: 1}}
+	tests := []struct{
+		name string
+		attr *syscall.SysProcAttr
+		n    NsAttr
+		want syscall.SysProcAttr
+	}{
+		{"plain",nil,NsAttr{Cloneflags: CLONE_NEWUTS|CLONE_NEWIPC},
+			syscall.SysProcAttr{Cloneflags: CLONE_NEWUTS|CLONE_NEWIPC}},
+		{"mappings imply user ns",nil,NsAttr{UidMap: []IDMap{{0,1000,1}}, GidMap: []IDMap{{0,100,1}}, Setgroups: true},
+			syscall.SysProcAttr{Cloneflags: CLONE_NEWUSER,
+				UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 1000, Size: 1}},
+				GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100, Size: 1}},
+				GidMappingsEnableSetgroups: true}},
+		{"user ns without mappings",nil,NsAttr{Cloneflags: CLONE_NEWUSER},
+			syscall.SysProcAttr{Cloneflags: CLONE_NEWUSER}},
+		{"pid ns sets pdeathsig",nil,NsAttr{Cloneflags: CLONE_NEWPID},
+			syscall.SysProcAttr{Cloneflags: CLONE_NEWPID, Pdeathsig: syscall.SIGKILL}},
+		{"pid ns keeps pdeathsig",&syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM},NsAttr{Cloneflags: CLONE_NEWPID},
+			syscall.SysProcAttr{Cloneflags: CLONE_NEWPID, Pdeathsig: syscall.SIGTERM}},
+		{"flags are added",&syscall.SysProcAttr{Cloneflags: CLONE_NEWNS, Setsid: true},NsAttr{Cloneflags: CLONE_NEWNET},
+			syscall.SysProcAttr{Cloneflags: CLONE_NEWNS|CLONE_NEWNET, Setsid: true}},
+		{"caller's user ns is kept",&syscall.SysProcAttr{Cloneflags: CLONE_NEWUSER, UidMappings: callerMap, GidMappings: callerMap},
+			NsAttr{Cloneflags: CLONE_NEWNS},
+			syscall.SysProcAttr{Cloneflags: CLONE_NEWUSER|CLONE_NEWNS, UidMappings: callerMap, GidMappings: callerMap}},
+	}
+	for _,tt := range tests {
+		cmd := exec.Command("true")
+		cmd.SysProcAttr = tt.attr
+		tt.n.Apply(cmd)
+		if !reflect.DeepEqual(*cmd.SysProcAttr,tt.want) { t.Errorf("%s: got %+v, want %+v",tt.name,*cmd.SysProcAttr,tt.want) }
+	}
+}
+
+func TestRootlessNsAttr(t *testing.T) {
+	n := RootlessNsAttr(CLONE_NEWNS)
+	if n.Cloneflags!=CLONE_NEWNS|CLONE_NEWUSER { t.Errorf("flags %#x",n.Cloneflags) }
+	want := []IDMap{{0,os.Geteuid(),1}}
+	if !reflect.DeepEqual(n.UidMap,want) { t.Errorf("uid map %+v",n.UidMap) }
+	want = []IDMap{{0,os.Getegid(),1}}
+	if !reflect.DeepEqual(n.GidMap,want) { t.Errorf("gid map %+v",n.GidMap) }
+}
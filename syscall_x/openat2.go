@@ -0,0 +1,237 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+import "strings"
+import "strconv"
+import "io/ioutil"
+import "os"
+
+// openat2() resolve flags (OpenHow.Resolve).
+const RESOLVE_NO_XDEV       = 0x01
+const RESOLVE_NO_MAGICLINKS = 0x02
+const RESOLVE_NO_SYMLINKS   = 0x04
+const RESOLVE_BENEATH       = 0x08
+const RESOLVE_IN_ROOT       = 0x10
+const RESOLVE_CACHED        = 0x20
+
+const O_TMPFILE = 0x400000|syscall.O_DIRECTORY
+
+// struct open_how
+type OpenHow struct{
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64
+}
+
+/*
+ Does openat2(dirfd,path,how,sizeof(*how)). Linux 5.6 or newer. Unlike
+ openat(), unknown flags and a mode without O_CREAT/O_TMPFILE are rejected
+ with EINVAL.
+ */
+func Openat2(dirfd int, path string, how *OpenHow) (int,error) {
+	p,err := syscall.BytePtrFromString(path)
+	if err!=nil { return -1,err }
+	return sysResult(syscall.Syscall6(sys_OPENAT2,uintptr(dirfd),uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(how)),unsafe.Sizeof(*how),0,0))
+}
+
+// Does readlinkat(fd,"",...), which reads the symlink fd (opened with O_PATH|O_NOFOLLOW).
+func readlinkFd(fd int) (string,error) {
+	var empty [1]byte
+	for n := 256;; n *= 2 {
+		buf := make([]byte,n)
+		r,err := sysResult(syscall.Syscall6(syscall.SYS_READLINKAT,uintptr(fd),
+			uintptr(unsafe.Pointer(&empty[0])),uintptr(unsafe.Pointer(&buf[0])),uintptr(n),0,0))
+		if err!=nil { return "",err }
+		if r<n { return string(buf[:r]),nil }
+	}
+}
+
+// Like the kernel's MAXSYMLINKS.
+const maxSymlinks = 40
+
+func closeAll(fds []int) {
+	for _,fd := range fds { syscall.Close(fd) }
+}
+
+/*
+ Returns the mount ID of the open file fd: from statx() (Linux 5.8), or else
+ from /proc/self/fdinfo.
+ */
+func mountID(fd int) (uint64,error) {
+	var st Statx_t
+	err := Statx(fd,"",AT_EMPTY_PATH,STATX_MNT_ID,&st)
+	if err==nil && (st.Mask&STATX_MNT_ID)!=0 { return st.Mnt_id,nil }
+	b,err := ioutil.ReadFile("/proc/self/fdinfo/"+strconv.Itoa(fd))
+	if err!=nil { return 0,err }
+	for _,l := range strings.Split(string(b),"\n") {
+		if strings.HasPrefix(l,"mnt_id:") { return strconv.ParseUint(strings.TrimSpace(l[7:]),10,64) }
+	}
+	return 0,syscall.ENOSYS
+}
+
+/*
+ Resolves path beneath dirfd in user space, one component at a time, for
+ kernels without openat2(). Every component is opened with O_PATH|O_NOFOLLOW
+ relative to its parent; symlinks are read and their targets are resolved the
+ same way, ".." goes back to the parent, that has been opened before, and
+ never above dirfd. Magic links are not followed, as they are resolved like
+ ordinary symlinks.
+
+ Unlike openat2(), this does not detect concurrent renames: if a directory
+ on the path is moved out of dirfd meanwhile, the file is opened outside of it.
+ */
+func openBeneath(dirfd int, path string, flags int, mode uint32, resolve uint64) (int,error) {
+	if strings.HasPrefix(path,"/") && (resolve&RESOLVE_IN_ROOT)==0 { return -1,syscall.EXDEV }
+	var rootMnt uint64
+	xdev := func(fd int) error {
+		if (resolve&RESOLVE_NO_XDEV)==0 { return nil }
+		m,err := mountID(fd)
+		if err==nil && m!=rootMnt { err = syscall.EXDEV }
+		return err
+	}
+	if (resolve&RESOLVE_NO_XDEV)!=0 {
+		var err error
+		if rootMnt,err = mountID(dirfd); err!=nil { return -1,err }
+	}
+	var stack []int
+	defer func() { closeAll(stack) }()
+	cur := func() int {
+		if len(stack)==0 { return dirfd }
+		return stack[len(stack)-1]
+	}
+	queue := strings.Split(path,"/")
+	links := 0
+	for len(queue)>0 {
+		name := queue[0]
+		queue = queue[1:]
+		switch name {
+		case "",".": continue
+		case "..":
+			if len(stack)==0 {
+				if (resolve&RESOLVE_IN_ROOT)==0 { return -1,syscall.EXDEV }
+				continue
+			}
+			syscall.Close(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		last := true
+		for _,q := range queue {
+			if q!="" && q!="." { last = false; break }
+		}
+		// A trailing slash: the last component must be a directory.
+		dirOnly := last && len(queue)>0
+		if dirOnly && (flags&syscall.O_CREAT)!=0 { return -1,syscall.EISDIR }
+		if last && !dirOnly {
+			// Try the final open directly; O_NOFOLLOW fails with ELOOP on
+			// a symlink, which is then resolved below.
+			fd,err := syscall.Openat(cur(),name,flags|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,mode)
+			if err==nil {
+				if err = xdev(fd); err!=nil { syscall.Close(fd); fd = -1 }
+			}
+			if err!=syscall.ELOOP { return fd,err }
+		}
+		fd,err := syscall.Openat(cur(),name,O_PATH|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,0)
+		if err!=nil { return -1,err }
+		var st syscall.Stat_t
+		err = syscall.Fstat(fd,&st)
+		if err==nil { err = xdev(fd) }
+		if err!=nil { syscall.Close(fd); return -1,err }
+		switch st.Mode&syscall.S_IFMT {
+		case syscall.S_IFLNK:
+			if (resolve&RESOLVE_NO_SYMLINKS)!=0 { syscall.Close(fd); return -1,syscall.ELOOP }
+			// A trailing slash follows the symlink, even with O_NOFOLLOW.
+			if last && !dirOnly && (flags&syscall.O_NOFOLLOW)!=0 { syscall.Close(fd); return -1,syscall.ELOOP }
+			links++
+			if links>maxSymlinks { syscall.Close(fd); return -1,syscall.ELOOP }
+			target,err := readlinkFd(fd)
+			syscall.Close(fd)
+			if err!=nil { return -1,err }
+			if strings.HasPrefix(target,"/") {
+				if (resolve&RESOLVE_IN_ROOT)==0 { return -1,syscall.EXDEV }
+				closeAll(stack)
+				stack = stack[:0]
+			}
+			queue = append(strings.Split(target,"/"),queue...)
+		case syscall.S_IFDIR:
+			stack = append(stack,fd)
+			if last { return syscall.Openat(fd,".",flags|syscall.O_CLOEXEC,mode) }
+		default:
+			syscall.Close(fd)
+			if dirOnly || !last { return -1,syscall.ENOTDIR }
+			// Replaced by a file, since the symlink was seen.
+			return syscall.Openat(cur(),name,flags|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,mode)
+		}
+	}
+	return syscall.Openat(cur(),".",flags|syscall.O_CLOEXEC,mode)
+}
+
+/*
+ Opens path relative to dirfd with openat2() and the resolve flags (RESOLVE_*).
+ On kernels older than 5.6 the path is resolved in user space instead; this
+ fallback honors RESOLVE_BENEATH, RESOLVE_IN_ROOT, RESOLVE_NO_SYMLINKS and
+ RESOLVE_NO_XDEV and never follows magic links. One of RESOLVE_BENEATH or
+ RESOLVE_IN_ROOT must be given, when the fallback is used.
+
+ The fd is close-on-exec.
+ */
+func OpenatBeneath(dirfd int, path string, flags int, mode uint32, resolve uint64) (int,error) {
+	how := OpenHow{Flags: uint64(flags|syscall.O_CLOEXEC), Resolve: resolve}
+	if (flags&(syscall.O_CREAT|O_TMPFILE))!=0 { how.Mode = uint64(mode) }
+	fd,err := Openat2(dirfd,path,&how)
+	if err!=syscall.ENOSYS { return fd,err }
+	if (resolve&(RESOLVE_BENEATH|RESOLVE_IN_ROOT))==0 { return -1,syscall.EINVAL }
+	return openBeneath(dirfd,path,flags,mode,resolve&^RESOLVE_CACHED)
+}
+
+/*
+ Opens path inside the directory dir, treating dir as the root directory:
+ Absolute paths, ".." and symlinks are resolved within dir and can not escape
+ it (RESOLVE_IN_ROOT|RESOLVE_NO_MAGICLINKS). The flags are O_*, as with
+ os.OpenFile.
+
+ The result can be passed to the fd-based functions, e.g. by
+ posix_acl.Acl.LoadF(int(f.Fd()),...).
+ */
+func OpenInRoot(dir *os.File, path string, flags int, mode os.FileMode) (*os.File,error) {
+	return OpenFileAt(dir,path,flags,mode,RESOLVE_IN_ROOT|RESOLVE_NO_MAGICLINKS)
+}
+
+/*
+ Like OpenInRoot, but with the given resolve flags (RESOLVE_*). With
+ RESOLVE_BENEATH, absolute paths and attempts to leave dir fail with EXDEV.
+ */
+func OpenFileAt(dir *os.File, path string, flags int, mode os.FileMode, resolve uint64) (*os.File,error) {
+	fd,err := OpenatBeneath(int(dir.Fd()),path,flags,fileMode(mode),resolve)
+	if err!=nil { return nil,&os.PathError{Op: "openat2", Path: path, Err: err} }
+	return os.NewFile(uintptr(fd),dir.Name()+"/"+strings.TrimPrefix(path,"/")),nil
+}
+
+func fileMode(m os.FileMode) uint32 {
+	r := uint32(m.Perm())
+	if (m&os.ModeSetuid)!=0 { r |= syscall.S_ISUID }
+	if (m&os.ModeSetgid)!=0 { r |= syscall.S_ISGID }
+	if (m&os.ModeSticky)!=0 { r |= syscall.S_ISVTX }
+	return r
+}
+
+/*
+ Opens the directory root and then path inside it, see OpenInRoot.
+ */
+func OpenInRootPath(root string, path string, flags int, mode os.FileMode) (*os.File,error) {
+	dir,err := os.OpenFile(root,O_PATH|syscall.O_DIRECTORY,0)
+	if err!=nil { return nil,err }
+	defer dir.Close()
+	return OpenInRoot(dir,path,flags,mode)
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strconv"
+import "syscall"
+import "testing"
+
+/*
+ A directory tree: file, dir/file, and symlinks abs -> /file, dir/up ->
+ ../file, esc -> ../../../../file, loop -> loop, flink -> file, dlink -> dir.
+ */
+func testTree(t *testing.T) (string,int) {
+	d,err := ioutil.TempDir("","openat2test")
+	if err!=nil { t.Fatal(err) }
+	os.Mkdir(filepath.Join(d,"dir"),0755)
+	ioutil.WriteFile(filepath.Join(d,"file"),[]byte("root"),0644)
+	ioutil.WriteFile(filepath.Join(d,"dir","file"),[]byte("in"),0644)
+	for l,target := range map[string]string{
+		"abs": "/file", "dir/up": "../file", "esc": "../../../../file",
+		"loop": "loop", "flink": "file", "dlink": "dir",
+	} {
+		if err = os.Symlink(target,filepath.Join(d,l)); err!=nil { t.Fatal(err) }
+	}
+	fd,err := syscall.Open(d,syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC,0)
+	if err!=nil { t.Fatal(err) }
+	return d,fd
+}
+
+// The contents of the file fd, or "/" for a directory; fd is closed.
+func readFd(fd int) string {
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	syscall.Fstat(fd,&st)
+	if st.Mode&syscall.S_IFMT==syscall.S_IFDIR { return "/" }
+	b := make([]byte,64)
+	n,_ := syscall.Read(fd,b)
+	if n<0 { n = 0 }
+	return string(b[:n])
+}
+
+type openTest struct{
+	path    string
+	flags   int
+	resolve uint64
+	want    string
+	err     error
+}
+
+// Runs the tests with openat2(), if available, and with the fallback.
+func runOpenTests(t *testing.T, dirfd int, tests []openTest) {
+	_,err := Openat2(dirfd,".",&OpenHow{Flags: syscall.O_RDONLY|syscall.O_CLOEXEC})
+	kernel := err!=syscall.ENOSYS
+	for _,tt := range tests {
+		check := func(name string, fd int, err error) {
+			got := ""
+			if err==nil { got = readFd(fd) }
+			if err!=tt.err || got!=tt.want { t.Errorf("%s %q (resolve %#x): %q %v, want %q %v",name,tt.path,tt.resolve,got,err,tt.want,tt.err) }
+		}
+		if kernel {
+			fd,err := Openat2(dirfd,tt.path,&OpenHow{Flags: uint64(tt.flags|syscall.O_CLOEXEC), Resolve: tt.resolve})
+			check("openat2",fd,err)
+		}
+		fd,err := openBeneath(dirfd,tt.path,tt.flags,0,tt.resolve)
+		check("fallback",fd,err)
+	}
+}
+
+func TestOpenBeneath(t *testing.T) {
+	d,dirfd := testTree(t)
+	defer os.RemoveAll(d)
+	defer syscall.Close(dirfd)
+	const rd = syscall.O_RDONLY
+	const nf = syscall.O_RDONLY|syscall.O_NOFOLLOW
+	B,R := uint64(RESOLVE_BENEATH),uint64(RESOLVE_IN_ROOT)
+	runOpenTests(t,dirfd,[]openTest{
+		{"file",rd,B,"root",nil},
+		{"dir/file",rd,B,"in",nil},
+		{"./dir//file",rd,B,"in",nil},
+		{"dir/../file",rd,B,"root",nil},
+		{"dir/./../dir/../file",rd,B,"root",nil},
+		{"missing",rd,B,"",syscall.ENOENT},
+		{"dir/file/x",rd,B,"",syscall.ENOTDIR},
+		// ".." and absolute paths.
+		{"..",rd,B,"",syscall.EXDEV},
+		{"../file",rd,B,"",syscall.EXDEV},
+		{"dir/../../file",rd,B,"",syscall.EXDEV},
+		{"/file",rd,B,"",syscall.EXDEV},
+		{"..",rd,R,"/",nil},
+		{"../../file",rd,R,"root",nil},
+		{"dir/../../dir/file",rd,R,"in",nil},
+		{"/file",rd,R,"root",nil},
+		// Symlinks.
+		{"dir/up",rd,B,"root",nil},
+		{"abs",rd,B,"",syscall.EXDEV},
+		{"abs",rd,R,"root",nil},
+		{"esc",rd,B,"",syscall.EXDEV},
+		{"esc",rd,R,"root",nil},
+		{"dlink/file",rd,B,"in",nil},
+		{"dlink/up",rd,B,"root",nil},
+		{"loop",rd,B,"",syscall.ELOOP},
+		{"flink",nf,B,"",syscall.ELOOP},
+		{"dir/up",rd,B|RESOLVE_NO_SYMLINKS,"",syscall.ELOOP},
+		{"dlink/file",rd,B|RESOLVE_NO_SYMLINKS,"",syscall.ELOOP},
+		// A trailing slash needs a directory, and follows symlinks.
+		{"dir/",rd,B,"/",nil},
+		{"dir/.",rd,B,"/",nil},
+		{"file/",rd,B,"",syscall.ENOTDIR},
+		{"file/.",rd,B,"",syscall.ENOTDIR},
+		{"file//",rd,B,"",syscall.ENOTDIR},
+		{"flink/",rd,B,"",syscall.ENOTDIR},
+		{"dlink/",nf,B,"/",nil},
+		{"dir/up/",rd,B,"",syscall.ENOTDIR},
+		{"new/",syscall.O_RDWR|syscall.O_CREAT,B,"",syscall.EISDIR},
+	})
+	if _,err := os.Stat(filepath.Join(d,"new")); !os.IsNotExist(err) { t.Errorf("new/ created: %v",err) }
+}
+
+// Magic links of /proc are never followed.
+func TestOpenBeneathMagicLinks(t *testing.T) {
+	d,dirfd := testTree(t)
+	defer os.RemoveAll(d)
+	defer syscall.Close(dirfd)
+	proc,err := syscall.Open("/proc/self",syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC,0)
+	if err!=nil { t.Skip(err) }
+	defer syscall.Close(proc)
+	for _,resolve := range []uint64{RESOLVE_BENEATH,RESOLVE_IN_ROOT} {
+		// fd/N -> the tree (absolute), cwd -> the working directory.
+		for _,p := range []string{"fd/"+strconv.Itoa(dirfd)+"/file","cwd/.","root/etc"} {
+			fd,err := openBeneath(proc,p,syscall.O_RDONLY,0,resolve)
+			if err==nil { syscall.Close(fd); t.Errorf("%q (resolve %#x) followed",p,resolve) }
+		}
+	}
+}
+
+func TestOpenBeneathNoXdev(t *testing.T) {
+	if os.Geteuid()!=0 { t.Skip("needs root") }
+	d,dirfd := testTree(t)
+	defer os.RemoveAll(d)
+	defer syscall.Close(dirfd)
+	mnt := filepath.Join(d,"mnt")
+	bind := filepath.Join(d,"bind")
+	os.Mkdir(mnt,0755)
+	os.Mkdir(bind,0755)
+	if err := syscall.Mount("tmpfs",mnt,"tmpfs",0,"size=1m"); err!=nil { t.Skipf("can not mount a tmpfs: %v",err) }
+	defer syscall.Unmount(mnt,syscall.MNT_DETACH)
+	ioutil.WriteFile(filepath.Join(mnt,"file"),[]byte("mnt"),0644)
+	// A bind mount has the device number of the tree, but another mount ID.
+	if err := syscall.Mount(filepath.Join(d,"dir"),bind,"",syscall.MS_BIND,""); err!=nil { t.Fatal(err) }
+	defer syscall.Unmount(bind,syscall.MNT_DETACH)
+	os.Symlink("mnt/file",filepath.Join(d,"mlink"))
+	B := uint64(RESOLVE_BENEATH)
+	X := B|RESOLVE_NO_XDEV
+	runOpenTests(t,dirfd,[]openTest{
+		{"mnt/file",syscall.O_RDONLY,B,"mnt",nil},
+		{"bind/file",syscall.O_RDONLY,B,"in",nil},
+		{"dir/file",syscall.O_RDONLY,X,"in",nil},
+		{"mnt/file",syscall.O_RDONLY,X,"",syscall.EXDEV},
+		{"mnt",syscall.O_RDONLY,X,"",syscall.EXDEV},
+		{"mlink",syscall.O_RDONLY,X,"",syscall.EXDEV},
+		{"bind/file",syscall.O_RDONLY,X,"",syscall.EXDEV},
+		{"bind",syscall.O_RDONLY,X,"",syscall.EXDEV},
+	})
+	if m,err := mountID(dirfd); err!=nil || m==0 { t.Errorf("mount ID %d %v",m,err) }
+}
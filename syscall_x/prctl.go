@@ -0,0 +1,156 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+
+const PR_SET_PDEATHSIG       = 1
+const PR_GET_PDEATHSIG       = 2
+const PR_GET_DUMPABLE        = 3
+const PR_SET_DUMPABLE        = 4
+const PR_SET_KEEPCAPS        = 8
+const PR_SET_NAME            = 15
+const PR_GET_NAME            = 16
+const PR_GET_SECCOMP         = 21
+const PR_SET_SECCOMP         = 22
+const PR_CAPBSET_READ        = 23
+const PR_CAPBSET_DROP        = 24
+const PR_GET_SECUREBITS      = 27
+const PR_SET_SECUREBITS      = 28
+const PR_SET_CHILD_SUBREAPER = 36
+const PR_GET_CHILD_SUBREAPER = 37
+const PR_SET_NO_NEW_PRIVS    = 38
+const PR_GET_NO_NEW_PRIVS    = 39
+const PR_CAP_AMBIENT         = 47
+
+const PR_CAP_AMBIENT_IS_SET    = 1
+const PR_CAP_AMBIENT_RAISE     = 2
+const PR_CAP_AMBIENT_LOWER     = 3
+const PR_CAP_AMBIENT_CLEAR_ALL = 4
+
+/*
+ Does prctl(option,arg2,arg3,arg4,arg5) on the calling thread.
+ */
+func Prctl(option int, arg2, arg3, arg4, arg5 uintptr) (int,error) {
+	r,_,err := syscall.Syscall6(syscall.SYS_PRCTL,uintptr(option),arg2,arg3,arg4,arg5,0)
+	if err==syscall.Errno(0) { return int(r),nil }
+	return int(r),err
+}
+
+/*
+ Does prctl(option,arg2,arg3,arg4,arg5) on every thread of the process, using
+ syscall.AllThreadsSyscall6. If this is not supported (the program uses cgo),
+ syscall.ENOTSUP is returned and no thread is changed; a per-thread setting
+ applied to some threads only would give a false sense of security.
+ */
+func PrctlAllThreads(option int, arg2, arg3, arg4, arg5 uintptr) (int,error) {
+	return allThreads(syscall.SYS_PRCTL,uintptr(option),arg2,arg3,arg4,arg5,0)
+}
+
+func allThreads(trap, a1, a2, a3, a4, a5, a6 uintptr) (int,error) {
+	r,_,err := syscall.AllThreadsSyscall6(trap,a1,a2,a3,a4,a5,a6)
+	if err==syscall.Errno(0) { return int(r),nil }
+	return int(r),err
+}
+
+/*
+ Sets the no_new_privs bit on every thread of the process. It is inherited by
+ children and can not be unset: execve() will no longer grant privileges
+ (setuid/setgid bits and file capabilities are ignored).
+ */
+func SetNoNewPrivs() error {
+	_,err := PrctlAllThreads(PR_SET_NO_NEW_PRIVS,1,0,0,0)
+	return err
+}
+func GetNoNewPrivs() (bool,error) {
+	r,err := Prctl(PR_GET_NO_NEW_PRIVS,0,0,0,0)
+	return r==1,err
+}
+
+/*
+ Sets the signal, the calling thread gets, when its parent dies. Note that the
+ "parent" is the thread, that created the process. For children started with
+ os/exec use SysProcAttr.Pdeathsig instead.
+ */
+func SetPdeathsig(sig syscall.Signal) error {
+	_,err := Prctl(PR_SET_PDEATHSIG,uintptr(sig),0,0,0)
+	return err
+}
+func GetPdeathsig() (syscall.Signal,error) {
+	var sig int32
+	_,err := Prctl(PR_GET_PDEATHSIG,uintptr(unsafe.Pointer(&sig)),0,0,0)
+	return syscall.Signal(sig),err
+}
+
+/*
+ Marks the process as child subreaper: Orphaned descendants are reparented to
+ this process instead of init. The process must wait() for them, else they stay
+ zombies; Reaper.Kill only waits for the orphans, it has collected before. As
+ a wait4(-1) loop would also reap the children, that exec.Cmd.Wait waits for,
+ this is for processes, that are prepared to reap all their children.
+ */
+func SetChildSubreaper(on bool) error {
+	_,err := Prctl(PR_SET_CHILD_SUBREAPER,b2u(on),0,0,0)
+	return err
+}
+func GetChildSubreaper() (bool,error) {
+	var v int32
+	_,err := Prctl(PR_GET_CHILD_SUBREAPER,uintptr(unsafe.Pointer(&v)),0,0,0)
+	return v!=0,err
+}
+
+/*
+ Sets the name of the calling thread (max. 15 bytes, longer names are
+ truncated).
+ */
+func SetName(name string) error {
+	var buf [16]byte
+	copy(buf[:15],name)
+	_,err := Prctl(PR_SET_NAME,uintptr(unsafe.Pointer(&buf[0])),0,0,0)
+	return err
+}
+func GetName() (string,error) {
+	var buf [16]byte
+	_,err := Prctl(PR_GET_NAME,uintptr(unsafe.Pointer(&buf[0])),0,0,0)
+	if err!=nil { return "",err }
+	i := 0
+	for i<len(buf) && buf[i]!=0 { i++ }
+	return string(buf[:i]),nil
+}
+
+/*
+ Sets the dumpable attribute of the process. A non-dumpable process produces
+ no core dumps and can not be ptrace()'d by unprivileged processes.
+ */
+func SetDumpable(on bool) error {
+	_,err := PrctlAllThreads(PR_SET_DUMPABLE,b2u(on),0,0,0)
+	return err
+}
+func GetDumpable() (bool,error) {
+	r,err := Prctl(PR_GET_DUMPABLE,0,0,0,0)
+	return r==1,err
+}
+
+const SECCOMP_MODE_DISABLED = 0
+const SECCOMP_MODE_STRICT   = 1
+const SECCOMP_MODE_FILTER   = 2
+
+/*
+ Returns the seccomp mode of the calling thread (SECCOMP_MODE_*).
+ */
+func GetSeccomp() (int,error) {
+	return Prctl(PR_GET_SECCOMP,0,0,0,0)
+}
+
+func b2u(b bool) uintptr {
+	if b { return 1 }
+	return 0
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+import "os"
+import "os/exec"
+import "strconv"
+
+func ioctlPtr(fd int, req uintptr, arg unsafe.Pointer) error {
+	_,_,e := syscall.Syscall(syscall.SYS_IOCTL,uintptr(fd),req,uintptr(arg))
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Does ioctl(fd,TIOCSPTLCK,&0). Unlocks the slave of the pseudo-terminal master fd.
+ */
+func Unlockpt(fd int) error {
+	var u int32
+	return ioctlPtr(fd,syscall.TIOCSPTLCK,unsafe.Pointer(&u))
+}
+
+/*
+ On Linux, the devpts file system sets owner and mode of the slave, so this
+ only checks, that fd is a pseudo-terminal master.
+ */
+func Grantpt(fd int) error {
+	_,err := Ptsname(fd)
+	return err
+}
+
+/*
+ Returns the name of the slave of the pseudo-terminal master fd (TIOCGPTN).
+ */
+func Ptsname(fd int) (string,error) {
+	var n uint32
+	err := ioctlPtr(fd,syscall.TIOCGPTN,unsafe.Pointer(&n))
+	if err!=nil { return "",err }
+	return "/dev/pts/"+strconv.FormatUint(uint64(n),10),nil
+}
+
+/*
+ Opens the slave of the pseudo-terminal master fd, without looking it up by
+ name (ioctl(fd,TIOCGPTPEER,flags), Linux 4.13 or newer).
+ */
+func Ptspeer(fd int, flags int) (int,error) {
+	return sysResult(syscall.Syscall(syscall.SYS_IOCTL,uintptr(fd),TIOCGPTPEER,uintptr(flags)))
+}
+
+/*
+ Allocates a pseudo-terminal: Opens /dev/ptmx, grants and unlocks the slave and
+ opens it, race-free through TIOCGPTPEER if possible. Both fds are close-on-exec
+ and the slave does not become the controlling terminal of the caller.
+ */
+func Openpty() (master int, name string, slave int, err error) {
+	master,err = syscall.Open("/dev/ptmx",syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC,0)
+	if err!=nil { return -1,"",-1,err }
+	name,err = Ptsname(master)
+	if err==nil { err = Grantpt(master) }
+	if err==nil { err = Unlockpt(master) }
+	if err==nil {
+		sflags := syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC
+		slave,err = Ptspeer(master,sflags)
+		if err==syscall.EINVAL || err==syscall.ENOTTY {
+			slave,err = syscall.Open(name,sflags,0)
+		}
+	}
+	if err!=nil {
+		syscall.Close(master)
+		return -1,"",-1,err
+	}
+	return
+}
+
+/*
+ Allocates a pseudo-terminal and starts cmd with the slave as stdin, stdout and
+ stderr and as its controlling terminal (setsid() and TIOCSCTTY in the child).
+ Returns the master.
+ */
+func StartPty(cmd *exec.Cmd) (*os.File,error) {
+	return StartPtyFunc(cmd,nil)
+}
+
+/*
+ Like StartPty, but the process is started by start (e.g. ExecSetup.Start),
+ once the pseudo-terminal is set up; cmd.Start, if start is nil.
+ */
+func StartPtyFunc(cmd *exec.Cmd, start func(cmd *exec.Cmd) error) (*os.File,error) {
+	m,name,s,err := Openpty()
+	if err!=nil { return nil,err }
+	master := os.NewFile(uintptr(m),"/dev/ptmx")
+	slave := os.NewFile(uintptr(s),name)
+	defer slave.Close()
+	cmd.Stdin  = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if cmd.SysProcAttr==nil { cmd.SysProcAttr = new(syscall.SysProcAttr) }
+	cmd.SysProcAttr.Setsid  = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty    = 0 // stdin of the child
+	if start!=nil {
+		err = start(cmd)
+	} else {
+		err = cmd.Start()
+	}
+	if err!=nil {
+		master.Close()
+		return nil,err
+	}
+	return master,nil
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+import "bufio"
+import "os"
+import "strings"
+import "fmt"
+
+// Quota types.
+const USRQUOTA = 0
+const GRPQUOTA = 1
+const PRJQUOTA = 2
+
+// quotactl() commands, to be combined with a type by QCMD.
+const Q_SYNC         = 0x800001
+const Q_QUOTAON      = 0x800002
+const Q_QUOTAOFF     = 0x800003
+const Q_GETFMT       = 0x800004
+const Q_GETINFO      = 0x800005
+const Q_SETINFO      = 0x800006
+const Q_GETQUOTA     = 0x800007
+const Q_SETQUOTA     = 0x800008
+const Q_GETNEXTQUOTA = 0x800009
+
+// Quota formats (Q_GETFMT).
+const QFMT_VFS_OLD = 1
+const QFMT_VFS_V0  = 2
+const QFMT_VFS_V1  = 4
+const QFMT_SHMEM   = 5
+
+// Dqblk.Valid
+const QIF_BLIMITS = 1
+const QIF_SPACE   = 2
+const QIF_ILIMITS = 4
+const QIF_INODES  = 8
+const QIF_BTIME   = 16
+const QIF_ITIME   = 32
+const QIF_LIMITS  = QIF_BLIMITS|QIF_ILIMITS
+const QIF_USAGE   = QIF_SPACE|QIF_INODES
+const QIF_TIMES   = QIF_BTIME|QIF_ITIME
+const QIF_ALL     = QIF_LIMITS|QIF_USAGE|QIF_TIMES
+
+// Dqinfo.Valid
+const IIF_BGRACE = 1
+const IIF_IGRACE = 2
+const IIF_FLAGS  = 4
+const IIF_ALL    = IIF_BGRACE|IIF_IGRACE|IIF_FLAGS
+
+// Size of a block in the block limits of Dqblk.
+const QIF_DQBLKSIZE = 1024
+
+func QCMD(cmd, typ int) int { return (cmd<<8)|(typ&0xff) }
+
+/*
+ struct if_dqblk. Block limits are in units of QIF_DQBLKSIZE, Curspace is in
+ bytes, Btime and Itime are the times (seconds since the epoch), when the soft
+ limits begin to be enforced.
+ */
+type Dqblk struct{
+	Bhardlimit uint64
+	Bsoftlimit uint64
+	Curspace   uint64
+	Ihardlimit uint64
+	Isoftlimit uint64
+	Curinodes  uint64
+	Btime      uint64
+	Itime      uint64
+	Valid      uint32
+}
+
+// struct if_nextdqblk (no embedded Dqblk, as that would be padded on 64 bit)
+type NextDqblk struct{
+	Bhardlimit uint64
+	Bsoftlimit uint64
+	Curspace   uint64
+	Ihardlimit uint64
+	Isoftlimit uint64
+	Curinodes  uint64
+	Btime      uint64
+	Itime      uint64
+	Valid      uint32
+	Id         uint32
+}
+
+// struct if_dqinfo. Grace periods are in seconds.
+type Dqinfo struct{
+	Bgrace uint64
+	Igrace uint64
+	Flags  uint32
+	Valid  uint32
+}
+
+/*
+ Does quotactl(cmd,special,id,addr). special is the block device of the file
+ system.
+ */
+func Quotactl(cmd int, special string, id int, addr unsafe.Pointer) error {
+	var sp *byte
+	if special!="" {
+		var err error
+		sp,err = syscall.BytePtrFromString(special)
+		if err!=nil { return err }
+	}
+	_,_,e := syscall.Syscall6(syscall.SYS_QUOTACTL,uintptr(cmd),uintptr(unsafe.Pointer(sp)),uintptr(id),uintptr(addr),0,0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Does quotactl_fd(fd,cmd,id,addr). fd is any file on the file system. Linux
+ 5.14 or newer. Works for file systems without a block device, like tmpfs.
+ */
+func QuotactlFd(fd int, cmd int, id int, addr unsafe.Pointer) error {
+	_,_,e := syscall.Syscall6(sys_QUOTACTL_FD,uintptr(fd),uintptr(cmd),uintptr(id),uintptr(addr),0,0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ Returns the mount source (the block device) of the file system with the
+ device number dev, from /proc/self/mountinfo.
+ */
+func mountSource(dev uint64) (string,error) {
+	f,err := os.Open("/proc/self/mountinfo")
+	if err!=nil { return "",err }
+	defer f.Close()
+	want := fmt.Sprintf("%d:%d",devMajor(dev),devMinor(dev))
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fl := strings.Fields(s.Text())
+		if len(fl)<3 || fl[2]!=want { continue }
+		for i,x := range fl {
+			if x=="-" && i+2<len(fl) { return fl[i+2],nil }
+		}
+	}
+	if s.Err()!=nil { return "",s.Err() }
+	return "",syscall.ENODEV
+}
+
+/*
+ Quota management for one mounted file system. Uses quotactl_fd() where
+ available, and quotactl() on the block device of the file system otherwise.
+ */
+type Quotas struct{
+	fd      int
+	special string
+}
+
+/*
+ Opens the file system, path (usually the mount point) resides on.
+ */
+func OpenQuotas(path string) (*Quotas,error) {
+	fd,err := syscall.Open(path,syscall.O_RDONLY|syscall.O_CLOEXEC,0)
+	if err!=nil { return nil,&os.PathError{Op: "open", Path: path, Err: err} }
+	q := &Quotas{fd: fd}
+	var f uint32
+	err = QuotactlFd(fd,QCMD(Q_GETFMT,USRQUOTA),0,unsafe.Pointer(&f))
+	if err==syscall.ENOSYS {
+		var st syscall.Stat_t
+		err = syscall.Fstat(fd,&st)
+		if err==nil { q.special,err = mountSource(uint64(st.Dev)) }
+		if err!=nil { syscall.Close(fd); return nil,&os.PathError{Op: "quotactl", Path: path, Err: err} }
+	}
+	return q,nil
+}
+
+func (q *Quotas) Close() error {
+	return syscall.Close(q.fd)
+}
+
+// Returns the block device, if quotactl() is used, and "" otherwise.
+func (q *Quotas) Special() string { return q.special }
+
+func (q *Quotas) ctl(cmd, typ, id int, addr unsafe.Pointer) error {
+	if q.special!="" { return Quotactl(QCMD(cmd,typ),q.special,id,addr) }
+	return QuotactlFd(q.fd,QCMD(cmd,typ),id,addr)
+}
+
+// Returns the quota format (QFMT_*). Fails with ESRCH, if the quota is off.
+func (q *Quotas) Format(typ int) (int,error) {
+	var f uint32
+	err := q.ctl(Q_GETFMT,typ,0,unsafe.Pointer(&f))
+	return int(f),err
+}
+
+// Returns limits and usage of the user, group or project id.
+func (q *Quotas) Get(typ int, id uint32) (*Dqblk,error) {
+	d := new(Dqblk)
+	err := q.ctl(Q_GETQUOTA,typ,int(id),unsafe.Pointer(d))
+	if err!=nil { return nil,err }
+	return d,nil
+}
+
+/*
+ Returns limits and usage of the first id, that is greater or equal to id and
+ has a quota entry. Fails with ENOENT, if there is none.
+ */
+func (q *Quotas) Next(typ int, id uint32) (*NextDqblk,error) {
+	d := new(NextDqblk)
+	err := q.ctl(Q_GETNEXTQUOTA,typ,int(id),unsafe.Pointer(d))
+	if err!=nil { return nil,err }
+	return d,nil
+}
+
+/*
+ Sets the fields of id, whose QIF_* bits are set in d.Valid. E.g. to set the
+ limits only:
+
+	q.Set(USRQUOTA,uid,&Dqblk{Bsoftlimit: 1<<20, Bhardlimit: 2<<20, Valid: QIF_BLIMITS})
+ */
+func (q *Quotas) Set(typ int, id uint32, d *Dqblk) error {
+	return q.ctl(Q_SETQUOTA,typ,int(id),unsafe.Pointer(d))
+}
+
+// Returns the grace periods and flags.
+func (q *Quotas) Info(typ int) (*Dqinfo,error) {
+	i := new(Dqinfo)
+	err := q.ctl(Q_GETINFO,typ,0,unsafe.Pointer(i))
+	if err!=nil { return nil,err }
+	return i,nil
+}
+
+// Sets the fields, whose IIF_* bits are set in i.Valid.
+func (q *Quotas) SetInfo(typ int, i *Dqinfo) error {
+	return q.ctl(Q_SETINFO,typ,0,unsafe.Pointer(i))
+}
+
+// Writes the quota usage to disk.
+func (q *Quotas) Sync(typ int) error {
+	return q.ctl(Q_SYNC,typ,0,nil)
+}
+
+/*
+ Calls fn for every id with a quota entry, in ascending order. Stops, if fn
+ returns false.
+ */
+func (q *Quotas) Each(typ int, fn func(d *NextDqblk) bool) error {
+	var id uint32
+	for {
+		d,err := q.Next(typ,id)
+		if err==syscall.ENOENT { return nil }
+		if err!=nil { return err }
+		if !fn(d) || d.Id==^uint32(0) { return nil }
+		id = d.Id+1
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "syscall"
+import "testing"
+import "unsafe"
+
+func TestQuotaABI(t *testing.T) {
+	if c := uint32(QCMD(Q_GETQUOTA,GRPQUOTA)); c!=0x80000701 { t.Errorf("QCMD %#x",c) }
+	// The layout of the kernel's structures (the padding of if_dqblk differs).
+	var d Dqblk
+	var n NextDqblk
+	var i Dqinfo
+	if o := unsafe.Offsetof(d.Valid); o!=64 { t.Errorf("if_dqblk.dqb_valid at %d",o) }
+	if o := unsafe.Offsetof(n.Id); o!=68 { t.Errorf("if_nextdqblk.dqb_id at %d",o) }
+	if o := unsafe.Offsetof(i.Valid); o!=20 { t.Errorf("if_dqinfo.dqi_valid at %d",o) }
+	if s := unsafe.Sizeof(Fsxattr{}); s!=28 { t.Errorf("fsxattr: %d bytes",s) }
+}
+
+/*
+ Mounts a tmpfs with user and group quotas in a temporary directory; needs
+ root and a kernel with tmpfs quotas (CONFIG_TMPFS_QUOTA, Linux 6.6).
+ */
+func testQuotaTmpfs(t *testing.T) string {
+	if os.Geteuid()!=0 { t.Skip("needs root") }
+	d,err := ioutil.TempDir("","quotatest")
+	if err!=nil { t.Fatal(err) }
+	err = syscall.Mount("tmpfs",d,"tmpfs",0,"size=16m,usrquota,grpquota")
+	if err!=nil {
+		os.RemoveAll(d)
+		if err==syscall.EINVAL { t.Skip("no tmpfs quotas") }
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestQuotas(t *testing.T) {
+	mnt := testQuotaTmpfs(t)
+	defer os.RemoveAll(mnt)
+	defer syscall.Unmount(mnt,0)
+	q,err := OpenQuotas(mnt)
+	if err!=nil { t.Fatal(err) }
+	defer q.Close()
+	// A tmpfs has no block device, so this is quotactl_fd().
+	if q.Special()!="" { t.Errorf("special %q",q.Special()) }
+	for _,typ := range []int{USRQUOTA,GRPQUOTA} {
+		if f,err := q.Format(typ); err!=nil || f!=QFMT_SHMEM { t.Errorf("format of %d: %d %v",typ,f,err) }
+	}
+	if _,err = q.Format(PRJQUOTA); err==nil { t.Error("project quotas on a tmpfs") }
+	err = q.Set(USRQUOTA,1000,&Dqblk{Bsoftlimit: 100, Bhardlimit: 200, Isoftlimit: 10, Ihardlimit: 20, Valid: QIF_LIMITS})
+	if err!=nil { t.Fatal(err) }
+	p := filepath.Join(mnt,"f")
+	if err = ioutil.WriteFile(p,make([]byte,64<<10),0644); err!=nil { t.Fatal(err) }
+	if err = os.Chown(p,1000,1000); err!=nil { t.Fatal(err) }
+	d,err := q.Get(USRQUOTA,1000)
+	if err!=nil { t.Fatal(err) }
+	if d.Bsoftlimit!=100 || d.Bhardlimit!=200 || d.Isoftlimit!=10 || d.Ihardlimit!=20 { t.Errorf("limits %+v",d) }
+	if d.Curinodes!=1 || d.Curspace<64<<10 { t.Errorf("usage %+v",d) }
+	if d,err = q.Get(GRPQUOTA,1000); err!=nil || d.Curinodes!=1 { t.Errorf("group 1000: %+v %v",d,err) }
+	var ids []uint32
+	if err = q.Each(USRQUOTA,func(d *NextDqblk) bool { ids = append(ids,d.Id); return true }); err!=nil { t.Fatal(err) }
+	// Root may have an entry for the root directory.
+	if len(ids)==0 || ids[len(ids)-1]!=1000 || len(ids)>2 { t.Errorf("ids %v",ids) }
+}
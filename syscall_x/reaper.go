@@ -0,0 +1,193 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "os"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "sync"
+
+// Some fields of /proc/[pid]/stat.
+type ProcStat struct{
+	Pid       int
+	PPid      int
+	Pgrp      int
+	Session   int
+	// In clock ticks after boot. Together with Pid it identifies a process.
+	StartTime uint64
+}
+
+/*
+ Reads /proc/[pid]/stat.
+ */
+func ReadProcStat(pid int) (s ProcStat,err error) {
+	b,err := ioutil.ReadFile(procPath(pid,"stat"))
+	if err!=nil { return }
+	return parseProcStat(string(b))
+}
+
+func parseProcStat(str string) (s ProcStat,err error) {
+	err = syscall.EINVAL
+	i := strings.IndexByte(str,' ')
+	j := strings.LastIndexByte(str,')')
+	if i<0 || j<0 { return }
+	s.Pid,_ = strconv.Atoi(str[:i])
+	// The fields after the command name, starting with the state (3).
+	f := strings.Fields(str[j+1:])
+	if len(f)<20 { return }
+	s.PPid,_    = strconv.Atoi(f[1])
+	s.Pgrp,_    = strconv.Atoi(f[2])
+	s.Session,_ = strconv.Atoi(f[3])
+	s.StartTime,_ = strconv.ParseUint(f[19],10,64)
+	err = nil
+	return
+}
+
+/*
+ Reads the stat of all processes in /proc.
+ */
+func ListProcs() ([]ProcStat,error) {
+	d,err := os.Open("/proc")
+	if err!=nil { return nil,err }
+	names,err := d.Readdirnames(-1)
+	d.Close()
+	if err!=nil { return nil,err }
+	l := make([]ProcStat,0,len(names))
+	for _,n := range names {
+		pid,e := strconv.Atoi(n)
+		if e!=nil { continue }
+		s,e := ReadProcStat(pid)
+		if e!=nil { continue } // Process has gone.
+		l = append(l,s)
+	}
+	return l,nil
+}
+
+/*
+ Returns all descendants of pid (not including pid itself).
+ */
+func Descendants(pid int) ([]int,error) {
+	l,err := ListProcs()
+	if err!=nil { return nil,err }
+	var r []int
+	for _,s := range descendants(l,map[int]bool{pid:true}) { r = append(r,s.Pid) }
+	return r,nil
+}
+
+func descendants(l []ProcStat, roots map[int]bool) []ProcStat {
+	children := make(map[int][]ProcStat)
+	for _,s := range l { children[s.PPid] = append(children[s.PPid],s) }
+	var r []ProcStat
+	var stack []int
+	for pid := range roots { stack = append(stack,pid) }
+	seen := make(map[int]bool)
+	for len(stack)>0 {
+		pid := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _,c := range children[pid] {
+			if seen[c.Pid] { continue }
+			seen[c.Pid] = true
+			r = append(r,c)
+			stack = append(stack,c.Pid)
+		}
+	}
+	return r
+}
+
+/*
+ A Reaper keeps track of all processes, that descend from a root process (for
+ example the shell of a session), and kills them at once.
+
+ Orphaned processes are reparented to init (or the nearest child subreaper),
+ so they can only be found, if they were seen before. Therefore Collect should
+ be called periodically while the session is running. Processes in the session
+ of the root are found as well. A process, that calls setsid() and is orphaned
+ before it was collected, escapes. If the calling process is a child
+ subreaper (see SetChildSubreaper), Kill also waits for the orphans, that have
+ been reparented to it.
+ */
+type Reaper struct{
+	Root  int
+	mutex sync.Mutex
+	procs map[int]uint64 // pid -> start time
+}
+
+func NewReaper(root int) *Reaper {
+	r := new(Reaper)
+	r.Root = root
+	r.procs = make(map[int]uint64)
+	if s,e := ReadProcStat(root); e==nil { r.procs[root] = s.StartTime }
+	return r
+}
+
+/*
+ Scans /proc and adds all descendants of the root process and of every
+ process collected before. Processes, that have exited, are removed.
+ */
+func (r *Reaper) Collect() error {
+	l,err := ListProcs()
+	if err!=nil { return err }
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	alive := make(map[int]bool)
+	for _,s := range l {
+		st,ok := r.procs[s.Pid]
+		// Same pid and start time, this is the process we know.
+		if ok && st==s.StartTime { alive[s.Pid] = true }
+		// Processes in the session of the root, that escaped the tree.
+		if s.Session==r.Root && s.Pid!=r.Root { alive[s.Pid] = true; r.procs[s.Pid] = s.StartTime }
+	}
+	for pid := range r.procs {
+		if !alive[pid] && pid!=r.Root { delete(r.procs,pid) }
+	}
+	for _,s := range descendants(l,alive) { r.procs[s.Pid] = s.StartTime }
+	return nil
+}
+
+// Returns the pids of all collected processes, without the root.
+func (r *Reaper) Pids() []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var l []int
+	for pid := range r.procs {
+		if pid!=r.Root { l = append(l,pid) }
+	}
+	return l
+}
+
+/*
+ Collects once more and sends sig to every collected process, including the
+ root. With SIGKILL, orphans that have been reparented to the calling process
+ are waited for. The root process itself is never waited for, that is left to
+ its owner (exec.Cmd.Wait).
+ */
+func (r *Reaper) Kill(sig syscall.Signal) error {
+	err := r.Collect()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for pid,st := range r.procs {
+		// Guard against pid reuse.
+		if s,e := ReadProcStat(pid); e!=nil || s.StartTime!=st { continue }
+		syscall.Kill(pid,sig)
+	}
+	if sig!=syscall.SIGKILL { return err }
+	self := os.Getpid()
+	for pid,st := range r.procs {
+		if pid==r.Root { continue }
+		s,e := ReadProcStat(pid)
+		if e!=nil || s.StartTime!=st || s.PPid!=self { continue }
+		var ws syscall.WaitStatus
+		syscall.Wait4(pid,&ws,0,nil)
+	}
+	return err
+}
+
@@ -0,0 +1,43 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+
+const RLIMIT_LOCKS      = 10
+const RLIMIT_SIGPENDING = 11
+const RLIMIT_MSGQUEUE   = 12
+const RLIMIT_NICE       = 13
+const RLIMIT_RTPRIO     = 14
+const RLIMIT_RTTIME     = 15
+const RLIM_NLIMITS      = 16
+
+const RLIM_INFINITY = ^uint64(0)
+
+/*
+ Does prlimit64(pid,resource,new,old): Sets (if new!=nil) and returns (if
+ old!=nil) a resource limit of the process pid (0 means the calling process).
+ Raising a hard limit requires CAP_SYS_RESOURCE; changing the limits of
+ another process requires the same uids and gids or CAP_SYS_RESOURCE.
+ */
+func Prlimit(pid int, resource int, new, old *syscall.Rlimit) error {
+	_,_,e := syscall.RawSyscall6(syscall.SYS_PRLIMIT64,uintptr(pid),uintptr(resource),
+		uintptr(unsafe.Pointer(new)),uintptr(unsafe.Pointer(old)),0,0)
+	if e!=0 { return e }
+	return nil
+}
+
+// Returns a resource limit of the process pid.
+func GetRlimitOf(pid int, resource int) (syscall.Rlimit,error) {
+	var r syscall.Rlimit
+	err := Prlimit(pid,resource,nil,&r)
+	return r,err
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+
+const SECCOMP_SET_MODE_STRICT  = 0
+const SECCOMP_SET_MODE_FILTER  = 1
+const SECCOMP_GET_ACTION_AVAIL = 2
+const SECCOMP_GET_NOTIF_SIZES  = 3
+
+const SECCOMP_FILTER_FLAG_TSYNC              = 1<<0
+const SECCOMP_FILTER_FLAG_LOG                = 1<<1
+const SECCOMP_FILTER_FLAG_SPEC_ALLOW         = 1<<2
+const SECCOMP_FILTER_FLAG_NEW_LISTENER       = 1<<3
+const SECCOMP_FILTER_FLAG_TSYNC_ESRCH        = 1<<4
+const SECCOMP_FILTER_FLAG_WAIT_KILLABLE_RECV = 1<<5
+
+const SECCOMP_RET_KILL_PROCESS = 0x80000000
+const SECCOMP_RET_KILL_THREAD  = 0x00000000
+const SECCOMP_RET_TRAP         = 0x00030000
+const SECCOMP_RET_ERRNO        = 0x00050000
+const SECCOMP_RET_USER_NOTIF   = 0x7fc00000
+const SECCOMP_RET_TRACE        = 0x7ff00000
+const SECCOMP_RET_LOG          = 0x7ffc0000
+const SECCOMP_RET_ALLOW        = 0x7fff0000
+const SECCOMP_RET_ACTION_FULL  = 0xffff0000
+const SECCOMP_RET_DATA         = 0x0000ffff
+
+// Offsets within struct seccomp_data.
+const SECCOMP_DATA_NR     = 0
+const SECCOMP_DATA_ARCH   = 4
+const SECCOMP_DATA_IP     = 8
+const SECCOMP_DATA_ARGS   = 16
+
+/*
+ Does seccomp(op,flags,args).
+ */
+func Seccomp(op int, flags int, args unsafe.Pointer) (int,error) {
+	return sysResult(syscall.Syscall(sys_SECCOMP,uintptr(op),uintptr(flags),uintptr(args)))
+}
+
+/*
+ Does seccomp(SECCOMP_SET_MODE_FILTER,flags,prog). The calling thread must
+ have no_new_privs set (see SetNoNewPrivs) or CAP_SYS_ADMIN.
+
+ With SECCOMP_FILTER_FLAG_NEW_LISTENER, the result is the notification fd.
+ If SECCOMP_FILTER_FLAG_TSYNC fails, the result is the id of the thread, that
+ could not be synchronized.
+ */
+func SeccompSetFilter(flags int, prog *syscall.SockFprog) (int,error) {
+	r,err := Seccomp(SECCOMP_SET_MODE_FILTER,flags,unsafe.Pointer(prog))
+	if err==nil && r>0 && (flags&SECCOMP_FILTER_FLAG_TSYNC)!=0 && (flags&SECCOMP_FILTER_FLAG_NEW_LISTENER)==0 {
+		return r,syscall.EAGAIN
+	}
+	return r,err
+}
+
+/*
+ Reports, whether the kernel supports the action (SECCOMP_RET_*).
+ */
+func SeccompActionAvail(action uint32) bool {
+	_,err := Seccomp(SECCOMP_GET_ACTION_AVAIL,0,unsafe.Pointer(&action))
+	return err==nil
+}
+
@@ -0,0 +1,263 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+import "syscall"
+import "unsafe"
+import "time"
+
+// statx() mask bits: Requested fields and fields, that are valid.
+const STATX_TYPE          = 0x1
+const STATX_MODE          = 0x2
+const STATX_NLINK         = 0x4
+const STATX_UID           = 0x8
+const STATX_GID           = 0x10
+const STATX_ATIME         = 0x20
+const STATX_MTIME         = 0x40
+const STATX_CTIME         = 0x80
+const STATX_INO           = 0x100
+const STATX_SIZE          = 0x200
+const STATX_BLOCKS        = 0x400
+const STATX_BASIC_STATS   = 0x7ff
+const STATX_BTIME         = 0x800
+const STATX_MNT_ID        = 0x1000
+const STATX_DIOALIGN      = 0x2000
+const STATX_MNT_ID_UNIQUE = 0x4000
+const STATX_SUBVOL        = 0x8000
+
+// Everything, this package knows about.
+const STATX_ALL_KNOWN = STATX_BASIC_STATS|STATX_BTIME|STATX_MNT_ID|STATX_DIOALIGN|STATX_SUBVOL
+
+// File attributes (Attributes, AttributesMask).
+const STATX_ATTR_COMPRESSED   = 0x4
+const STATX_ATTR_IMMUTABLE    = 0x10
+const STATX_ATTR_APPEND       = 0x20
+const STATX_ATTR_NODUMP       = 0x40
+const STATX_ATTR_ENCRYPTED    = 0x800
+const STATX_ATTR_AUTOMOUNT    = 0x1000
+const STATX_ATTR_MOUNT_ROOT   = 0x2000
+const STATX_ATTR_VERITY       = 0x100000
+const STATX_ATTR_DAX          = 0x200000
+const STATX_ATTR_WRITE_ATOMIC = 0x400000
+
+// Synchronization with the server on network file systems (flags).
+const AT_STATX_SYNC_AS_STAT = 0x0
+const AT_STATX_FORCE_SYNC   = 0x2000
+const AT_STATX_DONT_SYNC    = 0x4000
+
+// struct statx_timestamp
+type StatxTimestamp struct{
+	Sec  int64
+	Nsec uint32
+	_    int32
+}
+
+// struct statx (256 bytes)
+type Statx_t struct{
+	Mask             uint32
+	Blksize          uint32
+	Attributes       uint64
+	Nlink            uint32
+	Uid              uint32
+	Gid              uint32
+	Mode             uint16
+	_                uint16
+	Ino              uint64
+	Size             uint64
+	Blocks           uint64
+	Attributes_mask  uint64
+	Atime            StatxTimestamp
+	Btime            StatxTimestamp
+	Ctime            StatxTimestamp
+	Mtime            StatxTimestamp
+	Rdev_major       uint32
+	Rdev_minor       uint32
+	Dev_major        uint32
+	Dev_minor        uint32
+	Mnt_id           uint64
+	Dio_mem_align    uint32
+	Dio_offset_align uint32
+	Subvol           uint64
+	_                [88]byte
+}
+
+/*
+ Does statx(dirfd,path,flags,mask,st). Linux 4.11 or newer.
+ */
+func Statx(dirfd int, path string, flags int, mask int, st *Statx_t) error {
+	p,err := syscall.BytePtrFromString(path)
+	if err!=nil { return err }
+	_,_,e := syscall.Syscall6(sys_STATX,uintptr(dirfd),uintptr(unsafe.Pointer(p)),uintptr(flags),uintptr(mask),uintptr(unsafe.Pointer(st)),0)
+	if e!=0 { return e }
+	return nil
+}
+
+/*
+ The result of StatxAt. Only the fields, whose STATX_* bit is set in Mask, are
+ valid; all others are zero. The file system may return less than requested,
+ e.g. not every file system records the birth time (STATX_BTIME).
+
+ The same applies to Attributes: Only the bits set in AttributesMask are
+ supported by the file system.
+ */
+type StatxInfo struct{
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	AttributesMask uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	// File type and permission bits (S_IF*, as in syscall.Stat_t).
+	Mode           uint32
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	Atime          time.Time
+	Btime          time.Time
+	Ctime          time.Time
+	Mtime          time.Time
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	MntID          uint64
+	DioMemAlign    uint32
+	DioOffsetAlign uint32
+	Subvol         uint64
+	// Set, if the kernel lacks statx() and fstat() has been used instead.
+	Fallback       bool
+}
+
+// Returns true, if all fields in mask (STATX_*) are valid.
+func (s *StatxInfo) Has(mask uint32) bool {
+	return (s.Mask&mask)==mask
+}
+
+/*
+ Tests the file attribute attr (STATX_ATTR_*). supported is false, if the file
+ system (or the kernel) does not report attr at all.
+ */
+func (s *StatxInfo) Attr(attr uint64) (set, supported bool) {
+	return (s.Attributes&attr)!=0,(s.AttributesMask&attr)!=0
+}
+
+func statxTime(t StatxTimestamp) time.Time {
+	return time.Unix(t.Sec,int64(t.Nsec))
+}
+
+func (s *StatxInfo) fromRaw(r *Statx_t) {
+	m := r.Mask
+	*s = StatxInfo{Mask: m, Blksize: r.Blksize}
+	s.Attributes     = r.Attributes
+	s.AttributesMask = r.Attributes_mask
+	if (m&STATX_NLINK)!=0 { s.Nlink = r.Nlink }
+	if (m&STATX_UID)!=0 { s.Uid = r.Uid }
+	if (m&STATX_GID)!=0 { s.Gid = r.Gid }
+	if (m&STATX_TYPE)!=0 { s.Mode |= uint32(r.Mode)&syscall.S_IFMT }
+	if (m&STATX_MODE)!=0 { s.Mode |= uint32(r.Mode)&^syscall.S_IFMT }
+	if (m&STATX_INO)!=0 { s.Ino = r.Ino }
+	if (m&STATX_SIZE)!=0 { s.Size = r.Size }
+	if (m&STATX_BLOCKS)!=0 { s.Blocks = r.Blocks }
+	if (m&STATX_ATIME)!=0 { s.Atime = statxTime(r.Atime) }
+	if (m&STATX_BTIME)!=0 { s.Btime = statxTime(r.Btime) }
+	if (m&STATX_CTIME)!=0 { s.Ctime = statxTime(r.Ctime) }
+	if (m&STATX_MTIME)!=0 { s.Mtime = statxTime(r.Mtime) }
+	s.RdevMajor,s.RdevMinor = r.Rdev_major,r.Rdev_minor
+	s.DevMajor,s.DevMinor = r.Dev_major,r.Dev_minor
+	if (m&(STATX_MNT_ID|STATX_MNT_ID_UNIQUE))!=0 { s.MntID = r.Mnt_id }
+	if (m&STATX_DIOALIGN)!=0 {
+		s.DioMemAlign    = r.Dio_mem_align
+		s.DioOffsetAlign = r.Dio_offset_align
+	}
+	if (m&STATX_SUBVOL)!=0 { s.Subvol = r.Subvol }
+}
+
+func devMajor(dev uint64) uint32 {
+	return uint32(((dev>>8)&0xfff)|((dev>>32)&^0xfff))
+}
+func devMinor(dev uint64) uint32 {
+	return uint32((dev&0xff)|((dev>>12)&^0xff))
+}
+
+func (s *StatxInfo) fromStat(st *syscall.Stat_t) {
+	*s = StatxInfo{Mask: STATX_BASIC_STATS, Fallback: true}
+	s.Blksize   = uint32(st.Blksize)
+	s.Nlink     = uint32(st.Nlink)
+	s.Uid       = st.Uid
+	s.Gid       = st.Gid
+	s.Mode      = st.Mode
+	s.Ino       = st.Ino
+	s.Size      = uint64(st.Size)
+	s.Blocks    = uint64(st.Blocks)
+	s.Atime     = time.Unix(st.Atim.Unix())
+	s.Ctime     = time.Unix(st.Ctim.Unix())
+	s.Mtime     = time.Unix(st.Mtim.Unix())
+	s.RdevMajor = devMajor(uint64(st.Rdev))
+	s.RdevMinor = devMinor(uint64(st.Rdev))
+	s.DevMajor  = devMajor(uint64(st.Dev))
+	s.DevMinor  = devMinor(uint64(st.Dev))
+}
+
+/*
+ fstat() emulation of statx() for kernels older than 4.11. path is opened with
+ O_PATH, so neither read permission nor an open() of device files is needed.
+ */
+func statxFallback(dirfd int, path string, flags int, s *StatxInfo) error {
+	var st syscall.Stat_t
+	fd := dirfd
+	if path!="" || (flags&AT_EMPTY_PATH)==0 {
+		oflags := O_PATH|syscall.O_CLOEXEC
+		if (flags&AT_SYMLINK_NOFOLLOW)!=0 { oflags |= syscall.O_NOFOLLOW }
+		var err error
+		fd,err = syscall.Openat(dirfd,path,oflags,0)
+		if err!=nil { return err }
+		defer syscall.Close(fd)
+	}
+	err := syscall.Fstat(fd,&st)
+	if err!=nil { return err }
+	s.fromStat(&st)
+	return nil
+}
+
+/*
+ Calls statx(dirfd,path,flags,mask) and converts the result. flags are AT_*
+ (AT_SYMLINK_NOFOLLOW, AT_EMPTY_PATH, AT_NO_AUTOMOUNT, AT_STATX_*). dirfd may be
+ AT_FDCWD.
+
+ If the kernel lacks statx(), fstat() is used. Then only STATX_BASIC_STATS is
+ set in Mask, Fallback is true and Btime, MntID, the DIO alignment and the
+ attributes are unavailable (zero).
+ */
+func StatxAt(dirfd int, path string, flags int, mask int) (*StatxInfo,error) {
+	var r Statx_t
+	s := new(StatxInfo)
+	err := Statx(dirfd,path,flags,mask,&r)
+	if err==syscall.ENOSYS {
+		err = statxFallback(dirfd,path,flags,s)
+		if err!=nil { return nil,err }
+		return s,nil
+	}
+	if err!=nil { return nil,err }
+	s.fromRaw(&r)
+	return s,nil
+}
+
+// Stats the file name. Symlinks are followed, unless nofollow is true.
+func StatxPath(name string, nofollow bool, mask int) (*StatxInfo,error) {
+	flags := 0
+	if nofollow { flags = AT_SYMLINK_NOFOLLOW }
+	return StatxAt(AT_FDCWD,name,flags,mask)
+}
+
+// Stats the open file fd (statx(fd,"",AT_EMPTY_PATH,mask)).
+func StatxFd(fd int, mask int) (*StatxInfo,error) {
+	return StatxAt(fd,"",AT_EMPTY_PATH,mask)
+}
@@ -47,6 +47,42 @@ func Fsetxattr(fd int, attr string, dest []byte,flags int) error {
 	return err
 }
 
+func Lgetxattr(path string, attr string, dest []byte) (sz int, err error) {
+	path2 , err := syscall.BytePtrFromString(path)
+	if err!=nil { return 0,err }
+	attr2 , err := syscall.BytePtrFromString(attr)
+	if err!=nil { return 0,err }
+	destp := uintptr(0)
+	destl := uintptr(len(dest))
+	if destl>0 { destp = uintptr(unsafe.Pointer(&dest[0])) }
+	sz_,_,e := syscall.Syscall6(
+			syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(path2)),
+			uintptr(unsafe.Pointer(attr2)),
+			destp,
+			destl,
+		0, 0)
+	if e!=0 { return 0,e }
+	return int(sz_),nil
+}
+
+func Lsetxattr(path string, attr string, dest []byte,flags int) error {
+	path2 , err := syscall.BytePtrFromString(path)
+	if err!=nil { return err }
+	attr2 , err := syscall.BytePtrFromString(attr)
+	if err!=nil { return err }
+	destp := uintptr(0)
+	destl := uintptr(len(dest))
+	if destl>0 { destp = uintptr(unsafe.Pointer(&dest[0])) }
+	_,_,e := syscall.Syscall6(
+			syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(path2)),
+			uintptr(unsafe.Pointer(attr2)),
+			destp,
+			destl,
+		uintptr(flags), 0)
+	if e!=0 { return e }
+	return nil
+}
+
 type winsize struct{
 	ws_row 		uint16	/* rows, in characters */
 	ws_col 		uint16	/* columns, in characters */
@@ -0,0 +1,31 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+/*
+ System call numbers, that are missing in the syscall package. Since Linux 5.1,
+ new system calls have the same number on every architecture (plus an
+ ABI-specific base on mips). Older ones are found in sysnum_$GOARCH.go.
+ */
+const sys_PIDFD_SEND_SIGNAL       = sys_BASE + 424
+const sys_OPEN_TREE               = sys_BASE + 428
+const sys_MOVE_MOUNT              = sys_BASE + 429
+const sys_FSOPEN                  = sys_BASE + 430
+const sys_FSCONFIG                = sys_BASE + 431
+const sys_FSMOUNT                 = sys_BASE + 432
+const sys_FSPICK                  = sys_BASE + 433
+const sys_PIDFD_OPEN              = sys_BASE + 434
+const sys_OPENAT2                 = sys_BASE + 437
+const sys_PIDFD_GETFD             = sys_BASE + 438
+const sys_MOUNT_SETATTR           = sys_BASE + 442
+const sys_QUOTACTL_FD             = sys_BASE + 443
+const sys_LANDLOCK_CREATE_RULESET = sys_BASE + 444
+const sys_LANDLOCK_ADD_RULE       = sys_BASE + 445
+const sys_LANDLOCK_RESTRICT_SELF  = sys_BASE + 446
@@ -0,0 +1,32 @@
+/*
+ * Copyright(C) 2015 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package syscall_x
+
+const sys_BASE              = 0
+const sys_NAME_TO_HANDLE_AT = 341
+const sys_OPEN_BY_HANDLE_AT = 342
+const sys_SETNS             = 346
+const sys_SECCOMP           = 354
+const sys_STATX             = 383
+
+// AUDIT_ARCH_* of the native architecture, as seen by seccomp filters.
+const AUDIT_ARCH_NATIVE = 0x40000003
+
+// _IO('T',0x41)
+const TIOCGPTPEER = 0x5441
+
+// _IOC_READ and _IOC_WRITE, shifted to the direction bits of an ioctl number.
+const ioc_READ  = 0x80000000
+const ioc_WRITE = 0x40000000
+
+// Resource limits, that are missing in the syscall package or differ on mips.
+const RLIMIT_RSS     = 5
+const RLIMIT_NPROC   = 6
+const RLIMIT_MEMLOCK = 8
@@ -0,0 +1,395 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+/*
+ Reads the user database files /etc/passwd, /etc/group, /etc/shadow and
+ /etc/gshadow, relative to a configurable root directory.
+
+	db := &userdb.DB{Root: "/srv/chroot"}
+	pw,err := db.LookupUser("alice")
+	sp,err := db.LookupShadow("alice")
+
+ Empty lines and lines starting with '#' are skipped. Lines starting with
+ '+' or '-' are NIS compat entries (nsswitch "compat"); they are returned by
+ the Parse and Read functions with Compat set, but are never matched by the
+ Lookup methods, as this package does not query NIS.
+
+ The Parse functions fail on the first malformed line (a ParseError). The Read
+ functions and the Lookup methods skip malformed lines, like the C library,
+ so one bad line does not lock every user out.
+ */
+package userdb
+
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+const PasswdFile  = "/etc/passwd"
+const GroupFile   = "/etc/group"
+const ShadowFile  = "/etc/shadow"
+const GShadowFile = "/etc/gshadow"
+
+var ErrNoSuchUser  = errors.New("no such user")
+var ErrNoSuchGroup = errors.New("no such group")
+
+// A malformed line.
+type ParseError struct{
+	File string
+	Line int
+	Err  string
+}
+
+func (p *ParseError) Error() string { return fmt.Sprintf("%s:%d: %s",p.File,p.Line,p.Err) }
+
+// An entry of passwd(5).
+type Passwd struct{
+	// '+' or '-' for NIS compat entries, otherwise 0.
+	Compat   byte
+	Name     string
+	Password string
+	Uid      uint32
+	Gid      uint32
+	Gecos    string
+	Home     string
+	Shell    string
+}
+
+// An entry of group(5).
+type Group struct{
+	Compat   byte
+	Name     string
+	Password string
+	Gid      uint32
+	Members  []string
+}
+
+/*
+ An entry of shadow(5). The dates are in days since 1970-01-01, the other
+ numeric fields in days; empty fields are -1.
+ */
+type Shadow struct{
+	Compat     byte
+	Name       string
+	Password   string
+	LastChange int64
+	Min        int64
+	Max        int64
+	Warn       int64
+	Inactive   int64
+	Expire     int64
+	Reserved   string
+}
+
+// An entry of gshadow(5).
+type GShadow struct{
+	Compat   byte
+	Name     string
+	Password string
+	Admins   []string
+	Members  []string
+}
+
+func compatName(c byte, n string) string {
+	if c==0 { return n }
+	return string(c)+n
+}
+
+func joinList(l []string) string { return strings.Join(l,",") }
+
+func splitList(s string) []string {
+	if s=="" { return nil }
+	return strings.Split(s,",")
+}
+
+// Ids of compat entries are empty (not overridden) if zero.
+func formatId(id uint32, compat byte) string {
+	if id==0 && compat!=0 { return "" }
+	return strconv.FormatUint(uint64(id),10)
+}
+
+func formatDays(d int64) string {
+	if d<0 { return "" }
+	return strconv.FormatInt(d,10)
+}
+
+// Formats the entry as a line of passwd(5), without newline.
+func (p *Passwd) String() string {
+	return strings.Join([]string{compatName(p.Compat,p.Name),p.Password,formatId(p.Uid,p.Compat),
+		formatId(p.Gid,p.Compat),p.Gecos,p.Home,p.Shell},":")
+}
+
+// Formats the entry as a line of group(5), without newline.
+func (g *Group) String() string {
+	return strings.Join([]string{compatName(g.Compat,g.Name),g.Password,formatId(g.Gid,g.Compat),joinList(g.Members)},":")
+}
+
+// Formats the entry as a line of shadow(5), without newline.
+func (s *Shadow) String() string {
+	return strings.Join([]string{compatName(s.Compat,s.Name),s.Password,
+		formatDays(s.LastChange),formatDays(s.Min),formatDays(s.Max),formatDays(s.Warn),
+		formatDays(s.Inactive),formatDays(s.Expire),s.Reserved},":")
+}
+
+// Formats the entry as a line of gshadow(5), without newline.
+func (g *GShadow) String() string {
+	return strings.Join([]string{compatName(g.Compat,g.Name),g.Password,joinList(g.Admins),joinList(g.Members)},":")
+}
+
+/*
+ Calls fn with the fields of every line, that is not empty or a comment.
+ Compat lines, and lines with at least min fields, are padded to n fields,
+ other lines must have exactly n. If lenient, malformed lines (those, for
+ which fn returns a ParseError as well) are skipped.
+ */
+func scanLines(r io.Reader, name string, n, min int, lenient bool, fn func(line int, compat byte, f []string) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil,1<<20)
+	ln := 0
+	for s.Scan() {
+		ln++
+		l := s.Text()
+		if strings.TrimSpace(l)=="" || l[0]=='#' { continue }
+		var c byte
+		if l[0]=='+' || l[0]=='-' { c = l[0]; l = l[1:] }
+		f := strings.Split(l,":")
+		if (c!=0 || len(f)>=min) && len(f)<n { f = append(f,make([]string,n-len(f))...) }
+		var err error
+		switch {
+		case len(f)!=n: err = &ParseError{name,ln,fmt.Sprintf("expected %d fields, got %d",n,len(f))}
+		case c==0 && f[0]=="": err = &ParseError{name,ln,"empty name"}
+		default: err = fn(ln,c,f)
+		}
+		if _,ok := err.(*ParseError); ok && lenient { continue }
+		if err!=nil { return err }
+	}
+	return s.Err()
+}
+
+// Parses a numeric id; may be empty in compat lines.
+func parseId(s string, compat byte) (uint32,error) {
+	if s=="" && compat!=0 { return 0,nil }
+	v,err := strconv.ParseUint(s,10,32)
+	if err!=nil { return 0,fmt.Errorf("invalid id %q",s) }
+	return uint32(v),nil
+}
+
+func parseDays(s string) (int64,error) {
+	if s=="" { return -1,nil }
+	v,err := strconv.ParseInt(s,10,64)
+	if err!=nil || v<0 { return 0,fmt.Errorf("invalid number %q",s) }
+	return v,nil
+}
+
+/*
+ Parses passwd(5)-formatted data. name is used in error messages.
+ */
+func ParsePasswd(r io.Reader, name string) ([]Passwd,error) { return parsePasswd(r,name,false) }
+
+func parsePasswd(r io.Reader, name string, lenient bool) ([]Passwd,error) {
+	var res []Passwd
+	err := scanLines(r,name,7,7,lenient,func(ln int, c byte, f []string) error {
+		uid,err := parseId(f[2],c)
+		if err!=nil { return &ParseError{name,ln,err.Error()} }
+		gid,err := parseId(f[3],c)
+		if err!=nil { return &ParseError{name,ln,err.Error()} }
+		res = append(res,Passwd{c,f[0],f[1],uid,gid,f[4],f[5],f[6]})
+		return nil
+	})
+	return res,err
+}
+
+/*
+ Parses group(5)-formatted data. name is used in error messages.
+ */
+func ParseGroup(r io.Reader, name string) ([]Group,error) { return parseGroup(r,name,false) }
+
+func parseGroup(r io.Reader, name string, lenient bool) ([]Group,error) {
+	var res []Group
+	err := scanLines(r,name,4,4,lenient,func(ln int, c byte, f []string) error {
+		gid,err := parseId(f[2],c)
+		if err!=nil { return &ParseError{name,ln,err.Error()} }
+		res = append(res,Group{c,f[0],f[1],gid,splitList(f[3])})
+		return nil
+	})
+	return res,err
+}
+
+/*
+ Parses shadow(5)-formatted data. name is used in error messages. Like the C
+ library, it accepts short "name:password" lines; the missing fields are
+ empty.
+ */
+func ParseShadow(r io.Reader, name string) ([]Shadow,error) { return parseShadow(r,name,false) }
+
+func parseShadow(r io.Reader, name string, lenient bool) ([]Shadow,error) {
+	var res []Shadow
+	err := scanLines(r,name,9,2,lenient,func(ln int, c byte, f []string) error {
+		var d [6]int64
+		for i := range d {
+			v,err := parseDays(f[2+i])
+			if err!=nil { return &ParseError{name,ln,err.Error()} }
+			d[i] = v
+		}
+		res = append(res,Shadow{c,f[0],f[1],d[0],d[1],d[2],d[3],d[4],d[5],f[8]})
+		return nil
+	})
+	return res,err
+}
+
+/*
+ Parses gshadow(5)-formatted data. name is used in error messages.
+ */
+func ParseGShadow(r io.Reader, name string) ([]GShadow,error) { return parseGShadow(r,name,false) }
+
+func parseGShadow(r io.Reader, name string, lenient bool) ([]GShadow,error) {
+	var res []GShadow
+	err := scanLines(r,name,4,4,lenient,func(ln int, c byte, f []string) error {
+		res = append(res,GShadow{c,f[0],f[1],splitList(f[2]),splitList(f[3])})
+		return nil
+	})
+	return res,err
+}
+
+func readFile(path string, parse func(r io.Reader, name string) error) error {
+	f,err := os.Open(path)
+	if err!=nil { return err }
+	defer f.Close()
+	return parse(f,path)
+}
+
+// Reads a passwd(5) file; malformed lines are skipped.
+func ReadPasswd(path string) (r []Passwd, err error) {
+	err = readFile(path,func(f io.Reader, n string) (e error) { r,e = parsePasswd(f,n,true); return })
+	return
+}
+
+// Reads a group(5) file; malformed lines are skipped.
+func ReadGroup(path string) (r []Group, err error) {
+	err = readFile(path,func(f io.Reader, n string) (e error) { r,e = parseGroup(f,n,true); return })
+	return
+}
+
+// Reads a shadow(5) file; malformed lines are skipped.
+func ReadShadow(path string) (r []Shadow, err error) {
+	err = readFile(path,func(f io.Reader, n string) (e error) { r,e = parseShadow(f,n,true); return })
+	return
+}
+
+// Reads a gshadow(5) file; malformed lines are skipped.
+func ReadGShadow(path string) (r []GShadow, err error) {
+	err = readFile(path,func(f io.Reader, n string) (e error) { r,e = parseGShadow(f,n,true); return })
+	return
+}
+
+/*
+ The user database below a root directory. The zero value (or Root "/")
+ reads the database of the system.
+ */
+type DB struct{
+	Root string
+}
+
+// Returns the path of file (for example PasswdFile) below the root directory.
+func (d *DB) Path(file string) string {
+	if d==nil || d.Root=="" { return file }
+	return filepath.Join(d.Root,file)
+}
+
+func (d *DB) Passwd() ([]Passwd,error) { return ReadPasswd(d.Path(PasswdFile)) }
+func (d *DB) Group() ([]Group,error) { return ReadGroup(d.Path(GroupFile)) }
+func (d *DB) Shadow() ([]Shadow,error) { return ReadShadow(d.Path(ShadowFile)) }
+func (d *DB) GShadow() ([]GShadow,error) { return ReadGShadow(d.Path(GShadowFile)) }
+
+func (d *DB) lookupPasswd(match func(p *Passwd) bool) (*Passwd,error) {
+	l,err := d.Passwd()
+	if err!=nil { return nil,err }
+	for i := range l {
+		if l[i].Compat==0 && match(&l[i]) { return &l[i],nil }
+	}
+	return nil,ErrNoSuchUser
+}
+
+func (d *DB) lookupGroup(match func(g *Group) bool) (*Group,error) {
+	l,err := d.Group()
+	if err!=nil { return nil,err }
+	for i := range l {
+		if l[i].Compat==0 && match(&l[i]) { return &l[i],nil }
+	}
+	return nil,ErrNoSuchGroup
+}
+
+// Looks up a user by name in passwd.
+func (d *DB) LookupUser(name string) (*Passwd,error) {
+	return d.lookupPasswd(func(p *Passwd) bool { return p.Name==name })
+}
+
+// Looks up a user by uid in passwd. The first entry wins.
+func (d *DB) LookupUid(uid uint32) (*Passwd,error) {
+	return d.lookupPasswd(func(p *Passwd) bool { return p.Uid==uid })
+}
+
+// Looks up a group by name in group.
+func (d *DB) LookupGroup(name string) (*Group,error) {
+	return d.lookupGroup(func(g *Group) bool { return g.Name==name })
+}
+
+// Looks up a group by gid in group. The first entry wins.
+func (d *DB) LookupGid(gid uint32) (*Group,error) {
+	return d.lookupGroup(func(g *Group) bool { return g.Gid==gid })
+}
+
+// Looks up the shadow entry of a user.
+func (d *DB) LookupShadow(name string) (*Shadow,error) {
+	return LookupShadowFile(d.Path(ShadowFile),name)
+}
+
+// Looks up the shadow entry of a user in a shadow(5) file.
+func LookupShadowFile(path string, name string) (*Shadow,error) {
+	l,err := ReadShadow(path)
+	if err!=nil { return nil,err }
+	for i := range l {
+		if l[i].Compat==0 && l[i].Name==name { return &l[i],nil }
+	}
+	return nil,ErrNoSuchUser
+}
+
+// Looks up the gshadow entry of a group.
+func (d *DB) LookupGShadow(name string) (*GShadow,error) {
+	l,err := d.GShadow()
+	if err!=nil { return nil,err }
+	for i := range l {
+		if l[i].Compat==0 && l[i].Name==name { return &l[i],nil }
+	}
+	return nil,ErrNoSuchGroup
+}
+
+/*
+ Returns the groups of a user: its primary group, followed by the groups
+ listing it as a member. A primary group, that is not in group, is omitted.
+ */
+func (d *DB) GroupsOf(p *Passwd) ([]Group,error) {
+	l,err := d.Group()
+	if err!=nil { return nil,err }
+	var res []Group
+	for _,g := range l {
+		if g.Compat==0 && g.Gid==p.Gid { res = append(res,g); break }
+	}
+	for _,g := range l {
+		if g.Compat!=0 || g.Gid==p.Gid { continue }
+		for _,m := range g.Members {
+			if m==p.Name { res = append(res,g); break }
+		}
+	}
+	return res,nil
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package userdb
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+
+const testPasswd = `root:x:0:0:root:/root:/bin/bash
+# comment
+alice:x:1000:100:Alice,,,:/home/alice:/bin/sh
+
+bob:x:1001:1001::/home/bob:/bin/sh
++@netgroup
+-carl
+`
+
+const testGroup = `root:x:0:
+users:x:100:bob
+bob:x:1001:
+wheel:x:10:alice,bob
++
+`
+
+const testShadow = `root:*:19000:0:99999:7:::
+alice:$6$salt$hash:19500:1:90:7:30:20000:
+bob:!$y$j9T$salt$hash
+`
+
+const testGShadow = `wheel:!:alice:alice,bob
+users:::bob
+`
+
+// Creates a root directory with the database files.
+func testRoot(t *testing.T, files map[string]string) *DB {
+	d,err := ioutil.TempDir("","userdbtest")
+	if err!=nil { t.Fatal(err) }
+	if err = os.Mkdir(filepath.Join(d,"etc"),0755); err!=nil { t.Fatal(err) }
+	for f,c := range files {
+		if err = ioutil.WriteFile(filepath.Join(d,f),[]byte(c),0644); err!=nil { t.Fatal(err) }
+	}
+	return &DB{Root: d}
+}
+
+func testFiles() map[string]string {
+	return map[string]string{PasswdFile: testPasswd, GroupFile: testGroup, ShadowFile: testShadow, GShadowFile: testGShadow}
+}
+
+func TestParsePasswd(t *testing.T) {
+	l,err := ParsePasswd(strings.NewReader(testPasswd),"passwd")
+	if err!=nil { t.Fatal(err) }
+	want := []Passwd{
+		{0,"root","x",0,0,"root","/root","/bin/bash"},
+		{0,"alice","x",1000,100,"Alice,,,","/home/alice","/bin/sh"},
+		{0,"bob","x",1001,1001,"","/home/bob","/bin/sh"},
+		{'+',"@netgroup","",0,0,"","",""},
+		{'-',"carl","",0,0,"","",""},
+	}
+	if !reflect.DeepEqual(l,want) { t.Errorf("got %+v",l) }
+	if s := l[1].String(); s!="alice:x:1000:100:Alice,,,:/home/alice:/bin/sh" { t.Errorf("formatted as %q",s) }
+	if s := l[3].String(); s!="+@netgroup::::::" { t.Errorf("compat formatted as %q",s) }
+}
+
+func TestParseStrict(t *testing.T) {
+	for _,tt := range []struct{ data string; parse func(string) error; line int }{
+		{"root:x:0:0:root:/root:/bin/bash\nbad:x:zero:0:::\n",func(s string) error { _,e := ParsePasswd(strings.NewReader(s),"f"); return e },2},
+		{"root:x:0:0\n",func(s string) error { _,e := ParsePasswd(strings.NewReader(s),"f"); return e },1},
+		{":x:0:0:::\n",func(s string) error { _,e := ParsePasswd(strings.NewReader(s),"f"); return e },1},
+		{"g:x:1:\ng:x:-1:\n",func(s string) error { _,e := ParseGroup(strings.NewReader(s),"f"); return e },2},
+		{"a:x:1:2:3:4:5:6:\nb:x:y::::::\n",func(s string) error { _,e := ParseShadow(strings.NewReader(s),"f"); return e },2},
+		{"a\n",func(s string) error { _,e := ParseShadow(strings.NewReader(s),"f"); return e },1},
+		{"g:x\n",func(s string) error { _,e := ParseGShadow(strings.NewReader(s),"f"); return e },1},
+	} {
+		err := tt.parse(tt.data)
+		pe,ok := err.(*ParseError)
+		if !ok || pe.File!="f" || pe.Line!=tt.line { t.Errorf("%q: %v",tt.data,err) }
+	}
+}
+
+func TestParseShadowShort(t *testing.T) {
+	l,err := ParseShadow(strings.NewReader(testShadow),"shadow")
+	if err!=nil { t.Fatal(err) }
+	if len(l)!=3 { t.Fatalf("got %d entries",len(l)) }
+	want := Shadow{0,"bob","!$y$j9T$salt$hash",-1,-1,-1,-1,-1,-1,""}
+	if l[2]!=want { t.Errorf("short line: %+v",l[2]) }
+	want = Shadow{0,"alice","$6$salt$hash",19500,1,90,7,30,20000,""}
+	if l[1]!=want { t.Errorf("got %+v",l[1]) }
+	if s := l[1].String(); s!="alice:$6$salt$hash:19500:1:90:7:30:20000:" { t.Errorf("formatted as %q",s) }
+}
+
+func TestLookup(t *testing.T) {
+	db := testRoot(t,testFiles())
+	defer os.RemoveAll(db.Root)
+	if p,err := db.LookupUser("alice"); err!=nil || p.Uid!=1000 || p.Home!="/home/alice" { t.Errorf("alice: %+v %v",p,err) }
+	if p,err := db.LookupUid(1001); err!=nil || p.Name!="bob" { t.Errorf("uid 1001: %+v %v",p,err) }
+	if _,err := db.LookupUser("carl"); err!=ErrNoSuchUser { t.Errorf("compat entry matched: %v",err) }
+	if g,err := db.LookupGid(10); err!=nil || g.Name!="wheel" { t.Errorf("gid 10: %+v %v",g,err) }
+	if _,err := db.LookupGroup("nogroup"); err!=ErrNoSuchGroup { t.Errorf("nogroup: %v",err) }
+	if sp,err := db.LookupShadow("bob"); err!=nil || sp.Password!="!$y$j9T$salt$hash" { t.Errorf("shadow bob: %+v %v",sp,err) }
+	if gs,err := db.LookupGShadow("wheel"); err!=nil || !reflect.DeepEqual(gs.Admins,[]string{"alice"}) { t.Errorf("gshadow wheel: %+v %v",gs,err) }
+	p,_ := db.LookupUser("bob")
+	gs,err := db.GroupsOf(p)
+	if err!=nil { t.Fatal(err) }
+	var names []string
+	for _,g := range gs { names = append(names,g.Name) }
+	if !reflect.DeepEqual(names,[]string{"bob","users","wheel"}) { t.Errorf("groups of bob %q",names) }
+}
+
+// A malformed line does not keep the other users from being found.
+func TestLookupSkipsMalformed(t *testing.T) {
+	f := testFiles()
+	f[PasswdFile] = "broken\nroot:x:0:0:root:/root:/bin/bash\nx:x:notanumber:0:::\nalice:x:1000:100::/home/alice:/bin/sh\n"
+	f[ShadowFile] = "root:*:bad:::::\nalice:$6$salt$hash:19500::::::\n:x:::::::\n"
+	db := testRoot(t,f)
+	defer os.RemoveAll(db.Root)
+	if _,err := ParsePasswd(strings.NewReader(f[PasswdFile]),"passwd"); err==nil { t.Error("ParsePasswd accepts malformed lines") }
+	l,err := db.Passwd()
+	if err!=nil || len(l)!=2 { t.Errorf("passwd: %+v %v",l,err) }
+	if p,err := db.LookupUser("alice"); err!=nil || p.Uid!=1000 { t.Errorf("alice: %+v %v",p,err) }
+	if _,err := db.LookupShadow("root"); err!=ErrNoSuchUser { t.Errorf("malformed root entry: %v",err) }
+	if sp,err := db.LookupShadow("alice"); err!=nil || sp.LastChange!=19500 { t.Errorf("alice: %+v %v",sp,err) }
+}
+
+func TestUpdateShadow(t *testing.T) {
+	db := testRoot(t,testFiles())
+	defer os.RemoveAll(db.Root)
+	path := db.Path(ShadowFile)
+	err := db.UpdateShadow("alice",func(sp *Shadow) error {
+		sp.Password = "$y$new"
+		sp.LastChange = 20000
+		return nil
+	})
+	if err!=nil { t.Fatal(err) }
+	b,err := ioutil.ReadFile(path)
+	if err!=nil { t.Fatal(err) }
+	want := strings.Replace(testShadow,"alice:$6$salt$hash:19500:","alice:$y$new:20000:",1)
+	if string(b)!=want { t.Errorf("got %q",b) }
+	if b,_ = ioutil.ReadFile(path+"-"); string(b)!=testShadow { t.Errorf("backup %q",b) }
+	fi,err := os.Stat(path)
+	if err!=nil || fi.Mode().Perm()!=0644 { t.Errorf("mode %v %v",fi.Mode(),err) }
+	// The short line is written back in full.
+	err = db.UpdateShadow("bob",func(sp *Shadow) error { sp.Expire = 1; return nil })
+	if err!=nil { t.Fatal(err) }
+	if sp,err := db.LookupShadow("bob"); err!=nil || sp.Expire!=1 || sp.Password!="!$y$j9T$salt$hash" { t.Errorf("bob: %+v %v",sp,err) }
+	if err = db.UpdateShadow("nobody",func(sp *Shadow) error { return nil }); err!=ErrNoSuchUser { t.Errorf("nobody: %v",err) }
+	if err = db.UpdateShadow("al",func(sp *Shadow) error { return nil }); err!=ErrNoSuchUser { t.Errorf("prefix: %v",err) }
+	if _,err = os.Stat(db.Path(LockFile)); err!=nil { t.Errorf("lock file: %v",err) }
+}
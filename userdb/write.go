@@ -0,0 +1,147 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+
+package userdb
+
+import "github.com/maxymania/go-system/label"
+import "bytes"
+import "errors"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "syscall"
+import "time"
+
+// The lock file of lckpwdf(3).
+const LockFile = "/etc/.pwd.lock"
+
+// The timeout of lckpwdf(3).
+const LockTimeout = 15*time.Second
+
+var ErrLockTimeout = errors.New("timeout waiting for the password database lock")
+
+// fcntl() locks do not exclude each other within a process.
+var inProcess = make(chan struct{},1)
+
+// A held lock of the user database.
+type Lock struct{
+	f *os.File
+}
+
+/*
+ Locks the user database like lckpwdf(3): a write lock (fcntl) on the file
+ path, usually LockFile. Waits at most timeout.
+ */
+func LockPath(path string, timeout time.Duration) (*Lock,error) {
+	deadline := time.Now().Add(timeout)
+	select {
+	case inProcess <- struct{}{}:
+	case <-time.After(timeout): return nil,ErrLockTimeout
+	}
+	f,err := os.OpenFile(path,os.O_WRONLY|os.O_CREATE|syscall.O_CLOEXEC,0600)
+	if err!=nil { <-inProcess; return nil,err }
+	fl := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0}
+	for {
+		err = syscall.FcntlFlock(f.Fd(),syscall.F_SETLK,&fl)
+		if err==nil { return &Lock{f},nil }
+		if err!=syscall.EAGAIN && err!=syscall.EACCES { break }
+		if time.Now().After(deadline) { err = ErrLockTimeout; break }
+		time.Sleep(100*time.Millisecond)
+	}
+	f.Close()
+	<-inProcess
+	return nil,err
+}
+
+// Locks the user database below the root directory, like lckpwdf(3).
+func (d *DB) Lock() (*Lock,error) {
+	return LockPath(d.Path(LockFile),LockTimeout)
+}
+
+// Releases the lock, like ulckpwdf(3).
+func (l *Lock) Unlock() error {
+	err := l.f.Close()
+	<-inProcess
+	return err
+}
+
+/*
+ Replaces the file path with data atomically: data is written to path+"+"
+ with the owner, mode and SELinux context of path, synced and renamed over
+ path. The old file is kept as path+"-".
+ */
+func ReplaceFile(path string, data []byte) (err error) {
+	fi,err := os.Lstat(path)
+	if err!=nil { return }
+	st := fi.Sys().(*syscall.Stat_t)
+	tmp := path+"+"
+	os.Remove(tmp)
+	f,err := os.OpenFile(tmp,os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_CLOEXEC,0)
+	if err!=nil { return }
+	defer func() {
+		if err!=nil { f.Close(); os.Remove(tmp) }
+	}()
+	if err = f.Chown(int(st.Uid),int(st.Gid)); err!=nil { return }
+	if err = f.Chmod(fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err!=nil { return }
+	if label.SELinuxEnabled() {
+		if c,e := label.Get(path,label.XATTR_SELINUX,true); e==nil {
+			if err = label.FSet(int(f.Fd()),label.XATTR_SELINUX,c); err!=nil { return }
+		}
+	}
+	if _,err = f.Write(data); err!=nil { return }
+	if err = f.Sync(); err!=nil { return }
+	if err = f.Close(); err!=nil { return }
+	bak := path+"-"
+	if err = os.Remove(bak); err!=nil && !os.IsNotExist(err) { return }
+	if err = os.Link(path,bak); err!=nil { return }
+	if err = os.Rename(tmp,path); err!=nil { return }
+	if d,e := os.Open(filepath.Dir(path)); e==nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+/*
+ Calls fn with the entry of user name in the shadow(5) file path and writes
+ the modified entry back using ReplaceFile. The other lines are kept as they
+ are. The caller should hold the Lock.
+ */
+func UpdateShadowFile(path string, name string, fn func(sp *Shadow) error) error {
+	if name=="" || strings.ContainsAny(name,":\n") { return ErrNoSuchUser }
+	data,err := ioutil.ReadFile(path)
+	if err!=nil { return err }
+	lines := bytes.SplitAfter(data,[]byte("\n"))
+	for i,l := range lines {
+		s := strings.TrimRight(string(l),"\n")
+		if !strings.HasPrefix(s,name+":") { continue }
+		e,err := ParseShadow(strings.NewReader(s),path)
+		if pe,ok := err.(*ParseError); ok { pe.Line = i+1 }
+		if err!=nil { return err }
+		if len(e)!=1 { continue }
+		if err = fn(&e[0]); err!=nil { return err }
+		nl := e[0].String()
+		if len(l)>len(s) { nl += "\n" }
+		lines[i] = []byte(nl)
+		return ReplaceFile(path,bytes.Join(lines,nil))
+	}
+	return ErrNoSuchUser
+}
+
+/*
+ Locks the database, and calls fn with the shadow entry of user name, like
+ UpdateShadowFile.
+ */
+func (d *DB) UpdateShadow(name string, fn func(sp *Shadow) error) error {
+	l,err := d.Lock()
+	if err!=nil { return err }
+	defer l.Unlock()
+	return UpdateShadowFile(d.Path(ShadowFile),name,fn)
+}
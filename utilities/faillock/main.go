@@ -0,0 +1,66 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import "github.com/maxymania/go-system/authen"
+
+import "os"
+import "flag"
+import "fmt"
+import "io/ioutil"
+
+var dir = flag.String("dir","","The tally directory (default from faillock.conf, or "+authen.DefaultFaillockDir+")")
+var usr = flag.String("user","","The user (default: all users)")
+var reset = flag.Bool("reset",false,"Reset the tally")
+
+func doUser(d, user string) error {
+	if *reset { return authen.ResetTally(d,user) }
+	recs,err := authen.ReadTally(d,user)
+	if err!=nil { return err }
+	fmt.Printf("%s:\n",user)
+	fmt.Printf("%-19s %-5s %-52s %s\n","When","Type","Source","Valid")
+	for _,t := range recs {
+		v := "I"
+		if t.Valid() { v = "V" }
+		fmt.Printf("%-19s %-5s %-52.52s %s\n",t.Time.Format("2006-01-02 15:04:05"),t.Type(),t.Source,v)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,"Usage: %s [-dir /path/to/tally-directory] [-user username] [-reset]\n",os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	d := *dir
+	if d=="" {
+		f,err := authen.LoadFaillock(nil)
+		if err!=nil { fmt.Fprintln(os.Stderr,err); os.Exit(1) }
+		d = f.Dir
+	}
+	if d=="" { d = authen.DefaultFaillockDir }
+	users := []string{*usr}
+	if *usr=="" {
+		fis,err := ioutil.ReadDir(d)
+		if err!=nil && !os.IsNotExist(err) { fmt.Fprintln(os.Stderr,err); os.Exit(1) }
+		users = users[:0]
+		for _,fi := range fis {
+			if fi.Mode().IsRegular() && fi.Name()[0]!='.' { users = append(users,fi.Name()) }
+		}
+	}
+	code := 0
+	for _,u := range users {
+		if err := doUser(d,u); err!=nil {
+			fmt.Fprintf(os.Stderr,"%s: %v\n",u,err)
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
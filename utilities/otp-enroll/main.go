@@ -0,0 +1,71 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import "github.com/maxymania/go-system/authen"
+import "github.com/maxymania/go-system/userdb"
+
+import "os"
+import "flag"
+import "fmt"
+
+var usr = flag.String("user","","The user (default: the calling user)")
+var file = flag.String("file","","The secret file (%h, %u; default "+authen.DefaultOTPFile+")")
+var fileUser = flag.String("file-user","","Access the secret file as this user (default: the user)")
+var hotp = flag.Bool("hotp",false,"Counter based codes (HOTP) instead of time based ones (TOTP)")
+var issuer = flag.String("issuer","","The issuer shown by the authenticator app")
+var label = flag.String("label","","The account shown by the authenticator app (default: user@host)")
+var window = flag.Int("window",0,"The number of codes accepted (default 3)")
+var step = flag.Int("step",0,"The TOTP step in seconds (default 30)")
+var noReuse = flag.Bool("disallow-reuse",false,"Accept every TOTP code only once")
+var rateLimit = flag.Int("rate-limit",0,"At most this many attempts ...")
+var rateTime = flag.Int("rate-time",30,"... within this many seconds")
+var scratch = flag.Int("scratch",5,"The number of scratch codes")
+var force = flag.Bool("force",false,"Replace an existing secret")
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr,err)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,"Usage: %s [-user username] [-hotp] [-issuer name] [options]\n",os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	user := *usr
+	if user=="" {
+		pw,err := new(userdb.DB).LookupUid(uint32(os.Getuid()))
+		if err!=nil { fail(err) }
+		user = pw.Name
+	}
+	o := &authen.OTP{Path: *file, User: *fileUser}
+	if !*force {
+		ok,err := o.Enrolled(user)
+		if err!=nil { fail(err) }
+		if ok { fail(fmt.Errorf("%s already has a secret (use -force to replace it)",user)) }
+	}
+	s,err := authen.NewOTPSecret(*hotp,*scratch)
+	if err!=nil { fail(err) }
+	s.WindowSize = *window
+	s.StepSize = *step
+	s.DisallowReuse = *noReuse
+	if *rateLimit>0 { s.RateLimit,s.RateInterval = *rateLimit,*rateTime }
+	if err = o.Enroll(user,s); err!=nil { fail(err) }
+	l := *label
+	if l=="" {
+		h,_ := os.Hostname()
+		l = user+"@"+h
+	}
+	fmt.Println(s.URI(l,*issuer))
+	fmt.Printf("Your new secret key is: %s\n",authen.EncodeSecret(s.Secret))
+	fmt.Println("Your emergency scratch codes are:")
+	for _,c := range s.ScratchCodes { fmt.Printf("  %s\n",c) }
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright(C) 2017 Simon Schmidt
+ *
+ * This Source Code Form is subject to the terms of the
+ * Mozilla Public License, v. 2.0. If a copy of the MPL
+ * was not distributed with this file, You can obtain one at
+ * http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import "github.com/maxymania/go-system/syscall_x"
+
+import "os"
+import "os/user"
+import "flag"
+import "fmt"
+import "time"
+import "strconv"
+import "strings"
+
+var usr = flag.Bool("u",false,"Report user quotas (default)")
+var grp = flag.Bool("g",false,"Report group quotas")
+var prj = flag.Bool("P",false,"Report project quotas")
+var num = flag.Bool("n",false,"Do not resolve ids to names")
+var all = flag.Bool("v",false,"Report ids without usage, too")
+
+var now = time.Now()
+
+func idName(typ int, id uint32) string {
+	s := strconv.FormatUint(uint64(id),10)
+	if *num { return "#"+s }
+	switch typ {
+	case syscall_x.USRQUOTA:
+		if u,err := user.LookupId(s); err==nil { return u.Username }
+	case syscall_x.GRPQUOTA:
+		if g,err := user.LookupGroupId(s); err==nil { return g.Name }
+	}
+	return "#"+s
+}
+
+// Formats a duration like repquota: "7days", "23:59" or "00:05".
+func fmtDuration(d time.Duration) string {
+	if d>=48*time.Hour { return fmt.Sprintf("%ddays",int(d/(24*time.Hour))) }
+	m := int((d+time.Minute-1)/time.Minute)
+	return fmt.Sprintf("%02d:%02d",m/60,m%60)
+}
+
+// The remaining grace time of a soft limit, that has been exceeded.
+func grace(over bool, t uint64) string {
+	if !over { return "" }
+	if t==0 { return "" }
+	r := time.Unix(int64(t),0).Sub(now)
+	if r<=0 { return "none" }
+	return fmtDuration(r)
+}
+
+func flag2(over bool) string {
+	if over { return "+" }
+	return "-"
+}
+
+var typNames = []string{"user","group","project"}
+var typTitles = []string{"User","Group","Project"}
+
+func report(q *syscall_x.Quotas, mp string, typ int) error {
+	info,err := q.Info(typ)
+	if err!=nil { return err }
+	dev := q.Special()
+	if dev=="" { dev = mp }
+	fmt.Printf("*** Report for %s quotas on device %s\n",typNames[typ],dev)
+	fmt.Printf("Block grace time: %s; Inode grace time: %s\n",
+		fmtDuration(time.Duration(info.Bgrace)*time.Second),
+		fmtDuration(time.Duration(info.Igrace)*time.Second))
+	fmt.Printf("%-16s%-35s%s\n","","Block limits","File limits")
+	fmt.Printf("%-12s %2s %8s %8s %8s %7s %8s %6s %6s %7s\n",typTitles[typ],"","used","soft","hard","grace","used","soft","hard","grace")
+	fmt.Println(strings.Repeat("-",80))
+	err = q.Each(typ,func(d *syscall_x.NextDqblk) bool {
+		if !*all && d.Curspace==0 && d.Curinodes==0 { return true }
+		used := (d.Curspace+syscall_x.QIF_DQBLKSIZE-1)/syscall_x.QIF_DQBLKSIZE
+		bover := d.Bsoftlimit!=0 && used>d.Bsoftlimit
+		iover := d.Isoftlimit!=0 && d.Curinodes>d.Isoftlimit
+		fmt.Printf("%-12s %s%s %8d %8d %8d %7s %8d %6d %6d %7s\n",
+			idName(typ,d.Id),flag2(bover),flag2(iover),
+			used,d.Bsoftlimit,d.Bhardlimit,grace(bover,d.Btime),
+			d.Curinodes,d.Isoftlimit,d.Ihardlimit,grace(iover,d.Itime))
+		return true
+	})
+	fmt.Println()
+	return err
+}
+
+func main(){
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,"usage: %s [-ugPnv] mountpoint...\n",os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var types []int
+	if *usr { types = append(types,syscall_x.USRQUOTA) }
+	if *grp { types = append(types,syscall_x.GRPQUOTA) }
+	if *prj { types = append(types,syscall_x.PRJQUOTA) }
+	if len(types)==0 { types = append(types,syscall_x.USRQUOTA) }
+	if flag.NArg()==0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	code := 0
+	for _,mp := range flag.Args() {
+		q,err := syscall_x.OpenQuotas(mp)
+		if err!=nil {
+			fmt.Fprintln(os.Stderr,err)
+			code = 1
+			continue
+		}
+		for _,typ := range types {
+			err = report(q,mp,typ)
+			if err!=nil {
+				fmt.Fprintf(os.Stderr,"%s: %s quotas: %v\n",mp,typNames[typ],err)
+				code = 1
+			}
+		}
+		q.Close()
+	}
+	os.Exit(code)
+}
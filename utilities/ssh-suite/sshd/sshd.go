@@ -16,8 +16,11 @@ import "fmt"
 import "github.com/maxymania/go-system/sshlib"
 import "github.com/maxymania/go-system/sshlib/unixssh"
 
+import "os"
 import "os/exec"
 import "io/ioutil"
+import "context"
+import "flag"
 
 import "github.com/maxymania/go-system/authen"
 
@@ -29,9 +32,43 @@ var P *ssh.Permissions
 
 var SC = make(chan *sshlib.ShellSession,100)
 
+// Checks the passwords; any authen.Authenticator will do.
+var Auth authen.Authenticator = new(authen.Shadow)
+
+var svcFile = flag.String("service-accounts","","htpasswd file with service accounts")
+var noFaillock = flag.Bool("no-faillock",false,"do not lock users out after failed logins (faillock.conf)")
+
+// User certificates (TrustedUserCAKeys).
+var Certs = new(authen.CertAuth)
+
+func init() {
+	flag.StringVar(&Certs.TrustedUserCAKeys,"trusted-user-ca-keys","","file with the CA keys, that sign user certificates")
+	flag.StringVar(&Certs.AuthorizedPrincipalsFile,"authorized-principals-file","","principals, that may log in as a user (%h, %u)")
+	flag.StringVar(&Certs.RevokedKeys,"revoked-keys","","KRL or list of revoked public keys")
+	flag.BoolVar(&authen.PermitUserEnvironment,"permit-user-environment",false,"pass on environment= of authorized_keys (never LD_* and the like)")
+}
+
+// One-time codes (google_authenticator files).
+var OTP = new(authen.OTP)
+var useOTP = flag.Bool("otp",false,"require a verification code after the password or the public key (keyboard-interactive)")
+
+func init() {
+	flag.StringVar(&OTP.Path,"otp-file","","secret file of a user (%h, %u; default "+authen.DefaultOTPFile+")")
+	flag.BoolVar(&OTP.NullOK,"otp-nullok",false,"users without a secret file need no code")
+	flag.StringVar(&OTP.User,"otp-file-user","","access the secret files as this user (default: the user logging in)")
+}
+
 func handleSession(sl *sshlib.ShellSession) {
 	//unixssh.HandleSess(sl,exec.Command("/bin/bash"))
-	unixssh.HandleSess(sl,exec.Command("/bin/su",sl.Permission.CriticalOptions["user"]))
+	cmd := exec.Command("/bin/su",sl.Permission.CriticalOptions["user"])
+	if sl.Command!="" {
+		cmd = exec.Command("/bin/su",sl.Permission.CriticalOptions["user"],"-c",sl.Command)
+	}
+	cmd.Env = os.Environ()
+	for _,v := range sl.Env {
+		if !sshlib.UnsafeEnv(v) { cmd.Env = append(cmd.Env,v) }
+	}
+	unixssh.HandleSess(sl,cmd)
 }
 
 func handler(){
@@ -44,18 +81,93 @@ func handle(nc net.Conn) {
 	sshlib.Handle(nc,SC,S)
 }
 
+// Counts failed logins (faillock.conf); nil, if disabled. Its Auth is set per login.
+var Faillock *authen.Faillock
+
 func passwd_auth(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-	e := authen.AuthenticatePassword(conn.User(),password)
-	if e!=nil { return nil,e }
+	return authenticate(conn,Auth,password)
+}
+
+func authenticate(conn ssh.ConnMetadata, a authen.Authenticator, password []byte) (*ssh.Permissions, error) {
+	if Faillock!=nil {
+		fl := *Faillock
+		fl.Auth = a
+		a = &fl
+	}
+	r := &authen.Remote{
+		Addr: conn.RemoteAddr(),
+		LocalAddr: conn.LocalAddr(),
+		Service: "ssh",
+		Client: string(conn.ClientVersion()),
+	}
+	id,e := a.Authenticate(context.Background(),conn.User(),password,r)
+	switch e {
+	case nil:
+	case authen.ErrAccountLocked,authen.ErrAccountExpired,authen.ErrPasswordExpired,authen.ErrPasswordChangeRequired,
+		authen.ErrTooManyFailures:
+		// The account may not log in (the password may well be right).
+		fmt.Println(conn.User(),e)
+		return nil,e
+	default:
+		return nil,e
+	}
 	P := new(ssh.Permissions)
 	P.CriticalOptions = make(map[string]string)
 	P.Extensions = make(map[string]string)
-	P.CriticalOptions["user"] = conn.User()
+	P.CriticalOptions["user"] = id.User
+	P.Extensions["authen-backend"] = id.Backend
 	return P,nil
 }
 
-// it is disabled, for now.
+// The password, then the verification code; wrong codes count as failed logins.
+func otp_auth(conn ssh.ConnMetadata, answers []string) (*ssh.Permissions, error) {
+	P,e := authenticate(conn,OTP.Authenticator(Auth,answers[1]),[]byte(answers[0]))
+	switch e {
+	case authen.ErrWrongCode,authen.ErrCodeReused,authen.ErrNotEnrolled:
+		fmt.Println(conn.User(),e)
+	}
+	return P,e
+}
+
+// The verification code only, after a public key; wrong codes count as failed logins.
+func otpAfterKey(P *ssh.Permissions) ssh.ServerAuthCallbacks {
+	return ssh.ServerAuthCallbacks{KeyboardInteractiveCallback: sshlib.KeyboardInteractive("",[]sshlib.Question{
+		{Prompt: "Verification code: "},
+	},func(conn ssh.ConnMetadata, answers []string) (*ssh.Permissions, error) {
+		code := authen.AuthenticatorFunc(func(ctx context.Context, user string, password []byte, r *authen.Remote) (*authen.Identity,error) {
+			if e := OTP.Verify(user,answers[0]); e!=nil { return nil,e }
+			return &authen.Identity{User: user, Backend: "otp"},nil
+		})
+		_,e := authenticate(conn,code,nil)
+		switch e {
+		case nil: return P,nil
+		case authen.ErrWrongCode,authen.ErrCodeReused,authen.ErrNotEnrolled:
+			fmt.Println(conn.User(),e)
+		}
+		return nil,e
+	})}
+}
+
+// Checks the key against the trusted CAs and the authorized_keys file of the user.
 func pubk_auth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if r,e := Certs.IsRevoked(key); r {
+		if e==nil { e = authen.ErrCertRevoked }
+		return nil,e
+	}
+	backend := "trusted-user-ca-keys"
+	P,e := Certs.Authenticate(conn.User(),key,conn.RemoteAddr())
+	if e==authen.ErrKeyNotAuthorized {
+		backend = "authorized_keys"
+		P,e = authen.AuthenticatePublicKey(conn.User(),key,conn.RemoteAddr())
+	}
+	if e!=nil { return nil,e }
+	P.CriticalOptions["user"] = conn.User()
+	P.Extensions["authen-backend"] = backend
+	if id,ok := P.Extensions[sshlib.CertKeyID]; ok {
+		fmt.Printf("%s: certificate ID %q serial %s from %v\n",conn.User(),id,P.Extensions[sshlib.CertSerial],conn.RemoteAddr())
+	}
+	// The key alone does not suffice either.
+	if *useOTP { return nil,&ssh.PartialSuccessError{Next: otpAfterKey(P)} }
 	return P,nil
 }
 
@@ -76,12 +188,32 @@ func load_keys() bool {
 }
 
 func main() {
+	flag.Parse()
+	if *svcFile!="" {
+		Auth = authen.FirstMatch(Auth,&authen.Htpasswd{Path: *svcFile})
+	}
+	if !*noFaillock {
+		fl,e := authen.LoadFaillock(nil)
+		if e!=nil {
+			fmt.Println(e)
+			return
+		}
+		Faillock = fl
+	}
 	S = new(ssh.ServerConfig)
 	P = new(ssh.Permissions)
 	P.CriticalOptions = make(map[string]string)
 	P.Extensions = make(map[string]string)
 	S.PasswordCallback = passwd_auth
-	//S.PublicKeyCallback = pubk_auth
+	if *useOTP {
+		// The password alone does not suffice.
+		S.PasswordCallback = nil
+		S.KeyboardInteractiveCallback = sshlib.KeyboardInteractive("",[]sshlib.Question{
+			{Prompt: "Password: "},
+			{Prompt: "Verification code: "},
+		},otp_auth)
+	}
+	S.PublicKeyCallback = pubk_auth
 	
 	if load_keys() { return }
 	